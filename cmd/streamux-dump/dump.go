@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kstenerud/go-streamux/internal"
+)
+
+type capture struct {
+	name string
+	data []byte
+}
+
+type dumpOptions struct {
+	// Negative if not specified.
+	idBits     int
+	lengthBits int
+
+	showPayloads bool
+}
+
+type negotiatedParameters struct {
+	idBits     int
+	lengthBits int
+	extensions int
+	// Only if both initialize messages were available.
+	isExtensionsKnown bool
+}
+
+// Dump the initialize message of each capture, what was negotiated, and then
+// every message chunk in each capture.
+func dump(out io.Writer, captures []capture, options dumpOptions) error {
+	for _, capture := range captures {
+		message, ok := internal.DecodeInitializeMessage(capture.data)
+		if !ok {
+			return fmt.Errorf("%v: Too short to hold an initialize message (%v bytes)", capture.name, len(capture.data))
+		}
+		fmt.Fprintf(out, "%v: initialize: %v\n", capture.name, describeInitializeMessage(message))
+	}
+
+	parameters, err := negotiate(captures, options)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "negotiated: ID bits %v, length bits %v", parameters.idBits, parameters.lengthBits)
+	if parameters.isExtensionsKnown {
+		fmt.Fprintf(out, ", extensions %v", describeExtensions(parameters.extensions))
+	}
+	fmt.Fprintln(out)
+
+	for _, capture := range captures {
+		fmt.Fprintf(out, "\n%v:\n", capture.name)
+		if err = dumpMessages(out, capture.data, parameters, options); err != nil {
+			return fmt.Errorf("%v: %v", capture.name, err)
+		}
+	}
+	return nil
+}
+
+// Work out the ID and length bits, preferring (in order) those specified in
+// the options, the outcome of negotiating both initialize messages, and a
+// quick init request's recommended values.
+func negotiate(captures []capture, options dumpOptions) (parameters negotiatedParameters, err error) {
+	parameters.idBits = -1
+	parameters.lengthBits = -1
+	first, _ := internal.DecodeInitializeMessage(captures[0].data)
+
+	if len(captures) > 1 {
+		negotiator, err := newNegotiator(first)
+		if err == nil {
+			_, err = negotiator.Feed(captures[1].data[:internal.InitializeMessageLength])
+		}
+		if err == nil {
+			parameters.idBits = negotiator.IdBits
+			parameters.lengthBits = negotiator.LengthBits
+			parameters.extensions = negotiator.Extensions
+			parameters.isExtensionsKnown = true
+		} else if options.idBits < 0 || options.lengthBits < 0 {
+			return parameters, fmt.Errorf("Negotiation failed (use -id-bits and -length-bits to decode anyway): %v", err)
+		}
+	} else if first.RequestQuickInit {
+		parameters.idBits = first.IdBits.Recommended
+		parameters.lengthBits = first.LengthBits.Recommended
+	}
+
+	if options.idBits >= 0 {
+		parameters.idBits = options.idBits
+	}
+	if options.lengthBits >= 0 {
+		parameters.lengthBits = options.lengthBits
+	}
+	if parameters.idBits < 0 || parameters.lengthBits < 0 {
+		return parameters, fmt.Errorf("Can't tell what was negotiated from one capture without a quick init. Supply the peer's capture, or use -id-bits and -length-bits")
+	}
+	if parameters.idBits+parameters.lengthBits > 30 {
+		return parameters, fmt.Errorf("ID bits (%v) plus length bits (%v) must not exceed 30", parameters.idBits, parameters.lengthBits)
+	}
+	return parameters, nil
+}
+
+func newNegotiator(message internal.InitializeMessage) (*internal.ProtocolNegotiator, error) {
+	if err := internal.ValidateParameters(
+		message.IdBits.Min, message.IdBits.Max, message.IdBits.Recommended,
+		message.LengthBits.Min, message.LengthBits.Max, message.LengthBits.Recommended,
+		message.RequestQuickInit, message.AllowQuickInit); err != nil {
+
+		return nil, err
+	}
+	negotiator := internal.NewNegotiator(message.Version,
+		message.IdBits.Min, message.IdBits.Max, message.IdBits.Recommended,
+		message.LengthBits.Min, message.LengthBits.Max, message.LengthBits.Recommended,
+		message.RequestQuickInit, message.AllowQuickInit)
+	negotiator.SetExtensions(message.Extensions)
+	return negotiator, nil
+}
+
+func dumpMessages(out io.Writer, data []byte, parameters negotiatedParameters, options dumpOptions) error {
+	var header internal.MessageHeader
+	header.Init(parameters.idBits, parameters.lengthBits)
+	hasControl := parameters.isExtensionsKnown && parameters.extensions&internal.ExtensionControl != 0
+	controlMessageId := internal.ControlMessageId(parameters.idBits)
+	notificationMessageId := internal.NotificationMessageId(parameters.idBits)
+	// Messages that have begun but not ended, keyed by ID and response bit.
+	openMessages := make(map[[2]int]bool)
+
+	offset := internal.InitializeMessageLength
+	data = data[offset:]
+	for len(data) > 0 {
+		header.ClearEncoded()
+		remainingData, err := header.Feed(data)
+		if err != nil {
+			return fmt.Errorf("Offset %v: %v", offset, err)
+		}
+		if !header.IsDecoded() {
+			fmt.Fprintf(out, "%8d: truncated header (%v of %v bytes)\n", offset, len(data), header.HeaderLength)
+			return nil
+		}
+
+		payload := remainingData
+		isTruncated := len(payload) < header.Length
+		if !isTruncated {
+			payload = payload[:header.Length]
+		}
+
+		key := [2]int{header.Id, boolToInt(header.IsResponse)}
+		isFirstChunk := !openMessages[key]
+		if header.MessageType == internal.MessageTypeRequest || header.MessageType == internal.MessageTypeResponse {
+			openMessages[key] = !header.IsEndOfMessage
+		} else {
+			delete(openMessages, key)
+		}
+
+		notes := ""
+		if hasControl && !header.IsResponse {
+			switch header.Id {
+			case controlMessageId:
+				notes = " [control]"
+				if isFirstChunk && len(payload) > 0 {
+					notes = fmt.Sprintf(" [control opcode %v]", payload[0])
+				}
+			case notificationMessageId:
+				notes = " [notification]"
+			}
+		}
+		if isTruncated {
+			notes += fmt.Sprintf(" [truncated: %v of %v bytes]", len(payload), header.Length)
+		}
+
+		fmt.Fprintf(out, "%8d: id %-5d %-25v length %-6d response %v end %v%v\n",
+			offset, header.Id, header.MessageType, header.Length,
+			boolToInt(header.IsResponse), boolToInt(header.IsEndOfMessage), notes)
+		if options.showPayloads && len(payload) > 0 {
+			dumpPayload(out, payload)
+		}
+
+		offset += header.HeaderLength + len(payload)
+		data = remainingData[len(payload):]
+	}
+	return nil
+}
+
+func dumpPayload(out io.Writer, payload []byte) {
+	lines := strings.Split(strings.TrimSuffix(hex.Dump(payload), "\n"), "\n")
+	for _, line := range lines {
+		fmt.Fprintf(out, "          %v\n", line)
+	}
+}
+
+func describeInitializeMessage(message internal.InitializeMessage) string {
+	description := fmt.Sprintf("version %v, ID bits %v, length bits %v",
+		message.Version, describeBitRange(message.IdBits), describeBitRange(message.LengthBits))
+	if message.RequestQuickInit {
+		description += ", requests quick init"
+	}
+	if message.AllowQuickInit {
+		description += ", allows quick init"
+	}
+	return description + ", extensions " + describeExtensions(message.Extensions)
+}
+
+func describeBitRange(bitRange internal.BitRange) string {
+	recommended := fmt.Sprint(bitRange.Recommended)
+	if bitRange.Recommended == internal.RecommendedWildcard {
+		recommended = "any"
+	}
+	return fmt.Sprintf("%v-%v (recommends %v)", bitRange.Min, bitRange.Max, recommended)
+}
+
+func describeExtensions(extensions int) string {
+	var names []string
+	if extensions&internal.ExtensionControl != 0 {
+		names = append(names, "control")
+	}
+	if extensions&internal.ExtensionFlowControl != 0 {
+		names = append(names, "flow control")
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
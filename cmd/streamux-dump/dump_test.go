@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kstenerud/go-streamux"
+)
+
+// Records everything written to the connection.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+	mutex   sync.Mutex
+}
+
+func (this *recordingConn) Write(data []byte) (int, error) {
+	this.mutex.Lock()
+	this.written.Write(data)
+	this.mutex.Unlock()
+	return this.Conn.Write(data)
+}
+
+func (this *recordingConn) Captured() []byte {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]byte(nil), this.written.Bytes()...)
+}
+
+func newTestConfig(isServer bool) *streamux.Config {
+	config := streamux.NewDefaultConfig()
+	config.IdRecommendBits = 8
+	config.LengthRecommendBits = 10
+	config.EnableControlExtension = true
+	config.Codecs = streamux.DefaultCodecNames
+	config.RequestQuickInit = !isServer
+	config.AllowQuickInit = isServer
+	return config
+}
+
+// Capture both directions of a connection that makes one call.
+func captureCall(t *testing.T) (client, server []byte) {
+	clientPipe, serverPipe := net.Pipe()
+	clientConn := &recordingConn{Conn: clientPipe}
+	serverConn := &recordingConn{Conn: serverPipe}
+	clientSession, _ := streamux.NewSession(clientConn, newTestConfig(false), nil)
+	serverSession, _ := streamux.NewSession(serverConn, newTestConfig(true), nil)
+
+	go func() {
+		id, body, err := serverSession.AcceptRequest()
+		if err != nil {
+			return
+		}
+		request, _ := ioutil.ReadAll(body)
+		serverSession.SendResponse(0, id, request)
+	}()
+	if _, err := clientSession.Call(context.Background(), 0, bytes.Repeat([]byte("x"), 1500)); err != nil {
+		t.Error(err)
+	}
+	clientSession.Close()
+	serverSession.Close()
+	clientSession.Wait()
+	serverSession.Wait()
+	return clientConn.Captured(), serverConn.Captured()
+}
+
+func assertContains(t *testing.T, output string, expected string) {
+	if !strings.Contains(output, expected) {
+		t.Errorf("Expected output to contain %q, but got:\n%v", expected, output)
+	}
+}
+
+// =============================================================================
+
+func TestDumpBothDirections(t *testing.T) {
+	client, server := captureCall(t)
+	var out bytes.Buffer
+	options := dumpOptions{idBits: -1, lengthBits: -1, showPayloads: true}
+	if err := dump(&out, []capture{{"client", client}, {"server", server}}, options); err != nil {
+		t.Error(err)
+		return
+	}
+
+	output := out.String()
+	assertContains(t, output, "client: initialize: version 1, ID bits")
+	assertContains(t, output, "requests quick init")
+	assertContains(t, output, "negotiated: ID bits 8, length bits 10, extensions control")
+	assertContains(t, output, "[control opcode")
+	// The request is split into two chunks, and echoed back the same way.
+	assertContains(t, output, "request                   length 1023   response 0 end 0")
+	assertContains(t, output, "request                   length 477    response 0 end 1")
+	assertContains(t, output, "response                  length 477    response 1 end 1")
+	assertContains(t, output, "78 78 78 78")
+}
+
+func TestDumpOneDirection(t *testing.T) {
+	client, server := captureCall(t)
+	var out bytes.Buffer
+	options := dumpOptions{idBits: -1, lengthBits: -1}
+
+	// The client requested a quick init, so its capture can be decoded alone.
+	if err := dump(&out, []capture{{"client", client}}, options); err != nil {
+		t.Error(err)
+		return
+	}
+	assertContains(t, out.String(), "negotiated: ID bits 8, length bits 10\n")
+
+	if err := dump(&out, []capture{{"server", server}}, options); err == nil {
+		t.Errorf("Expected the server's capture to need the bit counts")
+	}
+	options.idBits = 8
+	options.lengthBits = 10
+	if err := dump(&out, []capture{{"server", server}}, options); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDumpTruncated(t *testing.T) {
+	client, _ := captureCall(t)
+	var out bytes.Buffer
+	options := dumpOptions{idBits: -1, lengthBits: -1}
+	if err := dump(&out, []capture{{"client", client[:len(client)-1]}}, options); err != nil {
+		t.Error(err)
+		return
+	}
+	assertContains(t, out.String(), "[truncated:")
+
+	if err := dump(&out, []capture{{"short", client[:3]}}, options); err == nil {
+		t.Errorf("Expected a capture without an initialize message to be rejected")
+	}
+}
@@ -0,0 +1,53 @@
+// Command streamux-dump prints a human readable trace of a raw capture of a
+// streamux connection: the initialize message, then the header of every message
+// chunk (ID, length, response and termination bits, and message type).
+//
+// Usage:
+//
+//	streamux-dump [flags] capture [peer-capture]
+//
+// A capture holds the bytes sent in one direction of a connection. Message
+// headers can only be decoded once the negotiated ID and length bit counts are
+// known. These are worked out from both initialize messages if the peer's
+// capture is also given (in which case it's dumped too), or from the capture
+// alone if it requested a quick init. Otherwise, pass -id-bits and
+// -length-bits.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+func main() {
+	var options dumpOptions
+	flag.IntVar(&options.idBits, "id-bits", -1, "The negotiated ID bits (overrides negotiation)")
+	flag.IntVar(&options.lengthBits, "length-bits", -1, "The negotiated length bits (overrides negotiation)")
+	flag.BoolVar(&options.showPayloads, "hex", false, "Print a hex dump of each chunk's payload")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [flags] capture [peer-capture]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var captures []capture
+	for _, path := range flag.Args() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		captures = append(captures, capture{path, data})
+	}
+
+	if err := dump(os.Stdout, captures, options); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,190 @@
+package streamux
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A Codec marshals values to and from message payloads. Peers agree on a codec
+// per connection (see Config.Codecs), so each codec is identified by a name
+// that must be the same on both sides.
+type Codec interface {
+	Name() string
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, value interface{}) error
+}
+
+// CodecProvider supplies the codec that the peers agreed on. Session and
+// Protocol implement it.
+type CodecProvider interface {
+	Codec() (Codec, error)
+}
+
+// The built-in codecs, in order of preference. Use these as Config.Codecs to
+// offer them all.
+var DefaultCodecNames = []string{"json", "gob", "binary"}
+
+// The longest allowed codec name.
+const MaxCodecNameLength = 255
+
+// How long to wait for the peer's codecs when Config.CodecTimeout is 0.
+const DefaultCodecTimeout = 5 * time.Second
+
+// API
+
+// Make a codec available for negotiation, replacing any registered earlier
+// under the same name. The built-in codecs are registered already.
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// Returns nil if no codec with that name is registered.
+func LookupCodec(name string) Codec {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	return codecs[name]
+}
+
+// JSONCodec marshals with encoding/json.
+type JSONCodec struct{}
+
+func (this JSONCodec) Name() string {
+	return "json"
+}
+
+func (this JSONCodec) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (this JSONCodec) Unmarshal(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
+
+// GobCodec marshals with encoding/gob. Each payload carries its own type
+// information, since messages may be decoded independently.
+type GobCodec struct{}
+
+func (this GobCodec) Name() string {
+	return "gob"
+}
+
+func (this GobCodec) Marshal(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (this GobCodec) Unmarshal(data []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+// BinaryCodec is a compact encoding with no type information. It supports
+// []byte and string (sent as is), types implementing encoding.BinaryMarshaler
+// and encoding.BinaryUnmarshaler, and fixed-size values such as numbers and
+// structs of numbers (sent little endian, via encoding/binary).
+type BinaryCodec struct{}
+
+func (this BinaryCodec) Name() string {
+	return "binary"
+}
+
+func (this BinaryCodec) Marshal(value interface{}) ([]byte, error) {
+	switch value := value.(type) {
+	case []byte:
+		return value, nil
+	case *[]byte:
+		return *value, nil
+	case string:
+		return []byte(value), nil
+	case *string:
+		return []byte(*value), nil
+	case encoding.BinaryMarshaler:
+		return value.MarshalBinary()
+	}
+	var buffer bytes.Buffer
+	if err := binary.Write(&buffer, binary.LittleEndian, value); err != nil {
+		return nil, fmt.Errorf("BinaryCodec: %v", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+func (this BinaryCodec) Unmarshal(data []byte, value interface{}) error {
+	switch value := value.(type) {
+	case *[]byte:
+		*value = append([]byte(nil), data...)
+		return nil
+	case *string:
+		*value = string(data)
+		return nil
+	case encoding.BinaryUnmarshaler:
+		return value.UnmarshalBinary(data)
+	}
+	reader := bytes.NewReader(data)
+	if err := binary.Read(reader, binary.LittleEndian, value); err != nil {
+		return fmt.Errorf("BinaryCodec: %v", err)
+	}
+	if reader.Len() != 0 {
+		return fmt.Errorf("BinaryCodec: %v bytes left over", reader.Len())
+	}
+	return nil
+}
+
+// Internal
+
+var codecs = map[string]Codec{
+	"json":   JSONCodec{},
+	"gob":    GobCodec{},
+	"binary": BinaryCodec{},
+}
+var codecsMutex sync.Mutex
+
+// Choose the codec that both peers rank best (lowest combined position in
+// their preference lists). Ties go to the alphabetically first name, so that
+// both peers make the same choice.
+func chooseCodec(local []string, remote []string) (name string, ok bool) {
+	bestRank := -1
+	for localRank, localName := range local {
+		for remoteRank, remoteName := range remote {
+			if localName != remoteName {
+				continue
+			}
+			rank := localRank + remoteRank
+			if bestRank < 0 || rank < bestRank || (rank == bestRank && localName < name) {
+				bestRank = rank
+				name = localName
+			}
+		}
+	}
+	return name, bestRank >= 0
+}
+
+func encodeCodecNames(names []string) []byte {
+	var payload []byte
+	for _, name := range names {
+		payload = append(payload, byte(len(name)))
+		payload = append(payload, name...)
+	}
+	return payload
+}
+
+func decodeCodecNames(payload []byte) (names []string, ok bool) {
+	for len(payload) > 0 {
+		length := int(payload[0])
+		if len(payload) < 1+length {
+			return nil, false
+		}
+		names = append(names, string(payload[1:1+length]))
+		payload = payload[1+length:]
+	}
+	return names, true
+}
@@ -0,0 +1,239 @@
+package streamux
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testCodecValue struct {
+	Id    int32
+	Score float64
+	Flags [4]uint8
+}
+
+func newTestCodecSessionPair(clientCodecs, serverCodecs []string, serverReceiver MessageReceiver) (client, server *Session) {
+	return newTestPipeSessionPair(func(config *Config, isServer bool) {
+		config.EnableControlExtension = true
+		config.Codecs = clientCodecs
+		if isServer {
+			config.Codecs = serverCodecs
+		}
+	}, nil, serverReceiver)
+}
+
+func assertCodecRoundTrip(t *testing.T, codec Codec, value interface{}, decoded interface{}) {
+	data, err := codec.Marshal(value)
+	if err != nil {
+		t.Errorf("%v: %v", codec.Name(), err)
+		return
+	}
+	if err = codec.Unmarshal(data, decoded); err != nil {
+		t.Errorf("%v: %v", codec.Name(), err)
+		return
+	}
+	if actual := reflect.ValueOf(decoded).Elem().Interface(); !reflect.DeepEqual(actual, value) {
+		t.Errorf("%v: Expected %v but got %v", codec.Name(), value, actual)
+	}
+}
+
+// =============================================================================
+
+func TestCodecsRoundTrip(t *testing.T) {
+	value := testCodecValue{Id: 5, Score: 1.5, Flags: [4]uint8{1, 2, 3, 4}}
+	for _, name := range DefaultCodecNames {
+		codec := LookupCodec(name)
+		assertCodecRoundTrip(t, codec, value, new(testCodecValue))
+		assertCodecRoundTrip(t, codec, "text", new(string))
+		assertCodecRoundTrip(t, codec, []byte{1, 2, 3}, new([]byte))
+	}
+}
+
+func TestChooseCodec(t *testing.T) {
+	assertChoice := func(local, remote []string, expected string) {
+		// Both peers must make the same choice.
+		for _, lists := range [][2][]string{{local, remote}, {remote, local}} {
+			actual, ok := chooseCodec(lists[0], lists[1])
+			if expected == "" && ok {
+				t.Errorf("%v, %v: Expected no choice but got %v", lists[0], lists[1], actual)
+			}
+			if expected != "" && actual != expected {
+				t.Errorf("%v, %v: Expected %v but got %v", lists[0], lists[1], expected, actual)
+			}
+		}
+	}
+	assertChoice([]string{"json", "gob"}, []string{"json", "gob"}, "json")
+	assertChoice([]string{"gob", "json"}, []string{"json", "gob"}, "gob")
+	assertChoice([]string{"binary", "gob", "json"}, []string{"json", "gob"}, "gob")
+	assertChoice([]string{"binary"}, []string{"json"}, "")
+}
+
+func TestCodecConfigValidation(t *testing.T) {
+	config := NewDefaultConfig()
+	config.Codecs = []string{"json", "no such codec"}
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an unregistered codec to be rejected")
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	client, server := newTestCodecSessionPair([]string{"binary", "gob"}, []string{"json", "gob"}, nil)
+	defer server.Close()
+	defer client.Close()
+
+	for _, session := range []*Session{client, server} {
+		codec, err := session.Codec()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if codec.Name() != "gob" {
+			t.Errorf("Expected gob but got %v", codec.Name())
+		}
+	}
+}
+
+func TestCodecNoCommonCodec(t *testing.T) {
+	client, server := newTestCodecSessionPair([]string{"binary"}, []string{"json"}, nil)
+	defer server.Close()
+	defer client.Close()
+
+	if _, err := client.Codec(); err != ErrNoCommonCodec {
+		t.Errorf("Expected %v but got %v", ErrNoCommonCodec, err)
+	}
+}
+
+func TestCodecPeerPredatesCodecs(t *testing.T) {
+	config := newTestConfig(8, 10, false)
+	config.EnableControlExtension = true
+	config.Codecs = DefaultCodecNames
+	config.CodecTimeout = 10 * time.Millisecond
+	sender := newSchedulingSender()
+	client, err := NewProtocol(config, sender, newSessionTestReceiver())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	peerConfig := newTestConfig(8, 10, true)
+	peerConfig.EnableControlExtension = true
+	peerConfig.Codecs = DefaultCodecNames
+	peerSender := newSchedulingSender()
+	peer, err := NewProtocol(peerConfig, peerSender, newSessionTestReceiver())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = client.SendInitialization(); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = peer.SendInitialization(); err != nil {
+		t.Error(err)
+		return
+	}
+	// The peer only sends its codecs once it has our initialize message, which
+	// it never gets, so it behaves like a peer that doesn't know about codecs.
+	if err = feedQueued(peerSender, client); err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case <-client.CodecNegotiated():
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for codec negotiation to give up")
+		return
+	}
+	if _, err = client.Codec(); err != ErrCodecNegotiationTimeout {
+		t.Errorf("Expected %v but got %v", ErrCodecNegotiationTimeout, err)
+	}
+}
+
+func TestCodecWithContext(t *testing.T) {
+	// The peer never answers, so negotiation never completes.
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go ioutil.ReadAll(serverConn)
+	config := newTestConfig(8, 10, false)
+	config.EnableControlExtension = true
+	config.Codecs = DefaultCodecNames
+	client, _ := NewSession(clientConn, config, nil)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := client.CodecWithContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v but got %v", context.DeadlineExceeded, err)
+	}
+	if err := client.CallTyped(ctx, 0, 1, nil); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v but got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestCodecRequiresControlExtension(t *testing.T) {
+	enableControlExtension := false
+	client, server := newTestControlSessionPair(enableControlExtension)
+	defer server.Close()
+	defer client.Close()
+
+	if _, err := client.Codec(); err != ErrCodecsUnavailable {
+		t.Errorf("Expected %v but got %v", ErrCodecsUnavailable, err)
+	}
+}
+
+func TestCodecRequiresCodecs(t *testing.T) {
+	client, server := newTestCodecSessionPair(nil, nil, nil)
+	defer server.Close()
+	defer client.Close()
+
+	for _, session := range []*Session{client, server} {
+		if _, err := session.Codec(); err != ErrCodecsUnavailable {
+			t.Errorf("Expected %v but got %v", ErrCodecsUnavailable, err)
+		}
+	}
+}
+
+func TestCallRouteTyped(t *testing.T) {
+	if err := NewServeMux().HandleTyped("bad", func(value int) int { return value }); err == nil {
+		t.Errorf("Expected a handler with the wrong signature to be rejected")
+	}
+	if err := NewServeMux().HandleTyped("nil", nil); err == nil {
+		t.Errorf("Expected a nil handler to be rejected")
+	}
+	var nilFunction func(*Request, int) (int, error)
+	if err := NewServeMux().HandleTyped("nil", nilFunction); err == nil {
+		t.Errorf("Expected a nil handler to be rejected")
+	}
+
+	for _, codecName := range DefaultCodecNames {
+		// A mux responds via only one session, so each session pair needs its own.
+		mux := NewServeMux()
+		err := mux.HandleTyped("double", func(request *Request, value testCodecValue) (*testCodecValue, error) {
+			value.Id *= 2
+			value.Score *= 2
+			return &value, nil
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		codecs := []string{codecName}
+		client, server := newTestCodecSessionPair(codecs, codecs, mux)
+		mux.SetResponder(server)
+
+		var actual testCodecValue
+		err = client.CallRoute(context.Background(), 0, "double", &testCodecValue{Id: 3, Score: 1.25}, &actual)
+		server.Close()
+		client.Close()
+		if err != nil {
+			t.Errorf("%v: %v", codecName, err)
+			return
+		}
+		if expected := (testCodecValue{Id: 6, Score: 2.5}); actual != expected {
+			t.Errorf("%v: Expected %v but got %v", codecName, expected, actual)
+		}
+	}
+}
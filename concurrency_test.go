@@ -0,0 +1,248 @@
+package streamux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A protocol peer that is safe for concurrent use. Outgoing chunks are queued
+// in a SendScheduler, and a pump goroutine feeds them to the other peer.
+type concurrentTestPeer struct {
+	t          *testing.T
+	protocol   *Protocol
+	scheduler  *SendScheduler
+	ableToSend chan struct{}
+	ableOnce   sync.Once
+	requests   map[int][]byte
+	responses  map[int][]byte
+	errors     []error
+	mutex      sync.Mutex
+}
+
+func newConcurrentTestPeer(t *testing.T, idBits, lengthBits int, isServer bool) *concurrentTestPeer {
+	this := new(concurrentTestPeer)
+	this.t = t
+	this.scheduler = NewSendScheduler()
+	this.ableToSend = make(chan struct{})
+	this.requests = make(map[int][]byte)
+	this.responses = make(map[int][]byte)
+	var err error
+	if this.protocol, err = NewProtocol(newTestConfig(idBits, lengthBits, isServer), this, this); err != nil {
+		t.Error(err)
+	}
+	return this
+}
+
+func (this *concurrentTestPeer) pumpTo(peer *concurrentTestPeer, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			chunk, ok := this.scheduler.Pop()
+			if !ok {
+				return
+			}
+			if err := peer.protocol.Feed(chunk); err != nil {
+				peer.recordError(err)
+				return
+			}
+		}
+	}()
+}
+
+func (this *concurrentTestPeer) recordError(err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.errors = append(this.errors, err)
+}
+
+func (this *concurrentTestPeer) getErrors() []error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.errors
+}
+
+func (this *concurrentTestPeer) OnAbleToSend() {
+	this.ableOnce.Do(func() {
+		close(this.ableToSend)
+	})
+}
+
+func (this *concurrentTestPeer) OnMessageChunkToSend(priority int, messageId int, chunk []byte) error {
+	return this.scheduler.Push(priority, messageId, chunk)
+}
+
+func (this *concurrentTestPeer) OnPurgeRequestChunks(messageId int) {
+	this.scheduler.PurgeRequests(messageId)
+}
+
+func (this *concurrentTestPeer) OnRequestChunkReceived(messageId int, isEnd bool, data []byte) error {
+	this.mutex.Lock()
+	this.requests[messageId] = append(this.requests[messageId], data...)
+	request := this.requests[messageId]
+	if isEnd {
+		delete(this.requests, messageId)
+	}
+	this.mutex.Unlock()
+
+	if isEnd {
+		return this.protocol.SendResponse(0, messageId, request)
+	}
+	return nil
+}
+
+func (this *concurrentTestPeer) OnResponseChunkReceived(messageId int, isEnd bool, data []byte) error {
+	this.mutex.Lock()
+	this.responses[messageId] = append(this.responses[messageId], data...)
+	response := this.responses[messageId]
+	if isEnd {
+		delete(this.responses, messageId)
+	}
+	this.mutex.Unlock()
+
+	if isEnd {
+		return verifyTaggedContents(response)
+	}
+	return nil
+}
+
+func (this *concurrentTestPeer) OnPingReceived(messageId int) error {
+	return nil
+}
+
+func (this *concurrentTestPeer) OnPingAckReceived(messageId int, latency time.Duration) error {
+	return nil
+}
+
+func (this *concurrentTestPeer) OnCancelReceived(messageId int) error {
+	this.scheduler.PurgeResponses(messageId)
+	return nil
+}
+
+func (this *concurrentTestPeer) OnCancelAckReceived(messageId int) error {
+	// Drop any partial response to the canceled request.
+	this.mutex.Lock()
+	delete(this.responses, messageId)
+	this.mutex.Unlock()
+	return nil
+}
+
+func (this *concurrentTestPeer) OnEmptyResponseReceived(messageId int) error {
+	return this.OnResponseChunkReceived(messageId, true, []byte{})
+}
+
+// Build contents consisting of a repeated 8-byte tag, so that a message
+// assembled from the wrong chunks can be detected.
+func newTaggedContents(tag uint64, length int) []byte {
+	var tagBytes [8]byte
+	binary.LittleEndian.PutUint64(tagBytes[:], tag)
+	contents := bytes.Repeat(tagBytes[:], length/8+1)
+	return contents[:length]
+}
+
+func verifyTaggedContents(contents []byte) error {
+	if len(contents) < 8 {
+		return nil
+	}
+	tag := binary.LittleEndian.Uint64(contents)
+	if !bytes.Equal(contents, newTaggedContents(tag, len(contents))) {
+		return fmt.Errorf("Message with tag %v was corrupted", tag)
+	}
+	return nil
+}
+
+func hammerProtocol(t *testing.T, peer *concurrentTestPeer, senderIndex int, iterations int) {
+	for i := 0; i < iterations; i++ {
+		tag := uint64(senderIndex)<<32 | uint64(i)
+		id, err := peer.protocol.SendRequest(i%4, newTaggedContents(tag, 8+(i*37)%3000))
+		if err == ErrIdPoolExhausted {
+			runtime.Gosched()
+			continue
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if i%3 == 0 {
+			if err = peer.protocol.Cancel(id); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		if i%5 == 0 {
+			if _, err = peer.protocol.Ping(); err != nil && err != ErrIdPoolExhausted {
+				t.Error(err)
+				return
+			}
+		}
+	}
+}
+
+func awaitAllIdsReleased(t *testing.T, peers ...*concurrentTestPeer) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, peer := range peers {
+		for peer.protocol.requestStateMachine.ActiveRequestCount() > 0 {
+			if time.Now().After(deadline) {
+				t.Errorf("Timed out with %v request IDs still in use", peer.protocol.requestStateMachine.ActiveRequestCount())
+				return false
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return true
+}
+
+// =============================================================================
+
+// Run with -race to detect unsynchronized access.
+func TestProtocolConcurrentSendersAndFeeder(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	client := newConcurrentTestPeer(t, 5, 8, false)
+	server := newConcurrentTestPeer(t, 5, 8, true)
+	client.pumpTo(server, wg)
+	server.pumpTo(client, wg)
+	defer func() {
+		client.scheduler.Close()
+		server.scheduler.Close()
+		wg.Wait()
+	}()
+
+	if err := client.protocol.SendInitialization(); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := server.protocol.SendInitialization(); err != nil {
+		t.Error(err)
+		return
+	}
+	if !awaitSignal(t, client.ableToSend, "client able to send") ||
+		!awaitSignal(t, server.ableToSend, "server able to send") {
+		return
+	}
+
+	senders := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		senders.Add(2)
+		go func(index int) {
+			defer senders.Done()
+			hammerProtocol(t, client, index, 200)
+		}(i)
+		go func(index int) {
+			defer senders.Done()
+			hammerProtocol(t, server, index, 200)
+		}(i)
+	}
+	senders.Wait()
+
+	if !awaitAllIdsReleased(t, client, server) {
+		return
+	}
+	for _, err := range append(client.getErrors(), server.getErrors()...) {
+		t.Error(err)
+	}
+}
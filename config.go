@@ -0,0 +1,205 @@
+package streamux
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/kstenerud/go-streamux/internal"
+)
+
+// BitsWildcard can be used as a recommended bit count, leaving the choice to
+// the negotiation (the midpoint of the negotiated range). It cannot be used
+// when requesting quick init.
+const BitsWildcard = internal.RecommendedWildcard
+
+// Config holds the settings that a Protocol (or Session) is created with.
+//
+// Start from one of the preset constructors and adjust as needed. Fields added
+// in future versions will treat their zero value as "use the default", so
+// configs built from a preset will keep working.
+type Config struct {
+	// Range of message ID field sizes (in bits) that we will accept, and the
+	// size we'd prefer. More ID bits allow more concurrent requests.
+	IdMinBits       int
+	IdMaxBits       int
+	IdRecommendBits int
+
+	// Range of length field sizes (in bits) that we will accept, and the size
+	// we'd prefer. More length bits allow larger chunks, which lowers overhead
+	// but increases latency for higher priority messages.
+	LengthMinBits       int
+	LengthMaxBits       int
+	LengthRecommendBits int
+
+	// Quick init allows the requesting side to begin sending messages without
+	// waiting for the other peer's initialize message, saving a round trip.
+	// A peer can't both request and allow quick init. Typically a client
+	// requests quick init and a server allows it.
+	RequestQuickInit bool
+	AllowQuickInit   bool
+
+	// Advertise the control extension, which carries control messages such as
+	// the GOAWAY sent by Protocol.Drain(). It's only used if the peer
+	// advertises it too, and at least 2 ID bits are negotiated. The highest
+	// message ID is reserved for it.
+	EnableControlExtension bool
+
+	// Advertise the flow control extension, which limits how much message data
+	// the peer may send ahead of what we've consumed (see SendableMessage and
+	// GrantCredit()). Requires the control extension, since credit is granted
+	// via control messages.
+	EnableFlowControl bool
+
+	// How many bytes of a single message's data, and of all messages' data
+	// combined, the peer may send ahead of what we've consumed. 0 means
+	// DefaultMessageWindow and DefaultConnectionWindow, which are also the
+	// minimums.
+	MessageWindow    int
+	ConnectionWindow int
+
+	// Normally, credit is granted back to the peer once a MessageReceiver
+	// callback returns. Set this to grant it yourself via GrantCredit() once
+	// the data has actually been consumed.
+	ManualCreditGrants bool
+
+	// The codecs (see RegisterCodec()) to offer the peer for encoding typed
+	// payloads, in order of preference, such as DefaultCodecNames. Once
+	// negotiation completes, the peers agree on one (see Protocol.Codec()).
+	// This requires the control extension. If empty, codecs aren't negotiated
+	// at all, and typed payloads are unavailable.
+	Codecs []string
+
+	// How long to wait for the peer's codecs once negotiation completes. A peer
+	// that has the control extension but predates codec negotiation (or has no
+	// codecs configured) never sends them, so after this long Codec() fails
+	// with ErrCodecNegotiationTimeout. 0 means DefaultCodecTimeout.
+	CodecTimeout time.Duration
+}
+
+// API
+
+// Create a general purpose config: a moderate number of concurrent requests,
+// with moderately sized chunks.
+func NewDefaultConfig() *Config {
+	return &Config{
+		IdMinBits:           0,
+		IdMaxBits:           29,
+		IdRecommendBits:     12,
+		LengthMinBits:       1,
+		LengthMaxBits:       30,
+		LengthRecommendBits: 14,
+		AllowQuickInit:      true,
+	}
+}
+
+// Create a config favoring latency over throughput: small chunks (so that high
+// priority messages never wait long behind low priority ones) and a 2-byte
+// header. Set RequestQuickInit on the client side to also save a round trip
+// during initialization.
+func NewLowLatencyConfig() *Config {
+	return &Config{
+		IdMinBits:           0,
+		IdMaxBits:           29,
+		IdRecommendBits:     6,
+		LengthMinBits:       1,
+		LengthMaxBits:       30,
+		LengthRecommendBits: 8,
+		AllowQuickInit:      true,
+	}
+}
+
+// Create a config favoring throughput over latency: large chunks with little
+// header overhead, for bulk data transfer.
+func NewBulkTransferConfig() *Config {
+	return &Config{
+		IdMinBits:           0,
+		IdMaxBits:           29,
+		IdRecommendBits:     8,
+		LengthMinBits:       1,
+		LengthMaxBits:       30,
+		LengthRecommendBits: 20,
+		AllowQuickInit:      true,
+	}
+}
+
+// Check that this config is usable, returning a *ConfigError describing the
+// first problem found.
+func (this *Config) Validate() error {
+	if err := internal.ValidateParameters(this.IdMinBits, this.IdMaxBits, this.IdRecommendBits,
+		this.LengthMinBits, this.LengthMaxBits, this.LengthRecommendBits,
+		this.RequestQuickInit, this.AllowQuickInit); err != nil {
+
+		return &ConfigError{Reason: err.Error()}
+	}
+	if this.EnableFlowControl && !this.EnableControlExtension {
+		return &ConfigError{Reason: "Flow control requires the control extension"}
+	}
+	if err := validateWindow("Message", this.MessageWindow, DefaultMessageWindow); err != nil {
+		return err
+	}
+	if err := validateWindow("Connection", this.ConnectionWindow, DefaultConnectionWindow); err != nil {
+		return err
+	}
+	if this.CodecTimeout < 0 {
+		return &ConfigError{Reason: fmt.Sprintf("Codec timeout (%v) must not be negative", this.CodecTimeout)}
+	}
+	return this.validateCodecs()
+}
+
+// Internal
+
+func (this *Config) extensions() (extensions int) {
+	if this.EnableControlExtension {
+		extensions |= internal.ExtensionControl
+	}
+	if this.EnableFlowControl {
+		extensions |= internal.ExtensionFlowControl
+	}
+	return extensions
+}
+
+func (this *Config) messageWindow() int {
+	if this.MessageWindow == 0 {
+		return DefaultMessageWindow
+	}
+	return this.MessageWindow
+}
+
+func (this *Config) connectionWindow() int {
+	if this.ConnectionWindow == 0 {
+		return DefaultConnectionWindow
+	}
+	return this.ConnectionWindow
+}
+
+func (this *Config) codecTimeout() time.Duration {
+	if this.CodecTimeout == 0 {
+		return DefaultCodecTimeout
+	}
+	return this.CodecTimeout
+}
+
+func (this *Config) validateCodecs() error {
+	for _, name := range this.Codecs {
+		if len(name) == 0 || len(name) > MaxCodecNameLength {
+			return &ConfigError{Reason: fmt.Sprintf("Codec name %q must be 1-%v bytes long", name, MaxCodecNameLength)}
+		}
+		if LookupCodec(name) == nil {
+			return &ConfigError{Reason: fmt.Sprintf("Codec %q is not registered", name)}
+		}
+	}
+	// The names must fit in a control message, after the opcode.
+	if len(encodeCodecNames(this.Codecs)) >= maxControlMessageLength {
+		return &ConfigError{Reason: "Too many codecs"}
+	}
+	return nil
+}
+
+func validateWindow(name string, window int, minimum int) error {
+	if window != 0 && (window < minimum || window > math.MaxInt32) {
+		return &ConfigError{Reason: fmt.Sprintf("%v window (%v) must be 0 or in the range %v-%v",
+			name, window, minimum, math.MaxInt32)}
+	}
+	return nil
+}
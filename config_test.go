@@ -0,0 +1,103 @@
+package streamux
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func assertConfigValid(t *testing.T, name string, config *Config) {
+	if err := config.Validate(); err != nil {
+		t.Errorf("%v config should be valid but got %v", name, err)
+	}
+}
+
+func assertConfigInvalid(t *testing.T, config *Config) {
+	if err := config.Validate(); err == nil {
+		t.Errorf("Config %+v should be invalid", *config)
+	}
+}
+
+// =============================================================================
+
+func TestConfigPresetsAreValid(t *testing.T) {
+	assertConfigValid(t, "Default", NewDefaultConfig())
+	assertConfigValid(t, "Low latency", NewLowLatencyConfig())
+	assertConfigValid(t, "Bulk transfer", NewBulkTransferConfig())
+
+	config := NewLowLatencyConfig()
+	config.RequestQuickInit = true
+	config.AllowQuickInit = false
+	assertConfigValid(t, "Quick init client", config)
+}
+
+func TestConfigInvalid(t *testing.T) {
+	config := NewDefaultConfig()
+	config.RequestQuickInit = true
+	assertConfigInvalid(t, config)
+
+	config = NewDefaultConfig()
+	config.IdMinBits = 10
+	config.IdMaxBits = 9
+	assertConfigInvalid(t, config)
+
+	config = NewDefaultConfig()
+	config.LengthRecommendBits = 0
+	assertConfigInvalid(t, config)
+
+	config = NewDefaultConfig()
+	config.AllowQuickInit = false
+	config.RequestQuickInit = true
+	config.IdRecommendBits = BitsWildcard
+	assertConfigInvalid(t, config)
+}
+
+func TestConfigFlowControl(t *testing.T) {
+	config := NewDefaultConfig()
+	config.EnableFlowControl = true
+	assertConfigInvalid(t, config)
+
+	config.EnableControlExtension = true
+	assertConfigValid(t, "Flow control", config)
+
+	config.MessageWindow = DefaultMessageWindow - 1
+	assertConfigInvalid(t, config)
+
+	config.MessageWindow = DefaultMessageWindow * 4
+	config.ConnectionWindow = DefaultConnectionWindow - 1
+	assertConfigInvalid(t, config)
+}
+
+func TestConfigCodecTimeout(t *testing.T) {
+	config := NewDefaultConfig()
+	config.CodecTimeout = time.Second
+	assertConfigValid(t, "Codec timeout", config)
+
+	config.CodecTimeout = -1
+	assertConfigInvalid(t, config)
+}
+
+func TestConfigWildcard(t *testing.T) {
+	config := NewDefaultConfig()
+	config.IdRecommendBits = BitsWildcard
+	config.LengthRecommendBits = BitsWildcard
+	assertConfigValid(t, "Wildcard", config)
+}
+
+func TestNewProtocolInvalidConfig(t *testing.T) {
+	config := NewDefaultConfig()
+	config.LengthMaxBits = 31
+	if _, err := NewProtocol(config, nil, nil); err == nil {
+		t.Errorf("Expected NewProtocol to fail")
+	}
+}
+
+func TestNewSessionInvalidConfig(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	config := NewDefaultConfig()
+	config.IdMaxBits = 30
+	if _, err := NewSession(clientConn, config, nil); err == nil {
+		t.Errorf("Expected NewSession to fail")
+	}
+}
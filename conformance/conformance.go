@@ -0,0 +1,256 @@
+// Package conformance provides golden test vectors for the streamux wire
+// protocol, generated from this implementation, and a driver that checks
+// another implementation against them.
+//
+// The vectors are stored as JSON in the vectors directory, so that
+// implementations in other languages can use them directly. Byte strings are
+// encoded as lowercase hex. There are three kinds:
+//
+// Initialize vectors (initialize.json) pair the initialize message that a
+// local peer sends with one that it receives, and give the negotiated outcome.
+//
+// Header vectors (headers.json) give the encoded header of a message chunk,
+// for every combination of ID and length bits.
+//
+// Conversation vectors (conversations.json) give the chunks of data that the
+// driver sends to an implementation, and the initialize message and messages
+// that the implementation must send back. The implementation uses the
+// vector's config (see PeerConfig), and acts as an echo server: when a request
+// ends, it responds with the request's contents. Pings and cancels are
+// acknowledged as the protocol requires. Response chunks may be split however
+// the implementation likes, since messages are compared once reassembled, in
+// the order they end.
+//
+// When the control extension is negotiated, control messages and
+// notifications are sent as requests on the message IDs that it reserves, so
+// they're listed like any other message. The implementation must send the
+// same ones: its codecs (if it has any) once negotiation completes, and any
+// flow control credit that its windows call for.
+//
+// To check an implementation in Go, pass a PeerFactory to RunConversation().
+// To check one in another language, build a program that reads its config as
+// JSON (see PeerConfig) from the STREAMUX_CONFORMANCE_CONFIG environment
+// variable, speaks the protocol over stdin and stdout, and exits once stdin
+// ends: with status 0, or nonzero if the peer violated the protocol. Then run
+// the driver against it, either with RunSubprocessConversation(), or with
+// this package's tests:
+//
+// go test github.com/kstenerud/go-streamux/conformance -args -peer=/path/to/peer
+package conformance
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/kstenerud/go-streamux"
+)
+
+// HexBytes is a byte string that is encoded in JSON as lowercase hex.
+type HexBytes []byte
+
+// The settings that a peer is configured with. Extensions are only used if
+// enabled here (see streamux.Config for what each setting means).
+type PeerConfig struct {
+	IdMinBits           int  `json:"id_min_bits"`
+	IdMaxBits           int  `json:"id_max_bits"`
+	IdRecommendBits     int  `json:"id_recommend_bits"`
+	LengthMinBits       int  `json:"length_min_bits"`
+	LengthMaxBits       int  `json:"length_max_bits"`
+	LengthRecommendBits int  `json:"length_recommend_bits"`
+	RequestQuickInit    bool `json:"request_quick_init"`
+	AllowQuickInit      bool `json:"allow_quick_init"`
+
+	EnableControlExtension bool `json:"enable_control_extension,omitempty"`
+	EnableFlowControl      bool `json:"enable_flow_control,omitempty"`
+	// 0 means streamux.DefaultMessageWindow and
+	// streamux.DefaultConnectionWindow.
+	MessageWindow    int `json:"message_window,omitempty"`
+	ConnectionWindow int `json:"connection_window,omitempty"`
+	// The codecs offered via the control extension. Empty means that codecs
+	// aren't negotiated.
+	Codecs []string `json:"codecs,omitempty"`
+}
+
+type InitializeVector struct {
+	Name          string     `json:"name"`
+	Local         PeerConfig `json:"local"`
+	LocalMessage  HexBytes   `json:"local_message"`
+	RemoteMessage HexBytes   `json:"remote_message"`
+	// If negotiation fails, the bit counts are 0.
+	Fails      bool `json:"fails"`
+	IdBits     int  `json:"id_bits"`
+	LengthBits int  `json:"length_bits"`
+}
+
+type HeaderVector struct {
+	IdBits     int  `json:"id_bits"`
+	LengthBits int  `json:"length_bits"`
+	Id         int  `json:"id"`
+	Length     int  `json:"length"`
+	IsResponse bool `json:"is_response"`
+	IsEnd      bool `json:"is_end"`
+	// One of the names in MessageTypes.
+	Type    string   `json:"type"`
+	Encoded HexBytes `json:"encoded"`
+}
+
+// The names of the message types, as used in vectors. A chunk with data is a
+// request or response. Without data, the response and end bits select the
+// type: a cancel has neither, a cancel ack only the response bit, an empty
+// request termination (which is a ping if no request is in progress) only the
+// end bit, and an empty response (which is a ping ack if it answers a ping)
+// both.
+var MessageTypes = []string{
+	"request",
+	"response",
+	"cancel",
+	"cancel ack",
+	"empty request termination",
+	"empty response",
+}
+
+// A message as sent by the peer under test. A request or response's chunks
+// are reassembled into one message, which ends with its last chunk (possibly
+// an empty termination).
+type Message struct {
+	Type string   `json:"type"`
+	Id   int      `json:"id"`
+	Data HexBytes `json:"data,omitempty"`
+}
+
+type ConversationVector struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Config      PeerConfig `json:"config"`
+	// Sent to the peer under test in order, beginning with the initialize
+	// message. Each entry is fed to an in-process peer separately.
+	Input []HexBytes `json:"input"`
+	// The bit counts that the conversation negotiates, for decoding the
+	// output. 0 if negotiation fails.
+	IdBits     int `json:"id_bits"`
+	LengthBits int `json:"length_bits"`
+	// The initialize message that the peer under test must send first.
+	ExpectedInitialize HexBytes  `json:"expected_initialize"`
+	ExpectedMessages   []Message `json:"expected_messages"`
+	// The peer under test must report a failure (Feed() returns an error, or
+	// the subprocess exits with a nonzero status).
+	ExpectFailure bool `json:"expect_failure"`
+}
+
+type Vectors struct {
+	Initialize    []InitializeVector
+	Headers       []HeaderVector
+	Conversations []ConversationVector
+}
+
+// API
+
+// Load the vectors from the JSON files in dir.
+func LoadVectors(dir string) (*Vectors, error) {
+	vectors := new(Vectors)
+	if err := loadVectorFile(dir, initializeVectorsFile, &vectors.Initialize); err != nil {
+		return nil, err
+	}
+	if err := loadVectorFile(dir, headerVectorsFile, &vectors.Headers); err != nil {
+		return nil, err
+	}
+	if err := loadVectorFile(dir, conversationVectorsFile, &vectors.Conversations); err != nil {
+		return nil, err
+	}
+	return vectors, nil
+}
+
+// Write the vectors as JSON files in dir, with one vector per line.
+func WriteVectors(dir string, vectors *Vectors) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeVectorFile(dir, initializeVectorsFile, vectors.Initialize); err != nil {
+		return err
+	}
+	if err := writeVectorFile(dir, headerVectorsFile, vectors.Headers); err != nil {
+		return err
+	}
+	return writeVectorFile(dir, conversationVectorsFile, vectors.Conversations)
+}
+
+// Build a streamux config with these settings.
+func (this PeerConfig) Config() *streamux.Config {
+	config := streamux.NewDefaultConfig()
+	config.IdMinBits = this.IdMinBits
+	config.IdMaxBits = this.IdMaxBits
+	config.IdRecommendBits = this.IdRecommendBits
+	config.LengthMinBits = this.LengthMinBits
+	config.LengthMaxBits = this.LengthMaxBits
+	config.LengthRecommendBits = this.LengthRecommendBits
+	config.RequestQuickInit = this.RequestQuickInit
+	config.AllowQuickInit = this.AllowQuickInit
+	config.EnableControlExtension = this.EnableControlExtension
+	config.EnableFlowControl = this.EnableFlowControl
+	config.MessageWindow = this.MessageWindow
+	config.ConnectionWindow = this.ConnectionWindow
+	config.Codecs = this.Codecs
+	return config
+}
+
+func (this HexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(this))
+}
+
+func (this *HexBytes) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	*this = decoded
+	return nil
+}
+
+// Internal
+
+const (
+	initializeVectorsFile   = "initialize.json"
+	headerVectorsFile       = "headers.json"
+	conversationVectorsFile = "conversations.json"
+)
+
+func loadVectorFile(dir string, name string, vectors interface{}) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, vectors); err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	return nil
+}
+
+func writeVectorFile(dir string, name string, vectors interface{}) error {
+	// Each vector gets its own line, which keeps diffs of regenerated vectors
+	// readable.
+	elements := reflect.ValueOf(vectors)
+	data := []byte("[\n")
+	for i := 0; i < elements.Len(); i++ {
+		encoded, err := json.Marshal(elements.Index(i).Interface())
+		if err != nil {
+			return err
+		}
+		data = append(data, "  "...)
+		data = append(data, encoded...)
+		if i < elements.Len()-1 {
+			data = append(data, ',')
+		}
+		data = append(data, '\n')
+	}
+	data = append(data, "]\n"...)
+	return ioutil.WriteFile(filepath.Join(dir, name), data, 0644)
+}
@@ -0,0 +1,166 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kstenerud/go-streamux/internal"
+)
+
+var peerCommand = flag.String("peer", "", "Command (with space separated arguments) of a subprocess to run the conversations against")
+
+// Set when this test binary is run as the subprocess under test.
+const helperEnvironmentVariable = "STREAMUX_CONFORMANCE_HELPER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(helperEnvironmentVariable) != "" {
+		config, err := ConfigFromEnvironment()
+		if err == nil {
+			err = ServeEcho(config, os.Stdin, os.Stdout, NewProtocolPeer)
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	flag.Parse()
+	os.Exit(m.Run())
+}
+
+func loadVectors(t *testing.T) *Vectors {
+	vectors, err := LoadVectors(vectorsDir)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	return vectors
+}
+
+// =============================================================================
+
+func TestVectorsUpToDate(t *testing.T) {
+	generated, err := generateVectors()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if *updateVectors {
+		if err = WriteVectors(vectorsDir, generated); err != nil {
+			t.Error(err)
+		}
+		return
+	}
+
+	loaded := loadVectors(t)
+	if loaded == nil {
+		return
+	}
+	// Compared as JSON, which is what the files hold.
+	for _, pair := range [][2]interface{}{
+		{loaded.Initialize, generated.Initialize},
+		{loaded.Headers, generated.Headers},
+		{loaded.Conversations, generated.Conversations},
+	} {
+		expected, _ := json.Marshal(pair[1])
+		actual, _ := json.Marshal(pair[0])
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("The %T vectors are out of date (run the tests with -update)", pair[0])
+			return
+		}
+	}
+}
+
+func TestInitializeVectors(t *testing.T) {
+	vectors := loadVectors(t)
+	if vectors == nil {
+		return
+	}
+	for _, vector := range vectors.Initialize {
+		if !bytes.Equal(newInitializeMessage(1, vector.Local), vector.LocalMessage) {
+			t.Errorf("%v: Expected local initialize message %x", vector.Name, []byte(vector.LocalMessage))
+			return
+		}
+		idBits, lengthBits, err := negotiate(vector.Local, vector.RemoteMessage)
+		if (err != nil) != vector.Fails || idBits != vector.IdBits || lengthBits != vector.LengthBits {
+			t.Errorf("%v: Expected fails %v, ID bits %v, length bits %v, but got error %v, ID bits %v, length bits %v",
+				vector.Name, vector.Fails, vector.IdBits, vector.LengthBits, err, idBits, lengthBits)
+			return
+		}
+	}
+}
+
+func TestHeaderVectors(t *testing.T) {
+	vectors := loadVectors(t)
+	if vectors == nil {
+		return
+	}
+	for _, vector := range vectors.Headers {
+		header := internal.NewMessageHeader(vector.IdBits, vector.LengthBits)
+		remainingData, err := header.Feed(vector.Encoded)
+		if err != nil || len(remainingData) != 0 || !header.IsDecoded() {
+			t.Errorf("%+v: Failed to decode (error %v)", vector, err)
+			return
+		}
+		if header.Id != vector.Id || header.Length != vector.Length || header.IsResponse != vector.IsResponse ||
+			header.IsEndOfMessage != vector.IsEnd || header.MessageType.String() != vector.Type {
+
+			t.Errorf("%+v: Decoded as ID %v, length %v, response %v, end %v, type %v", vector,
+				header.Id, header.Length, header.IsResponse, header.IsEndOfMessage, header.MessageType)
+			return
+		}
+	}
+}
+
+func TestConversations(t *testing.T) {
+	vectors := loadVectors(t)
+	if vectors == nil {
+		return
+	}
+	for _, vector := range vectors.Conversations {
+		if err := RunConversation(vector, NewProtocolPeer); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestSubprocessConversations(t *testing.T) {
+	vectors := loadVectors(t)
+	if vectors == nil {
+		return
+	}
+	command := []string{os.Args[0]}
+	if *peerCommand != "" {
+		command = strings.Fields(*peerCommand)
+	} else {
+		os.Setenv(helperEnvironmentVariable, "1")
+		defer os.Unsetenv(helperEnvironmentVariable)
+	}
+	for _, vector := range vectors.Conversations {
+		if err := RunSubprocessConversation(vector, command[0], command[1:]...); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestConversationMismatch(t *testing.T) {
+	vectors := loadVectors(t)
+	if vectors == nil {
+		return
+	}
+	vector := vectors.Conversations[0]
+	vector.ExpectedMessages = []Message{{Type: "response", Id: vector.ExpectedMessages[0].Id, Data: []byte("wrong")}}
+	if err := RunConversation(vector, NewProtocolPeer); err == nil {
+		t.Errorf("Expected a mismatched response to be reported")
+	}
+	vector = vectors.Conversations[0]
+	vector.ExpectFailure = true
+	if err := RunConversation(vector, NewProtocolPeer); err == nil {
+		t.Errorf("Expected a missing failure to be reported")
+	}
+}
@@ -0,0 +1,365 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/kstenerud/go-streamux"
+	"github.com/kstenerud/go-streamux/internal"
+)
+
+// Peer is an implementation under test, driven in-process. *streamux.Protocol
+// implements it.
+type Peer interface {
+	SendInitialization() error
+	Feed(data []byte) error
+	SendResponse(priority int, responseToId int, contents []byte) error
+}
+
+// PeerFactory creates a peer under test, which must send everything via sender
+// and deliver everything it receives to receiver.
+type PeerFactory func(config *streamux.Config, sender streamux.MessageSender, receiver streamux.MessageReceiver) (Peer, error)
+
+// The environment variable that a subprocess under test reads its PeerConfig
+// from (as JSON).
+const ConfigEnvironmentVariable = "STREAMUX_CONFORMANCE_CONFIG"
+
+// How long RunSubprocessConversation() waits for the subprocess to exit.
+const SubprocessTimeout = 10 * time.Second
+
+// API
+
+// Create a peer using this package's implementation.
+func NewProtocolPeer(config *streamux.Config, sender streamux.MessageSender, receiver streamux.MessageReceiver) (Peer, error) {
+	protocol, err := streamux.NewProtocol(config, sender, receiver)
+	if err != nil {
+		return nil, err
+	}
+	return protocol, nil
+}
+
+// Run a conversation against a peer created by factory, returning an error
+// describing the first way in which the peer's behavior differs from the
+// vector.
+func RunConversation(vector ConversationVector, factory PeerFactory) error {
+	output, isFailed, err := converse(vector, factory)
+	if err != nil {
+		return err
+	}
+	return checkConversation(vector, output, isFailed)
+}
+
+// Run a conversation against a subprocess, which speaks the protocol over
+// stdin and stdout (see the package documentation).
+func RunSubprocessConversation(vector ConversationVector, command string, args ...string) error {
+	config, err := json.Marshal(vector.Config)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(command, args...)
+	cmd.Env = append(os.Environ(), ConfigEnvironmentVariable+"="+string(config))
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	timer := time.AfterFunc(SubprocessTimeout, func() {
+		cmd.Process.Kill()
+	})
+	defer timer.Stop()
+
+	go func() {
+		defer stdin.Close()
+		for _, input := range vector.Input {
+			if _, err := stdin.Write(input); err != nil {
+				// The subprocess has exited, which is checked below.
+				return
+			}
+		}
+	}()
+
+	output, readErr := ioutil.ReadAll(stdout)
+	waitErr := cmd.Wait()
+	if !timer.Stop() {
+		return fmt.Errorf("Timed out after %v waiting for the subprocess to exit", SubprocessTimeout)
+	}
+	if readErr != nil {
+		return readErr
+	}
+	_, isExitError := waitErr.(*exec.ExitError)
+	if waitErr != nil && !isExitError {
+		return waitErr
+	}
+	return checkConversation(vector, output, isExitError)
+}
+
+// Act as a subprocess under test: run a peer created by factory over in and
+// out, echoing requests as conversations expect, until in ends. Returns an
+// error if the peer fails (such as when the other peer violates the protocol).
+// A program wrapping a Go implementation can pass its PeerConfig from
+// ConfigEnvironmentVariable, and exit with a nonzero status on error.
+func ServeEcho(config PeerConfig, in io.Reader, out io.Writer, factory PeerFactory) error {
+	script := newEchoScript(out)
+	peer, err := factory(config.Config(), script, script)
+	if err != nil {
+		return err
+	}
+	script.peer = peer
+	if err = peer.SendInitialization(); err != nil {
+		return err
+	}
+	buffer := make([]byte, 4096)
+	for {
+		bytesRead, err := in.Read(buffer)
+		if bytesRead > 0 {
+			if feedErr := peer.Feed(buffer[:bytesRead]); feedErr != nil {
+				return feedErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Read a subprocess's PeerConfig from ConfigEnvironmentVariable.
+func ConfigFromEnvironment() (config PeerConfig, err error) {
+	encoded := os.Getenv(ConfigEnvironmentVariable)
+	if encoded == "" {
+		return config, fmt.Errorf("%v is not set", ConfigEnvironmentVariable)
+	}
+	err = json.Unmarshal([]byte(encoded), &config)
+	return config, err
+}
+
+// Decode the messages in a peer's output (after its initialize message),
+// given the negotiated bit counts. Requests and responses are reassembled, and
+// listed in the order they end.
+func DecodeMessages(data []byte, idBits int, lengthBits int) ([]Message, error) {
+	var header internal.MessageHeader
+	header.Init(idBits, lengthBits)
+	// Requests and responses that have begun but not ended, keyed by ID and
+	// response bit.
+	openMessages := make(map[[2]int][]byte)
+	messages := []Message{}
+
+	for len(data) > 0 {
+		header.ClearEncoded()
+		remainingData, err := header.Feed(data)
+		if err != nil {
+			return messages, err
+		}
+		if !header.IsDecoded() || len(remainingData) < header.Length {
+			return messages, fmt.Errorf("Output ends partway through a message chunk")
+		}
+		payload := remainingData[:header.Length]
+		data = remainingData[header.Length:]
+
+		key := [2]int{header.Id, boolToInt(header.IsResponse)}
+		contents, isOpen := openMessages[key]
+		switch header.MessageType {
+		case internal.MessageTypeRequest, internal.MessageTypeResponse:
+			contents = append(contents, payload...)
+			if !header.IsEndOfMessage {
+				openMessages[key] = contents
+				continue
+			}
+		case internal.MessageTypeCancel, internal.MessageTypeCancelAck:
+			// Whatever was sent of the canceled message is discarded.
+			contents = nil
+		case internal.MessageTypeRequestEmptyTermination, internal.MessageTypeEmptyResponse:
+			if isOpen {
+				// Ends a message that has data.
+				messageType := internal.MessageTypeRequest
+				if header.IsResponse {
+					messageType = internal.MessageTypeResponse
+				}
+				delete(openMessages, key)
+				messages = append(messages, Message{messageType.String(), header.Id, contents})
+				continue
+			}
+		}
+		delete(openMessages, key)
+		messages = append(messages, Message{header.MessageType.String(), header.Id, contents})
+	}
+	if len(openMessages) > 0 {
+		return messages, fmt.Errorf("Output ends with %v unfinished messages", len(openMessages))
+	}
+	return messages, nil
+}
+
+// Internal
+
+// Feed the vector's input to a peer that echoes requests, collecting what it
+// sends.
+func converse(vector ConversationVector, factory PeerFactory) (output []byte, isFailed bool, err error) {
+	buffer := new(bytes.Buffer)
+	script := newEchoScript(buffer)
+	peer, err := factory(vector.Config.Config(), script, script)
+	if err != nil {
+		return nil, false, err
+	}
+	script.peer = peer
+	if err = peer.SendInitialization(); err != nil {
+		return nil, false, err
+	}
+	for _, input := range vector.Input {
+		if err = peer.Feed(input); err != nil {
+			isFailed = true
+			break
+		}
+	}
+	script.mutex.Lock()
+	defer script.mutex.Unlock()
+	return buffer.Bytes(), isFailed, script.err
+}
+
+func checkConversation(vector ConversationVector, output []byte, isFailed bool) error {
+	initializeLength := len(vector.ExpectedInitialize)
+	if len(output) < initializeLength || !bytes.Equal(output[:initializeLength], vector.ExpectedInitialize) {
+		return fmt.Errorf("%v: Expected initialize message %x, but output began with %x",
+			vector.Name, []byte(vector.ExpectedInitialize), output[:minInt(initializeLength, len(output))])
+	}
+	output = output[initializeLength:]
+
+	var messages []Message
+	if len(output) > 0 {
+		if vector.IdBits == 0 && vector.LengthBits == 0 {
+			return fmt.Errorf("%v: Expected nothing after the initialize message, but got %x", vector.Name, output)
+		}
+		var err error
+		if messages, err = DecodeMessages(output, vector.IdBits, vector.LengthBits); err != nil {
+			return fmt.Errorf("%v: %v", vector.Name, err)
+		}
+	}
+	if len(messages) != len(vector.ExpectedMessages) {
+		return fmt.Errorf("%v: Expected messages %v, but got %v", vector.Name, vector.ExpectedMessages, messages)
+	}
+	for i, expected := range vector.ExpectedMessages {
+		actual := messages[i]
+		if actual.Type != expected.Type || actual.Id != expected.Id || !bytes.Equal(actual.Data, expected.Data) {
+			return fmt.Errorf("%v: Expected message %v to be %v, but got %v", vector.Name, i, expected, actual)
+		}
+	}
+
+	if isFailed != vector.ExpectFailure {
+		if vector.ExpectFailure {
+			return fmt.Errorf("%v: Expected the peer to fail, but it didn't", vector.Name)
+		}
+		return fmt.Errorf("%v: The peer failed unexpectedly", vector.Name)
+	}
+	return nil
+}
+
+func (this Message) String() string {
+	if len(this.Data) == 0 {
+		return fmt.Sprintf("{%v %v}", this.Type, this.Id)
+	}
+	return fmt.Sprintf("{%v %v %x}", this.Type, this.Id, []byte(this.Data))
+}
+
+// echoScript is the behavior that conversations expect of the peer under
+// test: each request is answered with its contents once it ends.
+type echoScript struct {
+	peer     Peer
+	requests map[int][]byte
+	output   io.Writer
+	// The first error writing the output.
+	err   error
+	mutex sync.Mutex
+}
+
+func newEchoScript(output io.Writer) *echoScript {
+	this := new(echoScript)
+	this.requests = make(map[int][]byte)
+	this.output = output
+	return this
+}
+
+func (this *echoScript) OnAbleToSend() {
+}
+
+func (this *echoScript) OnMessageChunkToSend(priority int, messageId int, chunk []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.err != nil {
+		return this.err
+	}
+	_, this.err = this.output.Write(chunk)
+	return this.err
+}
+
+func (this *echoScript) OnRequestChunkReceived(messageId int, isEnd bool, data []byte) error {
+	this.mutex.Lock()
+	request := append(this.requests[messageId], data...)
+	if isEnd {
+		delete(this.requests, messageId)
+	} else {
+		this.requests[messageId] = request
+	}
+	this.mutex.Unlock()
+
+	if isEnd {
+		return this.peer.SendResponse(0, messageId, request)
+	}
+	return nil
+}
+
+func (this *echoScript) OnResponseChunkReceived(messageId int, isEnd bool, data []byte) error {
+	return nil
+}
+
+func (this *echoScript) OnPingReceived(messageId int) error {
+	return nil
+}
+
+func (this *echoScript) OnPingAckReceived(messageId int, latency time.Duration) error {
+	return nil
+}
+
+func (this *echoScript) OnCancelReceived(messageId int) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	delete(this.requests, messageId)
+	return nil
+}
+
+func (this *echoScript) OnCancelAckReceived(messageId int) error {
+	return nil
+}
+
+func (this *echoScript) OnEmptyResponseReceived(messageId int) error {
+	return nil
+}
+
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func minInt(a, b int) int {
+	if a > b {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,436 @@
+package conformance
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+
+	"github.com/kstenerud/go-streamux"
+	"github.com/kstenerud/go-streamux/internal"
+)
+
+var updateVectors = flag.Bool("update", false, "Regenerate the vector files from this implementation")
+
+const vectorsDir = "vectors"
+
+// Generate the vectors from this implementation.
+func generateVectors() (*Vectors, error) {
+	vectors := new(Vectors)
+	var err error
+	if vectors.Initialize, err = generateInitializeVectors(); err != nil {
+		return nil, err
+	}
+	vectors.Headers = generateHeaderVectors()
+	if vectors.Conversations, err = generateConversationVectors(); err != nil {
+		return nil, err
+	}
+	return vectors, nil
+}
+
+func newPeerConfig(idMin, idMax, idRecommend, lengthMin, lengthMax, lengthRecommend int, requestQuickInit, allowQuickInit bool) PeerConfig {
+	return PeerConfig{
+		IdMinBits:           idMin,
+		IdMaxBits:           idMax,
+		IdRecommendBits:     idRecommend,
+		LengthMinBits:       lengthMin,
+		LengthMaxBits:       lengthMax,
+		LengthRecommendBits: lengthRecommend,
+		RequestQuickInit:    requestQuickInit,
+		AllowQuickInit:      allowQuickInit,
+	}
+}
+
+func newInitializeMessage(version int, config PeerConfig) []byte {
+	return internal.EncodeInitializeMessage(internal.InitializeMessage{
+		Version:          version,
+		RequestQuickInit: config.RequestQuickInit,
+		AllowQuickInit:   config.AllowQuickInit,
+		IdBits:           internal.BitRange{Min: config.IdMinBits, Max: config.IdMaxBits, Recommended: config.IdRecommendBits},
+		LengthBits:       internal.BitRange{Min: config.LengthMinBits, Max: config.LengthMaxBits, Recommended: config.LengthRecommendBits},
+		Extensions:       peerExtensions(config),
+	})
+}
+
+func peerExtensions(config PeerConfig) (extensions int) {
+	if config.EnableControlExtension {
+		extensions |= internal.ExtensionControl
+	}
+	if config.EnableFlowControl {
+		extensions |= internal.ExtensionFlowControl
+	}
+	return extensions
+}
+
+// Negotiate as local would on receiving the remote initialize message.
+func negotiate(local PeerConfig, remoteMessage []byte) (idBits int, lengthBits int, err error) {
+	negotiator := internal.NewNegotiator(streamux.ProtocolVersion,
+		local.IdMinBits, local.IdMaxBits, local.IdRecommendBits,
+		local.LengthMinBits, local.LengthMaxBits, local.LengthRecommendBits,
+		local.RequestQuickInit, local.AllowQuickInit)
+	if _, err = negotiator.Feed(remoteMessage[:internal.InitializeMessageLength]); err != nil {
+		return 0, 0, err
+	}
+	return negotiator.IdBits, negotiator.LengthBits, nil
+}
+
+func generateInitializeVectors() (vectors []InitializeVector, err error) {
+	both := false
+	request := true
+	allow := true
+	specs := []struct {
+		name          string
+		local         PeerConfig
+		remoteVersion int
+		remote        PeerConfig
+		// Extensions advertised by the remote peer.
+		remoteExtensions int
+	}{
+		{"compatible", newPeerConfig(6, 12, 8, 6, 20, 14, both, both), 1, newPeerConfig(6, 15, 7, 5, 15, 15, both, both), 0},
+		{"wildcard capped at 30 bits", newPeerConfig(6, 16, 14, 6, 20, 31, both, both), 1, newPeerConfig(6, 18, 15, 15, 18, 31, both, both), 0},
+		{"all wildcards", newPeerConfig(6, 16, 31, 6, 20, 31, both, both), 1, newPeerConfig(6, 18, 31, 8, 15, 31, both, both), 0},
+		{"recommendations capped at 30 bits", newPeerConfig(0, 29, 20, 1, 30, 20, both, both), 1, newPeerConfig(0, 29, 20, 1, 30, 20, both, both), 0},
+		{"no ID bits", newPeerConfig(0, 0, 0, 1, 30, 14, both, both), 1, newPeerConfig(0, 29, 12, 1, 30, 14, both, both), 0},
+		{"unknown extensions ignored", newPeerConfig(0, 29, 12, 1, 30, 14, both, both), 1, newPeerConfig(0, 29, 12, 1, 30, 14, both, both), 3},
+		{"ID ranges don't overlap", newPeerConfig(6, 8, 8, 5, 12, 12, both, both), 1, newPeerConfig(10, 15, 10, 5, 15, 15, both, both), 0},
+		{"length ranges don't overlap", newPeerConfig(0, 29, 10, 1, 8, 8, both, both), 1, newPeerConfig(0, 29, 10, 10, 20, 12, both, both), 0},
+		{"peer requests quick init", newPeerConfig(0, 29, 12, 1, 30, 14, !request, allow), 1, newPeerConfig(0, 29, 8, 1, 30, 10, request, !allow), 0},
+		{"we request quick init", newPeerConfig(0, 29, 8, 1, 30, 10, request, !allow), 1, newPeerConfig(0, 29, 12, 1, 30, 14, !request, allow), 0},
+		{"quick init not allowed", newPeerConfig(0, 29, 12, 1, 30, 14, both, both), 1, newPeerConfig(0, 29, 8, 1, 30, 10, request, !allow), 0},
+		{"both request quick init", newPeerConfig(0, 29, 8, 1, 30, 10, request, !allow), 1, newPeerConfig(0, 29, 8, 1, 30, 10, request, !allow), 0},
+		{"quick init outside our limits", newPeerConfig(0, 10, 8, 1, 12, 10, !request, allow), 1, newPeerConfig(0, 29, 12, 1, 30, 10, request, !allow), 0},
+		{"quick init exceeding 30 bits", newPeerConfig(0, 29, 12, 1, 30, 14, !request, allow), 1, newPeerConfig(0, 29, 3, 1, 30, 28, request, !allow), 0},
+		{"min length bits below 1", newPeerConfig(0, 29, 12, 1, 30, 14, both, both), 1, newPeerConfig(0, 29, 12, 0, 30, 14, both, both), 0},
+		{"recommendation outside own range", newPeerConfig(0, 29, 12, 1, 30, 14, both, both), 1, newPeerConfig(0, 10, 12, 1, 30, 14, both, both), 0},
+		{"version mismatch", newPeerConfig(0, 29, 12, 1, 30, 14, both, both), 2, newPeerConfig(0, 29, 12, 1, 30, 14, both, both), 0},
+	}
+
+	for _, spec := range specs {
+		remoteMessage := newInitializeMessage(spec.remoteVersion, spec.remote)
+		remoteMessage[1] |= byte(spec.remoteExtensions << 6)
+		vector := InitializeVector{
+			Name:          spec.name,
+			Local:         spec.local,
+			LocalMessage:  newInitializeMessage(streamux.ProtocolVersion, spec.local),
+			RemoteMessage: remoteMessage,
+		}
+		if vector.IdBits, vector.LengthBits, err = negotiate(spec.local, remoteMessage); err != nil {
+			vector.Fails = true
+		}
+		vectors = append(vectors, vector)
+	}
+	return vectors, nil
+}
+
+// Every message type, for every combination of ID and length bits.
+func generateHeaderVectors() (vectors []HeaderVector) {
+	for idBits := 0; idBits <= 29; idBits++ {
+		for lengthBits := 1; lengthBits+idBits <= 30; lengthBits++ {
+			header := internal.NewMessageHeader(idBits, lengthBits)
+			maxId := 1<<uint(idBits) - 1
+			maxLength := 1<<uint(lengthBits) - 1
+			// The highest ID and length, then the lowest, then a mix, so that
+			// every field's bits are exercised.
+			header.SetAll(maxId, maxLength, false, true)
+			vectors = append(vectors, newHeaderVector(idBits, lengthBits, header))
+			header.SetAll(0, 1, true, false)
+			vectors = append(vectors, newHeaderVector(idBits, lengthBits, header))
+			messageTypes := []internal.MessageType{
+				internal.MessageTypeCancel,
+				internal.MessageTypeCancelAck,
+				internal.MessageTypeRequestEmptyTermination,
+				internal.MessageTypeEmptyResponse,
+			}
+			header.SetIdAndType(maxId/3, messageTypes[(idBits+lengthBits)%len(messageTypes)])
+			vectors = append(vectors, newHeaderVector(idBits, lengthBits, header))
+		}
+	}
+	return vectors
+}
+
+func newHeaderVector(idBits, lengthBits int, header *internal.MessageHeader) HeaderVector {
+	return HeaderVector{
+		IdBits:     idBits,
+		LengthBits: lengthBits,
+		Id:         header.Id,
+		Length:     header.Length,
+		IsResponse: header.IsResponse,
+		IsEnd:      header.IsEndOfMessage,
+		Type:       header.MessageType.String(),
+		Encoded:    append([]byte(nil), header.Encoded.Data...),
+	}
+}
+
+// The config that the peer under test uses in conversations: a typical server.
+var conversationConfig = newPeerConfig(0, 29, 12, 1, 30, 14, false, true)
+
+// The driver's side of conversations negotiates 8 ID bits and 6 length bits
+// (so chunks hold at most 63 bytes).
+const (
+	conversationIdBits     = 8
+	conversationLengthBits = 6
+)
+
+func encodeChunk(idBits int, lengthBits int, id int, isResponse bool, isEnd bool, data []byte) HexBytes {
+	header := internal.NewMessageHeader(idBits, lengthBits)
+	header.SetAll(id, len(data), isResponse, isEnd)
+	return append(append([]byte(nil), header.Encoded.Data...), data...)
+}
+
+func encodeEmpty(id int, messageType internal.MessageType) HexBytes {
+	header := internal.NewMessageHeader(conversationIdBits, conversationLengthBits)
+	header.SetIdAndType(id, messageType)
+	return append([]byte(nil), header.Encoded.Data...)
+}
+
+func request(id int, isEnd bool, data string) HexBytes {
+	isResponse := false
+	return encodeChunk(conversationIdBits, conversationLengthBits, id, isResponse, isEnd, []byte(data))
+}
+
+func concatenate(pieces ...HexBytes) HexBytes {
+	return bytes.Join(toByteSlices(pieces), nil)
+}
+
+func toByteSlices(pieces []HexBytes) (slices [][]byte) {
+	for _, piece := range pieces {
+		slices = append(slices, piece)
+	}
+	return slices
+}
+
+func splitBytes(data []byte) (pieces []HexBytes) {
+	for _, value := range data {
+		pieces = append(pieces, HexBytes{value})
+	}
+	return pieces
+}
+
+func newTestData(length int) string {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+	return string(data)
+}
+
+func generateConversationVectors() (vectors []ConversationVector, err error) {
+	isEnd := true
+	driverConfig := newPeerConfig(0, 29, conversationIdBits, 1, 30, conversationLengthBits, false, false)
+	initialize := HexBytes(newInitializeMessage(streamux.ProtocolVersion, driverConfig))
+	quickInitConfig := driverConfig
+	quickInitConfig.RequestQuickInit = true
+	quickInitialize := HexBytes(newInitializeMessage(streamux.ProtocolVersion, quickInitConfig))
+	longData := newTestData(150)
+
+	specs := []struct {
+		name        string
+		description string
+		input       []HexBytes
+	}{
+		{"request", "A request after negotiation completes",
+			[]HexBytes{initialize, request(5, isEnd, "hello")}},
+		{"quick init", "A request sent right after a quick init request",
+			[]HexBytes{concatenate(quickInitialize, request(5, isEnd, "hello"))}},
+		{"multi-chunk request", "A request longer than a chunk, whose response must also be chunked",
+			[]HexBytes{initialize, request(1, !isEnd, longData[:63]), request(1, !isEnd, longData[63:126]), request(1, isEnd, longData[126:])}},
+		{"interleaved requests", "Two requests whose chunks are interleaved, the second ending first",
+			[]HexBytes{initialize, request(1, !isEnd, "first "), request(2, isEnd, "second"), request(1, isEnd, "request")}},
+		{"ping", "An empty request termination with no request in progress is a ping, answered with an empty response",
+			[]HexBytes{initialize, encodeEmpty(7, internal.MessageTypeRequestEmptyTermination)}},
+		{"cancel", "A request canceled partway through is acknowledged, and never answered",
+			[]HexBytes{initialize, request(3, !isEnd, "partial"), encodeEmpty(3, internal.MessageTypeCancel)}},
+		{"cancel unknown request", "A cancel for an ID that isn't in use is still acknowledged",
+			[]HexBytes{initialize, encodeEmpty(4, internal.MessageTypeCancel)}},
+		{"empty termination", "A request ended by an empty request termination",
+			[]HexBytes{initialize, request(4, !isEnd, "data"), encodeEmpty(4, internal.MessageTypeRequestEmptyTermination)}},
+		{"ID reuse", "An ID may be reused once its response has been received",
+			[]HexBytes{initialize, request(5, isEnd, "one"), request(5, isEnd, "two")}},
+		{"one byte at a time", "Everything arrives split into single bytes",
+			splitBytes(concatenate(initialize, request(9, !isEnd, "split "), request(9, isEnd, "apart")))},
+		{"unfinished request", "A request that hasn't ended isn't answered",
+			[]HexBytes{initialize, request(6, !isEnd, "waiting")}},
+		{"response to unknown request", "A response to a request that was never sent violates the protocol",
+			[]HexBytes{initialize, encodeChunk(conversationIdBits, conversationLengthBits, 9, true, isEnd, []byte("?"))}},
+		{"unused header bits set", "Header bits beyond the ID and length fields must be 0",
+			[]HexBytes{newUnusedBitsInput()}},
+		{"version mismatch", "A peer speaking another protocol version fails negotiation",
+			[]HexBytes{HexBytes(newInitializeMessage(2, driverConfig))}},
+		{"quick init exceeding 30 bits", "A quick init request whose bit counts can't fit in a header fails negotiation",
+			[]HexBytes{HexBytes(newInitializeMessage(streamux.ProtocolVersion, newPeerConfig(0, 29, 3, 1, 30, 28, true, false)))}},
+	}
+
+	for _, spec := range specs {
+		vector, err := newConversationVector(spec.name, spec.description, conversationConfig, spec.input)
+		if err != nil {
+			return nil, err
+		}
+		vectors = append(vectors, vector)
+	}
+
+	extensionVectors, err := generateExtensionConversationVectors()
+	if err != nil {
+		return nil, err
+	}
+	return append(vectors, extensionVectors...), nil
+}
+
+// Record what this implementation sends when configured with config and fed
+// input.
+func newConversationVector(name string, description string, config PeerConfig, input []HexBytes) (vector ConversationVector, err error) {
+	vector = ConversationVector{
+		Name:               name,
+		Description:        description,
+		Config:             config,
+		Input:              input,
+		ExpectedInitialize: newInitializeMessage(streamux.ProtocolVersion, config),
+	}
+	// Bit counts are only needed to decode the output, which there is none of
+	// if negotiation fails.
+	vector.IdBits, vector.LengthBits, _ = negotiate(config, concatenate(input...))
+
+	output, isFailed, err := converse(vector, NewProtocolPeer)
+	if err != nil {
+		return vector, fmt.Errorf("%v: %v", name, err)
+	}
+	vector.ExpectFailure = isFailed
+	output = output[len(vector.ExpectedInitialize):]
+	if vector.ExpectedMessages, err = DecodeMessages(output, vector.IdBits, vector.LengthBits); err != nil {
+		return vector, fmt.Errorf("%v: %v", name, err)
+	}
+	return vector, nil
+}
+
+// Control message opcodes.
+const (
+	opcodeGoAway           = 1
+	opcodeMessageCredit    = 2
+	opcodeConnectionCredit = 3
+	opcodeOpenStream       = 4
+	opcodeCodecs           = 5
+)
+
+// A control message, in as many chunks as it takes.
+func controlMessage(opcode byte, payload ...byte) HexBytes {
+	return chunkedRequest(internal.ControlMessageId(conversationIdBits), append([]byte{opcode}, payload...))
+}
+
+func notification(data string) HexBytes {
+	return chunkedRequest(internal.NotificationMessageId(conversationIdBits), []byte(data))
+}
+
+func chunkedRequest(id int, data []byte) HexBytes {
+	maxChunkLength := 1<<uint(conversationLengthBits) - 1
+	isResponse := false
+	var chunks []HexBytes
+	for len(data) > maxChunkLength {
+		chunks = append(chunks, encodeChunk(conversationIdBits, conversationLengthBits, id, isResponse, false, data[:maxChunkLength]))
+		data = data[maxChunkLength:]
+	}
+	chunks = append(chunks, encodeChunk(conversationIdBits, conversationLengthBits, id, isResponse, true, data))
+	return concatenate(chunks...)
+}
+
+func uint32LE(values ...int) (encoded []byte) {
+	for _, value := range values {
+		encoded = append(encoded, byte(value), byte(value>>8), byte(value>>16), byte(value>>24))
+	}
+	return encoded
+}
+
+func codecNames(names ...string) (encoded []byte) {
+	for _, name := range names {
+		encoded = append(encoded, byte(len(name)))
+		encoded = append(encoded, name...)
+	}
+	return encoded
+}
+
+// Conversations that use the control and flow control extensions.
+func generateExtensionConversationVectors() (vectors []ConversationVector, err error) {
+	isEnd := true
+	controlConfig := conversationConfig
+	controlConfig.EnableControlExtension = true
+	noCodecsConfig := controlConfig
+	controlConfig.Codecs = []string{"json", "gob"}
+	flowControlConfig := controlConfig
+	flowControlConfig.EnableFlowControl = true
+	largeMessageWindowConfig := flowControlConfig
+	largeMessageWindowConfig.MessageWindow = streamux.DefaultMessageWindow + 1000
+	largeConnectionWindowConfig := flowControlConfig
+	largeConnectionWindowConfig.ConnectionWindow = streamux.DefaultConnectionWindow + 1000
+
+	driverConfig := newPeerConfig(0, 29, conversationIdBits, 1, 30, conversationLengthBits, false, false)
+	initialize := HexBytes(newInitializeMessage(streamux.ProtocolVersion, driverConfig))
+	driverConfig.EnableControlExtension = true
+	controlInitialize := HexBytes(newInitializeMessage(streamux.ProtocolVersion, driverConfig))
+	driverConfig.EnableFlowControl = true
+	flowControlInitialize := HexBytes(newInitializeMessage(streamux.ProtocolVersion, driverConfig))
+	messageFlag := byte(0)
+	responseFlag := byte(1)
+	controlId := internal.ControlMessageId(conversationIdBits)
+	isResponse := false
+
+	specs := []struct {
+		name        string
+		description string
+		config      PeerConfig
+		input       []HexBytes
+	}{
+		{"control extension", "With the control extension negotiated, the peer sends its codecs as a control message on the highest ID",
+			controlConfig, []HexBytes{controlInitialize, request(5, isEnd, "hello")}},
+		{"control extension without codecs", "A peer with no codecs configured doesn't negotiate codecs, so sends no control messages",
+			noCodecsConfig, []HexBytes{controlInitialize, request(5, isEnd, "hello")}},
+		{"control extension not negotiated", "Without the control extension on both sides, no control messages are sent",
+			controlConfig, []HexBytes{initialize, request(5, isEnd, "hello")}},
+		{"GOAWAY", "A GOAWAY only stops the peer from beginning requests, so requests are still answered",
+			controlConfig, []HexBytes{controlInitialize, controlMessage(opcodeGoAway), request(5, isEnd, "hello")}},
+		{"codecs", "Receiving the driver's codecs completes codec negotiation, which sends nothing",
+			controlConfig, []HexBytes{controlInitialize, controlMessage(opcodeCodecs, codecNames("gob", "json")...), request(5, isEnd, "hello")}},
+		{"open stream", "A stream's data arrives as a request on the ID that it opened",
+			controlConfig, []HexBytes{controlInitialize, controlMessage(opcodeOpenStream, uint32LE(3, 2)...), request(3, !isEnd, "stream "), request(3, isEnd, "data")}},
+		{"open stream without priority", "The priority may be left out of an OpenStream message",
+			controlConfig, []HexBytes{controlInitialize, controlMessage(opcodeOpenStream, uint32LE(3)...), request(3, isEnd, "stream")}},
+		{"open stream on active request", "Opening a stream on an ID that's in use violates the protocol",
+			controlConfig, []HexBytes{controlInitialize, request(3, !isEnd, "partial"), controlMessage(opcodeOpenStream, uint32LE(3)...)}},
+		{"unknown control opcode", "Control messages with unknown opcodes are ignored",
+			controlConfig, []HexBytes{controlInitialize, controlMessage(200, 1, 2, 3), request(5, isEnd, "hello")}},
+		{"control message in chunks", "A control message may be split across several chunks",
+			controlConfig, []HexBytes{controlInitialize,
+				encodeChunk(conversationIdBits, conversationLengthBits, controlId, isResponse, !isEnd, []byte{opcodeOpenStream, 3, 0}),
+				encodeChunk(conversationIdBits, conversationLengthBits, controlId, isResponse, isEnd, []byte{0, 0}),
+				request(3, isEnd, "stream")}},
+		{"control message too long", "A control message longer than 1024 bytes violates the protocol",
+			controlConfig, []HexBytes{controlInitialize, controlMessage(200, []byte(newTestData(1024))...)}},
+		{"notification", "A notification is sent as a request on the second highest ID, and is never answered",
+			controlConfig, []HexBytes{controlInitialize, notification("news"), request(5, isEnd, "hello")}},
+		{"credit grants", "Credit granted for a message and for the connection is accepted silently",
+			flowControlConfig, []HexBytes{flowControlInitialize,
+				controlMessage(opcodeMessageCredit, append([]byte{responseFlag}, uint32LE(5, 1000)...)...),
+				controlMessage(opcodeConnectionCredit, uint32LE(1000)...),
+				request(5, isEnd, "hello")}},
+		{"malformed credit", "A message credit with the wrong length violates the protocol",
+			flowControlConfig, []HexBytes{flowControlInitialize, controlMessage(opcodeMessageCredit, append([]byte{messageFlag}, uint32LE(5)...)...)}},
+		{"larger message window", "A peer with a message window larger than the default grants the difference when a message begins",
+			largeMessageWindowConfig, []HexBytes{flowControlInitialize, request(5, !isEnd, "hello "), request(5, isEnd, "world")}},
+		{"larger connection window", "A peer with a connection window larger than the default grants the difference once negotiation completes",
+			largeConnectionWindowConfig, []HexBytes{flowControlInitialize, request(5, isEnd, "hello")}},
+	}
+
+	for _, spec := range specs {
+		vector, err := newConversationVector(spec.name, spec.description, spec.config, spec.input)
+		if err != nil {
+			return nil, err
+		}
+		vectors = append(vectors, vector)
+	}
+	return vectors, nil
+}
+
+// A quick init request for 5 ID bits and 6 length bits, so that the 2 byte
+// header has an unused bit, followed by a request with that bit set.
+func newUnusedBitsInput() HexBytes {
+	config := newPeerConfig(0, 29, 5, 1, 30, 6, true, false)
+	chunk := encodeChunk(5, 6, 1, false, true, []byte("x"))
+	chunk[1] |= 0x80
+	return concatenate(HexBytes(newInitializeMessage(streamux.ProtocolVersion, config)), chunk)
+}
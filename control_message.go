@@ -0,0 +1,117 @@
+package streamux
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/kstenerud/go-streamux/internal"
+)
+
+// Control messages are sent as (never answered) requests on the control message
+// ID, when the control extension is active. The first byte of a control message
+// is its opcode, followed by any opcode-specific payload. Unknown opcodes are
+// ignored, so that new ones can be added without breaking older peers.
+type controlOpcode byte
+
+const (
+	// The sender is draining, and will accept no new requests.
+	controlOpcodeGoAway controlOpcode = 1
+
+	// Flow control credit for one message's data. Payload: a flags byte (bit 0
+	// set if the credit is for response data), then the message ID and the
+	// byte count as 32-bit little endian integers.
+	controlOpcodeMessageCredit controlOpcode = 2
+
+	// Flow control credit for the connection. Payload: the byte count as a
+	// 32-bit little endian integer.
+	controlOpcodeConnectionCredit controlOpcode = 3
+
+	// The sender has begun a stream on a request ID (see Protocol.BeginStream()).
+	// Payload: the message ID and the stream's priority as 32-bit little endian
+	// integers. The priority may be omitted, in which case it's 0.
+	controlOpcodeOpenStream controlOpcode = 4
+
+	// The codecs that the sender supports, in order of preference (see
+	// Config.Codecs). Sent once, after negotiation. Payload: each name as a
+	// length byte followed by the name.
+	controlOpcodeCodecs controlOpcode = 5
+)
+
+const controlFlagResponse = 0x01
+
+// A control message longer than this is a protocol violation.
+const maxControlMessageLength = 1024
+
+// Sends control message and notification chunks directly, bypassing the
+// request state machine (neither uses allocated IDs, and neither gets a
+// response).
+type controlMessageSender struct {
+	protocol *Protocol
+}
+
+// Internal callback
+func (this *controlMessageSender) OnRequestChunkToSend(priority int, weight int, messageId int, isEnd bool, chunk []byte) error {
+	return this.protocol.sendWeightedMessage(priority, weight, messageId, chunk)
+}
+
+// Internal callback
+func (this *controlMessageSender) OnResponseChunkToSend(priority int, weight int, messageId int, isEnd bool, chunk []byte) error {
+	return fmt.Errorf("Internal bug: controlMessageSender.OnResponseChunkToSend: Control messages are never responses")
+}
+
+func encodeMessageCredit(key flowKey, byteCount int) []byte {
+	payload := make([]byte, 9)
+	if key.isResponse {
+		payload[0] = controlFlagResponse
+	}
+	binary.LittleEndian.PutUint32(payload[1:], uint32(key.messageId))
+	binary.LittleEndian.PutUint32(payload[5:], uint32(byteCount))
+	return payload
+}
+
+func decodeMessageCredit(payload []byte) (key flowKey, byteCount int, ok bool) {
+	if len(payload) != 9 {
+		return key, 0, false
+	}
+	key.isResponse = payload[0]&controlFlagResponse != 0
+	key.messageId = int(binary.LittleEndian.Uint32(payload[1:]))
+	return key, int(binary.LittleEndian.Uint32(payload[5:])), true
+}
+
+func encodeConnectionCredit(byteCount int) []byte {
+	payload := make([]byte, 4)
+	binary.LittleEndian.PutUint32(payload, uint32(byteCount))
+	return payload
+}
+
+func decodeConnectionCredit(payload []byte) (byteCount int, ok bool) {
+	if len(payload) != 4 {
+		return 0, false
+	}
+	return int(binary.LittleEndian.Uint32(payload)), true
+}
+
+func encodeOpenStream(messageId int, priority int) []byte {
+	payload := make([]byte, 8)
+	binary.LittleEndian.PutUint32(payload, uint32(messageId))
+	binary.LittleEndian.PutUint32(payload[4:], uint32(int32(priority)))
+	return payload
+}
+
+func decodeOpenStream(payload []byte) (messageId int, priority int, ok bool) {
+	switch len(payload) {
+	case 4:
+		return int(binary.LittleEndian.Uint32(payload)), 0, true
+	case 8:
+		return int(binary.LittleEndian.Uint32(payload)), int(int32(binary.LittleEndian.Uint32(payload[4:]))), true
+	}
+	return 0, 0, false
+}
+
+func newControlProtocolViolation(messageId int, reason string) error {
+	return &internal.ProtocolViolationError{MessageId: messageId, State: "control", Reason: reason}
+}
+
+func newNotificationProtocolViolation(messageId int, reason string) error {
+	return &internal.ProtocolViolationError{MessageId: messageId, State: "notification", Reason: reason}
+}
@@ -0,0 +1,107 @@
+package streamux
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/kstenerud/go-streamux/test"
+)
+
+func assertNoActiveRequests(t *testing.T, session *Session) bool {
+	deadline := time.Now().Add(time.Second)
+	for session.protocol.requestStateMachine.ActiveRequestCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Errorf("Expected all request IDs to be released, but %v are still in use",
+				session.protocol.requestStateMachine.ActiveRequestCount())
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// =============================================================================
+
+func TestDeadlineExceededCancelsRequest(t *testing.T) {
+	client, server := newTestStreamingSessionPair(8, 10)
+	defer server.Close()
+	defer client.Close()
+
+	request, response, err := client.OpenRequestWithDeadline(0, time.Now().Add(30*time.Millisecond))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = request.Write(test.NewTestBytes(100)); err != nil {
+		t.Error(err)
+		return
+	}
+	request.Close()
+
+	// The server never responds.
+	if _, _, err = server.AcceptRequest(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err = ioutil.ReadAll(response); err != ErrDeadlineExceeded {
+		t.Errorf("Expected %v but got %v", ErrDeadlineExceeded, err)
+		return
+	}
+	// The ID is only released once the server acks the cancel.
+	assertNoActiveRequests(t, client)
+}
+
+func TestDeadlineMet(t *testing.T) {
+	client, server := newTestStreamingSessionPair(8, 10)
+	defer server.Close()
+	defer client.Close()
+	go serveStreamingEcho(t, server)
+
+	expected := test.NewTestBytes(1000)
+	request, response, err := client.OpenRequestWithDeadline(0, time.Now().Add(time.Second))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	request.Write(expected)
+	request.Close()
+
+	actual, err := ioutil.ReadAll(response)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	test.AssertSlicesAreEquivalent(t, actual, expected)
+
+	client.protocol.mutex.Lock()
+	deadlineCount := len(client.protocol.requestDeadlines)
+	client.protocol.mutex.Unlock()
+	if deadlineCount != 0 {
+		t.Errorf("Expected deadline to be cleared, but %v remain", deadlineCount)
+	}
+}
+
+func TestDeadlineExceededBeforeSending(t *testing.T) {
+	client, server := newTestStreamingSessionPair(8, 10)
+	defer server.Close()
+	defer client.Close()
+	if !awaitSignal(t, client.Ready(), "client ready") {
+		return
+	}
+
+	request, err := client.BeginRequestWithDeadline(0, time.Now().Add(10*time.Millisecond))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	request.Feed([]byte{1})
+	if err = request.End(); err != ErrDeadlineExceeded {
+		t.Errorf("Expected %v but got %v", ErrDeadlineExceeded, err)
+		return
+	}
+	assertNoActiveRequests(t, client)
+}
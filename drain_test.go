@@ -0,0 +1,177 @@
+package streamux
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/kstenerud/go-streamux/test"
+)
+
+func shutdownInBackground(session *Session) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		result <- session.Shutdown(ctx)
+	}()
+	return result
+}
+
+func awaitShutdown(t *testing.T, result <-chan error) bool {
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		return true
+	case <-time.After(2 * time.Second):
+		t.Errorf("Timed out waiting for shutdown")
+		return false
+	}
+}
+
+func assertBeginRequestFails(t *testing.T, session *Session, expected error) bool {
+	if _, err := session.BeginRequest(0); err != expected {
+		t.Errorf("Expected BeginRequest to fail with [%v] but got [%v]", expected, err)
+		return false
+	}
+	return true
+}
+
+// =============================================================================
+
+func TestDrainWaitsForIncomingRequests(t *testing.T) {
+	client, server := newTestControlSessionPair(true)
+	defer server.Close()
+	defer client.Close()
+
+	expected := test.NewTestBytes(100)
+	request, response, err := client.OpenRequest(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = request.Write(expected); err != nil {
+		t.Error(err)
+		return
+	}
+	request.Close()
+
+	id, body, err := server.AcceptRequest()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	received, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	shutdownResult := shutdownInBackground(server)
+	if !awaitSignal(t, client.PeerDraining(), "GOAWAY") {
+		return
+	}
+	if !assertBeginRequestFails(t, client, ErrPeerDraining) {
+		return
+	}
+	if !assertBeginRequestFails(t, server, ErrDraining) {
+		return
+	}
+
+	select {
+	case <-shutdownResult:
+		t.Errorf("Shutdown completed before the request was answered")
+		return
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err = server.SendResponse(0, id, received); err != nil {
+		t.Error(err)
+		return
+	}
+	if !awaitShutdown(t, shutdownResult) {
+		return
+	}
+
+	actual, err := ioutil.ReadAll(response)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	test.AssertSlicesAreEquivalent(t, actual, expected)
+}
+
+func TestDrainWaitsForOutgoingRequests(t *testing.T) {
+	client, server := newTestControlSessionPair(true)
+	defer server.Close()
+	defer client.Close()
+	go serveStreamingEcho(t, server)
+
+	expected := test.NewTestBytes(1000)
+	request, response, err := client.OpenRequest(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	shutdownResult := shutdownInBackground(client)
+	if !awaitSignal(t, server.PeerDraining(), "GOAWAY") {
+		return
+	}
+
+	// The request that was already begun may still be completed.
+	if _, err = request.Write(expected); err != nil {
+		t.Error(err)
+		return
+	}
+	request.Close()
+
+	actual, err := ioutil.ReadAll(response)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	test.AssertSlicesAreEquivalent(t, actual, expected)
+	awaitShutdown(t, shutdownResult)
+}
+
+func TestDrainWithoutControlExtension(t *testing.T) {
+	client, server := newTestControlSessionPair(false)
+	defer server.Close()
+	defer client.Close()
+	if !awaitSignal(t, client.Ready(), "client ready") {
+		return
+	}
+
+	if !awaitShutdown(t, shutdownInBackground(client)) {
+		return
+	}
+	select {
+	case <-server.PeerDraining():
+		t.Errorf("Peer should not have been notified without the control extension")
+	default:
+	}
+}
+
+func TestShutdownContextDone(t *testing.T) {
+	client, server := newTestControlSessionPair(true)
+	defer server.Close()
+	defer client.Close()
+
+	if _, _, err := client.OpenRequest(0); err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v but got %v", context.DeadlineExceeded, err)
+		return
+	}
+	awaitSignal(t, client.Done(), "session to close")
+}
@@ -0,0 +1,144 @@
+package streamux
+
+import (
+	"errors"
+
+	"github.com/kstenerud/go-streamux/internal"
+)
+
+// Errors returned by this package are either one of the following sentinel
+// values, which can be compared using ==, or one of the structured error types
+// below, which can be recognized using a type assertion (such as
+// err.(*NegotiationError)). Each structured error type also reports the
+// sentinel it belongs to via an Is() method, so with Go 1.13 or later,
+// errors.Is() matches it against that sentinel too.
+var (
+	// No message IDs are free. This clears up as outstanding requests complete.
+	ErrIdPoolExhausted = internal.ErrIdPoolExhausted
+
+	// Messages can't be sent or received until negotiation completes.
+	ErrNotReady = internal.ErrNotReady
+
+	// Matched by *NegotiationError.
+	ErrNegotiationFailed = internal.ErrNegotiationFailed
+
+	// Matched by *ProtocolViolationError. The peer is misbehaving, and the
+	// connection should be reset.
+	ErrProtocolViolation = internal.ErrProtocolViolation
+
+	// Matched by *RequestStateError. The request can't do that in its current state.
+	ErrInvalidState = internal.ErrInvalidState
+
+	// A request's deadline passed before its response completed, so it was
+	// canceled.
+	ErrDeadlineExceeded = internal.ErrDeadlineExceeded
+
+	// Matched by *ConfigError.
+	ErrInvalidConfig = errors.New("Invalid config")
+
+	ErrMessageEnded    = errors.New("Cannot add more data: message has ended")
+	ErrEmptyRequest    = errors.New("A request message must contain at least 1 byte of payload")
+	ErrCanceled        = internal.ErrCanceled
+	ErrCanceledByPeer  = errors.New("Request was canceled by the peer")
+	ErrSessionClosed   = errors.New("Session closed")
+	ErrSchedulerClosed = errors.New("Send scheduler closed")
+
+	// New requests can't be sent because we're draining (see Protocol.Drain()).
+	ErrDraining = errors.New("Cannot begin request: draining")
+
+	// New requests can't be sent because the peer has asked us to stop.
+	ErrPeerDraining = errors.New("Cannot begin request: peer is draining")
+
+	// The session was closed by its keepalive (see KeepaliveConfig).
+	ErrPeerUnresponsive = errors.New("Peer is unresponsive")
+
+	// A non-blocking message ran out of flow control credit. See
+	// SendableMessage.SetBlocking().
+	ErrWouldBlock = errors.New("Out of flow control credit")
+
+	// Streams need the control extension, which the peer doesn't support (see
+	// Config.EnableControlExtension).
+	ErrStreamsUnavailable = errors.New("Streams require the control extension")
+
+	// A route is longer than MaxRouteLength (see EncodeRoute()).
+	ErrRouteTooLong = errors.New("Route is too long")
+
+	// An HTTP request (see HTTPTransport) has a method, host, header name or
+	// header value that would corrupt the request's head, such as one
+	// containing CR or LF.
+	ErrInvalidHTTPRequest = errors.New("Invalid HTTP request")
+
+	// Codecs are only negotiated if some are configured (see Config.Codecs),
+	// and only via control messages, so the control extension is needed on
+	// both peers (see Config.EnableControlExtension).
+	ErrCodecsUnavailable = errors.New("Codec negotiation requires configured codecs and the control extension")
+
+	// The peer's codecs didn't arrive within Config.CodecTimeout. The peer may
+	// predate codec negotiation, or have no codecs configured.
+	ErrCodecNegotiationTimeout = errors.New("Timed out waiting for the peer's codecs")
+
+	// The peers have no codec in common (see Config.Codecs).
+	ErrNoCommonCodec = errors.New("No codec in common with the peer")
+
+	// Notifications use an ID reserved by the control extension, which the
+	// peer doesn't support (see Config.EnableControlExtension).
+	ErrNotificationsUnavailable = errors.New("Notifications require the control extension")
+
+	// A notification is longer than MaxNotificationLength.
+	ErrNotificationTooLong = errors.New("Notification is too long")
+
+	// A topic or topic pattern is malformed (see Broker).
+	ErrInvalidTopic = errors.New("Invalid topic")
+
+	// The peer has no Broker on the route, or rejected the topic pattern.
+	ErrSubscriptionRejected = errors.New("Subscription rejected")
+
+	// A recording (see Recorder) is malformed or was written by an
+	// incompatible version.
+	ErrInvalidRecording = errors.New("Invalid recording")
+
+	// The Listener was closed.
+	ErrListenerClosed = errors.New("Listener closed")
+
+	// A Stream deadline passed. Implements net.Error, reporting a timeout.
+	ErrTimeout error = &timeoutError{}
+
+	// AcceptRequest() can't be used because a MessageReceiver was supplied.
+	ErrAcceptUnavailable = errors.New("Incoming requests are being delivered to the MessageReceiver")
+)
+
+type timeoutError struct{}
+
+func (this *timeoutError) Error() string   { return "i/o timeout" }
+func (this *timeoutError) Timeout() bool   { return true }
+func (this *timeoutError) Temporary() bool { return true }
+
+// NoMessageId is used in errors that don't relate to any particular message.
+const NoMessageId = internal.NoMessageId
+
+type BitRange = internal.BitRange
+
+// NegotiationError reports why protocol negotiation failed, along with the bit
+// ranges that each side asked for.
+type NegotiationError = internal.NegotiationError
+
+// ProtocolViolationError reports that the peer sent something that the
+// protocol doesn't allow.
+type ProtocolViolationError = internal.ProtocolViolationError
+
+// RequestStateError reports an attempt to do something with a request that its
+// current state doesn't allow.
+type RequestStateError = internal.RequestStateError
+
+// ConfigError reports a problem with a Config.
+type ConfigError struct {
+	Reason string
+}
+
+func (this *ConfigError) Error() string {
+	return ErrInvalidConfig.Error() + ": " + this.Reason
+}
+
+func (this *ConfigError) Is(target error) bool {
+	return target == ErrInvalidConfig
+}
@@ -0,0 +1,170 @@
+package streamux
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kstenerud/go-streamux/internal"
+)
+
+type errorMatcher interface {
+	Is(target error) bool
+}
+
+func assertErrorMatches(t *testing.T, err error, target error) {
+	if matcher, ok := err.(errorMatcher); !ok || !matcher.Is(target) {
+		t.Errorf("Expected error %v to match %v", err, target)
+	}
+}
+
+// =============================================================================
+
+func TestConfigErrorType(t *testing.T) {
+	config := NewDefaultConfig()
+	config.IdMinBits = 16
+	err := config.Validate()
+	if _, ok := err.(*ConfigError); !ok {
+		t.Errorf("Expected *ConfigError but got %T (%v)", err, err)
+		return
+	}
+	assertErrorMatches(t, err, ErrInvalidConfig)
+}
+
+func TestNegotiationErrorType(t *testing.T) {
+	config := NewDefaultConfig()
+	config.IdMinBits = 10
+	config.IdMaxBits = 12
+	protocol, err := NewProtocol(config, new(nullSender), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	peerConfig := NewDefaultConfig()
+	peerConfig.IdMinBits = 2
+	peerConfig.IdMaxBits = 5
+	peerConfig.IdRecommendBits = 4
+	negotiator := internal.NewNegotiator(ProtocolVersion,
+		peerConfig.IdMinBits, peerConfig.IdMaxBits, peerConfig.IdRecommendBits,
+		peerConfig.LengthMinBits, peerConfig.LengthMaxBits, peerConfig.LengthRecommendBits,
+		peerConfig.RequestQuickInit, peerConfig.AllowQuickInit)
+
+	err = protocol.Feed(negotiator.BuildInitializeMessage())
+	negotiationError, ok := err.(*NegotiationError)
+	if !ok {
+		t.Errorf("Expected *NegotiationError but got %T (%v)", err, err)
+		return
+	}
+	assertErrorMatches(t, err, ErrNegotiationFailed)
+	if !negotiationError.HasRemote ||
+		negotiationError.LocalIdBits != (BitRange{Min: 10, Max: 12, Recommended: 12}) ||
+		negotiationError.RemoteIdBits != (BitRange{Min: 2, Max: 5, Recommended: 4}) {
+		t.Errorf("Unexpected ranges in %+v", *negotiationError)
+	}
+
+	if _, err := protocol.BeginRequest(0); err != negotiationError {
+		t.Errorf("Expected sending to fail with the negotiation error, but got %v", err)
+	}
+}
+
+func TestNotReadyError(t *testing.T) {
+	protocol, err := NewProtocol(newTestConfig(4, 10, true), new(nullSender), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := protocol.BeginRequest(0); err != ErrNotReady {
+		t.Errorf("Expected %v but got %v", ErrNotReady, err)
+	}
+}
+
+func TestIdPoolExhaustedError(t *testing.T) {
+	protocol, err := NewProtocol(newTestConfig(0, 10, false), new(nullSender), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	protocol.SendInitialization()
+	if _, err := protocol.BeginRequest(0); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := protocol.BeginRequest(0); err != ErrIdPoolExhausted {
+		t.Errorf("Expected %v but got %v", ErrIdPoolExhausted, err)
+	}
+}
+
+func TestRequestStateErrorType(t *testing.T) {
+	protocol, err := NewProtocol(newTestConfig(4, 10, false), new(nullSender), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	protocol.SendInitialization()
+	message, err := protocol.BeginRequest(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := message.End(); err != ErrEmptyRequest {
+		t.Errorf("Expected %v but got %v", ErrEmptyRequest, err)
+	}
+	if err := message.Feed([]byte{1}); err != ErrMessageEnded {
+		t.Errorf("Expected %v but got %v", ErrMessageEnded, err)
+	}
+
+	err = protocol.OnRequestChunkToSend(0, DefaultWeight, message.Id+1, true, []byte{1})
+	stateError, ok := err.(*RequestStateError)
+	if !ok {
+		t.Errorf("Expected *RequestStateError but got %T (%v)", err, err)
+		return
+	}
+	assertErrorMatches(t, err, ErrInvalidState)
+	if stateError.MessageId != message.Id+1 {
+		t.Errorf("Expected message ID %v but got %v", message.Id+1, stateError.MessageId)
+	}
+}
+
+func TestProtocolViolationErrorType(t *testing.T) {
+	protocol, err := NewProtocol(newTestConfig(4, 10, false), new(nullSender), new(sessionTestReceiver))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	protocol.SendInitialization()
+
+	err = protocol.OnResponseChunkReceived(3, true, []byte{1})
+	violation, ok := err.(*ProtocolViolationError)
+	if !ok {
+		t.Errorf("Expected *ProtocolViolationError but got %T (%v)", err, err)
+		return
+	}
+	assertErrorMatches(t, err, ErrProtocolViolation)
+	if violation.MessageId != 3 || violation.State == "" {
+		t.Errorf("Unexpected contents %+v", *violation)
+	}
+}
+
+func TestSessionErrors(t *testing.T) {
+	client, server, _, serverReceiver := newTestSessionPair(4, 10)
+	defer server.Close()
+	serverReceiver.isSilent = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := client.Call(ctx, 0, []byte{1}); err != context.Canceled {
+		t.Errorf("Expected %v but got %v", context.Canceled, err)
+	}
+	if _, _, err := client.AcceptRequest(); err != ErrAcceptUnavailable {
+		t.Errorf("Expected %v but got %v", ErrAcceptUnavailable, err)
+	}
+
+	client.Close()
+	if _, err := client.SendRequest(0, []byte{1}); err != ErrSessionClosed {
+		t.Errorf("Expected %v but got %v", ErrSessionClosed, err)
+	}
+}
@@ -0,0 +1,231 @@
+package streamux
+
+import (
+	"sync"
+	"time"
+)
+
+// The flow control windows that both peers start out with. A receiver with a
+// larger configured window grants the difference as soon as it can.
+const (
+	DefaultMessageWindow    = 256 * 1024
+	DefaultConnectionWindow = 1024 * 1024
+)
+
+// Message data is flow controlled per ID and direction (a request and its
+// response each have their own window), and per connection.
+type flowKey struct {
+	messageId  int
+	isResponse bool
+}
+
+type outgoingFlow struct {
+	credit int
+	// Set when the message can no longer be sent (for example it was canceled).
+	err error
+	// Waiting for credit fails with ErrTimeout once this passes (if not zero).
+	deadline      time.Time
+	deadlineTimer *time.Timer
+}
+
+// sendWindow tracks how much credit the peer has granted us. If we advertise
+// flow control, credit is enforced right away (data may be sent before
+// negotiation completes during a quick init), and the limits are lifted if the
+// peer turns out not to support it.
+type sendWindow struct {
+	isActive         bool
+	err              error
+	connectionCredit int
+	flows            map[flowKey]*outgoingFlow
+	mutex            sync.Mutex
+	cond             *sync.Cond
+}
+
+func (this *sendWindow) Init(isActive bool) {
+	this.isActive = isActive
+	this.connectionCredit = DefaultConnectionWindow
+	this.flows = make(map[flowKey]*outgoingFlow)
+	this.cond = sync.NewCond(&this.mutex)
+}
+
+// Stop enforcing credit, because the peer doesn't support flow control.
+func (this *sendWindow) deactivate() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.isActive = false
+	this.cond.Broadcast()
+}
+
+// Fail all current and future waits for credit.
+func (this *sendWindow) abort(err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.err == nil {
+		this.err = err
+	}
+	this.cond.Broadcast()
+}
+
+// Begin a new message, replacing any previous flow with the same key.
+func (this *sendWindow) openFlow(key flowKey) *outgoingFlow {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	flow := &outgoingFlow{credit: DefaultMessageWindow}
+	this.flows[key] = flow
+	return flow
+}
+
+// End a message. If err is not nil, anything waiting for credit to send more of
+// the message fails with it.
+func (this *sendWindow) closeFlow(key flowKey, err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if flow, exists := this.flows[key]; exists {
+		flow.err = err
+		delete(this.flows, key)
+	}
+	this.cond.Broadcast()
+}
+
+// Take up to byteCount bytes of credit for a flow. If there's none, either wait
+// for some, or fail with ErrWouldBlock.
+func (this *sendWindow) acquire(flow *outgoingFlow, byteCount int, isBlocking bool) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for {
+		if this.err != nil {
+			return 0, this.err
+		}
+		if flow.err != nil {
+			return 0, flow.err
+		}
+		if !this.isActive {
+			return byteCount, nil
+		}
+		available := minInt(flow.credit, this.connectionCredit)
+		if available > 0 {
+			granted := minInt(available, byteCount)
+			flow.credit -= granted
+			this.connectionCredit -= granted
+			return granted, nil
+		}
+		if !isBlocking {
+			return 0, ErrWouldBlock
+		}
+		if !flow.deadline.IsZero() && !time.Now().Before(flow.deadline) {
+			return 0, ErrTimeout
+		}
+		this.cond.Wait()
+	}
+}
+
+func (this *sendWindow) setDeadline(flow *outgoingFlow, deadline time.Time) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	flow.deadline = deadline
+	if flow.deadlineTimer != nil {
+		flow.deadlineTimer.Stop()
+		flow.deadlineTimer = nil
+	}
+	if !deadline.IsZero() {
+		flow.deadlineTimer = time.AfterFunc(time.Until(deadline), func() {
+			this.mutex.Lock()
+			defer this.mutex.Unlock()
+			this.cond.Broadcast()
+		})
+	}
+	this.cond.Broadcast()
+}
+
+// Credit for messages that have already ended is ignored.
+func (this *sendWindow) grant(key flowKey, byteCount int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if flow, exists := this.flows[key]; exists {
+		flow.credit += byteCount
+		this.cond.Broadcast()
+	}
+}
+
+func (this *sendWindow) grantConnection(byteCount int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.connectionCredit += byteCount
+	this.cond.Broadcast()
+}
+
+// receiveWindow tracks how much of the peer's data we've consumed, and decides
+// when to grant more credit. Credit is granted in batches of half a window, to
+// keep the number of control messages down.
+type receiveWindow struct {
+	messageWindow     int
+	connectionWindow  int
+	pendingConnection int
+	pendingByIncoming map[flowKey]int
+	mutex             sync.Mutex
+}
+
+func (this *receiveWindow) Init(messageWindow int, connectionWindow int) {
+	this.messageWindow = messageWindow
+	this.connectionWindow = connectionWindow
+	this.pendingByIncoming = make(map[flowKey]int)
+}
+
+// Record that a chunk of an incoming message has arrived. Returns the extra
+// credit to grant for a newly begun message when our window is larger than the
+// default.
+func (this *receiveWindow) receive(key flowKey, isEnd bool) (extraCredit int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	_, exists := this.pendingByIncoming[key]
+	if isEnd {
+		// Once a message has ended, only the connection needs more credit.
+		delete(this.pendingByIncoming, key)
+		return 0
+	}
+	if exists {
+		return 0
+	}
+	this.pendingByIncoming[key] = 0
+	return this.messageWindow - DefaultMessageWindow
+}
+
+// Forget a message that ended in a cancel, so that its ID can be reused.
+func (this *receiveWindow) forget(key flowKey) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	delete(this.pendingByIncoming, key)
+}
+
+// Record that data has been consumed, returning any credit that should now be
+// granted.
+func (this *receiveWindow) consume(key flowKey, byteCount int) (messageCredit int, connectionCredit int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.pendingConnection += byteCount
+	if this.pendingConnection >= this.connectionWindow/2 {
+		connectionCredit = this.pendingConnection
+		this.pendingConnection = 0
+	}
+
+	if pending, exists := this.pendingByIncoming[key]; exists {
+		pending += byteCount
+		if pending >= this.messageWindow/2 {
+			messageCredit = pending
+			pending = 0
+		}
+		this.pendingByIncoming[key] = pending
+	}
+	return messageCredit, connectionCredit
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
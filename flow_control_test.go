@@ -0,0 +1,280 @@
+package streamux
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kstenerud/go-streamux/test"
+)
+
+func newTestFlowControlConfig(isServer bool, messageWindow int) *Config {
+	config := newTestConfig(8, 10, isServer)
+	config.EnableControlExtension = true
+	config.EnableFlowControl = true
+	config.MessageWindow = messageWindow
+	return config
+}
+
+func newTestFlowControlSessionPair(serverMessageWindow int) (client, server *Session) {
+	client, server = newTestPipeSessionPair(func(config *Config, isServer bool) {
+		config.EnableControlExtension = true
+		config.EnableFlowControl = true
+		if isServer {
+			config.MessageWindow = serverMessageWindow
+		}
+	}, nil, nil)
+	<-client.Ready()
+	<-server.Ready()
+	return client, server
+}
+
+// Keep writing (non-blocking) until everything has been sent, or the timeout
+// expires.
+func writeAllNonBlocking(t *testing.T, message *SendableMessage, data []byte) bool {
+	deadline := time.Now().Add(time.Second)
+	for {
+		written, err := message.Write(data)
+		data = data[written:]
+		if err == nil && len(data) == 0 {
+			err = message.Flush()
+		}
+		if err == nil {
+			return true
+		}
+		if err != ErrWouldBlock {
+			t.Error(err)
+			return false
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("Timed out waiting for credit with %v bytes left to send", len(data))
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// =============================================================================
+
+func TestFlowControlLargeTransfer(t *testing.T) {
+	client, server := newTestFlowControlSessionPair(0)
+	defer server.Close()
+	defer client.Close()
+
+	// A response can't begin until the request has completely arrived, so the
+	// whole body is read first.
+	go func() {
+		id, body, err := server.AcceptRequest()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		contents, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		server.SendResponse(0, id, contents)
+	}()
+
+	// More than the connection window, so credit must be granted for the
+	// transfer to complete.
+	expected := test.NewTestBytes(DefaultConnectionWindow * 3)
+	request, response, err := client.OpenRequest(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	go func() {
+		request.Write(expected)
+		request.Close()
+	}()
+
+	actual, err := ioutil.ReadAll(response)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	test.AssertSlicesAreEquivalent(t, actual, expected)
+}
+
+func TestFlowControlWouldBlock(t *testing.T) {
+	client, server := newTestFlowControlSessionPair(0)
+	defer server.Close()
+	defer client.Close()
+
+	expected := test.NewTestBytes(DefaultMessageWindow * 2)
+	request, _, err := client.OpenRequest(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	request.SetBlocking(false)
+
+	written, err := request.Write(expected)
+	if err != ErrWouldBlock {
+		t.Errorf("Expected %v but got %v", ErrWouldBlock, err)
+		return
+	}
+	if written < DefaultMessageWindow || written >= len(expected) {
+		t.Errorf("Expected the message window to be sent, but %v bytes were written", written)
+		return
+	}
+
+	_, body, err := server.AcceptRequest()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	received := make([]byte, len(expected))
+	if _, err = io.ReadFull(body, received[:DefaultMessageWindow]); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Reading grants more credit.
+	readResult := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(body, received[DefaultMessageWindow:])
+		readResult <- err
+	}()
+	if !writeAllNonBlocking(t, request, expected[written:]) {
+		return
+	}
+	request.Close()
+	if err = <-readResult; err != nil {
+		t.Error(err)
+		return
+	}
+	test.AssertSlicesAreEquivalent(t, received, expected)
+}
+
+func TestFlowControlLargerMessageWindow(t *testing.T) {
+	messageWindow := DefaultMessageWindow * 2
+	client, server := newTestFlowControlSessionPair(messageWindow)
+	defer server.Close()
+	defer client.Close()
+
+	request, _, err := client.OpenRequest(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	request.SetBlocking(false)
+
+	// The server grants the extra credit once the request begins arriving.
+	if !writeAllNonBlocking(t, request, test.NewTestBytes(messageWindow)) {
+		return
+	}
+	request.Write([]byte{1})
+	if err = request.Flush(); err != ErrWouldBlock {
+		t.Errorf("Expected %v but got %v", ErrWouldBlock, err)
+	}
+}
+
+func TestFlowControlLargerMessageWindowAfterCancel(t *testing.T) {
+	messageWindow := DefaultMessageWindow * 2
+	client, server := newTestFlowControlSessionPair(messageWindow)
+	defer server.Close()
+	defer client.Close()
+
+	canceled, _, err := client.OpenRequest(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = canceled.Write(test.NewTestBytes(10)); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = canceled.Flush(); err != nil {
+		t.Error(err)
+		return
+	}
+	// Make sure the request has arrived before canceling it.
+	if _, _, err = server.AcceptRequest(); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = client.Cancel(canceled.Id); err != nil {
+		t.Error(err)
+		return
+	}
+	if !awaitIdsReleased(t, client) {
+		return
+	}
+
+	request, _, err := client.OpenRequest(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if request.Id != canceled.Id {
+		t.Errorf("Expected ID %v to be reused, but got %v", canceled.Id, request.Id)
+		return
+	}
+	request.SetBlocking(false)
+
+	// The reused ID begins a new message, so the extra credit is granted again.
+	writeAllNonBlocking(t, request, test.NewTestBytes(messageWindow))
+}
+
+func TestFlowControlCloseReleasesBlockedSender(t *testing.T) {
+	client, server := newTestFlowControlSessionPair(0)
+	defer server.Close()
+
+	request, _, err := client.OpenRequest(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- request.Feed(test.NewTestBytes(DefaultMessageWindow * 2))
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	client.Close()
+
+	select {
+	case err := <-result:
+		if err != ErrSessionClosed {
+			t.Errorf("Expected %v but got %v", ErrSessionClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for the blocked sender to be released")
+	}
+}
+
+func TestFlowControlNotNegotiated(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client, _ := NewSession(clientConn, newTestFlowControlConfig(false, 0), nil)
+	server, _ := NewSession(serverConn, newTestConfig(8, 10, true), nil)
+	defer server.Close()
+	defer client.Close()
+	<-client.Ready()
+	<-server.Ready()
+
+	request, _, err := client.OpenRequest(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// Nothing is read on the server side, but once negotiation completes there
+	// are no credit limits.
+	result := make(chan error, 1)
+	go func() {
+		result <- request.Feed(test.NewTestBytes(DefaultMessageWindow * 2))
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for the send to complete")
+	}
+}
@@ -0,0 +1,143 @@
+//go:build gofuzz
+// +build gofuzz
+
+package streamux
+
+import (
+	"time"
+)
+
+// Fuzz targets for go-fuzz (github.com/dvyukov/go-fuzz), which builds with the
+// gofuzz tag. Pick a target with go-fuzz-build's -func flag. A starting corpus
+// can be generated from recorded conversations (see TestWriteFuzzCorpus).
+// Native fuzzing needs a newer Go than this module targets.
+
+// Feed arbitrary data into a Protocol, as if it came from the peer. The first
+// byte selects the config (see fuzzProtocolConfig()), and the second how the
+// rest is split between calls to Feed().
+func FuzzProtocol(data []byte) int {
+	if len(data) < 2 {
+		return -1
+	}
+	config := fuzzProtocolConfig(data[0])
+	splitLength := int(data[1]) + 1
+	data = data[2:]
+
+	receiver := new(fuzzReceiver)
+	protocol, err := NewProtocol(config, receiver, receiver)
+	if err != nil {
+		panic(err)
+	}
+	receiver.protocol = protocol
+	if err = protocol.SendInitialization(); err != nil {
+		panic(err)
+	}
+
+	for len(data) > 0 {
+		length := splitLength
+		if length > len(data) {
+			length = len(data)
+		}
+		if err = protocol.Feed(data[:length]); err != nil {
+			return 0
+		}
+		data = data[length:]
+	}
+	return 1
+}
+
+// Internal
+
+// Bits 0-1 of the selector choose the ID bits (from few to many, so that the
+// fuzzer can guess the IDs of our own requests), bit 2 chooses client or
+// server, bit 3 the control extension, bit 4 flow control, and bit 5 manual
+// credit grants.
+func fuzzProtocolConfig(selector byte) *Config {
+	config := NewDefaultConfig()
+	config.IdMinBits = 0
+	config.IdRecommendBits = []int{2, 4, 8, 15}[selector&3]
+	config.LengthRecommendBits = 6
+	isServer := selector&4 != 0
+	config.RequestQuickInit = !isServer
+	config.AllowQuickInit = isServer
+	config.EnableControlExtension = selector&8 != 0
+	config.EnableFlowControl = config.EnableControlExtension && selector&16 != 0
+	config.ManualCreditGrants = selector&32 != 0
+	return config
+}
+
+// fuzzReceiver sends a few requests once it's able to, so that there's
+// something for responses to match, and answers requests and pings so that
+// the protocol's sending paths get exercised too.
+type fuzzReceiver struct {
+	protocol *Protocol
+}
+
+func (this *fuzzReceiver) OnAbleToSend() {
+	for i := 0; i < 3; i++ {
+		message, err := this.protocol.BeginRequest(0)
+		if err != nil {
+			return
+		}
+		message.SetBlocking(false)
+		message.Feed([]byte{byte(i)})
+		if i > 0 {
+			message.End()
+		}
+	}
+	this.protocol.Ping()
+}
+
+func (this *fuzzReceiver) OnMessageChunkToSend(priority int, messageId int, chunk []byte) error {
+	return nil
+}
+
+func (this *fuzzReceiver) OnRequestChunkReceived(messageId int, isEnd bool, data []byte) error {
+	if !isEnd {
+		return nil
+	}
+	message, err := this.protocol.BeginResponse(0, messageId)
+	if err != nil {
+		return nil
+	}
+	message.SetBlocking(false)
+	message.Feed(data)
+	message.End()
+	return nil
+}
+
+func (this *fuzzReceiver) OnResponseChunkReceived(messageId int, isEnd bool, data []byte) error {
+	if this.protocol != nil {
+		this.protocol.GrantCredit(messageId, true, len(data))
+	}
+	return nil
+}
+
+func (this *fuzzReceiver) OnPingReceived(messageId int) error {
+	return nil
+}
+
+func (this *fuzzReceiver) OnPingAckReceived(messageId int, latency time.Duration) error {
+	return nil
+}
+
+func (this *fuzzReceiver) OnCancelReceived(messageId int) error {
+	return nil
+}
+
+func (this *fuzzReceiver) OnCancelAckReceived(messageId int) error {
+	return nil
+}
+
+func (this *fuzzReceiver) OnEmptyResponseReceived(messageId int) error {
+	return nil
+}
+
+func (this *fuzzReceiver) OnStreamOpened(messageId int, priority int) error {
+	this.protocol.BeginResponse(priority, messageId)
+	return nil
+}
+
+func (this *fuzzReceiver) OnNotificationReceived(data []byte) error {
+	return nil
+}
@@ -0,0 +1,165 @@
+//go:build gofuzz
+// +build gofuzz
+
+package streamux
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+var fuzzCorpusDir = flag.String("fuzzcorpus", "", "Directory to write the FuzzProtocol corpus to (see TestWriteFuzzCorpus)")
+
+// Run a conversation between a session using the config that selector chooses
+// for FuzzProtocol, and a peer with the opposite role, and return the data
+// that the first session received, in the form FuzzProtocol expects.
+func recordFuzzConversation(t *testing.T, selector byte) []byte {
+	recording := new(bytes.Buffer)
+	recorder, err := NewRecorder(recording)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	recordedConn, peerConn := net.Pipe()
+	recorded, err := NewSession(NewRecordingTransport(recordedConn, recorder), fuzzProtocolConfig(selector), nil)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	peer, err := NewSession(peerConn, fuzzProtocolConfig(selector^4), nil)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	go serveStreamingEcho(t, recorded)
+	go serveStreamingEcho(t, peer)
+	go serveFuzzStreams(recorded)
+
+	ctx := context.Background()
+	if _, err = peer.Call(ctx, 0, []byte("a request that spans several chunks")); err != nil {
+		t.Error(err)
+		return nil
+	}
+	if _, err = recorded.Call(ctx, 1, []byte("a response to match")); err != nil {
+		t.Error(err)
+		return nil
+	}
+	if _, err = peer.Ping(); err != nil {
+		t.Error(err)
+		return nil
+	}
+	_, response, err := peer.OpenRequest(0)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	// Canceled before the request has even ended.
+	response.Close()
+
+	if selector&8 != 0 {
+		if err = peer.SendNotification([]byte("a notification")); err != nil {
+			t.Error(err)
+			return nil
+		}
+		stream, err := peer.OpenStream(0)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		stream.Write([]byte("stream data"))
+		stream.CloseWrite()
+		ioutil.ReadAll(stream)
+	}
+
+	peer.Close()
+	recorded.Wait()
+	peer.Wait()
+
+	seed := []byte{selector, 255}
+	seed = append(seed, readRecordedData(t, recording.Bytes(), RecordIncoming)...)
+	return seed
+}
+
+func serveFuzzStreams(session *Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(stream, stream)
+			stream.Close()
+		}()
+	}
+}
+
+func generateFuzzProtocolSeeds(t *testing.T) (seeds [][]byte) {
+	for selector := 0; selector < 64; selector++ {
+		seed := recordFuzzConversation(t, byte(selector))
+		if seed == nil {
+			return nil
+		}
+		seeds = append(seeds, seed)
+	}
+	return seeds
+}
+
+// Return variations of the data, made the way a fuzzer might.
+func mutateFuzzData(random *rand.Rand, data []byte, count int) (mutations [][]byte) {
+	for i := 0; i < count; i++ {
+		mutation := append([]byte(nil), data...)
+		for j := random.Intn(4); j >= 0 && len(mutation) > 0; j-- {
+			index := random.Intn(len(mutation))
+			switch random.Intn(4) {
+			case 0:
+				mutation[index] = byte(random.Intn(256))
+			case 1:
+				mutation[index] ^= 1 << uint(random.Intn(8))
+			case 2:
+				mutation = mutation[:index]
+			case 3:
+				mutation = append(mutation[:index], mutation[index+1:]...)
+			}
+		}
+		mutations = append(mutations, mutation)
+	}
+	return mutations
+}
+
+// =============================================================================
+
+func TestFuzzProtocol(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for _, seed := range generateFuzzProtocolSeeds(t) {
+		// Responses to the recorded side's requests won't match the IDs of
+		// FuzzProtocol's requests, so a seed may be rejected partway through.
+		FuzzProtocol(seed)
+		for _, mutation := range mutateFuzzData(random, seed, 100) {
+			FuzzProtocol(mutation)
+		}
+	}
+}
+
+// Write a starting corpus for go-fuzz, when run with -fuzzcorpus=<directory>.
+func TestWriteFuzzCorpus(t *testing.T) {
+	if *fuzzCorpusDir == "" {
+		t.Skip("No corpus directory specified")
+	}
+	for _, seed := range generateFuzzProtocolSeeds(t) {
+		path := filepath.Join(*fuzzCorpusDir, fmt.Sprintf("%x", sha1.Sum(seed)))
+		if err := ioutil.WriteFile(path, seed, 0644); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
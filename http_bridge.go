@@ -0,0 +1,308 @@
+package streamux
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HTTPTransport is an http.RoundTripper that sends HTTP requests over a
+// session, to an HTTPHandler registered with the peer's ServeMux.
+//
+// Each HTTP request is a streamux request: the route, then the HTTP/1.1
+// request line and headers, then the body, which is streamed as it's read.
+// The response comes back the same way, and its body can be read as it
+// arrives. Closing the response body before it ends, or canceling the
+// request's context, cancels the streamux request.
+type HTTPTransport struct {
+	Session *Session
+	// The route that the peer serves HTTP on (see EncodeRoute()).
+	Route    string
+	Priority int
+}
+
+// HTTPHandler is a streamux Handler that serves requests from an
+// HTTPTransport with an http.Handler. The http.Request's context is canceled
+// if the peer cancels the request.
+//
+// Since a streamux response can't begin until its request has ended, the
+// response headers aren't sent until the handler has read the whole request
+// body (or returned).
+type HTTPHandler struct {
+	Handler http.Handler
+}
+
+// API
+
+func (this *HTTPTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	route, err := EncodeRoute(this.Route)
+	if err != nil {
+		closeHTTPRequestBody(request)
+		return nil, err
+	}
+	head, err := newHTTPRequestHead(route, request)
+	if err != nil {
+		closeHTTPRequestBody(request)
+		return nil, err
+	}
+	message, responseReader, err := this.Session.OpenRequest(this.Priority)
+	if err != nil {
+		closeHTTPRequestBody(request)
+		return nil, err
+	}
+
+	body := &httpResponseBody{
+		ctx:    request.Context(),
+		reader: responseReader,
+		closed: make(chan struct{}),
+	}
+	go body.cancelWithContext()
+	go func() {
+		if err := writeHTTPRequest(message, head, request); err != nil {
+			// Cancels the request.
+			body.Close()
+		}
+	}()
+
+	response, err := http.ReadResponse(bufio.NewReader(body), request)
+	if err != nil {
+		body.Close()
+		if ctxErr := request.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	response.Body = &httpResponseBodyCloser{response.Body, body}
+	return response, nil
+}
+
+// Internal callback
+func (this *HTTPHandler) ServeStreamux(response ResponseWriter, request *Request) {
+	reader := bufio.NewReader(request.Body)
+	httpRequest, err := http.ReadRequest(reader)
+	if err != nil {
+		writer := newHTTPResponseWriter(response)
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// The body is the rest of the message, however long it turns out to be.
+	httpRequest.Body = ioutil.NopCloser(reader)
+	if httpRequest.Header.Get("Content-Length") == "" {
+		httpRequest.ContentLength = -1
+	}
+	httpRequest = httpRequest.WithContext(request.Context())
+
+	writer := newHTTPResponseWriter(response)
+	this.Handler.ServeHTTP(writer, httpRequest)
+	writer.finish()
+}
+
+// Internal
+
+// Headers that describe the HTTP/1.1 connection or the body's framing, which
+// a streamux message takes care of.
+var httpHopHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Host":              true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// The route, then the request line and headers. Fails with
+// ErrInvalidHTTPRequest rather than let the request's fields corrupt the head
+// (as net/http does).
+func newHTTPRequestHead(route []byte, request *http.Request) ([]byte, error) {
+	host := request.Host
+	if host == "" {
+		host = request.URL.Host
+	}
+	method := request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	requestURI := request.URL.RequestURI()
+	if !isHTTPToken(method) || !isValidHTTPHeaderValue(host) || !isValidHTTPHeaderValue(requestURI) {
+		return nil, ErrInvalidHTTPRequest
+	}
+	for name, values := range request.Header {
+		if !isHTTPToken(name) {
+			return nil, ErrInvalidHTTPRequest
+		}
+		for _, value := range values {
+			if !isValidHTTPHeaderValue(value) {
+				return nil, ErrInvalidHTTPRequest
+			}
+		}
+	}
+
+	head := append([]byte(nil), route...)
+	head = append(head, fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\n", method, requestURI, host)...)
+	if request.Body == nil || request.Body == http.NoBody {
+		head = append(head, "Content-Length: 0\r\n"...)
+	} else if request.ContentLength > 0 {
+		head = append(head, "Content-Length: "+strconv.FormatInt(request.ContentLength, 10)+"\r\n"...)
+	}
+	return appendHTTPHeaders(head, request.Header), nil
+}
+
+func writeHTTPRequest(message *SendableMessage, head []byte, request *http.Request) (err error) {
+	defer closeHTTPRequestBody(request)
+
+	if _, err = message.Write(head); err != nil {
+		return err
+	}
+	if request.Body != nil {
+		if _, err = io.Copy(message, request.Body); err != nil {
+			return err
+		}
+	}
+	return message.End()
+}
+
+func closeHTTPRequestBody(request *http.Request) {
+	if request.Body != nil {
+		request.Body.Close()
+	}
+}
+
+// Appends the headers and the blank line that ends them. Like net/http's
+// server, headers with invalid names are left out, and CR and LF in values are
+// replaced with spaces.
+func appendHTTPHeaders(head []byte, header http.Header) []byte {
+	for name, values := range header {
+		if httpHopHeaders[http.CanonicalHeaderKey(name)] || !isHTTPToken(name) {
+			continue
+		}
+		for _, value := range values {
+			head = append(head, name+": "+httpHeaderNewlineToSpace.Replace(value)+"\r\n"...)
+		}
+	}
+	return append(head, "\r\n"...)
+}
+
+var httpHeaderNewlineToSpace = strings.NewReplacer("\r", " ", "\n", " ")
+
+func isValidHTTPHeaderValue(value string) bool {
+	return !strings.ContainsAny(value, "\r\n")
+}
+
+// Reports whether value is a token as defined by RFC 7230, which header names
+// and methods must be.
+func isHTTPToken(value string) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		isAlphanumeric := (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+		if !isAlphanumeric && strings.IndexByte("!#$%&'*+-.^_`|~", ch) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// The raw response, which cancels the request if closed before it ends, or if
+// the request's context is done first.
+type httpResponseBody struct {
+	ctx       context.Context
+	reader    *MessageReader
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (this *httpResponseBody) Read(buffer []byte) (int, error) {
+	bytesRead, err := this.reader.Read(buffer)
+	if err != nil && err != io.EOF && this.ctx.Err() != nil {
+		err = this.ctx.Err()
+	}
+	return bytesRead, err
+}
+
+func (this *httpResponseBody) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+		this.reader.Close()
+	})
+	return nil
+}
+
+func (this *httpResponseBody) cancelWithContext() {
+	select {
+	case <-this.ctx.Done():
+		this.Close()
+	case <-this.closed:
+	}
+}
+
+// The response body as decoded by http.ReadResponse(), closing the raw
+// response too.
+type httpResponseBodyCloser struct {
+	io.ReadCloser
+	raw *httpResponseBody
+}
+
+func (this *httpResponseBodyCloser) Close() error {
+	this.ReadCloser.Close()
+	return this.raw.Close()
+}
+
+type httpResponseWriter struct {
+	response        ResponseWriter
+	header          http.Header
+	isHeaderWritten bool
+}
+
+func newHTTPResponseWriter(response ResponseWriter) *httpResponseWriter {
+	return &httpResponseWriter{
+		response: response,
+		header:   make(http.Header),
+	}
+}
+
+func (this *httpResponseWriter) Header() http.Header {
+	return this.header
+}
+
+func (this *httpResponseWriter) WriteHeader(statusCode int) {
+	if this.isHeaderWritten {
+		return
+	}
+	this.isHeaderWritten = true
+	head := []byte(fmt.Sprintf("HTTP/1.1 %03d %s\r\n", statusCode, http.StatusText(statusCode)))
+	if contentLength, err := strconv.ParseInt(this.header.Get("Content-Length"), 10, 64); err == nil && contentLength >= 0 {
+		head = append(head, "Content-Length: "+strconv.FormatInt(contentLength, 10)+"\r\n"...)
+	}
+	head = appendHTTPHeaders(head, this.header)
+	// If this fails, so will everything written afterwards.
+	this.response.Write(head)
+}
+
+func (this *httpResponseWriter) Write(data []byte) (int, error) {
+	if !this.isHeaderWritten {
+		if this.header.Get("Content-Type") == "" {
+			this.header.Set("Content-Type", http.DetectContentType(data))
+		}
+		this.WriteHeader(http.StatusOK)
+	}
+	return this.response.Write(data)
+}
+
+// Implements http.Flusher.
+func (this *httpResponseWriter) Flush() {
+	this.WriteHeader(http.StatusOK)
+	this.response.Flush()
+}
+
+func (this *httpResponseWriter) finish() {
+	this.WriteHeader(http.StatusOK)
+}
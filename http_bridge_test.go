@@ -0,0 +1,206 @@
+package streamux
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kstenerud/go-streamux/test"
+)
+
+func newTestHTTPClient(handler http.Handler) (client *http.Client, clientSession, serverSession *Session) {
+	mux := NewServeMux()
+	mux.Handle("http", &HTTPHandler{Handler: handler})
+	clientSession, serverSession = newTestServeMuxSessionPair(mux)
+	transport := &HTTPTransport{Session: clientSession, Route: "http"}
+	return &http.Client{Transport: transport}, clientSession, serverSession
+}
+
+// A request body that has nothing to read until it's released.
+type heldRequestBody struct {
+	released chan struct{}
+}
+
+func (this *heldRequestBody) Read(p []byte) (int, error) {
+	<-this.released
+	return 0, io.EOF
+}
+
+func (this *heldRequestBody) Close() error {
+	return nil
+}
+
+// =============================================================================
+
+func TestHTTPBridge(t *testing.T) {
+	handler := http.NewServeMux()
+	handler.HandleFunc("/echo", func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Set("X-Query", request.URL.Query().Get("q"))
+		response.Header().Set("X-Method", request.Method)
+		response.WriteHeader(http.StatusCreated)
+		io.Copy(response, request.Body)
+	})
+	client, clientSession, serverSession := newTestHTTPClient(handler)
+	defer serverSession.Close()
+	defer clientSession.Close()
+
+	expected := test.NewTestBytes(100000)
+	response, err := client.Post("http://example.com/echo?q=value", "application/octet-stream", bytes.NewReader(expected))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actual, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	test.AssertSlicesAreEquivalent(t, actual, expected)
+	if response.StatusCode != http.StatusCreated {
+		t.Errorf("Expected status %v but got %v", http.StatusCreated, response.StatusCode)
+	}
+	if query := response.Header.Get("X-Query"); query != "value" {
+		t.Errorf("Expected query %q but got %q", "value", query)
+	}
+
+	// A body of unknown length
+	response, err = client.Post("http://example.com/echo", "text/plain", ioutil.NopCloser(strings.NewReader("unknown")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actual, _ = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(actual) != "unknown" {
+		t.Errorf("Expected %q but got %q", "unknown", actual)
+	}
+
+	response, err = client.Get("http://example.com/missing")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %v but got %v", http.StatusNotFound, response.StatusCode)
+	}
+}
+
+func TestHTTPBridgeCancel(t *testing.T) {
+	serverCanceled := make(chan struct{})
+	handler := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		<-request.Context().Done()
+		close(serverCanceled)
+	})
+	client, clientSession, serverSession := newTestHTTPClient(handler)
+	defer serverSession.Close()
+	defer clientSession.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request, _ := http.NewRequest("GET", "http://example.com/", nil)
+	request = request.WithContext(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := client.Do(request); err == nil {
+		t.Errorf("Expected the canceled request to fail")
+	}
+
+	select {
+	case <-serverCanceled:
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for the handler to see the cancel")
+	}
+}
+
+func TestHTTPBridgeCancelBeforeBodyWritten(t *testing.T) {
+	handlerCalled := make(chan struct{}, 1)
+	handler := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		handlerCalled <- struct{}{}
+	})
+	client, clientSession, serverSession := newTestHTTPClient(handler)
+	defer serverSession.Close()
+	defer clientSession.Close()
+
+	body := &heldRequestBody{released: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	request, _ := http.NewRequest("POST", "http://example.com/", body)
+	request = request.WithContext(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := client.Do(request); err == nil {
+		t.Errorf("Expected the canceled request to fail")
+		return
+	}
+
+	// Nothing has been sent, so the request fails once the body finishes.
+	close(body.released)
+	if !awaitIdsReleased(t, clientSession) {
+		return
+	}
+	clientSession.readersMutex.Lock()
+	readerCount := len(clientSession.responseReaders)
+	cancelingCount := len(clientSession.cancelingResponses)
+	clientSession.readersMutex.Unlock()
+	if readerCount != 0 || cancelingCount != 0 {
+		t.Errorf("Expected no response readers but got %v (%v canceling)", readerCount, cancelingCount)
+	}
+
+	select {
+	case <-handlerCalled:
+		t.Errorf("The canceled request should not have reached the handler")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestHTTPBridgeHeaderInjection(t *testing.T) {
+	isHandlerCalled := false
+	handler := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		isHandlerCalled = true
+		response.Header().Set("X-Reply", "value\r\nX-Injected: reply")
+		response.Header()["X-Bad\r\nX-Injected"] = []string{"reply"}
+	})
+	client, clientSession, serverSession := newTestHTTPClient(handler)
+	defer serverSession.Close()
+	defer clientSession.Close()
+
+	badHeaders := []http.Header{
+		{"X-Value": {"value\r\nX-Injected: request"}},
+		{"X-Value": {"value\nX-Injected: request"}},
+		{"X-Name\r\nX-Injected": {"request"}},
+		{"X-Name: X-Injected": {"request"}},
+		{"": {"request"}},
+	}
+	for _, header := range badHeaders {
+		request, _ := http.NewRequest("GET", "http://example.com/", nil)
+		request.Header = header
+		if _, err := client.Transport.RoundTrip(request); err != ErrInvalidHTTPRequest {
+			t.Errorf("%q: Expected %v but got %v", header, ErrInvalidHTTPRequest, err)
+		}
+	}
+	request, _ := http.NewRequest("GET", "http://example.com/", nil)
+	request.Host = "example.com\r\nX-Injected: request"
+	if _, err := client.Transport.RoundTrip(request); err != ErrInvalidHTTPRequest {
+		t.Errorf("Expected %v but got %v", ErrInvalidHTTPRequest, err)
+	}
+	if isHandlerCalled {
+		t.Errorf("Expected invalid requests not to be sent")
+	}
+
+	// The handler's headers can't corrupt the response head either.
+	response, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	response.Body.Close()
+	if injected := response.Header.Get("X-Injected"); injected != "" {
+		t.Errorf("Expected no injected header but got %q", injected)
+	}
+	if reply := response.Header.Get("X-Reply"); reply != "value  X-Injected: reply" {
+		t.Errorf("Expected the reply header's newlines to be replaced but got %q", reply)
+	}
+}
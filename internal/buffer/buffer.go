@@ -1,5 +1,7 @@
 package buffer
 
+import "io"
+
 type FeedableBuffer struct {
 	Data         []byte
 	minByteCount int
@@ -63,6 +65,13 @@ func (this *FeedableBuffer) OverwriteHead(bytes []byte) {
 	copy(this.Data, bytes)
 }
 
+// Remove byteCount bytes from just past the minimum (head) portion, moving
+// any bytes after them down to take their place.
+func (this *FeedableBuffer) DiscardAfterHead(byteCount int) {
+	remaining := copy(this.Data[this.minByteCount:], this.Data[this.minByteCount+byteCount:])
+	this.Data = this.Data[:this.minByteCount+remaining]
+}
+
 // Feed as many bytes as will fit into this buffer (based on maxByteCount), returning whatever remains.
 func (this *FeedableBuffer) Feed(bytesToFeed []byte) (bytesRemaining []byte) {
 	byteCount := this.maxByteCount - len(this.Data)
@@ -71,6 +80,33 @@ func (this *FeedableBuffer) Feed(bytesToFeed []byte) (bytesRemaining []byte) {
 	return bytesRemaining
 }
 
+// Read at most maxBytes from the reader directly into this buffer's free space,
+// returning the number of bytes read. Capacity grows geometrically, so large
+// buffers aren't allocated until they're actually needed.
+func (this *FeedableBuffer) FeedFromReader(reader io.Reader, maxBytes int) (bytesRead int, err error) {
+	usedLength := len(this.Data)
+	readLength := this.maxByteCount - usedLength
+	if readLength > maxBytes {
+		readLength = maxBytes
+	}
+	if requiredCapacity := usedLength + readLength; cap(this.Data) < requiredCapacity {
+		newCapacity := cap(this.Data) * 2
+		if newCapacity < requiredCapacity {
+			newCapacity = requiredCapacity
+		}
+		if newCapacity > this.maxByteCount {
+			newCapacity = this.maxByteCount
+		}
+		old := this.Data
+		this.Data = make([]byte, usedLength, newCapacity)
+		copy(this.Data, old)
+	}
+
+	bytesRead, err = reader.Read(this.Data[usedLength : usedLength+readLength])
+	this.Data = this.Data[:usedLength+bytesRead]
+	return bytesRead, err
+}
+
 // Split a slice into a "consumed" portion buffer[:byteCount] and "remaining" portion buffer[byteCount:len(buffer)].
 func ConsumeBytes(byteCount int, buffer []byte) (consumedPortion []byte, remainingPortion []byte) {
 	if byteCount > len(buffer) {
@@ -1,6 +1,7 @@
 package buffer
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/kstenerud/go-streamux/test"
@@ -80,3 +81,28 @@ func TestOverwriteHead(t *testing.T) {
 	actual := buffer.Data[:len(expected)]
 	test.AssertSlicesAreEquivalent(t, actual, expected)
 }
+
+func TestDiscardAfterHead(t *testing.T) {
+	buffer := New(2, 8, 8)
+	buffer.OverwriteHead([]byte{9, 9})
+	buffer.Feed([]byte{1, 2, 3, 4, 5})
+	buffer.DiscardAfterHead(3)
+	test.AssertSlicesAreEquivalent(t, buffer.Data, []byte{9, 9, 4, 5})
+}
+
+func TestFeedFromReader(t *testing.T) {
+	source := test.NewTestBytes(20)
+	reader := bytes.NewReader(source)
+	buffer := New(2, 12, 3)
+
+	if bytesRead, err := buffer.FeedFromReader(reader, 4); err != nil || bytesRead != 4 {
+		t.Errorf("Expected 4 bytes read but got %v (%v)", bytesRead, err)
+	}
+	if bytesRead, err := buffer.FeedFromReader(reader, 100); err != nil || bytesRead != 6 {
+		t.Errorf("Expected 6 bytes read but got %v (%v)", bytesRead, err)
+	}
+	if !buffer.IsFull() {
+		t.Errorf("Expected buffer to be full")
+	}
+	test.AssertSlicesAreEquivalent(t, buffer.Data[2:], source[:10])
+}
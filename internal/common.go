@@ -1,8 +1,10 @@
 package internal
 
+import "fmt"
+
 type InternalMessageSender interface {
-	OnRequestChunkToSend(priority int, messageId int, isEnd bool, chunk []byte) error
-	OnResponseChunkToSend(priority int, messageId int, isEnd bool, chunk []byte) error
+	OnRequestChunkToSend(priority int, weight int, messageId int, isEnd bool, chunk []byte) error
+	OnResponseChunkToSend(priority int, weight int, messageId int, isEnd bool, chunk []byte) error
 }
 
 type InternalMessageReceiver interface {
@@ -21,3 +23,19 @@ const (
 	MessageTypeRequestEmptyTermination
 	MessageTypeEmptyResponse
 )
+
+var messageTypeNames = []string{
+	MessageTypeRequest:                 "request",
+	MessageTypeResponse:                "response",
+	MessageTypeCancel:                  "cancel",
+	MessageTypeCancelAck:               "cancel ack",
+	MessageTypeRequestEmptyTermination: "empty request termination",
+	MessageTypeEmptyResponse:           "empty response",
+}
+
+func (this MessageType) String() string {
+	if this >= 0 && int(this) < len(messageTypeNames) {
+		return messageTypeNames[this]
+	}
+	return fmt.Sprintf("unknown message type %d", int(this))
+}
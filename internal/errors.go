@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors. Structured errors report which of these they belong to via
+// their Is() method, so that Go 1.13's errors.Is() can match them.
+var (
+	ErrIdPoolExhausted   = errors.New("Could not allocate a new message ID. Please initialize with more ID bits")
+	ErrNotReady          = errors.New("Negotiation not complete")
+	ErrNegotiationFailed = errors.New("Negotiation failed")
+	ErrProtocolViolation = errors.New("Protocol violation")
+	ErrInvalidState      = errors.New("Invalid request state")
+	ErrDeadlineExceeded  = errors.New("Request deadline exceeded")
+	ErrCanceled          = errors.New("Request was canceled")
+)
+
+// NoMessageId is used in errors that don't relate to any particular message.
+const NoMessageId = -1
+
+// BitRange describes one side's acceptable range for a negotiated bit count.
+type BitRange struct {
+	Min         int
+	Max         int
+	Recommended int
+}
+
+// NegotiationError reports why protocol negotiation failed, along with what
+// each side asked for. The remote fields are only filled in if the peer's
+// initialize message was received (HasRemote).
+type NegotiationError struct {
+	Reason string
+
+	LocalVersion    int
+	LocalIdBits     BitRange
+	LocalLengthBits BitRange
+
+	HasRemote        bool
+	RemoteVersion    int
+	RemoteIdBits     BitRange
+	RemoteLengthBits BitRange
+}
+
+func (this *NegotiationError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrNegotiationFailed, this.Reason)
+}
+
+func (this *NegotiationError) Is(target error) bool {
+	return target == ErrNegotiationFailed
+}
+
+// ProtocolViolationError reports that the peer sent something that the
+// protocol doesn't allow, most likely due to a bug in the peer.
+type ProtocolViolationError struct {
+	MessageId int
+	State     string
+	Reason    string
+}
+
+func (this *ProtocolViolationError) Error() string {
+	if this.MessageId == NoMessageId {
+		return fmt.Sprintf("%v: %v", ErrProtocolViolation, this.Reason)
+	}
+	return fmt.Sprintf("%v: message %v (%v): %v", ErrProtocolViolation, this.MessageId, this.State, this.Reason)
+}
+
+func (this *ProtocolViolationError) Is(target error) bool {
+	return target == ErrProtocolViolation
+}
+
+// RequestStateError reports an attempt to do something with a request that its
+// current state doesn't allow, such as sending more data after it has ended.
+type RequestStateError struct {
+	MessageId int
+	State     string
+	Reason    string
+}
+
+func (this *RequestStateError) Error() string {
+	return fmt.Sprintf("Request %v (%v): %v", this.MessageId, this.State, this.Reason)
+}
+
+func (this *RequestStateError) Is(target error) bool {
+	return target == ErrInvalidState
+}
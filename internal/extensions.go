@@ -0,0 +1,33 @@
+package internal
+
+// Protocol extensions are advertised using the two high bits of the initialize
+// message (which the base protocol leaves unused). An extension is only active
+// if both peers advertise it, and the negotiated ID field is wide enough.
+const (
+	ExtensionControl = 1 << iota
+	// Credit-based flow control. Credit is granted via control messages, so
+	// this also requires ExtensionControl.
+	ExtensionFlowControl
+)
+
+const (
+	shiftExtensions = 30
+	maskExtensions  = 0x03
+)
+
+// Extensions reserve message IDs at the top of the ID range, so they require
+// at least this many ID bits.
+const MinExtensionIdBits = 2
+
+// When the control extension is active, the highest message ID is reserved for
+// control messages, which are sent as requests but never answered.
+func ControlMessageId(idBits int) int {
+	return 1<<uint(idBits) - 1
+}
+
+// When the control extension is active, the second highest message ID is
+// reserved for notifications, which are also sent as requests but never
+// answered.
+func NotificationMessageId(idBits int) int {
+	return 1<<uint(idBits) - 2
+}
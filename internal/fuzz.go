@@ -0,0 +1,134 @@
+//go:build gofuzz
+// +build gofuzz
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Fuzz targets for go-fuzz (github.com/dvyukov/go-fuzz), which builds with the
+// gofuzz tag. Pick a target with go-fuzz-build's -func flag.
+
+// Decode a message header, then check that encoding the decoded fields gives
+// back the same bytes. The first byte selects the ID and length bits.
+func FuzzMessageHeader(data []byte) int {
+	if len(data) < 1 {
+		return -1
+	}
+	idBits, lengthBits := fuzzBitCounts(data[0])
+	data = data[1:]
+
+	header := NewMessageHeader(idBits, lengthBits)
+	remainingData, err := header.Feed(data)
+	if err != nil {
+		return 0
+	}
+	if !header.IsDecoded() {
+		if len(remainingData) != 0 {
+			panic(fmt.Errorf("%v bytes remain, but the header isn't decoded", len(remainingData)))
+		}
+		return 0
+	}
+
+	encoded := NewMessageHeader(idBits, lengthBits)
+	if header.Length > 0 {
+		encoded.SetAll(header.Id, header.Length, header.IsResponse, header.IsEndOfMessage)
+	} else {
+		encoded.SetIdAndType(header.Id, header.MessageType)
+	}
+	if !bytes.Equal(encoded.Encoded.Data, data[:header.HeaderLength]) {
+		panic(fmt.Errorf("Header %x was re-encoded as %x", data[:header.HeaderLength], encoded.Encoded.Data))
+	}
+	return 1
+}
+
+// Decode a stream of message chunks. The first byte selects the ID and length
+// bits.
+func FuzzMessageDecoder(data []byte) int {
+	if len(data) < 1 {
+		return -1
+	}
+	idBits, lengthBits := fuzzBitCounts(data[0])
+	data = data[1:]
+
+	decoder := NewMessageDecoder(idBits, lengthBits, fuzzMessageReceiver{})
+	for len(data) > 0 {
+		var err error
+		if data, err = decoder.Feed(data); err != nil {
+			return 0
+		}
+	}
+	return 1
+}
+
+// Negotiate with an arbitrary initialize message. The first byte selects our
+// side's parameters (see fuzzNegotiator()), and the rest is fed as the peer's
+// initialize message.
+func FuzzNegotiator(data []byte) int {
+	if len(data) < 1 {
+		return -1
+	}
+	negotiator := fuzzNegotiator(data[0])
+	data = data[1:]
+
+	remainingData, err := negotiator.Feed(data)
+	if err != nil {
+		if negotiator.CanSendMessages() || negotiator.CanReceiveMessages() {
+			panic(fmt.Errorf("Negotiation failed with %v, but messages are still allowed", err))
+		}
+		return 0
+	}
+	if !negotiator.IsNegotiationComplete() {
+		if len(remainingData) != 0 {
+			panic(fmt.Errorf("%v bytes remain, but negotiation isn't complete", len(remainingData)))
+		}
+		return 0
+	}
+	if negotiator.IdBits < 0 || negotiator.LengthBits < 0 || negotiator.IdBits+negotiator.LengthBits > maxTotalBits {
+		panic(fmt.Errorf("Negotiated invalid bit counts: ID %v, length %v", negotiator.IdBits, negotiator.LengthBits))
+	}
+	return 1
+}
+
+// Internal
+
+func fuzzBitCounts(selector byte) (idBits, lengthBits int) {
+	idBits = int(selector>>3) % (maxTotalBits + 1)
+	lengthBits = int(selector&7) * 4
+	if lengthBits > maxTotalBits-idBits {
+		lengthBits = maxTotalBits - idBits
+	}
+	return idBits, lengthBits
+}
+
+// Bit 0 of the selector chooses whether we request or allow quick init, bit 1
+// whether we use wildcards, and bit 2 whether we advertise the extensions.
+func fuzzNegotiator(selector byte) *ProtocolNegotiator {
+	requestQuickInit := selector&1 != 0
+	allowQuickInit := !requestQuickInit
+	idRecommendBits, lengthRecommendBits := 10, 12
+	if selector&2 != 0 && !requestQuickInit {
+		idRecommendBits, lengthRecommendBits = RecommendedWildcard, RecommendedWildcard
+	}
+	negotiator := NewNegotiator(1, 0, 29, idRecommendBits, 1, 30, lengthRecommendBits, requestQuickInit, allowQuickInit)
+	if selector&4 != 0 {
+		negotiator.SetExtensions(ExtensionControl | ExtensionFlowControl)
+	}
+	return negotiator
+}
+
+type fuzzMessageReceiver struct{}
+
+func (this fuzzMessageReceiver) OnRequestChunkReceived(messageId int, isEnd bool, data []byte) error {
+	return nil
+}
+
+func (this fuzzMessageReceiver) OnResponseChunkReceived(messageId int, isEnd bool, data []byte) error {
+	return nil
+}
+
+func (this fuzzMessageReceiver) OnZeroLengthMessageReceived(messageId int, messageType MessageType) error {
+	return nil
+}
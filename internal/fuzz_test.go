@@ -0,0 +1,88 @@
+//go:build gofuzz
+// +build gofuzz
+
+package internal
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Headers of every message type, for every selector that fuzzBitCounts()
+// accepts, in the form FuzzMessageHeader and FuzzMessageDecoder expect.
+func generateFuzzHeaderSeeds() (seeds [][]byte) {
+	for selector := 0; selector < 256; selector++ {
+		idBits, lengthBits := fuzzBitCounts(byte(selector))
+		header := NewMessageHeader(idBits, lengthBits)
+		id := 1<<uint(idBits) - 1
+		data := []byte{1, 2, 3}
+		if header.MaxChunkLength < len(data) {
+			data = data[:header.MaxChunkLength]
+		}
+		for _, isResponse := range []bool{false, true} {
+			for _, isEnd := range []bool{false, true} {
+				header.SetAll(id, len(data), isResponse, isEnd)
+				seed := append([]byte{byte(selector)}, header.Encoded.Data...)
+				seeds = append(seeds, append(seed, data...))
+				header.SetAll(id, 0, isResponse, isEnd)
+				seeds = append(seeds, append([]byte{byte(selector)}, header.Encoded.Data...))
+			}
+		}
+	}
+	return seeds
+}
+
+// Initialize messages compatible with each of fuzzNegotiator()'s selectors, in
+// the form FuzzNegotiator expects.
+func generateFuzzNegotiatorSeeds() (seeds [][]byte) {
+	for selector := 0; selector < 8; selector++ {
+		messages := [][]byte{buildInitMsg(1, 0, 29, 10, 1, 30, 12, false, true)}
+		if selector&1 == 0 {
+			// We allow quick init rather than requesting it.
+			messages = [][]byte{
+				buildInitMsg(1, 0, 29, 10, 1, 30, 12, true, false),
+				buildInitMsg(1, 4, 20, 31, 6, 20, 31, false, false),
+			}
+		}
+		for _, message := range messages {
+			seeds = append(seeds, append([]byte{byte(selector)}, message...))
+		}
+	}
+	return seeds
+}
+
+func mutateFuzzData(random *rand.Rand, data []byte) []byte {
+	mutation := append([]byte(nil), data...)
+	for i := random.Intn(4); i >= 0; i-- {
+		index := random.Intn(len(mutation))
+		mutation[index] ^= 1 << uint(random.Intn(8))
+	}
+	return mutation
+}
+
+func assertFuzzSeedsAccepted(t *testing.T, fuzz func([]byte) int, seeds [][]byte) {
+	random := rand.New(rand.NewSource(1))
+	for _, seed := range seeds {
+		if fuzz(seed) != 1 {
+			t.Errorf("Seed %x was rejected", seed)
+			return
+		}
+		for i := 0; i < 100; i++ {
+			fuzz(mutateFuzzData(random, seed))
+		}
+	}
+}
+
+// =============================================================================
+
+func TestFuzzMessageHeader(t *testing.T) {
+	assertFuzzSeedsAccepted(t, FuzzMessageHeader, generateFuzzHeaderSeeds())
+}
+
+func TestFuzzMessageDecoder(t *testing.T) {
+	assertFuzzSeedsAccepted(t, FuzzMessageDecoder, generateFuzzHeaderSeeds())
+}
+
+func TestFuzzNegotiator(t *testing.T) {
+	assertFuzzSeedsAccepted(t, FuzzNegotiator, generateFuzzNegotiatorSeeds())
+}
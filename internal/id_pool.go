@@ -16,6 +16,8 @@ type IdPool struct {
 	salt          uint32
 	highestUsedId uint32
 	freedIds      []uint32
+	isFreed       map[uint32]bool
+	reservedIds   []uint32
 }
 
 func randomUint32() uint32 {
@@ -47,6 +49,14 @@ func (this *IdPool) Init(idBits int) {
 	this.idMask = this.maxIds - 1
 	this.highestUsedId = 0
 	this.highestUsedId--
+	this.freedIds = nil
+	this.isFreed = make(map[uint32]bool)
+	this.reservedIds = nil
+}
+
+// Permanently remove an ID from the pool, so that it will never be allocated.
+func (this *IdPool) ReserveId(id int) {
+	this.reservedIds = append(this.reservedIds, uint32(id)&this.idMask)
 }
 
 func (this *IdPool) AllocateId() (id int, ok bool) {
@@ -55,18 +65,48 @@ func (this *IdPool) AllocateId() (id int, ok bool) {
 	if freedIdsCount := len(this.freedIds); freedIdsCount > 0 {
 		newId = this.freedIds[freedIdsCount-1]
 		this.freedIds = this.freedIds[:freedIdsCount-1]
-	} else {
+		delete(this.isFreed, newId)
+		return int((newId + this.salt) & this.idMask), true
+	}
+
+	for {
 		newId = this.highestUsedId + 1
 		if newId >= this.maxIds {
 			return 0, false
 		}
 		this.highestUsedId = newId
+		// Reserved IDs are skipped, and never end up in freedIds.
+		if id := (newId + this.salt) & this.idMask; !this.isReserved(id) {
+			return int(id), true
+		}
 	}
+}
 
-	return int((newId + this.salt) & this.idMask), true
+func (this *IdPool) isReserved(id uint32) bool {
+	for _, reservedId := range this.reservedIds {
+		if reservedId == id {
+			return true
+		}
+	}
+	return false
 }
 
-// This method is not idempotent. Calling it with a not allocated ID will break things.
+// Return an allocated ID to the pool. IDs that aren't currently allocated
+// (including ones that were already deallocated) are ignored.
 func (this *IdPool) DeallocateId(id int) {
-	this.freedIds = append(this.freedIds, (uint32(id)-this.salt)&this.idMask)
+	index := (uint32(id) - this.salt) & this.idMask
+	if !this.isAllocated(index) {
+		return
+	}
+	this.freedIds = append(this.freedIds, index)
+	this.isFreed[index] = true
+}
+
+// index is an ID before the salt is applied.
+func (this *IdPool) isAllocated(index uint32) bool {
+	// highestUsedId wraps around to the maximum value when nothing's been used.
+	if this.highestUsedId == ^uint32(0) || index > this.highestUsedId {
+		return false
+	}
+	return !this.isFreed[index] && !this.isReserved((index+this.salt)&this.idMask)
 }
@@ -87,3 +87,46 @@ func TestIdPool2BitReplace(t *testing.T) {
 	assertAllocateSucceeds(t, pool)
 	assertAllocateFails(t, pool)
 }
+
+func TestIdPoolReservedIdNotAllocated(t *testing.T) {
+	pool := NewIdPool(2)
+	reservedId := ControlMessageId(2)
+	pool.ReserveId(reservedId)
+
+	for i := 0; i < 3; i++ {
+		if id := assertAllocateSucceeds(t, pool); id == reservedId {
+			t.Errorf("Reserved ID %v was allocated", reservedId)
+			return
+		}
+	}
+	assertAllocateFails(t, pool)
+}
+
+func TestIdPoolDeallocateTwice(t *testing.T) {
+	pool := NewIdPool(1)
+
+	id := assertAllocateSucceeds(t, pool)
+	pool.DeallocateId(id)
+	pool.DeallocateId(id)
+	assertAllocateSucceeds(t, pool)
+	assertAllocateSucceeds(t, pool)
+	assertAllocateFails(t, pool)
+}
+
+func TestIdPoolDeallocateUnallocated(t *testing.T) {
+	pool := NewIdPool(2)
+	reservedId := ControlMessageId(2)
+	pool.ReserveId(reservedId)
+
+	for id := 0; id < 4; id++ {
+		pool.DeallocateId(id)
+	}
+	for i := 0; i < 3; i++ {
+		if id := assertAllocateSucceeds(t, pool); id == reservedId {
+			t.Errorf("Reserved ID %v was allocated", reservedId)
+			return
+		}
+	}
+	pool.DeallocateId(reservedId)
+	assertAllocateFails(t, pool)
+}
@@ -56,7 +56,6 @@ func (this *MessageDecoder) Feed(incomingStreamData []byte) (remainingData []byt
 		this.remainingByteCount -= len(decodedData)
 		// fmt.Printf("#### MD %p: Message data. Length %v\n", this, len(decodedData))
 		if err := this.notifyMessageData(decodedData); err != nil {
-			fmt.Printf("ERROR %v\n", err)
 			return remainingData, err
 		}
 	}
@@ -75,12 +74,15 @@ func (this *MessageDecoder) isMessageChunkComplete() bool {
 }
 
 func (this *MessageDecoder) notifyMessageData(chunk []byte) error {
+	// A chunk split across calls to Feed() is delivered in pieces, and only
+	// the last piece can end the message.
+	isEnd := this.header.IsEndOfMessage && this.isMessageChunkComplete()
 	if this.header.IsResponse {
-		if err := this.receiver.OnResponseChunkReceived(this.header.Id, this.header.IsEndOfMessage, chunk); err != nil {
+		if err := this.receiver.OnResponseChunkReceived(this.header.Id, isEnd, chunk); err != nil {
 			return err
 		}
 	} else {
-		if err := this.receiver.OnRequestChunkReceived(this.header.Id, this.header.IsEndOfMessage, chunk); err != nil {
+		if err := this.receiver.OnRequestChunkReceived(this.header.Id, isEnd, chunk); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"testing"
+)
+
+type decoderTestChunk struct {
+	id         int
+	isResponse bool
+	isEnd      bool
+	data       []byte
+}
+
+type decoderTestReceiver struct {
+	chunks []decoderTestChunk
+}
+
+func (this *decoderTestReceiver) OnRequestChunkReceived(messageId int, isEnd bool, data []byte) error {
+	this.chunks = append(this.chunks, decoderTestChunk{messageId, false, isEnd, append([]byte(nil), data...)})
+	return nil
+}
+
+func (this *decoderTestReceiver) OnResponseChunkReceived(messageId int, isEnd bool, data []byte) error {
+	this.chunks = append(this.chunks, decoderTestChunk{messageId, true, isEnd, append([]byte(nil), data...)})
+	return nil
+}
+
+func (this *decoderTestReceiver) OnZeroLengthMessageReceived(messageId int, messageType MessageType) error {
+	return nil
+}
+
+func encodeTestChunk(idBits, lengthBits int, id int, isResponse bool, isEnd bool, data []byte) []byte {
+	header := NewMessageHeader(idBits, lengthBits)
+	header.SetAll(id, len(data), isResponse, isEnd)
+	return append(append([]byte(nil), header.Encoded.Data...), data...)
+}
+
+// =============================================================================
+
+func TestMessageDecoderSplitChunk(t *testing.T) {
+	idBits := 8
+	lengthBits := 10
+	receiver := new(decoderTestReceiver)
+	decoder := NewMessageDecoder(idBits, lengthBits, receiver)
+	isResponse := true
+	isEnd := true
+	encoded := encodeTestChunk(idBits, lengthBits, 5, isResponse, isEnd, []byte{1, 2, 3, 4, 5, 6})
+
+	for _, piece := range [][]byte{encoded[:1], encoded[1:4], encoded[4:6], encoded[6:]} {
+		if remainingData, err := decoder.Feed(piece); err != nil || len(remainingData) != 0 {
+			t.Errorf("Feed returned %v remaining bytes, error %v", len(remainingData), err)
+			return
+		}
+	}
+
+	var data []byte
+	for i, chunk := range receiver.chunks {
+		isLast := i == len(receiver.chunks)-1
+		if chunk.id != 5 || !chunk.isResponse || chunk.isEnd != isLast {
+			t.Errorf("Piece %v of %v: expected id 5, response, end %v, but got %+v", i+1, len(receiver.chunks), isLast, chunk)
+			return
+		}
+		data = append(data, chunk.data...)
+	}
+	if string(data) != string([]byte{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("Expected data [1 2 3 4 5 6] but got %v", data)
+	}
+}
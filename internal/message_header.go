@@ -116,7 +116,10 @@ func (this *MessageHeader) Feed(incomingStreamData []byte) (remainingData []byte
 			headerFields |= uint32(this.Encoded.Data[i])
 		}
 		if headerFields&this.maskUnused != 0 {
-			return remainingData, fmt.Errorf("Unused header bits were nonzero (0x%x)", headerFields&this.maskUnused)
+			return remainingData, &ProtocolViolationError{
+				MessageId: NoMessageId,
+				Reason:    fmt.Sprintf("Unused header bits were nonzero (0x%x)", headerFields&this.maskUnused),
+			}
 		}
 		this.IsEndOfMessage = (headerFields & 1) == 1
 		this.IsResponse = ((headerFields >> shiftResponseBit) & 1) == 1
@@ -131,6 +134,12 @@ func (this *MessageHeader) Feed(incomingStreamData []byte) (remainingData []byte
 	return remainingData, err
 }
 
+// Reports whether an encoded message chunk (header included) belongs to a
+// response message.
+func IsResponseChunk(encodedChunk []byte) bool {
+	return len(encodedChunk) > 0 && (encodedChunk[0]>>shiftResponseBit)&1 == 1
+}
+
 // Internal
 
 func boolToUint32(value bool) uint32 {
@@ -10,6 +10,10 @@ func assertHeaderEncoded(t *testing.T, idBits int, lengthBits int, id int, lengt
 	header := NewMessageHeader(idBits, lengthBits)
 	header.SetAll(id, length, isResponse, isEnd)
 	test.AssertSlicesAreEquivalent(t, header.Encoded.Data, expected)
+	if IsResponseChunk(expected) != isResponse {
+		t.Errorf("[%v %v %v %v %v %v] Expected IsResponseChunk to be %v",
+			idBits, lengthBits, id, length, isResponse, isEnd, isResponse)
+	}
 
 	header = NewMessageHeader(idBits, lengthBits)
 	remainingBytes, err := header.Feed(expected)
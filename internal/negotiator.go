@@ -19,6 +19,10 @@ type ProtocolNegotiator struct {
 	protocolVersion int
 	LengthBits      int
 	IdBits          int
+	// Extensions active on both sides. Only valid once fully negotiated.
+	Extensions int
+
+	localExtensions int
 
 	requestQuickInit int
 	allowQuickInit   int
@@ -28,6 +32,7 @@ type ProtocolNegotiator struct {
 	lengthMaxBits    int
 	messageBuffer    buffer.FeedableBuffer
 	state            negotiatorState
+	failure          *NegotiationError
 }
 
 const (
@@ -47,11 +52,87 @@ const (
 )
 
 const initializeMessageLength = 5
+
+// The length of the initialize message that begins each direction of a
+// connection.
+const InitializeMessageLength = initializeMessageLength
 const recommendedWildcard = 31
 const maxTotalBits = 30
 
+// RecommendedWildcard can be used as a recommended bit count, leaving the choice
+// to the negotiation.
+const RecommendedWildcard = recommendedWildcard
+
+// The fields of an initialize message (see DecodeInitializeMessage()).
+type InitializeMessage struct {
+	Version          int
+	Extensions       int
+	RequestQuickInit bool
+	AllowQuickInit   bool
+	IdBits           BitRange
+	LengthBits       BitRange
+}
+
 // API
 
+// Decode an initialize message. Only the layout is checked, not whether the
+// fields are valid (see ValidateParameters()).
+func DecodeInitializeMessage(data []byte) (message InitializeMessage, ok bool) {
+	if len(data) < initializeMessageLength {
+		return message, false
+	}
+	fields :=
+		uint(data[1])<<24 |
+			uint(data[2])<<16 |
+			uint(data[3])<<8 |
+			uint(data[4])
+
+	message.Version = int(data[0])
+	message.Extensions = int((fields >> shiftExtensions) & maskExtensions)
+	message.RequestQuickInit = (fields>>shiftQuickInitRequest)&1 == 1
+	message.AllowQuickInit = (fields>>shiftQuickInitAllowed)&1 == 1
+	message.IdBits.Min = int((fields >> shiftIdBitsMin) & maskMin)
+	message.IdBits.Max = int((fields >> shiftIdBitsMax) & maskMax)
+	message.IdBits.Recommended = int((fields >> shiftIdBitsRecommended) & maskRecommended)
+	message.LengthBits.Min = int((fields >> shiftLengthBitsMin) & maskMin)
+	message.LengthBits.Max = int((fields >> shiftLengthBitsMax) & maskMax)
+	message.LengthBits.Recommended = int(fields & maskRecommended)
+	return message, true
+}
+
+// Encode an initialize message. The fields are encoded as-is, without being
+// validated, so this can also build messages that a peer should reject.
+func EncodeInitializeMessage(message InitializeMessage) []byte {
+	fields := uint(message.Extensions&maskExtensions)<<shiftExtensions |
+		uint(boolToInt(message.RequestQuickInit))<<shiftQuickInitRequest |
+		uint(boolToInt(message.AllowQuickInit))<<shiftQuickInitAllowed |
+		uint(message.IdBits.Min&maskMin)<<shiftIdBitsMin |
+		uint(message.IdBits.Max&maskMax)<<shiftIdBitsMax |
+		uint(message.IdBits.Recommended&maskRecommended)<<shiftIdBitsRecommended |
+		uint(message.LengthBits.Min&maskMin)<<shiftLengthBitsMin |
+		uint(message.LengthBits.Max&maskMax)<<shiftLengthBitsMax |
+		uint(message.LengthBits.Recommended&maskRecommended)
+
+	return []byte{
+		byte(message.Version),
+		byte(fields >> 24),
+		byte(fields >> 16),
+		byte(fields >> 8),
+		byte(fields),
+	}
+}
+
+// Validate negotiation parameters, returning an error describing the first
+// problem found. ProtocolNegotiator.Init() panics on parameters that fail this.
+func ValidateParameters(idMinBits int, idMaxBits int, idRecommendBits int,
+	lengthMinBits int, lengthMaxBits int, lengthRecommendBits int,
+	requestQuickInit bool, allowQuickInit bool) error {
+
+	return validateInitializeFields(idMinBits, idMaxBits, idRecommendBits,
+		lengthMinBits, lengthMaxBits, lengthRecommendBits,
+		boolToInt(requestQuickInit), boolToInt(allowQuickInit))
+}
+
 func NewNegotiator(protocolVersion int,
 	idMinBits int, idMaxBits int, idRecommendBits int,
 	lengthMinBits int, lengthMaxBits int, lengthRecommendBits int,
@@ -77,14 +158,8 @@ func (this *ProtocolNegotiator) Init(protocolVersion int,
 	this.lengthMinBits = lengthMinBits
 	this.lengthMaxBits = lengthMaxBits
 	this.LengthBits = lengthRecommendBits
-	this.requestQuickInit = 0
-	if requestQuickInit {
-		this.requestQuickInit = 1
-	}
-	this.allowQuickInit = 0
-	if allowQuickInit {
-		this.allowQuickInit = 1
-	}
+	this.requestQuickInit = boolToInt(requestQuickInit)
+	this.allowQuickInit = boolToInt(allowQuickInit)
 
 	// fmt.Printf("### N %p: Init I (min %v, max %v, rec %v), L (min %v, max %v, rec %v), RQ %v, AQ %v\n", this,
 	// 	this.idMinBits, this.idMaxBits, this.IdBits, this.lengthMinBits, this.lengthMaxBits, this.LengthBits, this.requestQuickInit, this.allowQuickInit)
@@ -106,8 +181,15 @@ func (this *ProtocolNegotiator) Init(protocolVersion int,
 	}
 }
 
+// Set the extensions to advertise to the peer. This must be called before
+// building the initialize message.
+func (this *ProtocolNegotiator) SetExtensions(extensions int) {
+	this.localExtensions = extensions & maskExtensions
+}
+
 func (this *ProtocolNegotiator) BuildInitializeMessage() []byte {
-	requestPieces := this.requestQuickInit<<shiftQuickInitRequest |
+	requestPieces := this.localExtensions<<shiftExtensions |
+		this.requestQuickInit<<shiftQuickInitRequest |
 		this.allowQuickInit<<shiftQuickInitAllowed |
 		this.idMinBits<<shiftIdBitsMin |
 		this.idMaxBits<<shiftIdBitsMax |
@@ -136,7 +218,7 @@ func (this *ProtocolNegotiator) Feed(incomingStreamData []byte) (remainingData [
 
 		if err = this.negotiateInitializeMessage(); err != nil {
 			this.markNegotiationFailure()
-			return remainingData, err
+			return remainingData, this.failure
 		}
 		this.markNegotiationSuccess()
 	}
@@ -156,18 +238,30 @@ func (this *ProtocolNegotiator) IsNegotiationComplete() bool {
 	return this.state == negotiatorStateFullyNegotiated || this.state == negotiatorStateFailed
 }
 
-func (this *ProtocolNegotiator) ExplainFailure() string {
-	if this.state == negotiatorStateFailed {
-		return "Negotiation failed"
-	}
-	if this.state == negotiatorStateNotNegotiated {
-		return "Negotiation not complete"
+// Returns why messages can't be sent or received: ErrNotReady if negotiation
+// hasn't completed, or a *NegotiationError if it failed.
+func (this *ProtocolNegotiator) Failure() error {
+	switch this.state {
+	case negotiatorStateFailed:
+		if this.failure != nil {
+			return this.failure
+		}
+		return ErrNegotiationFailed
+	case negotiatorStateNotNegotiated, negotiatorStateQuickNegotiated:
+		return ErrNotReady
 	}
-	return fmt.Sprintf("Internal bug: ProtocolNegotiator.ExplainFailure: Unhandled state %v", this.state)
+	return fmt.Errorf("Internal bug: ProtocolNegotiator.Failure: Unhandled state %v", this.state)
 }
 
 // Internal
 
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
 func minInt(a, b int) int {
 	if a > b {
 		return b
@@ -201,7 +295,7 @@ func negotiateBitCount(name string, usMin int, usMax int, usRecommended int, the
 	min := maxInt(usMin, themMin)
 	max := minInt(usMax, themMax)
 	if max < min {
-		return -1, fmt.Errorf("Negotiation failed: max %v (%v) is less than min %v (%v)", name, max, name, min)
+		return -1, fmt.Errorf("max %v (%v) is less than min %v (%v)", name, max, name, min)
 	}
 
 	recommended := minInt(usRecommended, themRecommended)
@@ -235,17 +329,17 @@ func capBitCounts(idBits, lengthBits int) (idBitsCapped, lengthBitsCapped int) {
 
 func validateMinMaxLimits(name string, value int, min int, max int) error {
 	if value < min {
-		return fmt.Errorf("Negotiation failed: %v (%v) is less than min %v (%v)", name, value, name, min)
+		return fmt.Errorf("%v (%v) is less than min %v (%v)", name, value, name, min)
 	}
 	if value > max {
-		return fmt.Errorf("Negotiation failed: %v (%v) is greater than max %v (%v)", name, value, name, max)
+		return fmt.Errorf("%v (%v) is greater than max %v (%v)", name, value, name, max)
 	}
 	return nil
 }
 
 func validateMinMaxField(name string, min int, max int) error {
 	if min > max {
-		return fmt.Errorf("Negotiation failed: min %v (%v) is greater than max %v (%v)", name, min, name, max)
+		return fmt.Errorf("min %v (%v) is greater than max %v (%v)", name, min, name, max)
 	}
 	return nil
 }
@@ -256,10 +350,10 @@ func validateMinMaxRecommend(name string, min int, max int, recommend int) error
 	}
 
 	if recommend < min {
-		return fmt.Errorf("Negotiation failed: recommended %v (%v) is less than min %v (%v)", name, recommend, name, min)
+		return fmt.Errorf("recommended %v (%v) is less than min %v (%v)", name, recommend, name, min)
 	}
 	if recommend > max {
-		return fmt.Errorf("Negotiation failed: recommended %v (%v) is greater than max %v (%v)", name, recommend, name, max)
+		return fmt.Errorf("recommended %v (%v) is greater than max %v (%v)", name, recommend, name, max)
 	}
 	return nil
 }
@@ -278,6 +372,10 @@ func validateInitializeFields(idMinBits int, idMaxBits int, idRecommendBits int,
 		if idRecommendBits == recommendedWildcard {
 			return fmt.Errorf("Cannot set recommended ID bits to wildard (%v) when requesting quick init", idRecommendBits)
 		}
+		// The recommended values are used as-is, so they can't be capped.
+		if idRecommendBits+lengthRecommendBits > maxTotalBits {
+			return fmt.Errorf("Recommended ID bits (%v) plus length bits (%v) must not exceed %v when requesting quick init", idRecommendBits, lengthRecommendBits, maxTotalBits)
+		}
 	}
 
 	if err := validateMinMaxLimits("min length", lengthMinBits, 1, 15); err != nil {
@@ -333,29 +431,64 @@ func (this *ProtocolNegotiator) markNegotiationSuccess() {
 	}
 }
 
+func (this *ProtocolNegotiator) newNegotiationError(reason error) *NegotiationError {
+	return &NegotiationError{
+		Reason:          reason.Error(),
+		LocalVersion:    this.protocolVersion,
+		LocalIdBits:     BitRange{this.idMinBits, this.idMaxBits, this.IdBits},
+		LocalLengthBits: BitRange{this.lengthMinBits, this.lengthMaxBits, this.LengthBits},
+	}
+}
+
 func (this *ProtocolNegotiator) negotiateInitializeMessage() error {
-	version := int(this.messageBuffer.Data[0])
+	message, _ := DecodeInitializeMessage(this.messageBuffer.Data)
+	version := message.Version
 	if version != this.protocolVersion {
-		return fmt.Errorf("Negotiation failed: Expected protocol version %v, but got %v", this.protocolVersion, version)
-	}
-	message :=
-		uint(this.messageBuffer.Data[1])<<24 |
-			uint(this.messageBuffer.Data[2])<<16 |
-			uint(this.messageBuffer.Data[3])<<8 |
-			uint(this.messageBuffer.Data[4])
-
-	themRequestQuickInit := int((message >> shiftQuickInitRequest) & 1)
-	themAllowQuickInit := int((message >> shiftQuickInitAllowed) & 1)
-	themIdMinBits := int((message >> shiftIdBitsMin) & maskMin)
-	themIdMaxBits := int((message >> shiftIdBitsMax) & maskMax)
-	themIdBits := int((message >> shiftIdBitsRecommended) & maskRecommended)
-	themLengthMinBits := int((message >> shiftLengthBitsMin) & maskMin)
-	themLengthMaxBits := int((message >> shiftLengthBitsMax) & maskMax)
-	themLengthBits := int(message & maskRecommended)
+		this.failure = this.newNegotiationError(fmt.Errorf("Expected protocol version %v, but got %v", this.protocolVersion, version))
+		this.failure.RemoteVersion = version
+		return this.failure
+	}
+
+	themExtensions := message.Extensions
+	themRequestQuickInit := boolToInt(message.RequestQuickInit)
+	themAllowQuickInit := boolToInt(message.AllowQuickInit)
+	themIdMinBits := message.IdBits.Min
+	themIdMaxBits := message.IdBits.Max
+	themIdBits := message.IdBits.Recommended
+	themLengthMinBits := message.LengthBits.Min
+	themLengthMaxBits := message.LengthBits.Max
+	themLengthBits := message.LengthBits.Recommended
 
 	// fmt.Printf("### N %p: feed I (min %v, max %v, rec %v), L (min %v, max %v, rec %v), RQ %v, AQ %v\n", this,
 	// 	themIdMinBits, themIdMaxBits, themIdBits, themLengthMinBits, themLengthMaxBits, themLengthBits, themRequestQuickInit, themAllowQuickInit)
 
+	if err := this.negotiateWithPeer(themIdMinBits, themIdMaxBits, themIdBits,
+		themLengthMinBits, themLengthMaxBits, themLengthBits,
+		themRequestQuickInit, themAllowQuickInit); err != nil {
+
+		this.failure = this.newNegotiationError(err)
+		this.failure.HasRemote = true
+		this.failure.RemoteVersion = version
+		this.failure.RemoteIdBits = BitRange{themIdMinBits, themIdMaxBits, themIdBits}
+		this.failure.RemoteLengthBits = BitRange{themLengthMinBits, themLengthMaxBits, themLengthBits}
+		return this.failure
+	}
+
+	this.Extensions = this.localExtensions & themExtensions
+	if this.IdBits < MinExtensionIdBits {
+		this.Extensions = 0
+	}
+	if this.Extensions&ExtensionControl == 0 {
+		// All other extensions communicate via control messages.
+		this.Extensions = 0
+	}
+	return nil
+}
+
+func (this *ProtocolNegotiator) negotiateWithPeer(themIdMinBits int, themIdMaxBits int, themIdBits int,
+	themLengthMinBits int, themLengthMaxBits int, themLengthBits int,
+	themRequestQuickInit int, themAllowQuickInit int) error {
+
 	if err := validateInitializeFields(themIdMinBits, themIdMaxBits, themIdBits,
 		themLengthMinBits, themLengthMaxBits, themLengthBits,
 		themRequestQuickInit, themAllowQuickInit); err != nil {
@@ -367,11 +367,17 @@ func TestNegotiationQuickInitNotAccepting(t *testing.T) {
 func TestNegotiationQuickInitParamsOutOfRange(t *testing.T) {
 	assertNegotiation(t, 6, 19, 15, 6, 20, 10, true, false, 1, 7, 18, 10, 8, 15, 14, false, true, 15, 10)
 	assertNegotiationFail(t, 6, 19, 15, 6, 20, 6, true, false, 1, 7, 18, 10, 8, 15, 14, false, true)
-	assertNegotiationFail(t, 6, 19, 15, 6, 20, 17, true, false, 1, 7, 18, 10, 8, 15, 14, false, true)
+	assertNegotiationFail(t, 6, 19, 10, 6, 20, 17, true, false, 1, 7, 18, 10, 8, 15, 14, false, true)
 	assertNegotiationFail(t, 6, 19, 6, 6, 20, 15, true, false, 1, 7, 18, 10, 8, 15, 14, false, true)
 	assertNegotiationFail(t, 6, 19, 19, 6, 20, 10, true, false, 1, 7, 18, 10, 8, 15, 14, false, true)
 }
 
+func TestNegotiationQuickInitTooManyBits(t *testing.T) {
+	assertNegotiationInitFail(t, 0, 29, 3, 1, 30, 28, true, false)
+	assertNegotiationFail(t, 0, 29, 10, 1, 30, 12, false, true, 1, 0, 29, 3, 1, 30, 28, true, false)
+	assertNegotiation(t, 0, 29, 10, 1, 30, 12, false, true, 1, 0, 29, 3, 1, 30, 27, true, false, 3, 27)
+}
+
 // Spec Examples
 
 func TestNegotiationSpecCompatible(t *testing.T) {
@@ -401,3 +407,59 @@ func TestNegotiationSpecQuickInitOutOfRange(t *testing.T) {
 func TestNegotiationSpecQuickInitAllowedButNotRequested(t *testing.T) {
 	assertNegotiation(t, 8, 15, 8, 10, 18, 14, false, false, 1, 6, 18, 10, 8, 15, 10, false, true, 8, 10)
 }
+
+func negotiateExtensions(usExtensions, themExtensions int, idBits int) int {
+	us := NewNegotiator(1, 0, 29, idBits, 1, 30, 10, false, false)
+	us.SetExtensions(usExtensions)
+	them := NewNegotiator(1, 0, 29, idBits, 1, 30, 10, false, false)
+	them.SetExtensions(themExtensions)
+	us.Feed(them.BuildInitializeMessage())
+	return us.Extensions
+}
+
+func TestNegotiationExtensions(t *testing.T) {
+	if extensions := negotiateExtensions(ExtensionControl, ExtensionControl, 8); extensions != ExtensionControl {
+		t.Errorf("Expected extensions %v but got %v", ExtensionControl, extensions)
+	}
+	if extensions := negotiateExtensions(ExtensionControl, 0, 8); extensions != 0 {
+		t.Errorf("Extension should not be active unless both peers advertise it, but got %v", extensions)
+	}
+	if extensions := negotiateExtensions(0, ExtensionControl, 8); extensions != 0 {
+		t.Errorf("Extension should not be active unless both peers advertise it, but got %v", extensions)
+	}
+	if extensions := negotiateExtensions(ExtensionControl, ExtensionControl, MinExtensionIdBits-1); extensions != 0 {
+		t.Errorf("Extension should not be active with too few ID bits, but got %v", extensions)
+	}
+}
+
+func TestNegotiationFlowControlExtension(t *testing.T) {
+	both := ExtensionControl | ExtensionFlowControl
+	if extensions := negotiateExtensions(both, both, 8); extensions != both {
+		t.Errorf("Expected extensions %v but got %v", both, extensions)
+	}
+	if extensions := negotiateExtensions(both, ExtensionControl, 8); extensions != ExtensionControl {
+		t.Errorf("Expected extensions %v but got %v", ExtensionControl, extensions)
+	}
+	if extensions := negotiateExtensions(ExtensionFlowControl, ExtensionFlowControl, 8); extensions != 0 {
+		t.Errorf("Flow control should not be active without the control extension, but got %v", extensions)
+	}
+}
+
+func TestEncodeInitializeMessage(t *testing.T) {
+	message := InitializeMessage{
+		Version:          1,
+		Extensions:       ExtensionControl,
+		RequestQuickInit: true,
+		IdBits:           BitRange{3, 20, 9},
+		LengthBits:       BitRange{4, 25, 11},
+	}
+	encoded := EncodeInitializeMessage(message)
+	expected := buildInitMsg(1, 3, 20, 9, 4, 25, 11, true, false)
+	expected[1] |= byte(ExtensionControl << (shiftExtensions - 24))
+	test.AssertSlicesAreEquivalent(t, encoded, expected)
+
+	decoded, ok := DecodeInitializeMessage(encoded)
+	if !ok || decoded != message {
+		t.Errorf("Expected %+v to decode back, but got %+v", message, decoded)
+	}
+}
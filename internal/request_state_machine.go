@@ -8,7 +8,18 @@ import (
 type RequestStateMachine struct {
 	idPool   *IdPool
 	requests map[int]requestState
-	mutex    sync.Mutex
+	// Distinguishes successive requests that were allocated the same ID.
+	serials    map[int]uint64
+	nextSerial uint64
+	// Request chunks currently being passed to the sender, per ID. A cancel
+	// waits for these so that it can't be sent ahead of them.
+	sendsInProgress map[int]int
+	sendsDone       *sync.Cond
+	// Duplex requests may receive response chunks before the request has been
+	// completely sent, and are only finished once both directions have ended.
+	duplexIds     map[int]bool
+	responseEnded map[int]bool
+	mutex         sync.Mutex
 }
 
 // API
@@ -22,6 +33,20 @@ func NewRequestStateMachine(idPool *IdPool) *RequestStateMachine {
 func (this *RequestStateMachine) Init(IdPool *IdPool) {
 	this.idPool = IdPool
 	this.requests = make(map[int]requestState)
+	this.serials = make(map[int]uint64)
+	this.nextSerial = 0
+	this.sendsInProgress = make(map[int]int)
+	this.sendsDone = sync.NewCond(&this.mutex)
+	this.duplexIds = make(map[int]bool)
+	this.responseEnded = make(map[int]bool)
+}
+
+// Get the number of IDs currently in use (requests that haven't completed yet,
+// and pings that are being sent).
+func (this *RequestStateMachine) ActiveRequestCount() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return len(this.requests)
 }
 
 func (this *RequestStateMachine) TryPing(f func(id int)) error {
@@ -33,13 +58,13 @@ func (this *RequestStateMachine) TryPing(f func(id int)) error {
 	this.mutex.Unlock()
 
 	if !ok {
-		return fmt.Errorf("Could not allocate a new message ID. Please initialize with more ID bits")
+		return ErrIdPoolExhausted
 	}
 
 	f(id)
 
 	this.mutex.Lock()
-	this.idPool.DeallocateId(id)
+	this.removeId(id)
 	this.mutex.Unlock()
 
 	return nil
@@ -50,17 +75,76 @@ func (this *RequestStateMachine) TryBeginRequest(f func(id int)) error {
 	id, ok := this.idPool.AllocateId()
 	if ok {
 		this.requests[id] = requestStateAllocated
+		this.nextSerial++
+		this.serials[id] = this.nextSerial
 	}
 	this.mutex.Unlock()
 
 	if !ok {
-		return fmt.Errorf("Could not allocate a new message ID. Please initialize with more ID bits")
+		return ErrIdPoolExhausted
 	}
 
 	f(id)
 	return nil
 }
 
+// Allow a newly begun request to receive its response while it's still being
+// sent. Must be called before the first request chunk is sent.
+func (this *RequestStateMachine) SetDuplex(id int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.getRequestState(id) == requestStateAllocated {
+		this.duplexIds[id] = true
+	}
+}
+
+// Returns true if at least one chunk of the response to this request has been
+// received.
+func (this *RequestStateMachine) IsReceivingResponse(id int) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.getRequestState(id) == requestStateReceivingResponse
+}
+
+// Get the serial number of the request currently using an ID, for use with
+// TryExpireRequest(). Returns 0 if the ID isn't in use by a request.
+func (this *RequestStateMachine) GetRequestSerial(id int) uint64 {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.serials[id]
+}
+
+// Expire a request whose deadline has passed, but only if the ID is still in
+// use by the same request (serial). A request that has begun sending is
+// canceled, and f is called to send the cancel. A request that hasn't sent
+// anything yet fails (and its ID is released) when it next tries to send.
+// Returns false if there was nothing to expire.
+func (this *RequestStateMachine) TryExpireRequest(id int, serial uint64, f func(id int)) (isExpired bool) {
+	this.mutex.Lock()
+	if this.serials[id] != serial {
+		this.mutex.Unlock()
+		return false
+	}
+	state := this.getRequestState(id)
+	switch state {
+	case requestStateAllocated:
+		this.requests[id] = requestStateExpired
+	case requestStateSending, requestStateAwaitingResponse, requestStateReceivingResponse:
+		this.requests[id] = requestStateAwaitingCancelAck
+		this.waitForSendsToFinish(id)
+	}
+	this.mutex.Unlock()
+
+	switch state {
+	case requestStateAllocated:
+		return true
+	case requestStateSending, requestStateAwaitingResponse, requestStateReceivingResponse:
+		f(id)
+		return true
+	}
+	return false
+}
+
 func (this *RequestStateMachine) TrySendRequestChunk(id int, isTerminated bool, f func(id int, isTerminated bool)) error {
 	this.mutex.Lock()
 	state := this.getRequestState(id)
@@ -70,6 +154,7 @@ func (this *RequestStateMachine) TrySendRequestChunk(id int, isTerminated bool,
 		} else {
 			this.requests[id] = requestStateSending
 		}
+		this.sendsInProgress[id]++
 	}
 	this.mutex.Unlock()
 
@@ -78,13 +163,31 @@ func (this *RequestStateMachine) TrySendRequestChunk(id int, isTerminated bool,
 	default:
 		return fmt.Errorf("Request %v is in an unhandled state (%v)", id, state)
 	case requestStateDeallocated:
-		return fmt.Errorf("Cannot send request chunk: ID %v is not allocated", id)
+		return newRequestStateError(id, state, "Cannot send request chunk: ID is not allocated")
 	case requestStateAwaitingResponse, requestStateReceivingResponse:
-		return fmt.Errorf("Cannot send request chunk: Request %v has already been terminated", id)
+		return newRequestStateError(id, state, "Cannot send request chunk: Request has already been terminated")
 	case requestStateAwaitingCancelAck:
-		return fmt.Errorf("Cannot send request chunk: Request %v has been canceled", id)
+		return newRequestStateError(id, state, "Cannot send request chunk: Request has been canceled")
+	case requestStateExpired:
+		this.mutex.Lock()
+		this.removeId(id)
+		this.mutex.Unlock()
+		return ErrDeadlineExceeded
+	case requestStateCanceled:
+		// The ID is released by TryReceiveCancelAck().
+		return ErrCanceled
 	case requestStateAllocated, requestStateSending:
 		f(id, isTerminated)
+		this.mutex.Lock()
+		if this.sendsInProgress[id]--; this.sendsInProgress[id] == 0 {
+			delete(this.sendsInProgress, id)
+			this.sendsDone.Broadcast()
+		}
+		if isTerminated && this.responseEnded[id] && this.getRequestState(id) == requestStateAwaitingResponse {
+			// Duplex, and the response already ended.
+			this.removeId(id)
+		}
+		this.mutex.Unlock()
 	}
 	return nil
 }
@@ -97,6 +200,10 @@ func (this *RequestStateMachine) TryCancelRequest(id int, f func(id int)) error
 		state == requestStateReceivingResponse {
 
 		this.requests[id] = requestStateAwaitingCancelAck
+		this.waitForSendsToFinish(id)
+	}
+	if state == requestStateAllocated {
+		this.requests[id] = requestStateCanceled
 	}
 	this.mutex.Unlock()
 
@@ -107,61 +214,80 @@ func (this *RequestStateMachine) TryCancelRequest(id int, f func(id int)) error
 	case requestStateDeallocated:
 		// Ignore. There may be a race condition where the request was deallocated.
 	case requestStateAllocated:
-		// Message hasn't been sent yet, so nothing to do.
-	case requestStateAwaitingCancelAck:
-		// We've already requested a cancel, so nothing to do.
+		// Message hasn't been sent yet, so there's nothing for the peer to
+		// cancel. The request fails when it next tries to send.
+	case requestStateAwaitingCancelAck, requestStateExpired, requestStateCanceled:
+		// We've already requested a cancel (or will never send), so nothing to do.
 	case requestStateSending, requestStateAwaitingResponse, requestStateReceivingResponse:
 		f(id)
 	}
 	return nil
 }
 
+// The callback is called before the ID of a terminated response is released,
+// so the ID won't be reallocated until the callback has returned.
 func (this *RequestStateMachine) TryReceiveResponseChunk(id int, isTerminated bool, f func(id int, isTerminated bool)) error {
 	this.mutex.Lock()
 	state := this.getRequestState(id)
 	if state == requestStateAwaitingResponse {
 		this.requests[id] = requestStateReceivingResponse
 	}
-	if (state == requestStateAwaitingResponse || state == requestStateReceivingResponse) && isTerminated {
-		this.removeId(id)
-	}
+	isDuplex := this.duplexIds[id]
 	this.mutex.Unlock()
 
+	if isDuplex && (state == requestStateAllocated || state == requestStateSending) {
+		return this.receiveDuplexResponseChunk(id, isTerminated, f)
+	}
+
 	// fmt.Printf("### RSM %p: Receive chunk id %v, term %v, state %v -> %v\n", this, id, isTerminated, state, this.requests[id])
 	switch state {
 	default:
 		return fmt.Errorf("Request %v is in an unhandled state (%v)", id, state)
 	case requestStateDeallocated:
-		return fmt.Errorf("Cannot receive response %v: No such message", id)
-	case requestStateAllocated:
-		return fmt.Errorf("Cannot receive response %v: Message has not been sent yet", id)
+		return newProtocolViolationError(id, state, "Cannot receive response: No such message")
+	case requestStateAllocated, requestStateExpired, requestStateCanceled:
+		return newProtocolViolationError(id, state, "Cannot receive response: Message has not been sent yet")
 	case requestStateSending:
-		return fmt.Errorf("Cannot receive response %v: Message has not been completely sent", id)
+		return newProtocolViolationError(id, state, "Cannot receive response: Message has not been completely sent")
 	case requestStateAwaitingCancelAck:
 		// Ignore
 		// fmt.Printf("########## Awaiting cancel ack\n")
 	case requestStateAwaitingResponse, requestStateReceivingResponse:
 		f(id, isTerminated)
+		if isTerminated {
+			this.mutex.Lock()
+			// If the request was canceled in the meantime, the cancel ack will
+			// release the ID instead.
+			if this.getRequestState(id) == requestStateReceivingResponse {
+				this.removeId(id)
+			}
+			this.mutex.Unlock()
+		}
 	}
 	return nil
 }
 
+// The callback is called before the ID is released, so the ID won't be
+// reallocated until the callback has returned. A request that was canceled
+// before sending anything fails with ErrCanceled when it next tries to send,
+// and since the peer never saw it, the cancel must then be acknowledged
+// locally by calling this.
 func (this *RequestStateMachine) TryReceiveCancelAck(id int, f func(id int)) error {
 	this.mutex.Lock()
 	state := this.getRequestState(id)
-	if state == requestStateAwaitingCancelAck {
-		this.removeId(id)
-	}
 	this.mutex.Unlock()
 
 	switch state {
 	default:
 		return fmt.Errorf("Request %v is in an unhandled state (%v)", id, state)
 	case requestStateDeallocated, requestStateAllocated, requestStateSending,
-		requestStateAwaitingResponse, requestStateReceivingResponse:
+		requestStateAwaitingResponse, requestStateReceivingResponse, requestStateExpired:
 		// Shouldn't happen, but no harm done.
-	case requestStateAwaitingCancelAck:
+	case requestStateAwaitingCancelAck, requestStateCanceled:
 		f(id)
+		this.mutex.Lock()
+		this.removeId(id)
+		this.mutex.Unlock()
 	}
 	return nil
 }
@@ -177,8 +303,36 @@ const (
 	requestStateAwaitingResponse
 	requestStateReceivingResponse
 	requestStateAwaitingCancelAck
+	requestStateExpired
+	requestStateCanceled
 )
 
+var requestStateNames = []string{
+	requestStateDeallocated:       "deallocated",
+	requestStateAllocated:         "allocated",
+	requestStateSending:           "sending",
+	requestStateAwaitingResponse:  "awaiting response",
+	requestStateReceivingResponse: "receiving response",
+	requestStateAwaitingCancelAck: "awaiting cancel ack",
+	requestStateExpired:           "expired",
+	requestStateCanceled:          "canceled",
+}
+
+func (this requestState) String() string {
+	if this >= 0 && int(this) < len(requestStateNames) {
+		return requestStateNames[this]
+	}
+	return fmt.Sprintf("unknown state %d", int(this))
+}
+
+func newRequestStateError(id int, state requestState, reason string) error {
+	return &RequestStateError{MessageId: id, State: state.String(), Reason: reason}
+}
+
+func newProtocolViolationError(id int, state requestState, reason string) error {
+	return &ProtocolViolationError{MessageId: id, State: state.String(), Reason: reason}
+}
+
 func (this *RequestStateMachine) getRequestState(id int) requestState {
 	if state, ok := this.requests[id]; ok {
 		return state
@@ -186,7 +340,38 @@ func (this *RequestStateMachine) getRequestState(id int) requestState {
 	return requestStateDeallocated
 }
 
+// Must be called while holding the mutex. New sends must already be blocked by
+// the request's state.
+func (this *RequestStateMachine) waitForSendsToFinish(id int) {
+	for this.sendsInProgress[id] > 0 {
+		this.sendsDone.Wait()
+	}
+}
+
+// A response chunk arriving before the duplex request has been completely sent.
+func (this *RequestStateMachine) receiveDuplexResponseChunk(id int, isTerminated bool, f func(id int, isTerminated bool)) error {
+	f(id, isTerminated)
+	if !isTerminated {
+		return nil
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	// The request may be ending on another goroutine right now.
+	this.waitForSendsToFinish(id)
+	switch this.getRequestState(id) {
+	case requestStateAllocated, requestStateSending:
+		this.responseEnded[id] = true
+	case requestStateAwaitingResponse, requestStateReceivingResponse:
+		this.removeId(id)
+	}
+	return nil
+}
+
 func (this *RequestStateMachine) removeId(id int) {
 	delete(this.requests, id)
+	delete(this.serials, id)
+	delete(this.duplexIds, id)
+	delete(this.responseEnded, id)
 	this.idPool.DeallocateId(id)
 }
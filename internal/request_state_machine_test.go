@@ -3,6 +3,7 @@ package internal
 import (
 	// "fmt"
 	"testing"
+	"time"
 )
 
 func assertBeginRequestDoesCall(t *testing.T, rules *RequestStateMachine) (messageId int) {
@@ -220,6 +221,20 @@ func TestCancelBeforeSendIgnored(t *testing.T) {
 	assertCancelDoesNotCall(t, rules, id)
 }
 
+func TestCancelBeforeSendFailsOnSend(t *testing.T) {
+	rules := NewRequestStateMachine(NewIdPool(20))
+	id := assertBeginRequestDoesCall(t, rules)
+	assertCancelDoesNotCall(t, rules, id)
+	if err := rules.TrySendRequestChunk(id, true, func(id int, isTerminated bool) {}); err != ErrCanceled {
+		t.Errorf("Expected %v but got %v", ErrCanceled, err)
+		return
+	}
+	assertReceiveCancelAckDoesCall(t, rules, id)
+	if count := rules.ActiveRequestCount(); count != 0 {
+		t.Errorf("Expected no active requests but got %v", count)
+	}
+}
+
 func TestCancelBeforeRequestFinish(t *testing.T) {
 	rules := NewRequestStateMachine(NewIdPool(20))
 	id := assertBeginRequestDoesCall(t, rules)
@@ -304,3 +319,117 @@ func TestReceiveNonexistentMessageFails(t *testing.T) {
 	id := 1
 	assertReceiveResponseChunkFails(t, rules, id, true)
 }
+
+func TestIdNotReusedDuringResponseCallback(t *testing.T) {
+	rules := NewRequestStateMachine(NewIdPool(0))
+	id := assertBeginRequestDoesCall(t, rules)
+	assertSendRequestChunkDoesCall(t, rules, id, true)
+	err := rules.TryReceiveResponseChunk(id, true, func(id int, terminated bool) {
+		if err := rules.TryBeginRequest(func(id int) {}); err == nil {
+			t.Errorf("ID was released before the response callback returned")
+		}
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	assertBeginRequestDoesCall(t, rules)
+}
+
+func TestCancelDuringResponseCallbackKeepsId(t *testing.T) {
+	rules := NewRequestStateMachine(NewIdPool(0))
+	id := assertBeginRequestDoesCall(t, rules)
+	assertSendRequestChunkDoesCall(t, rules, id, true)
+	err := rules.TryReceiveResponseChunk(id, true, func(id int, terminated bool) {
+		assertCancelDoesCall(t, rules, id)
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	assertReceiveCancelAckDoesCall(t, rules, id)
+	assertBeginRequestDoesCall(t, rules)
+}
+
+func TestExpireSentRequestCancels(t *testing.T) {
+	rules := NewRequestStateMachine(NewIdPool(20))
+	id := assertBeginRequestDoesCall(t, rules)
+	serial := rules.GetRequestSerial(id)
+	assertSendRequestChunkDoesCall(t, rules, id, true)
+
+	didCall := false
+	if !rules.TryExpireRequest(id, serial, func(id int) { didCall = true }) || !didCall {
+		t.Errorf("Expiring request %v should have sent a cancel", id)
+		return
+	}
+	assertReceiveResponseChunkDoesNotCall(t, rules, id, true)
+	assertReceiveCancelAckDoesCall(t, rules, id)
+	if count := rules.ActiveRequestCount(); count != 0 {
+		t.Errorf("Expected no active requests but got %v", count)
+	}
+}
+
+func TestExpireUnsentRequestReleasesIdOnSend(t *testing.T) {
+	rules := NewRequestStateMachine(NewIdPool(20))
+	id := assertBeginRequestDoesCall(t, rules)
+
+	didCall := false
+	if !rules.TryExpireRequest(id, rules.GetRequestSerial(id), func(id int) { didCall = true }) || didCall {
+		t.Errorf("Expiring unsent request %v should succeed without sending a cancel", id)
+		return
+	}
+	if err := rules.TrySendRequestChunk(id, true, func(id int, isTerminated bool) {}); err != ErrDeadlineExceeded {
+		t.Errorf("Expected %v but got %v", ErrDeadlineExceeded, err)
+		return
+	}
+	if count := rules.ActiveRequestCount(); count != 0 {
+		t.Errorf("Expected no active requests but got %v", count)
+	}
+}
+
+func TestExpireIgnoresReallocatedId(t *testing.T) {
+	rules := NewRequestStateMachine(NewIdPool(0))
+	id := assertBeginRequestDoesCall(t, rules)
+	serial := rules.GetRequestSerial(id)
+	assertSendRequestChunkDoesCall(t, rules, id, true)
+	assertReceiveResponseChunkDoesCall(t, rules, id, true)
+
+	newId := assertBeginRequestDoesCall(t, rules)
+	if newId != id {
+		t.Errorf("Expected ID %v to be reused, but got %v", id, newId)
+		return
+	}
+	assertSendRequestChunkDoesCall(t, rules, newId, true)
+	if rules.TryExpireRequest(id, serial, func(id int) {}) {
+		t.Errorf("An old deadline should not expire the new request with ID %v", id)
+	}
+}
+
+func TestCancelWaitsForSendInProgress(t *testing.T) {
+	rules := NewRequestStateMachine(NewIdPool(20))
+	id := assertBeginRequestDoesCall(t, rules)
+	assertSendRequestChunkDoesCall(t, rules, id, false)
+
+	sendStarted := make(chan bool)
+	finishSend := make(chan bool)
+	cancelSent := make(chan bool, 1)
+	go rules.TrySendRequestChunk(id, true, func(id int, isTerminated bool) {
+		sendStarted <- true
+		<-finishSend
+	})
+	<-sendStarted
+	go rules.TryCancelRequest(id, func(id int) {
+		cancelSent <- true
+	})
+
+	select {
+	case <-cancelSent:
+		t.Errorf("Cancel was sent before the chunk being sent")
+		return
+	case <-time.After(20 * time.Millisecond):
+	}
+	finishSend <- true
+	select {
+	case <-cancelSent:
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for cancel to be sent")
+	}
+}
@@ -0,0 +1,266 @@
+package streamux
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// KeepaliveConfig holds the settings that a Keepalive is created with.
+type KeepaliveConfig struct {
+	// How often to ping the peer.
+	Interval time.Duration
+
+	// How long to wait for a ping ack before counting it as missed. Missed
+	// acks are detected at the next ping interval after the timeout elapses.
+	Timeout time.Duration
+
+	// The peer is considered unresponsive after this many consecutive missed
+	// acks.
+	MaxMissedAcks int
+
+	// Close the session with ErrPeerUnresponsive when the peer becomes
+	// unresponsive. Only used by Session.StartKeepalive().
+	CloseOnUnresponsive bool
+}
+
+// KeepaliveStats holds round trip time statistics derived from ping latencies.
+// The smoothed RTT and jitter are calculated as in RFC 6298 (SRTT and RTTVAR).
+type KeepaliveStats struct {
+	PingsSent    int
+	AcksReceived int
+	// Number of consecutive acks missed so far.
+	MissedAcks int
+
+	LastRtt     time.Duration
+	SmoothedRtt time.Duration
+	RttJitter   time.Duration
+}
+
+// Pinger is anything that can ping the peer, such as Protocol or Session.
+type Pinger interface {
+	Ping() (id int, err error)
+}
+
+// KeepaliveReceiver is notified when the peer stops acking pings.
+type KeepaliveReceiver interface {
+	// Signals that MaxMissedAcks consecutive pings went unacked. This fires
+	// once, and again only after the peer has acked a ping in the meantime.
+	OnPeerUnresponsive(stats KeepaliveStats)
+}
+
+// Keepalive periodically pings the peer, tracks round trip times, and reports
+// when the peer stops responding. Ping acks must be passed to
+// OnPingAckReceived() (Session.StartKeepalive() does this automatically).
+type Keepalive struct {
+	pinger         Pinger
+	config         KeepaliveConfig
+	receiver       KeepaliveReceiver
+	outstanding    []sentPing
+	isPinging      bool
+	earlyAcks      map[int]time.Duration
+	stats          KeepaliveStats
+	isUnresponsive bool
+	hasRttSample   bool
+	stop           chan struct{}
+	stopOnce       sync.Once
+	mutex          sync.Mutex
+}
+
+type sentPing struct {
+	id     int
+	sentAt time.Time
+}
+
+// API
+
+// Create a keepalive config that pings every 15 seconds, and considers the
+// peer unresponsive after 3 pings go unacked for 10 seconds each.
+func NewDefaultKeepaliveConfig() *KeepaliveConfig {
+	return &KeepaliveConfig{
+		Interval:            15 * time.Second,
+		Timeout:             10 * time.Second,
+		MaxMissedAcks:       3,
+		CloseOnUnresponsive: true,
+	}
+}
+
+// Check that this config is usable, returning a *ConfigError describing the
+// first problem found.
+func (this *KeepaliveConfig) Validate() error {
+	if this.Interval <= 0 {
+		return &ConfigError{Reason: fmt.Sprintf("Keepalive interval (%v) must be positive", this.Interval)}
+	}
+	if this.Timeout <= 0 {
+		return &ConfigError{Reason: fmt.Sprintf("Keepalive timeout (%v) must be positive", this.Timeout)}
+	}
+	if this.MaxMissedAcks < 1 {
+		return &ConfigError{Reason: fmt.Sprintf("Keepalive max missed acks (%v) must be at least 1", this.MaxMissedAcks)}
+	}
+	return nil
+}
+
+func NewKeepalive(pinger Pinger, config *KeepaliveConfig, receiver KeepaliveReceiver) (*Keepalive, error) {
+	this := new(Keepalive)
+	if err := this.Init(pinger, config, receiver); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+func (this *Keepalive) Init(pinger Pinger, config *KeepaliveConfig, receiver KeepaliveReceiver) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	this.pinger = pinger
+	this.config = *config
+	this.receiver = receiver
+	this.outstanding = nil
+	this.isPinging = false
+	this.earlyAcks = make(map[int]time.Duration)
+	this.stats = KeepaliveStats{}
+	this.isUnresponsive = false
+	this.hasRttSample = false
+	this.stop = make(chan struct{})
+	return nil
+}
+
+// Begin pinging the peer from a new goroutine.
+func (this *Keepalive) Start() {
+	go this.run()
+}
+
+// Stop pinging the peer. The keepalive can't be restarted.
+func (this *Keepalive) Stop() {
+	this.stopOnce.Do(func() {
+		close(this.stop)
+	})
+}
+
+func (this *Keepalive) Stats() KeepaliveStats {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.stats
+}
+
+// Callbacks
+
+// Pass ping acks to this method. Acks to pings that this keepalive didn't send
+// are ignored.
+func (this *Keepalive) OnPingAckReceived(messageId int, latency time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	// Ping IDs are released as soon as the ping is sent, so several
+	// outstanding pings may share an ID. Any ack shows that the peer is alive.
+	remaining := this.outstanding[:0]
+	for _, ping := range this.outstanding {
+		if ping.id != messageId {
+			remaining = append(remaining, ping)
+		}
+	}
+	if len(remaining) == len(this.outstanding) {
+		if this.isPinging {
+			// Possibly an ack to the ping being sent right now.
+			this.earlyAcks[messageId] = latency
+		}
+		return
+	}
+	this.outstanding = remaining
+	this.onAck(latency)
+}
+
+// Internal
+
+// Must be called while holding the mutex.
+func (this *Keepalive) onAck(latency time.Duration) {
+	this.stats.AcksReceived++
+	this.stats.MissedAcks = 0
+	this.isUnresponsive = false
+	this.addRttSample(latency)
+}
+
+func (this *Keepalive) run() {
+	ticker := time.NewTicker(this.config.Interval)
+	defer ticker.Stop()
+
+	this.sendPing()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+			this.expirePings(time.Now())
+			this.sendPing()
+		}
+	}
+}
+
+func (this *Keepalive) sendPing() {
+	// The ack can arrive (on another goroutine) before Ping() returns the ID,
+	// so acks to unknown IDs are kept until Ping() returns.
+	this.mutex.Lock()
+	this.isPinging = true
+	this.mutex.Unlock()
+
+	sentAt := time.Now()
+	id, err := this.pinger.Ping()
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	earlyAcks := this.earlyAcks
+	this.isPinging = false
+	this.earlyAcks = make(map[int]time.Duration)
+
+	if err != nil {
+		// Not ready yet, or the session is closing. Try again next interval.
+		return
+	}
+	this.stats.PingsSent++
+	if latency, isAcked := earlyAcks[id]; isAcked {
+		this.onAck(latency)
+		return
+	}
+	this.outstanding = append(this.outstanding, sentPing{id: id, sentAt: sentAt})
+}
+
+func (this *Keepalive) expirePings(now time.Time) {
+	this.mutex.Lock()
+	remaining := this.outstanding[:0]
+	for _, ping := range this.outstanding {
+		if now.Sub(ping.sentAt) >= this.config.Timeout {
+			this.stats.MissedAcks++
+		} else {
+			remaining = append(remaining, ping)
+		}
+	}
+	this.outstanding = remaining
+	shouldNotify := !this.isUnresponsive && this.stats.MissedAcks >= this.config.MaxMissedAcks
+	if shouldNotify {
+		this.isUnresponsive = true
+	}
+	stats := this.stats
+	this.mutex.Unlock()
+
+	if shouldNotify && this.receiver != nil {
+		this.receiver.OnPeerUnresponsive(stats)
+	}
+}
+
+// Must be called while holding the mutex.
+func (this *Keepalive) addRttSample(rtt time.Duration) {
+	this.stats.LastRtt = rtt
+	if !this.hasRttSample {
+		this.hasRttSample = true
+		this.stats.SmoothedRtt = rtt
+		this.stats.RttJitter = rtt / 2
+		return
+	}
+
+	deviation := this.stats.SmoothedRtt - rtt
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	this.stats.RttJitter = (3*this.stats.RttJitter + deviation) / 4
+	this.stats.SmoothedRtt = (7*this.stats.SmoothedRtt + rtt) / 8
+}
@@ -0,0 +1,172 @@
+package streamux
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Hands out sequential ping IDs, and never acks anything by itself.
+type testPinger struct {
+	nextId int
+	mutex  sync.Mutex
+}
+
+func (this *testPinger) Ping() (id int, err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	id = this.nextId
+	this.nextId++
+	return id, nil
+}
+
+type testKeepaliveReceiver struct {
+	unresponsive chan KeepaliveStats
+}
+
+func newTestKeepaliveReceiver() *testKeepaliveReceiver {
+	return &testKeepaliveReceiver{unresponsive: make(chan KeepaliveStats, 10)}
+}
+
+func (this *testKeepaliveReceiver) OnPeerUnresponsive(stats KeepaliveStats) {
+	this.unresponsive <- stats
+}
+
+func newTestKeepaliveConfig() *KeepaliveConfig {
+	return &KeepaliveConfig{
+		Interval:      10 * time.Millisecond,
+		Timeout:       15 * time.Millisecond,
+		MaxMissedAcks: 2,
+	}
+}
+
+// =============================================================================
+
+func TestKeepaliveConfig(t *testing.T) {
+	config := NewDefaultKeepaliveConfig()
+	if err := config.Validate(); err != nil {
+		t.Errorf("Default keepalive config should be valid but got %v", err)
+	}
+
+	config = NewDefaultKeepaliveConfig()
+	config.Interval = 0
+	if err := config.Validate(); err == nil {
+		t.Errorf("Config %+v should be invalid", *config)
+	}
+	config = NewDefaultKeepaliveConfig()
+	config.MaxMissedAcks = 0
+	if _, err := NewKeepalive(new(testPinger), config, nil); err == nil {
+		t.Errorf("Config %+v should be invalid", *config)
+	}
+}
+
+func TestKeepaliveRttStats(t *testing.T) {
+	keepalive, err := NewKeepalive(new(testPinger), NewDefaultKeepaliveConfig(), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, rtt := range []time.Duration{100, 100, 200} {
+		keepalive.sendPing()
+		keepalive.OnPingAckReceived(keepalive.Stats().PingsSent-1, rtt*time.Millisecond)
+	}
+
+	stats := keepalive.Stats()
+	if stats.PingsSent != 3 || stats.AcksReceived != 3 {
+		t.Errorf("Expected 3 pings and acks but got %+v", stats)
+		return
+	}
+	if stats.LastRtt != 200*time.Millisecond {
+		t.Errorf("Expected last RTT 200ms but got %v", stats.LastRtt)
+	}
+	// srtt: 100, 100, 112.5. rttvar: 50, 37.5, 53.125
+	if stats.SmoothedRtt != 112500*time.Microsecond {
+		t.Errorf("Expected smoothed RTT 112.5ms but got %v", stats.SmoothedRtt)
+	}
+	if stats.RttJitter != 53125*time.Microsecond {
+		t.Errorf("Expected jitter 53.125ms but got %v", stats.RttJitter)
+	}
+}
+
+func TestKeepaliveIgnoresUnknownAcks(t *testing.T) {
+	keepalive, _ := NewKeepalive(new(testPinger), NewDefaultKeepaliveConfig(), nil)
+	keepalive.OnPingAckReceived(5, time.Millisecond)
+	if stats := keepalive.Stats(); stats.AcksReceived != 0 {
+		t.Errorf("Expected no acks but got %+v", stats)
+	}
+}
+
+func TestKeepaliveUnresponsive(t *testing.T) {
+	receiver := newTestKeepaliveReceiver()
+	keepalive, err := NewKeepalive(new(testPinger), newTestKeepaliveConfig(), receiver)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	keepalive.Start()
+	defer keepalive.Stop()
+
+	select {
+	case stats := <-receiver.unresponsive:
+		if stats.MissedAcks < 2 {
+			t.Errorf("Expected at least 2 missed acks but got %+v", stats)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for unresponsive notification")
+	}
+}
+
+func TestSessionKeepalive(t *testing.T) {
+	client, server, _, _ := newTestSessionPair(8, 10)
+	defer server.Close()
+	defer client.Close()
+
+	receiver := newTestKeepaliveReceiver()
+	keepalive, err := client.StartKeepalive(newTestKeepaliveConfig(), receiver)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case stats := <-receiver.unresponsive:
+		t.Errorf("Peer should not be unresponsive: %+v", stats)
+		return
+	default:
+	}
+	if stats := keepalive.Stats(); stats.AcksReceived == 0 || stats.SmoothedRtt <= 0 {
+		t.Errorf("Expected RTT statistics but got %+v", stats)
+	}
+}
+
+func TestSessionKeepaliveClosesUnresponsive(t *testing.T) {
+	clientConn, peerConn := net.Pipe()
+	defer peerConn.Close()
+	// The peer reads everything, but never replies.
+	go io.Copy(ioutil.Discard, peerConn)
+
+	client, err := NewSession(clientConn, newTestConfig(8, 10, false), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer client.Close()
+
+	config := newTestKeepaliveConfig()
+	config.CloseOnUnresponsive = true
+	if _, err = client.StartKeepalive(config, nil); err != nil {
+		t.Error(err)
+		return
+	}
+	if !awaitSignal(t, client.Done(), "session to close") {
+		return
+	}
+	if err = client.Err(); err != ErrPeerUnresponsive {
+		t.Errorf("Expected %v but got %v", ErrPeerUnresponsive, err)
+	}
+}
@@ -0,0 +1,55 @@
+package streamux
+
+import (
+	"net"
+	"sync"
+)
+
+// Listener implements net.Listener, accepting the streams that the peer opens
+// on a session (see Session.OpenStream()). This allows servers written for
+// net.Listener, such as http.Server, to be served over a single streamux
+// connection. On the other side, dial by calling Session.OpenStream().
+//
+// Closing a Listener stops it from accepting streams, but leaves the session
+// and any accepted streams open. Streams that arrive afterwards wait for
+// Session.AcceptStream() (or another Listener).
+type Listener struct {
+	session   *Session
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// API
+
+func newListener(session *Session) *Listener {
+	this := new(Listener)
+	this.session = session
+	this.closed = make(chan struct{})
+	return this
+}
+
+// Wait for the next stream opened by the peer. Fails with ErrListenerClosed
+// once the listener is closed, or ErrSessionClosed once the session ends.
+func (this *Listener) Accept() (net.Conn, error) {
+	stream, err := this.session.acceptStream(this.closed)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (this *Listener) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+		this.session.wakeStreamAcceptors()
+	})
+	return nil
+}
+
+// Returns the local address of the session's transport if it's a net.Conn.
+func (this *Listener) Addr() net.Addr {
+	if conn, ok := this.session.transport.(net.Conn); ok {
+		return conn.LocalAddr()
+	}
+	return &StreamAddr{NoMessageId, false}
+}
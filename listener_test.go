@@ -0,0 +1,83 @@
+package streamux
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestListenerServesHTTP(t *testing.T) {
+	enableControlExtension := true
+	client, server := newTestControlSessionPair(enableControlExtension)
+	defer server.Close()
+	defer client.Close()
+
+	listener := server.Listen()
+	httpServer := &http.Server{Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("hello " + request.URL.Path))
+	})}
+	go httpServer.Serve(listener)
+	defer httpServer.Close()
+
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return client.OpenStream(0)
+		},
+	}}
+	// HTTP keeps the connection alive, so the second request reuses the stream.
+	for _, path := range []string{"/a", "/b"} {
+		response, err := httpClient.Get("http://streamux" + path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if expected := "hello " + path; string(body) != expected {
+			t.Errorf("Expected %q but got %q", expected, body)
+			return
+		}
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	enableControlExtension := true
+	client, server := newTestControlSessionPair(enableControlExtension)
+	defer server.Close()
+	defer client.Close()
+
+	listener := server.Listen()
+	result := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		result <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	listener.Close()
+
+	select {
+	case err := <-result:
+		if err != ErrListenerClosed {
+			t.Errorf("Expected %v but got %v", ErrListenerClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for Accept() to return")
+	}
+
+	// The session is still usable.
+	if _, err := client.OpenStream(0); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := server.AcceptStream(); err != nil {
+		t.Error(err)
+	}
+}
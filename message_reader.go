@@ -0,0 +1,189 @@
+package streamux
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// A MessageReader is part of the advanced streamux API, allowing a message
+// received from the other peer to be read incrementally as its chunks arrive.
+// It implements io.ReadCloser. Read() returns io.EOF once the message has been
+// completely read.
+//
+// Closing a MessageReader before the message ends discards any remaining data.
+type MessageReader struct {
+	Id int
+
+	chunks   [][]byte
+	isEnded  bool
+	isClosed bool
+	err      error
+	ended    chan struct{}
+	mutex    sync.Mutex
+	cond     *sync.Cond
+
+	// Read() fails with ErrTimeout once this passes (if not zero).
+	deadline      time.Time
+	deadlineTimer *time.Timer
+
+	// Called (once) when Close() is called before the message has ended.
+	onEarlyClose func(*MessageReader)
+
+	// If set, called with the number of bytes that have been read or
+	// discarded, so that flow control credit can be granted.
+	onConsumed func(byteCount int)
+}
+
+// API
+
+func newMessageReader(id int, onEarlyClose func(*MessageReader)) *MessageReader {
+	this := new(MessageReader)
+	this.Id = id
+	this.ended = make(chan struct{})
+	this.cond = sync.NewCond(&this.mutex)
+	this.onEarlyClose = onEarlyClose
+	return this
+}
+
+func (this *MessageReader) Read(buffer []byte) (bytesRead int, err error) {
+	defer func() {
+		this.notifyConsumed(bytesRead)
+	}()
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for len(this.chunks) == 0 && !this.isEnded && !this.isClosed {
+		if !this.deadline.IsZero() && !time.Now().Before(this.deadline) {
+			return 0, ErrTimeout
+		}
+		this.cond.Wait()
+	}
+
+	if this.isClosed {
+		return 0, io.ErrClosedPipe
+	}
+
+	for len(this.chunks) > 0 && bytesRead < len(buffer) {
+		copied := copy(buffer[bytesRead:], this.chunks[0])
+		bytesRead += copied
+		if copied == len(this.chunks[0]) {
+			this.chunks[0] = nil
+			this.chunks = this.chunks[1:]
+		} else {
+			this.chunks[0] = this.chunks[0][copied:]
+		}
+	}
+
+	if bytesRead == 0 && len(buffer) > 0 {
+		if this.err != nil {
+			return 0, this.err
+		}
+		return 0, io.EOF
+	}
+	return bytesRead, nil
+}
+
+func (this *MessageReader) Close() error {
+	this.mutex.Lock()
+	wasEnded := this.isEnded
+	wasClosed := this.isClosed
+	this.isClosed = true
+	discarded := 0
+	for _, chunk := range this.chunks {
+		discarded += len(chunk)
+	}
+	this.chunks = nil
+	this.cond.Broadcast()
+	this.mutex.Unlock()
+
+	this.notifyConsumed(discarded)
+
+	if !wasEnded && !wasClosed && this.onEarlyClose != nil {
+		this.onEarlyClose(this)
+	}
+	return nil
+}
+
+// Internal
+
+// Returns a channel that is closed once all of the message has arrived, or the
+// message has failed.
+func (this *MessageReader) endedSignal() <-chan struct{} {
+	return this.ended
+}
+
+// Returns the error that the message failed with, if any.
+func (this *MessageReader) failure() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.err
+}
+
+// A zero deadline means no deadline.
+func (this *MessageReader) setDeadline(deadline time.Time) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.deadline = deadline
+	if this.deadlineTimer != nil {
+		this.deadlineTimer.Stop()
+		this.deadlineTimer = nil
+	}
+	if !deadline.IsZero() {
+		this.deadlineTimer = time.AfterFunc(time.Until(deadline), func() {
+			this.mutex.Lock()
+			defer this.mutex.Unlock()
+			this.cond.Broadcast()
+		})
+	}
+	this.cond.Broadcast()
+}
+
+// Add a chunk of message data. The data is copied.
+func (this *MessageReader) feed(data []byte, isEnd bool) {
+	this.mutex.Lock()
+	isDiscarded := this.isEnded || this.isClosed
+	if !this.isEnded {
+		if len(data) > 0 && !this.isClosed {
+			chunk := make([]byte, len(data))
+			copy(chunk, data)
+			this.chunks = append(this.chunks, chunk)
+		}
+		if isEnd {
+			this.markEnded(nil)
+		}
+		this.cond.Broadcast()
+	}
+	this.mutex.Unlock()
+
+	if isDiscarded {
+		this.notifyConsumed(len(data))
+	}
+}
+
+// End the message with an error. Any data already buffered can still be read,
+// after which Read() returns the error.
+func (this *MessageReader) fail(err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.isEnded {
+		return
+	}
+	this.markEnded(err)
+	this.cond.Broadcast()
+}
+
+// Must be called without holding the mutex.
+func (this *MessageReader) notifyConsumed(byteCount int) {
+	if byteCount > 0 && this.onConsumed != nil {
+		this.onConsumed(byteCount)
+	}
+}
+
+func (this *MessageReader) markEnded(err error) {
+	this.isEnded = true
+	this.err = err
+	close(this.ended)
+}
@@ -0,0 +1,96 @@
+package streamux
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/kstenerud/go-streamux/test"
+)
+
+// =============================================================================
+
+func TestMessageReaderChunks(t *testing.T) {
+	reader := newMessageReader(1, nil)
+	expected := test.NewTestBytes(100)
+	reader.feed(expected[:10], false)
+	reader.feed(expected[10:11], false)
+	reader.feed(expected[11:], true)
+
+	actual, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	test.AssertSlicesAreEquivalent(t, actual, expected)
+}
+
+func TestMessageReaderCopiesData(t *testing.T) {
+	reader := newMessageReader(1, nil)
+	data := []byte{1, 2, 3}
+	reader.feed(data, true)
+	data[0] = 100
+
+	actual, _ := ioutil.ReadAll(reader)
+	test.AssertSlicesAreEquivalent(t, actual, []byte{1, 2, 3})
+}
+
+func TestMessageReaderBlocksUntilData(t *testing.T) {
+	reader := newMessageReader(1, nil)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		reader.feed([]byte{5}, false)
+	}()
+
+	buffer := make([]byte, 10)
+	bytesRead, err := reader.Read(buffer)
+	if err != nil || bytesRead != 1 || buffer[0] != 5 {
+		t.Errorf("Expected to read [5] but got %v (%v)", buffer[:bytesRead], err)
+	}
+}
+
+func TestMessageReaderFail(t *testing.T) {
+	reader := newMessageReader(1, nil)
+	expectedErr := fmt.Errorf("test failure")
+	reader.feed([]byte{1, 2}, false)
+	reader.fail(expectedErr)
+
+	actual, err := ioutil.ReadAll(reader)
+	test.AssertSlicesAreEquivalent(t, actual, []byte{1, 2})
+	if err != expectedErr {
+		t.Errorf("Expected error %v but got %v", expectedErr, err)
+	}
+}
+
+func TestMessageReaderEarlyClose(t *testing.T) {
+	closeCount := 0
+	reader := newMessageReader(1, func(*MessageReader) {
+		closeCount++
+	})
+	reader.feed([]byte{1, 2}, false)
+	reader.Close()
+	reader.Close()
+	reader.feed([]byte{3}, true)
+
+	if closeCount != 1 {
+		t.Errorf("Expected early close handler to be called once, but was called %v times", closeCount)
+	}
+	if _, err := reader.Read(make([]byte, 10)); err != io.ErrClosedPipe {
+		t.Errorf("Expected %v but got %v", io.ErrClosedPipe, err)
+	}
+}
+
+func TestMessageReaderCloseAfterEnd(t *testing.T) {
+	didCall := false
+	reader := newMessageReader(1, func(*MessageReader) {
+		didCall = true
+	})
+	reader.feed([]byte{1}, true)
+	reader.Close()
+
+	if didCall {
+		t.Errorf("Early close handler should not be called after the message ended")
+	}
+}
@@ -31,6 +31,34 @@ type MessageReceiver interface {
 	OnEmptyResponseReceived(messageId int) error
 }
 
+// DeadlineReceiver may optionally be implemented by a MessageReceiver, to be
+// notified when a request's deadline passes before its response has completed
+// (see Protocol.BeginRequestWithDeadline()). The request has already been
+// canceled, and the cancel ack will still arrive via OnCancelAckReceived() if
+// any of the request was sent.
+// Note: this is called from a timer goroutine, not the one feeding the protocol.
+type DeadlineReceiver interface {
+	OnRequestDeadlineExceeded(messageId int) error
+}
+
+// StreamReceiver may optionally be implemented by a MessageReceiver, to be
+// notified when the peer begins a stream (see Protocol.BeginStream()). The
+// stream's data arrives as request chunks to messageId, and data for the other
+// direction is sent with BeginResponse(), normally at the priority that the peer
+// opened the stream with. The two directions are independent: response chunks
+// may be sent before the request has ended.
+type StreamReceiver interface {
+	OnStreamOpened(messageId int, priority int) error
+}
+
+// NotificationReceiver may optionally be implemented by a MessageReceiver, to
+// receive the notifications that the peer sends (see
+// Protocol.SendNotification()). Each notification arrives whole. If not
+// implemented, notifications are discarded.
+type NotificationReceiver interface {
+	OnNotificationReceived(data []byte) error
+}
+
 // MessageSender is notified when communication is possible, and when data is
 // available to send over your communications channel.
 type MessageSender interface {
@@ -45,3 +73,30 @@ type MessageSender interface {
 	// Higher priority data must be sent before lower priority data.
 	OnMessageChunkToSend(priority int, messageId int, chunk []byte) error
 }
+
+// WeightedMessageSender may optionally be implemented by a MessageSender, to be
+// told each chunk's weight (see Protocol.BeginRequestWithWeight()) so that
+// messages sharing a priority can be scheduled fairly. If implemented, it's
+// called instead of OnMessageChunkToSend(). Session implements it, passing the
+// weight on to its SendScheduler.
+type WeightedMessageSender interface {
+	OnWeightedMessageChunkToSend(priority int, weight int, messageId int, chunk []byte) error
+}
+
+// PurgingMessageSender may optionally be implemented by a MessageSender that
+// queues chunks, to remove a canceled request's queued chunks before the cancel
+// is sent. Cancels are sent at PriorityOOB, so without this they could overtake
+// chunks of the request that are still queued, and the peer could ack the cancel
+// before those chunks arrive. Session implements it, purging its
+// SendScheduler.
+type PurgingMessageSender interface {
+	OnPurgeRequestChunks(messageId int)
+}
+
+// WaitingMessageSender may optionally be implemented by a MessageSender that
+// queues chunks, to wait until a message's queued chunks have left the queue
+// (see SendableMessage.WaitUntilSent()). Session implements it, waiting on its
+// SendScheduler.
+type WaitingMessageSender interface {
+	OnWaitUntilSent(messageId int, isResponse bool)
+}
@@ -0,0 +1,124 @@
+package streamux
+
+import (
+	"io/ioutil"
+)
+
+// An Interceptor runs around a handler, for cross-cutting concerns such as
+// logging, authorization, metrics and rate limiting. It calls next to continue
+// down the chain, or short-circuits by writing its own response (such as an
+// error) and returning without calling next.
+type Interceptor func(response ResponseWriter, request *Request, next Handler)
+
+// A UnaryHandler gets the whole request body, and returns the whole response.
+// If it returns an error, the response is encoded by the ServeMux's
+// ErrorEncoder instead.
+type UnaryHandler func(request *Request, body []byte) (response []byte, err error)
+
+// A UnaryInterceptor runs around a UnaryHandler. It can inspect or replace the
+// request body and the response, or short-circuit by returning without calling
+// next.
+type UnaryInterceptor func(request *Request, body []byte, next UnaryHandler) (response []byte, err error)
+
+// An ErrorEncoder turns an error returned by a UnaryHandler into a response.
+type ErrorEncoder func(request *Request, err error) []byte
+
+// API
+
+// Add interceptors that run around every handler, including unary handlers and
+// the not found handler. The first interceptor added runs first.
+func (this *ServeMux) Use(interceptors ...Interceptor) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.interceptors = append(this.interceptors, interceptors...)
+}
+
+// Add interceptors that run around every unary handler, inside those added via
+// Use(). The first interceptor added runs first.
+func (this *ServeMux) UseUnary(interceptors ...UnaryInterceptor) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.unaryInterceptors = append(this.unaryInterceptors, interceptors...)
+}
+
+// Register a unary handler for a route (see Handle()).
+func (this *ServeMux) HandleUnary(route string, handler UnaryHandler) {
+	this.Handle(route, &unaryAdapter{this, handler})
+}
+
+// Set how errors returned by unary handlers are sent. By default the response
+// is empty.
+func (this *ServeMux) SetErrorEncoder(encoder ErrorEncoder) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.errorEncoder = encoder
+}
+
+// Wrap a handler in interceptors. The first interceptor runs first.
+func ChainInterceptors(handler Handler, interceptors ...Interceptor) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		handler = &interceptedHandler{interceptors[i], handler}
+	}
+	return handler
+}
+
+// Wrap a unary handler in interceptors. The first interceptor runs first.
+func ChainUnaryInterceptors(handler UnaryHandler, interceptors ...UnaryInterceptor) UnaryHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor := interceptors[i]
+		next := handler
+		handler = func(request *Request, body []byte) ([]byte, error) {
+			return interceptor(request, body, next)
+		}
+	}
+	return handler
+}
+
+// Returns an interceptor that recovers from panics further down the chain, so
+// that one bad request doesn't bring down the process. onPanic may be nil.
+// Whatever was written of the response before the panic is ended as is.
+func NewRecoveryInterceptor(onPanic func(request *Request, recovered interface{})) Interceptor {
+	return func(response ResponseWriter, request *Request, next Handler) {
+		defer func() {
+			if recovered := recover(); recovered != nil && onPanic != nil {
+				onPanic(request, recovered)
+			}
+		}()
+		next.ServeStreamux(response, request)
+	}
+}
+
+// Internal
+
+type interceptedHandler struct {
+	interceptor Interceptor
+	next        Handler
+}
+
+func (this *interceptedHandler) ServeStreamux(response ResponseWriter, request *Request) {
+	this.interceptor(response, request, this.next)
+}
+
+type unaryAdapter struct {
+	mux     *ServeMux
+	handler UnaryHandler
+}
+
+func (this *unaryAdapter) ServeStreamux(response ResponseWriter, request *Request) {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		// Canceled, or the connection is going down.
+		return
+	}
+
+	this.mux.mutex.Lock()
+	handler := ChainUnaryInterceptors(this.handler, this.mux.unaryInterceptors...)
+	encodeError := this.mux.errorEncoder
+	this.mux.mutex.Unlock()
+
+	result, err := handler(request, body)
+	if err != nil {
+		result = encodeError(request, err)
+	}
+	response.Write(result)
+}
@@ -0,0 +1,130 @@
+package streamux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestInterceptorOrder(t *testing.T) {
+	var order []string
+	var mutex sync.Mutex
+	record := func(name string) Interceptor {
+		return func(response ResponseWriter, request *Request, next Handler) {
+			mutex.Lock()
+			order = append(order, name)
+			mutex.Unlock()
+			next.ServeStreamux(response, request)
+		}
+	}
+
+	mux := NewServeMux()
+	mux.Use(record("first"), record("second"))
+	mux.HandleFunc("echo", func(response ResponseWriter, request *Request) {
+		io.Copy(response, request.Body)
+	})
+	client, server := newTestServeMuxSessionPair(mux)
+	defer server.Close()
+	defer client.Close()
+
+	actual, err := callRoute(client, "echo", []byte("x"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if expected := []byte("x"); !bytes.Equal(actual, expected) {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if fmt.Sprint(order) != "[first second]" {
+		t.Errorf("Interceptors ran in the wrong order: %v", order)
+	}
+}
+
+func TestInterceptorShortCircuit(t *testing.T) {
+	mux := NewServeMux()
+	mux.Use(func(response ResponseWriter, request *Request, next Handler) {
+		if request.Route != "public" {
+			response.Write([]byte("denied"))
+			return
+		}
+		next.ServeStreamux(response, request)
+	})
+	handler := func(response ResponseWriter, request *Request) {
+		response.Write([]byte("allowed"))
+	}
+	mux.HandleFunc("public", handler)
+	mux.HandleFunc("private", handler)
+	client, server := newTestServeMuxSessionPair(mux)
+	defer server.Close()
+	defer client.Close()
+
+	for route, expected := range map[string]string{"public": "allowed", "private": "denied"} {
+		actual, err := callRoute(client, route, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(actual) != expected {
+			t.Errorf("Route %v: Expected %q but got %q", route, expected, actual)
+		}
+	}
+}
+
+func TestUnaryInterceptors(t *testing.T) {
+	mux := NewServeMux()
+	mux.UseUnary(func(request *Request, body []byte, next UnaryHandler) ([]byte, error) {
+		if len(body) == 0 {
+			return nil, fmt.Errorf("empty body")
+		}
+		response, err := next(request, body)
+		return append(response, '!'), err
+	})
+	mux.SetErrorEncoder(func(request *Request, err error) []byte {
+		return []byte("error: " + err.Error())
+	})
+	mux.HandleUnary("upper", func(request *Request, body []byte) ([]byte, error) {
+		return bytes.ToUpper(body), nil
+	})
+	client, server := newTestServeMuxSessionPair(mux)
+	defer server.Close()
+	defer client.Close()
+
+	for body, expected := range map[string]string{"abc": "ABC!", "": "error: empty body"} {
+		actual, err := callRoute(client, "upper", []byte(body))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(actual) != expected {
+			t.Errorf("Body %q: Expected %q but got %q", body, expected, actual)
+		}
+	}
+}
+
+func TestRecoveryInterceptor(t *testing.T) {
+	recoveredValues := make(chan interface{}, 1)
+	mux := NewServeMux()
+	mux.Use(NewRecoveryInterceptor(func(request *Request, recovered interface{}) {
+		recoveredValues <- recovered
+	}))
+	mux.HandleFunc("panic", func(response ResponseWriter, request *Request) {
+		panic("oops")
+	})
+	client, server := newTestServeMuxSessionPair(mux)
+	defer server.Close()
+	defer client.Close()
+
+	// The response still ends, so the call completes.
+	if _, err := callRoute(client, "panic", nil); err != nil {
+		t.Error(err)
+		return
+	}
+	if recovered := <-recoveredValues; recovered != "oops" {
+		t.Errorf("Expected to recover %q but got %v", "oops", recovered)
+	}
+}
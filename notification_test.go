@@ -0,0 +1,108 @@
+package streamux
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type notificationTestReceiver struct {
+	*sessionTestReceiver
+	notifications chan []byte
+}
+
+func (this *notificationTestReceiver) OnNotificationReceived(data []byte) error {
+	this.notifications <- data
+	return nil
+}
+
+func newTestNotificationSessionPair(enableControlExtension bool) (client, server *Session, serverReceiver *notificationTestReceiver) {
+	serverReceiver = &notificationTestReceiver{newSessionTestReceiver(), make(chan []byte, 1000)}
+	client, server = newTestPipeSessionPair(func(config *Config, isServer bool) {
+		config.EnableControlExtension = enableControlExtension
+	}, nil, serverReceiver)
+	serverReceiver.session = server
+	return client, server, serverReceiver
+}
+
+// =============================================================================
+
+func TestNotifications(t *testing.T) {
+	enableControlExtension := true
+	client, server, receiver := newTestNotificationSessionPair(enableControlExtension)
+	defer server.Close()
+	defer client.Close()
+
+	// More notifications than there are IDs, from several goroutines at once.
+	senderCount := 4
+	notificationCount := 100
+	notificationLength := 3000
+	var wg sync.WaitGroup
+	for i := 0; i < senderCount; i++ {
+		wg.Add(1)
+		go func(fill byte) {
+			defer wg.Done()
+			notification := bytes.Repeat([]byte{fill}, notificationLength)
+			for j := 0; j < notificationCount; j++ {
+				if err := client.SendNotification(notification); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(byte(i + 1))
+	}
+	wg.Wait()
+
+	for i := 0; i < senderCount*notificationCount; i++ {
+		select {
+		case notification := <-receiver.notifications:
+			// The chunks of concurrent notifications must not be interleaved.
+			expected := bytes.Repeat(notification[:1], notificationLength)
+			if !bytes.Equal(notification, expected) {
+				t.Errorf("Notification %v is corrupt", i)
+				return
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Timed out waiting for notification %v", i)
+			return
+		}
+	}
+	if count := client.protocol.requestStateMachine.ActiveRequestCount(); count != 0 {
+		t.Errorf("Expected notifications to use no request IDs, but %v are in use", count)
+	}
+
+	// Requests are unaffected.
+	expected := []byte{1, 2, 3}
+	actual, err := client.Call(context.Background(), 0, expected)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+func TestNotificationTooLong(t *testing.T) {
+	enableControlExtension := true
+	client, server, _ := newTestNotificationSessionPair(enableControlExtension)
+	defer server.Close()
+	defer client.Close()
+
+	if err := client.SendNotification(make([]byte, MaxNotificationLength+1)); err != ErrNotificationTooLong {
+		t.Errorf("Expected %v but got %v", ErrNotificationTooLong, err)
+	}
+}
+
+func TestNotificationsRequireControlExtension(t *testing.T) {
+	enableControlExtension := false
+	client, server, _ := newTestNotificationSessionPair(enableControlExtension)
+	defer server.Close()
+	defer client.Close()
+
+	if err := client.SendNotification([]byte{1}); err != ErrNotificationsUnavailable {
+		t.Errorf("Expected %v but got %v", ErrNotificationsUnavailable, err)
+	}
+}
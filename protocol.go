@@ -4,6 +4,7 @@ import (
 	// "encoding/hex"
 	"fmt"
 	"math"
+	"sync"
 	"time"
 
 	"github.com/kstenerud/go-streamux/internal"
@@ -14,7 +15,32 @@ const ProtocolVersion = 1
 const PriorityMax = math.MaxInt32
 const PriorityOOB = PriorityMax
 
+// The longest notification that can be sent (see SendNotification()).
+const MaxNotificationLength = 1 << 20
+
+// Notifications share an ID, so they're all sent at the same priority to keep
+// their chunks in order.
+const notificationPriority = 0
+
 // Protocol encapsulates the top level API of the streamux protocol.
+//
+// Concurrency model: the sending API (SendRequest(), BeginRequest(),
+// BeginResponse(), Cancel(), Ping(), Drain() and friends) may be called from any
+// number of goroutines, concurrently with Feed(). Each SendableMessage must only
+// be used from one goroutine at a time.
+//
+// Incoming data must be fed from one goroutine (concurrent Feed() calls are
+// serialized, but interleaving them would scramble the stream anyway).
+// MessageReceiver callbacks are called from within Feed(), so they run on the
+// feeding goroutine, and may call the sending API but not Feed().
+// DeadlineReceiver callbacks run on a timer goroutine.
+//
+// MessageSender callbacks are called from whichever goroutine is sending, so
+// the sender must be safe for concurrent use (SendScheduler is).
+//
+// With flow control, sending may block until the peer grants more credit,
+// which arrives via Feed(). So the feeding goroutine must not use blocking
+// sends (see SendableMessage.SetBlocking()).
 type Protocol struct {
 	hasBegunInitialization         bool
 	hasFinishedEarlyInitialization bool
@@ -22,50 +48,127 @@ type Protocol struct {
 	decoder                        internal.MessageDecoder
 	requestStateMachine            internal.RequestStateMachine
 	sender                         MessageSender
+	weightedSender                 WeightedMessageSender
+	purgingSender                  PurgingMessageSender
+	waitingSender                  WaitingMessageSender
 	receiver                       MessageReceiver
 	activeIncomingRequests         map[int]bool
-	activeOutgoingPings            map[int]time.Time
+	activeOutgoingPings            map[int][]time.Time
+	idBits                         int
+	lengthBits                     int
+	mutex                          sync.Mutex
+	// Held for the duration of Feed(). Guards the decoder and controlMessage.
+	feedMutex sync.Mutex
+
+	// Control extension
+	localExtensions  int
+	controlMessageId int
+	controlMessage   []byte
+	controlMutex     sync.Mutex
+
+	// Notifications (see SendNotification())
+	notificationMessageId int
+	notification          []byte
+	notificationMutex     sync.Mutex
+
+	// Draining (see Drain())
+	unansweredIncomingRequests map[int]bool
+	isDraining                 bool
+	isDrained                  bool
+	hasSentGoAway              bool
+	drained                    chan struct{}
+	isPeerDraining             bool
+	peerDraining               chan struct{}
+
+	// Closed once negotiation completes (see Negotiated()).
+	negotiated chan struct{}
+
+	requestDeadlines map[int]*requestDeadline
+
+	// Responses that haven't ended, so that they can be failed if the peer
+	// cancels their request.
+	outgoingResponses map[int]*SendableMessage
+
+	// Codec negotiation (see Codec())
+	localCodecs       []string
+	codecTimeout      time.Duration
+	codecTimer        *time.Timer
+	codec             Codec
+	codecErr          error
+	isCodecNegotiated bool
+	codecNegotiated   chan struct{}
+
+	// Flow control extension
+	isFlowControlActive  bool
+	isManualCreditGrants bool
+	sendWindow           sendWindow
+	receiveWindow        receiveWindow
 }
 
 // API
 
-func NewProtocol(idMinBits int, idMaxBits int, idRecommendBits int,
-	lengthMinBits int, lengthMaxBits int, lengthRecommendBits int,
-	requestQuickInit bool, allowQuickInit bool, sender MessageSender,
-	receiver MessageReceiver) *Protocol {
-
+func NewProtocol(config *Config, sender MessageSender, receiver MessageReceiver) (*Protocol, error) {
 	this := new(Protocol)
-	this.Init(idMinBits, idMaxBits, idRecommendBits,
-		lengthMinBits, lengthMaxBits, lengthRecommendBits,
-		requestQuickInit, allowQuickInit,
-		sender, receiver)
-
-	return this
+	if err := this.Init(config, sender, receiver); err != nil {
+		return nil, err
+	}
+	return this, nil
 }
 
-func (this *Protocol) Init(idMinBits int, idMaxBits int, idRecommendBits int,
-	lengthMinBits int, lengthMaxBits int, lengthRecommendBits int,
-	requestQuickInit bool, allowQuickInit bool, sender MessageSender,
-	receiver MessageReceiver) {
+func (this *Protocol) Init(config *Config, sender MessageSender, receiver MessageReceiver) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
 
 	this.negotiator.Init(ProtocolVersion,
-		idMinBits, idMaxBits, idRecommendBits,
-		lengthMinBits, lengthMaxBits, lengthRecommendBits,
-		requestQuickInit, allowQuickInit)
+		config.IdMinBits, config.IdMaxBits, config.IdRecommendBits,
+		config.LengthMinBits, config.LengthMaxBits, config.LengthRecommendBits,
+		config.RequestQuickInit, config.AllowQuickInit)
+	this.localExtensions = config.extensions()
+	this.negotiator.SetExtensions(this.localExtensions)
+	this.controlMessageId = -1
+	this.notificationMessageId = -1
 	this.sender = sender
+	this.weightedSender, _ = sender.(WeightedMessageSender)
+	this.purgingSender, _ = sender.(PurgingMessageSender)
+	this.waitingSender, _ = sender.(WaitingMessageSender)
 	this.receiver = receiver
 	this.activeIncomingRequests = make(map[int]bool)
-	this.activeOutgoingPings = make(map[int]time.Time)
+	this.activeOutgoingPings = make(map[int][]time.Time)
+	this.unansweredIncomingRequests = make(map[int]bool)
+	this.drained = make(chan struct{})
+	this.peerDraining = make(chan struct{})
+	this.negotiated = make(chan struct{})
+	this.localCodecs = config.Codecs
+	this.codecTimeout = config.codecTimeout()
+	this.codecNegotiated = make(chan struct{})
+	this.requestDeadlines = make(map[int]*requestDeadline)
+	this.outgoingResponses = make(map[int]*SendableMessage)
+	this.isManualCreditGrants = config.ManualCreditGrants
+	this.sendWindow.Init(this.localExtensions&internal.ExtensionFlowControl != 0)
+	this.receiveWindow.Init(config.messageWindow(), config.connectionWindow())
+	return nil
 }
 
 func (this *Protocol) SendInitialization() error {
-	if !this.hasBegunInitialization {
-		this.hasBegunInitialization = true
-		if this.negotiator.CanSendMessages() {
-			this.finishEarlyInitialization()
-		}
-		// fmt.Printf("### P %p: Sending init message\n", this)
-		return this.sendRawMessage(PriorityOOB, -1, this.negotiator.BuildInitializeMessage())
+	this.mutex.Lock()
+	if this.hasBegunInitialization {
+		this.mutex.Unlock()
+		return nil
+	}
+	this.hasBegunInitialization = true
+	canSendMessages := this.negotiator.CanSendMessages()
+	initializeMessage := this.negotiator.BuildInitializeMessage()
+	this.mutex.Unlock()
+
+	// fmt.Printf("### P %p: Sending init message\n", this)
+	// The initialize message must be queued before anything that the sender
+	// might send in response to OnAbleToSend().
+	if err := this.sendRawMessage(PriorityOOB, -1, initializeMessage); err != nil {
+		return err
+	}
+	if canSendMessages {
+		this.finishEarlyInitialization()
 	}
 	return nil
 }
@@ -95,39 +198,194 @@ func (this *Protocol) SendResponse(priority int, responseToId int, contents []by
 // Advanced API. The SendableMessage returned by this method can be used to incrementally
 // add data to the message being sent. Data will be queued and sent as it fills the maximum chunk length.
 func (this *Protocol) BeginRequest(priority int) (message *SendableMessage, err error) {
-	if !this.negotiator.CanSendMessages() {
-		return nil, fmt.Errorf("Can't send messages: %v", this.negotiator.ExplainFailure())
+	if err = this.checkCanSendMessages(); err != nil {
+		return nil, err
+	}
+	if err = this.checkCanBeginRequest(); err != nil {
+		return nil, err
 	}
 
 	err = this.requestStateMachine.TryBeginRequest(func(id int) {
 		isResponse := false
 		message = newSendableMessage(this, priority, id,
-			this.negotiator.IdBits, this.negotiator.LengthBits, isResponse)
+			this.idBits, this.lengthBits, isResponse)
+		this.openOutgoingFlow(message, flowKey{id, isResponse})
 		// fmt.Printf("### P %p: Begin request. New SM %p\n", this, message)
 	})
 	return message, err
 }
 
+// Advanced API. Begin a bidirectional stream. The returned message carries our
+// side of the stream as request data, and the peer's side arrives as response
+// chunks to the same ID, which may begin before the request has ended. The ID
+// is released once both sides have ended (or the stream is canceled).
+//
+// Unlike a request, a stream may be ended without sending any data.
+// Streams need the control extension, so this fails with ErrNotReady until
+// negotiation completes (see Negotiated()), and with ErrStreamsUnavailable if
+// the peer doesn't support it.
+func (this *Protocol) BeginStream(priority int) (message *SendableMessage, err error) {
+	if err = this.checkCanSendMessages(); err != nil {
+		return nil, err
+	}
+	this.mutex.Lock()
+	isNegotiationComplete := this.negotiator.IsNegotiationComplete()
+	hasControl := this.controlMessageId >= 0
+	this.mutex.Unlock()
+	if !isNegotiationComplete {
+		return nil, ErrNotReady
+	}
+	if !hasControl {
+		return nil, ErrStreamsUnavailable
+	}
+
+	if message, err = this.BeginRequest(priority); err != nil {
+		return nil, err
+	}
+	this.requestStateMachine.SetDuplex(message.Id)
+	message.isEmptyAllowed = true
+	// The control message is sent at PriorityOOB, so it always arrives before
+	// the stream's data.
+	if err = this.sendControlMessage(controlOpcodeOpenStream, encodeOpenStream(message.Id, priority)); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// Send a one-way notification, which the peer receives via
+// NotificationReceiver. Unlike a request, a notification doesn't allocate an
+// ID or get a response, so any number can be sent without waiting.
+//
+// Like a request, a notification must contain at least 1 byte. Notifications
+// share an ID reserved by the control extension, so they're sent one at a time
+// (each whole), at priority 0, and bypass flow control. This
+// fails with ErrNotReady until negotiation completes (see Negotiated()), and
+// with ErrNotificationsUnavailable if the peer doesn't support the control
+// extension.
+func (this *Protocol) SendNotification(contents []byte) error {
+	if err := this.checkCanSendMessages(); err != nil {
+		return err
+	}
+	if len(contents) > MaxNotificationLength {
+		return ErrNotificationTooLong
+	}
+	this.mutex.Lock()
+	isNegotiationComplete := this.negotiator.IsNegotiationComplete()
+	notificationMessageId := this.notificationMessageId
+	this.mutex.Unlock()
+	if !isNegotiationComplete {
+		return ErrNotReady
+	}
+	if notificationMessageId < 0 {
+		return ErrNotificationsUnavailable
+	}
+
+	// Notifications share an ID, so they must be sent one at a time.
+	this.notificationMutex.Lock()
+	defer this.notificationMutex.Unlock()
+
+	isResponse := false
+	message := newSendableMessage(&controlMessageSender{this}, notificationPriority,
+		notificationMessageId, this.idBits, this.lengthBits, isResponse)
+	if err := message.Feed(contents); err != nil {
+		return err
+	}
+	return message.End()
+}
+
+// Send a request that will be canceled automatically if its response hasn't
+// completed by the deadline. See BeginRequestWithDeadline().
+func (this *Protocol) SendRequestWithDeadline(priority int, deadline time.Time, contents []byte) (messageId int, err error) {
+	message, err := this.BeginRequestWithDeadline(priority, deadline)
+	if err != nil {
+		return 0, err
+	}
+	if err = message.Feed(contents); err != nil {
+		return message.Id, err
+	}
+	return message.Id, message.End()
+}
+
+// Advanced API. Like BeginRequest(), but if the response hasn't completed by the
+// deadline, the request is canceled and the receiver is notified via
+// DeadlineReceiver (if implemented). The ID is released once the cancel ack
+// arrives. If nothing has been sent by the deadline, the message fails with
+// ErrDeadlineExceeded when it next tries to send, releasing the ID.
+func (this *Protocol) BeginRequestWithDeadline(priority int, deadline time.Time) (message *SendableMessage, err error) {
+	if message, err = this.BeginRequest(priority); err != nil {
+		return nil, err
+	}
+
+	// The ID can't be released until the message sends, so the serial is safe
+	// to fetch now.
+	serial := this.requestStateMachine.GetRequestSerial(message.Id)
+	id := message.Id
+	entry := new(requestDeadline)
+	this.mutex.Lock()
+	this.requestDeadlines[id] = entry
+	entry.timer = time.AfterFunc(time.Until(deadline), func() {
+		this.expireRequest(id, serial, entry)
+	})
+	this.mutex.Unlock()
+	return message, nil
+}
+
+// Advanced API. Like BeginRequest(), but with a weight that sets the message's
+// share of the link relative to other messages at the same priority (the
+// default is DefaultWeight). Weights are only honored by a sender that
+// implements WeightedMessageSender, such as Session.
+func (this *Protocol) BeginRequestWithWeight(priority int, weight int) (message *SendableMessage, err error) {
+	if message, err = this.BeginRequest(priority); err != nil {
+		return nil, err
+	}
+	message.weight = weight
+	return message, nil
+}
+
 // Advanced API. The SendableMessage returned by this method can be used to incrementally
 // add data to the message being sent. Data will be queued and sent as it fills the maximum chunk length.
 func (this *Protocol) BeginResponse(priority int, responseToId int) (*SendableMessage, error) {
-	if !this.negotiator.CanSendMessages() {
-		return nil, fmt.Errorf("Can't send messages: %v", this.negotiator.ExplainFailure())
+	if err := this.checkCanSendMessages(); err != nil {
+		return nil, err
 	}
 
 	// fmt.Printf("### P %p: Begin response id %v\n", this, responseToId)
 	isResponse := true
-	return newSendableMessage(this, priority, responseToId,
-		this.negotiator.IdBits, this.negotiator.LengthBits, isResponse), nil
+	message := newSendableMessage(this, priority, responseToId,
+		this.idBits, this.lengthBits, isResponse)
+	this.openOutgoingFlow(message, flowKey{responseToId, isResponse})
+	this.mutex.Lock()
+	this.outgoingResponses[responseToId] = message
+	this.mutex.Unlock()
+	return message, nil
+}
+
+// Advanced API. Like BeginResponse(), but with a weight. See
+// BeginRequestWithWeight().
+func (this *Protocol) BeginResponseWithWeight(priority int, weight int, responseToId int) (*SendableMessage, error) {
+	message, err := this.BeginResponse(priority, responseToId)
+	if err != nil {
+		return nil, err
+	}
+	message.weight = weight
+	return message, nil
 }
 
 // Cancel a message/operation. If the operation is still active on the other peer,
 // it will be canceled and all remaining queued message chunks of that id removed.
 // You will always receive a cancel ack notification, even if no such operation exists.
+// A request that hasn't sent anything yet fails with ErrCanceled when it next
+// tries to send, and the cancel ack notification arrives then.
 func (this *Protocol) Cancel(messageId int) (err error) {
+	if err = this.checkCanSendMessages(); err != nil {
+		return err
+	}
+
 	outerErr := this.requestStateMachine.TryCancelRequest(messageId, func(id int) {
 		// fmt.Printf("### P %p: Send cancel %v\n", this, messageId)
-		err = this.sendRawMessage(PriorityOOB, id, this.newEmptyMessageHeader(id, internal.MessageTypeCancel))
+		isResponse := false
+		this.sendWindow.closeFlow(flowKey{id, isResponse}, ErrCanceled)
+		err = this.sendCancel(id)
 	})
 	if outerErr != nil {
 		err = outerErr
@@ -139,11 +397,25 @@ func (this *Protocol) Cancel(messageId int) (err error) {
 // with a report on how long it took to receive a reply from the time that the
 // ping was queued for sending.
 func (this *Protocol) Ping() (id int, err error) {
+	if err = this.checkCanSendMessages(); err != nil {
+		return 0, err
+	}
+
 	outerErr := this.requestStateMachine.TryPing(func(newId int) {
 		id = newId
 		// fmt.Printf("### P %p: Send ping %v\n", this, id)
-		if err = this.sendRawMessage(PriorityOOB, id, this.newEmptyMessageHeader(id, internal.MessageTypeRequestEmptyTermination)); err == nil {
-			this.activeOutgoingPings[id] = time.Now()
+		// Record the start time first, since the ack may arrive on another
+		// goroutine before sendRawMessage returns. Ping IDs are released right
+		// away, so several pings may be outstanding on the same ID (their acks
+		// arrive in order).
+		this.mutex.Lock()
+		this.activeOutgoingPings[id] = append(this.activeOutgoingPings[id], time.Now())
+		this.mutex.Unlock()
+		if err = this.sendRawMessage(PriorityOOB, id, this.newEmptyMessageHeader(id, internal.MessageTypeRequestEmptyTermination)); err != nil {
+			this.mutex.Lock()
+			isOldest := false
+			this.popOutgoingPing(id, isOldest)
+			this.mutex.Unlock()
 		}
 	})
 	if outerErr != nil {
@@ -152,12 +424,104 @@ func (this *Protocol) Ping() (id int, err error) {
 	return id, err
 }
 
+// Begin draining: new requests will be rejected with ErrDraining, and the peer
+// will be asked (via a GOAWAY control message) to stop sending new requests.
+// Requests already in progress in either direction are allowed to finish.
+//
+// The returned channel is closed once all of our requests have completed (or
+// been canceled), and all requests from the peer have been completely answered
+// (or canceled by the peer).
+//
+// The peer can only be notified if the control extension was negotiated (see
+// Config.EnableControlExtension). Otherwise it may keep sending new requests,
+// and the drain will only complete once it stops of its own accord.
+func (this *Protocol) Drain() (drained <-chan struct{}, err error) {
+	this.mutex.Lock()
+	this.isDraining = true
+	this.mutex.Unlock()
+
+	err = this.sendGoAwayIfPossible()
+	this.checkDrained()
+	return this.drained, err
+}
+
+// Returns a channel that is closed once the peer has asked us to stop sending
+// new requests because it's draining. BeginRequest() fails with ErrPeerDraining
+// from then on.
+func (this *Protocol) PeerDraining() <-chan struct{} {
+	return this.peerDraining
+}
+
+// Returns a channel that is closed once negotiation has completed. With a quick
+// init, messages may be sent before this.
+func (this *Protocol) Negotiated() <-chan struct{} {
+	return this.negotiated
+}
+
+// Get the codec that the peers agreed on (see Config.Codecs). Fails with
+// ErrNotReady until the peer's codecs arrive (see CodecNegotiated()),
+// ErrCodecsUnavailable if no codecs are configured or the control extension
+// wasn't negotiated, ErrCodecNegotiationTimeout if the peer's codecs didn't
+// arrive within Config.CodecTimeout, or ErrNoCommonCodec.
+func (this *Protocol) Codec() (Codec, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if !this.isCodecNegotiated {
+		return nil, ErrNotReady
+	}
+	return this.codec, this.codecErr
+}
+
+// Returns a channel that is closed once Codec() has its answer.
+func (this *Protocol) CodecNegotiated() <-chan struct{} {
+	return this.codecNegotiated
+}
+
+// Grant the peer credit to send more data for a message, once byteCount bytes
+// of it have been consumed. This is only needed with Config.ManualCreditGrants
+// (and does nothing if flow control wasn't negotiated). Credit must eventually
+// be granted for all incoming message data, including data that is discarded,
+// or the peer will run out of connection credit.
+//
+// Credit is batched, so not every call results in a control message.
+func (this *Protocol) GrantCredit(messageId int, isResponse bool, byteCount int) error {
+	this.mutex.Lock()
+	isActive := this.isFlowControlActive
+	this.mutex.Unlock()
+	if !isActive || byteCount <= 0 {
+		return nil
+	}
+
+	key := flowKey{messageId, isResponse}
+	messageCredit, connectionCredit := this.receiveWindow.consume(key, byteCount)
+	if messageCredit > 0 {
+		if err := this.sendControlMessage(controlOpcodeMessageCredit, encodeMessageCredit(key, messageCredit)); err != nil {
+			return err
+		}
+	}
+	if connectionCredit > 0 {
+		return this.sendControlMessage(controlOpcodeConnectionCredit, encodeConnectionCredit(connectionCredit))
+	}
+	return nil
+}
+
+// Fail any sends that are waiting for flow control credit (and all that try to
+// wait from now on) with err. Call this once the connection has gone away.
+// Session does this automatically when it closes.
+func (this *Protocol) Abort(err error) {
+	this.sendWindow.abort(err)
+}
+
 // Feed data from the other peer into this protocol. This method will always
 // either consume all bytes, or return an error.
 func (this *Protocol) Feed(incomingStreamData []byte) (err error) {
+	this.feedMutex.Lock()
+	defer this.feedMutex.Unlock()
+
 	// fmt.Printf("### P %p: Feed %v bytes. Negotiation complete: %v\n", this, len(incomingStreamData), this.negotiator.IsNegotiationComplete())
 	remainingData := incomingStreamData
 
+	// Only Feed() modifies the negotiator, so it can be read here unlocked.
 	if !this.negotiator.IsNegotiationComplete() {
 		if remainingData, err = this.feedNegotiator(remainingData); err != nil {
 			return err
@@ -165,7 +529,7 @@ func (this *Protocol) Feed(incomingStreamData []byte) (err error) {
 	}
 
 	if len(remainingData) > 0 && !this.negotiator.CanReceiveMessages() {
-		return fmt.Errorf("Can't receive messages: %v", this.negotiator.ExplainFailure())
+		return this.negotiator.Failure()
 	}
 
 	for len(remainingData) > 0 {
@@ -175,17 +539,35 @@ func (this *Protocol) Feed(incomingStreamData []byte) (err error) {
 		}
 	}
 
+	this.checkDrained()
 	return nil
 }
 
 // Callbacks
 
 // Internal callback
-func (this *Protocol) OnRequestChunkToSend(priority int, messageId int, isEnd bool, data []byte) (err error) {
+func (this *Protocol) OnRequestChunkToSend(priority int, weight int, messageId int, isEnd bool, data []byte) (err error) {
 	// fmt.Printf("### P %p: Send request chunk id %v, data %v, term %v\n", this, messageId, len(data), isEnd)
 	outerErr := this.requestStateMachine.TrySendRequestChunk(messageId, isEnd, func(id int, isTerminated bool) {
-		err = this.sendRawMessage(priority, id, data)
+		err = this.sendWeightedMessage(priority, weight, id, data)
+		if isTerminated {
+			isResponse := false
+			this.sendWindow.closeFlow(flowKey{id, isResponse}, nil)
+		}
 	})
+	switch outerErr {
+	case ErrDeadlineExceeded:
+		// The request expired before sending anything, and its ID was released.
+		this.clearDeadline(messageId)
+		this.checkDrained()
+	case ErrCanceled:
+		// The request was canceled before sending anything, so the peer never
+		// saw it, and won't acknowledge the cancel.
+		if ackErr := this.receiveCancelAck(messageId); ackErr != nil {
+			return ackErr
+		}
+		this.checkDrained()
+	}
 	if outerErr != nil {
 		err = outerErr
 	}
@@ -196,7 +578,17 @@ func (this *Protocol) OnRequestChunkToSend(priority int, messageId int, isEnd bo
 func (this *Protocol) OnResponseChunkReceived(messageId int, isEnd bool, data []byte) (err error) {
 	// fmt.Printf("### P %p: Receive response chunk id %v, term %v, data %v\n", this, messageId, isEnd, len(data))
 	outerErr := this.requestStateMachine.TryReceiveResponseChunk(messageId, isEnd, func(id int, isTerminated bool) {
-		err = this.receiver.OnResponseChunkReceived(id, isTerminated, data)
+		if isTerminated {
+			this.clearDeadline(id)
+		}
+		isResponse := true
+		if err = this.receiveMessageData(flowKey{id, isResponse}, isTerminated); err != nil {
+			return
+		}
+		if err = this.receiver.OnResponseChunkReceived(id, isTerminated, data); err != nil {
+			return
+		}
+		err = this.grantCreditAutomatically(flowKey{id, isResponse}, len(data))
 		// fmt.Printf("### P %p: Try receive did call with err %v\n", this, err)
 	})
 	if outerErr != nil {
@@ -208,18 +600,54 @@ func (this *Protocol) OnResponseChunkReceived(messageId int, isEnd bool, data []
 // Internal callback
 func (this *Protocol) OnRequestChunkReceived(messageId int, isEnd bool, data []byte) error {
 	// fmt.Printf("### P %p: Receive request chunk id %v, term %v, data %v\n", this, messageId, isEnd, len(data))
+	this.mutex.Lock()
+	_, isActive := this.activeIncomingRequests[messageId]
 	if isEnd {
 		delete(this.activeIncomingRequests, messageId)
 	} else {
 		this.activeIncomingRequests[messageId] = true
 	}
-	return this.receiver.OnRequestChunkReceived(messageId, isEnd, data)
+	isControlMessage := messageId == this.controlMessageId
+	isNotification := messageId == this.notificationMessageId
+	if !isActive && !isControlMessage && !isNotification {
+		this.unansweredIncomingRequests[messageId] = true
+	}
+	this.mutex.Unlock()
+
+	if isControlMessage {
+		return this.receiveControlMessageChunk(messageId, isEnd, data)
+	}
+	if isNotification {
+		return this.receiveNotificationChunk(messageId, isEnd, data)
+	}
+
+	isResponse := false
+	key := flowKey{messageId, isResponse}
+	if err := this.receiveMessageData(key, isEnd); err != nil {
+		return err
+	}
+	if err := this.receiver.OnRequestChunkReceived(messageId, isEnd, data); err != nil {
+		return err
+	}
+	return this.grantCreditAutomatically(key, len(data))
 }
 
 // Internal callback
-func (this *Protocol) OnResponseChunkToSend(priority int, messageId int, isEnd bool, data []byte) (err error) {
+func (this *Protocol) OnResponseChunkToSend(priority int, weight int, messageId int, isEnd bool, data []byte) (err error) {
 	// fmt.Printf("### P %p: Send response chunk id %v, data %v, term %v\n", this, messageId, len(data), isEnd)
-	return this.sendRawMessage(priority, messageId, data)
+	if err = this.sendWeightedMessage(priority, weight, messageId, data); err != nil {
+		return err
+	}
+	if isEnd {
+		isResponse := true
+		this.sendWindow.closeFlow(flowKey{messageId, isResponse}, nil)
+		this.mutex.Lock()
+		delete(this.unansweredIncomingRequests, messageId)
+		delete(this.outgoingResponses, messageId)
+		this.mutex.Unlock()
+		this.checkDrained()
+	}
+	return nil
 }
 
 // Internal callback
@@ -229,28 +657,43 @@ func (this *Protocol) OnZeroLengthMessageReceived(messageId int, messageType int
 	default:
 		err = fmt.Errorf("Internal bug: Protocol.OnZeroLengthMessageReceived: Unexpected message type %v", messageType)
 	case internal.MessageTypeCancel:
+		this.mutex.Lock()
+		delete(this.activeIncomingRequests, messageId)
+		delete(this.unansweredIncomingRequests, messageId)
+		response := this.outgoingResponses[messageId]
+		delete(this.outgoingResponses, messageId)
+		this.mutex.Unlock()
+		if response != nil {
+			// Otherwise the response would keep sending chunks after the
+			// cancel ack, possibly into a new request on the same ID.
+			response.fail(ErrCanceledByPeer)
+		}
+		isResponse := true
+		this.sendWindow.closeFlow(flowKey{messageId, isResponse}, ErrCanceledByPeer)
+		this.receiveWindow.forget(flowKey{messageId, !isResponse})
 		if err = this.receiver.OnCancelReceived(messageId); err == nil {
 			err = this.cancelAck(messageId)
 		}
 	case internal.MessageTypeCancelAck:
-		outerErr := this.requestStateMachine.TryReceiveCancelAck(messageId, func(id int) {
-			err = this.receiver.OnCancelAckReceived(messageId)
-		})
-		if outerErr != nil {
-			err = outerErr
-		}
+		err = this.receiveCancelAck(messageId)
 	case internal.MessageTypeEmptyResponse:
-		if startTime, exists := this.activeOutgoingPings[messageId]; exists {
+		this.mutex.Lock()
+		isOldest := true
+		startTime, exists := this.popOutgoingPing(messageId, isOldest)
+		this.mutex.Unlock()
+		if exists {
 			err = this.receiver.OnPingAckReceived(messageId, time.Now().Sub(startTime))
 		} else {
-			err = this.receiver.OnEmptyResponseReceived(messageId)
+			err = this.receiveEmptyResponse(messageId)
 		}
 	case internal.MessageTypeRequestEmptyTermination:
-		if _, isActive := this.activeIncomingRequests[messageId]; isActive {
+		this.mutex.Lock()
+		_, isActive := this.activeIncomingRequests[messageId]
+		this.mutex.Unlock()
+		if isActive {
 			isTerminated := true
 			err = this.OnRequestChunkReceived(messageId, isTerminated, []byte{})
 		} else {
-			delete(this.activeOutgoingPings, messageId)
 			if err = this.pingAck(messageId); err == nil {
 				err = this.receiver.OnPingReceived(messageId)
 			}
@@ -263,44 +706,469 @@ func (this *Protocol) OnZeroLengthMessageReceived(messageId int, messageType int
 
 func (this *Protocol) feedNegotiator(incomingStreamData []byte) (remainingData []byte, err error) {
 	// fmt.Printf("### P %p: Feeding %v bytes to negotiator\n", this, len(incomingStreamData))
-	remainingData = incomingStreamData
-	if remainingData, err = this.negotiator.Feed(remainingData); err != nil {
+	this.mutex.Lock()
+	remainingData, err = this.negotiator.Feed(incomingStreamData)
+	isNegotiationComplete := this.negotiator.IsNegotiationComplete()
+	this.mutex.Unlock()
+
+	if err != nil {
 		return nil, err
 	}
-	if !this.negotiator.IsNegotiationComplete() {
+	if !isNegotiationComplete {
 		if len(remainingData) != 0 {
 			return nil, fmt.Errorf("Internal bug: Protocol.feedNegotiator: %v bytes in incoming stream, but negotiation still not complete", len(incomingStreamData))
 		}
 		return remainingData, nil
 	}
 
+	this.mutex.Lock()
+	if this.negotiator.Extensions&internal.ExtensionControl != 0 {
+		this.controlMessageId = internal.ControlMessageId(this.negotiator.IdBits)
+		this.notificationMessageId = internal.NotificationMessageId(this.negotiator.IdBits)
+	}
+	this.isFlowControlActive = this.negotiator.Extensions&internal.ExtensionFlowControl != 0
+	this.mutex.Unlock()
+
 	this.finishEarlyInitialization()
+	close(this.negotiated)
 
+	if err = this.sendGoAwayIfPossible(); err != nil {
+		return nil, err
+	}
+	if err = this.beginFlowControl(); err != nil {
+		return nil, err
+	}
+	if err = this.beginCodecNegotiation(); err != nil {
+		return nil, err
+	}
 	return remainingData, nil
 }
 
 func (this *Protocol) finishEarlyInitialization() {
+	this.mutex.Lock()
+	if this.hasFinishedEarlyInitialization {
+		this.mutex.Unlock()
+		return
+	}
+	this.hasFinishedEarlyInitialization = true
+	this.idBits = this.negotiator.IdBits
+	this.lengthBits = this.negotiator.LengthBits
+	this.decoder.Init(this.idBits, this.lengthBits, this)
+	idPool := internal.NewIdPool(this.idBits)
+	// Reserve the control and notification message IDs even if we don't know
+	// yet whether the peer supports the extension, since a quick init starts
+	// sending early.
+	if this.localExtensions&internal.ExtensionControl != 0 && this.idBits >= internal.MinExtensionIdBits {
+		idPool.ReserveId(internal.ControlMessageId(this.idBits))
+		idPool.ReserveId(internal.NotificationMessageId(this.idBits))
+	}
+	this.requestStateMachine.Init(idPool)
+	this.mutex.Unlock()
+
+	this.sender.OnAbleToSend()
+}
+
+// Check that messages may be sent. Once this succeeds, idBits and lengthBits
+// are safe to read from any goroutine.
+func (this *Protocol) checkCanSendMessages() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if !this.negotiator.CanSendMessages() {
+		return this.negotiator.Failure()
+	}
 	if !this.hasFinishedEarlyInitialization {
-		this.hasFinishedEarlyInitialization = true
-		this.decoder.Init(this.negotiator.IdBits, this.negotiator.LengthBits, this)
-		this.requestStateMachine.Init(internal.NewIdPool(this.negotiator.IdBits))
-		this.sender.OnAbleToSend()
+		// Quick init, but SendInitialization() hasn't been called yet.
+		return ErrNotReady
+	}
+	return nil
+}
+
+type requestDeadline struct {
+	timer *time.Timer
+}
+
+// Stop and forget the deadline timer for a request, if any. This must be called
+// before the ID is released.
+func (this *Protocol) clearDeadline(id int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if entry, exists := this.requestDeadlines[id]; exists {
+		entry.timer.Stop()
+		delete(this.requestDeadlines, id)
+	}
+}
+
+// Releases the ID of a canceled request.
+func (this *Protocol) receiveCancelAck(messageId int) (err error) {
+	outerErr := this.requestStateMachine.TryReceiveCancelAck(messageId, func(id int) {
+		this.clearDeadline(id)
+		isResponse := true
+		this.receiveWindow.forget(flowKey{id, isResponse})
+		err = this.receiver.OnCancelAckReceived(id)
+	})
+	if outerErr != nil {
+		err = outerErr
+	}
+	return err
+}
+
+// Called from a timer goroutine when a request's deadline passes.
+func (this *Protocol) expireRequest(id int, serial uint64, entry *requestDeadline) {
+	this.mutex.Lock()
+	if this.requestDeadlines[id] == entry {
+		delete(this.requestDeadlines, id)
+	}
+	this.mutex.Unlock()
+
+	isExpired := this.requestStateMachine.TryExpireRequest(id, serial, func(id int) {
+		// If this fails, the connection is going down anyway.
+		this.sendCancel(id)
+	})
+	if !isExpired {
+		return
+	}
+	// Wake the message if it's waiting for credit to send.
+	isResponse := false
+	this.sendWindow.closeFlow(flowKey{id, isResponse}, ErrDeadlineExceeded)
+	if receiver, ok := this.receiver.(DeadlineReceiver); ok {
+		receiver.OnRequestDeadlineExceeded(id)
 	}
 }
 
+func (this *Protocol) checkCanBeginRequest() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.isDraining {
+		return ErrDraining
+	}
+	if this.isPeerDraining {
+		return ErrPeerDraining
+	}
+	return nil
+}
+
+// Close the drained channel if we're draining and nothing is outstanding.
+func (this *Protocol) checkDrained() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if !this.isDraining || this.isDrained {
+		return
+	}
+	if len(this.unansweredIncomingRequests) > 0 || this.requestStateMachine.ActiveRequestCount() > 0 {
+		return
+	}
+	this.isDrained = true
+	close(this.drained)
+}
+
+// Send a GOAWAY if we're draining, and it's possible to tell the peer. If it's
+// not possible yet, this gets called again once negotiation completes.
+func (this *Protocol) sendGoAwayIfPossible() error {
+	this.mutex.Lock()
+	shouldSend := this.isDraining && !this.hasSentGoAway &&
+		this.controlMessageId >= 0 && this.hasFinishedEarlyInitialization
+	if shouldSend {
+		this.hasSentGoAway = true
+	}
+	this.mutex.Unlock()
+
+	if !shouldSend {
+		return nil
+	}
+	return this.sendControlMessage(controlOpcodeGoAway, nil)
+}
+
+func (this *Protocol) sendControlMessage(opcode controlOpcode, payload []byte) error {
+	// Control messages share an ID, so they must be sent one at a time.
+	this.controlMutex.Lock()
+	defer this.controlMutex.Unlock()
+
+	isResponse := false
+	message := newSendableMessage(&controlMessageSender{this}, PriorityOOB,
+		this.controlMessageId, this.idBits, this.lengthBits, isResponse)
+	if err := message.Feed([]byte{byte(opcode)}); err != nil {
+		return err
+	}
+	if err := message.Feed(payload); err != nil {
+		return err
+	}
+	return message.End()
+}
+
+// Only called from within Feed().
+func (this *Protocol) receiveControlMessageChunk(messageId int, isEnd bool, data []byte) error {
+	if len(this.controlMessage)+len(data) > maxControlMessageLength {
+		return newControlProtocolViolation(messageId, "Control message is too long")
+	}
+	this.controlMessage = append(this.controlMessage, data...)
+	if !isEnd {
+		return nil
+	}
+
+	message := this.controlMessage
+	this.controlMessage = nil
+	if len(message) == 0 {
+		return newControlProtocolViolation(messageId, "Control message has no opcode")
+	}
+
+	switch controlOpcode(message[0]) {
+	default:
+		// Unknown opcodes are ignored.
+	case controlOpcodeGoAway:
+		this.mutex.Lock()
+		if !this.isPeerDraining {
+			this.isPeerDraining = true
+			close(this.peerDraining)
+		}
+		this.mutex.Unlock()
+	case controlOpcodeMessageCredit:
+		key, byteCount, ok := decodeMessageCredit(message[1:])
+		if !ok {
+			return newControlProtocolViolation(messageId, "Malformed message credit")
+		}
+		this.sendWindow.grant(key, byteCount)
+	case controlOpcodeConnectionCredit:
+		byteCount, ok := decodeConnectionCredit(message[1:])
+		if !ok {
+			return newControlProtocolViolation(messageId, "Malformed connection credit")
+		}
+		this.sendWindow.grantConnection(byteCount)
+	case controlOpcodeOpenStream:
+		streamId, priority, ok := decodeOpenStream(message[1:])
+		if !ok {
+			return newControlProtocolViolation(messageId, "Malformed stream ID")
+		}
+		return this.openIncomingStream(streamId, priority)
+	case controlOpcodeCodecs:
+		names, ok := decodeCodecNames(message[1:])
+		if !ok {
+			return newControlProtocolViolation(messageId, "Malformed codec list")
+		}
+		this.receiveCodecNames(names)
+	}
+	return nil
+}
+
+// Only called from within Feed().
+func (this *Protocol) receiveNotificationChunk(messageId int, isEnd bool, data []byte) error {
+	if len(this.notification)+len(data) > MaxNotificationLength {
+		return newNotificationProtocolViolation(messageId, "Notification is too long")
+	}
+	this.notification = append(this.notification, data...)
+	if !isEnd {
+		return nil
+	}
+
+	notification := this.notification
+	this.notification = nil
+	if receiver, ok := this.receiver.(NotificationReceiver); ok {
+		return receiver.OnNotificationReceived(notification)
+	}
+	return nil
+}
+
+// Called once negotiation completes. Codecs are only negotiated if we have
+// some, and can only be negotiated via the control extension. A peer that
+// predates codec negotiation (or has no codecs) ignores ours rather than
+// sending its own, so we only wait so long.
+func (this *Protocol) beginCodecNegotiation() error {
+	this.mutex.Lock()
+	isNegotiable := this.controlMessageId >= 0 && len(this.localCodecs) > 0
+	if isNegotiable && !this.isCodecNegotiated {
+		this.codecTimer = time.AfterFunc(this.codecTimeout, func() {
+			this.finishCodecNegotiation(nil, ErrCodecNegotiationTimeout)
+		})
+	}
+	this.mutex.Unlock()
+	if !isNegotiable {
+		this.finishCodecNegotiation(nil, ErrCodecsUnavailable)
+		return nil
+	}
+	return this.sendControlMessage(controlOpcodeCodecs, encodeCodecNames(this.localCodecs))
+}
+
+func (this *Protocol) receiveCodecNames(remoteCodecs []string) {
+	if len(this.localCodecs) == 0 {
+		// We aren't negotiating codecs.
+		return
+	}
+	name, ok := chooseCodec(this.localCodecs, remoteCodecs)
+	var codec Codec
+	if ok {
+		codec = LookupCodec(name)
+	}
+	if codec == nil {
+		this.finishCodecNegotiation(nil, ErrNoCommonCodec)
+		return
+	}
+	this.finishCodecNegotiation(codec, nil)
+}
+
+// Only the first outcome counts.
+func (this *Protocol) finishCodecNegotiation(codec Codec, err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.isCodecNegotiated {
+		return
+	}
+	this.isCodecNegotiated = true
+	this.codec = codec
+	this.codecErr = err
+	if this.codecTimer != nil {
+		this.codecTimer.Stop()
+	}
+	close(this.codecNegotiated)
+}
+
+// Only called from within Feed(). The stream is treated as an incoming request
+// that has already begun, so that even an empty one ends properly (rather than
+// being mistaken for a ping).
+func (this *Protocol) openIncomingStream(messageId int, priority int) error {
+	this.mutex.Lock()
+	_, isActive := this.activeIncomingRequests[messageId]
+	isValid := messageId >= 0 && messageId < 1<<uint(this.idBits) &&
+		messageId != this.controlMessageId && messageId != this.notificationMessageId
+	if isValid && !isActive {
+		this.activeIncomingRequests[messageId] = true
+		this.unansweredIncomingRequests[messageId] = true
+	}
+	this.mutex.Unlock()
+
+	if !isValid || isActive {
+		return newControlProtocolViolation(messageId, "Stream ID is invalid or already in use")
+	}
+	if receiver, ok := this.receiver.(StreamReceiver); ok {
+		return receiver.OnStreamOpened(messageId, priority)
+	}
+	return nil
+}
+
+// Called once negotiation completes. If flow control wasn't negotiated, stop
+// limiting what we send. Otherwise grant the peer any extra connection credit
+// beyond the default window.
+func (this *Protocol) beginFlowControl() error {
+	this.mutex.Lock()
+	isActive := this.isFlowControlActive
+	this.mutex.Unlock()
+	if !isActive {
+		this.sendWindow.deactivate()
+		return nil
+	}
+
+	if extraCredit := this.receiveWindow.connectionWindow - DefaultConnectionWindow; extraCredit > 0 {
+		return this.sendControlMessage(controlOpcodeConnectionCredit, encodeConnectionCredit(extraCredit))
+	}
+	return nil
+}
+
+func (this *Protocol) openOutgoingFlow(message *SendableMessage, key flowKey) {
+	if this.localExtensions&internal.ExtensionFlowControl != 0 {
+		message.setFlowControl(&this.sendWindow, this.sendWindow.openFlow(key))
+	}
+}
+
+// Only called from within Feed(), before the data is passed to the receiver.
+func (this *Protocol) receiveMessageData(key flowKey, isEnd bool) error {
+	if !this.isFlowControlActive {
+		return nil
+	}
+	if extraCredit := this.receiveWindow.receive(key, isEnd); extraCredit > 0 {
+		return this.sendControlMessage(controlOpcodeMessageCredit, encodeMessageCredit(key, extraCredit))
+	}
+	return nil
+}
+
+func (this *Protocol) grantCreditAutomatically(key flowKey, byteCount int) error {
+	if this.isManualCreditGrants {
+		return nil
+	}
+	return this.GrantCredit(key.messageId, key.isResponse, byteCount)
+}
+
+// An empty response is also how a response that fills its last chunk exactly
+// is terminated. Only called from within Feed().
+func (this *Protocol) receiveEmptyResponse(messageId int) (err error) {
+	hasBegun := this.requestStateMachine.IsReceivingResponse(messageId)
+	isTerminated := true
+	outerErr := this.requestStateMachine.TryReceiveResponseChunk(messageId, isTerminated, func(id int, isTerminated bool) {
+		this.clearDeadline(id)
+		if hasBegun {
+			isResponse := true
+			if err = this.receiveMessageData(flowKey{id, isResponse}, isTerminated); err != nil {
+				return
+			}
+			err = this.receiver.OnResponseChunkReceived(id, isTerminated, []byte{})
+		} else {
+			err = this.receiver.OnEmptyResponseReceived(id)
+		}
+	})
+	if outerErr != nil {
+		err = outerErr
+	}
+	return err
+}
+
+// Must be called while holding the mutex. Pops the oldest ping sent on this ID,
+// or the newest if the ping wasn't actually sent.
+func (this *Protocol) popOutgoingPing(id int, isOldest bool) (sentAt time.Time, exists bool) {
+	pings := this.activeOutgoingPings[id]
+	if len(pings) == 0 {
+		return sentAt, false
+	}
+	if isOldest {
+		sentAt = pings[0]
+		pings = pings[1:]
+	} else {
+		sentAt = pings[len(pings)-1]
+		pings = pings[:len(pings)-1]
+	}
+	if len(pings) == 0 {
+		delete(this.activeOutgoingPings, id)
+	} else {
+		this.activeOutgoingPings[id] = pings
+	}
+	return sentAt, true
+}
+
 func (this *Protocol) sendRawMessage(priority int, messageId int, data []byte) error {
+	return this.sendWeightedMessage(priority, DefaultWeight, messageId, data)
+}
+
+func (this *Protocol) sendWeightedMessage(priority int, weight int, messageId int, data []byte) error {
 	// fmt.Printf("### P %p: Send raw message id %v, data %v\n", this, messageId, len(data))
+	if this.weightedSender != nil {
+		return this.weightedSender.OnWeightedMessageChunkToSend(priority, weight, messageId, data)
+	}
 	return this.sender.OnMessageChunkToSend(priority, messageId, data)
 }
 
 func (this *Protocol) newEmptyMessageHeader(id int, messageType internal.MessageType) []byte {
 	var header internal.MessageHeader
-	header.Init(this.negotiator.IdBits, this.negotiator.LengthBits)
+	header.Init(this.idBits, this.lengthBits)
 	header.SetIdAndType(id, messageType)
 	// fmt.Printf("### P %p: Sending empty message [%v]\n", this, hex.EncodeToString(header.Encoded.Data))
 	return header.Encoded.Data
 }
 
+// The request's queued chunks are purged first, so that the cancel can't
+// overtake them.
+func (this *Protocol) sendCancel(id int) error {
+	if this.purgingSender != nil {
+		this.purgingSender.OnPurgeRequestChunks(id)
+	}
+	return this.sendRawMessage(PriorityOOB, id, this.newEmptyMessageHeader(id, internal.MessageTypeCancel))
+}
+
+func (this *Protocol) waitUntilSent(messageId int, isResponse bool) {
+	if this.waitingSender != nil {
+		this.waitingSender.OnWaitUntilSent(messageId, isResponse)
+	}
+}
+
 func (this *Protocol) cancelAck(id int) error {
 	// fmt.Printf("### P %p: Send cancel ack id %v\n", this, id)
 	return this.sendRawMessage(PriorityOOB, id, this.newEmptyMessageHeader(id, internal.MessageTypeCancelAck))
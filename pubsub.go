@@ -0,0 +1,328 @@
+package streamux
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// What a Broker does when a subscriber's buffer is full.
+type OverflowPolicy int
+
+const (
+	// Discard the oldest buffered event to make room for the new one.
+	OverflowDropOldest OverflowPolicy = iota
+	// End the subscription. The subscriber gets the events buffered so far,
+	// then Subscription.Next() returns io.EOF.
+	OverflowDisconnect
+)
+
+// The number of events buffered per subscriber when none is specified.
+const DefaultSubscriberBufferSize = 64
+
+// Broker is a streamux Handler that publishes events to subscribers on the peer
+// (see Session.Subscribe()). Register it with a ServeMux under the route that
+// subscribers use.
+//
+// A subscription is a request carrying a topic pattern, whose response stays
+// open: the broker pushes each matching event as a chunk of the response, and
+// the subscriber unsubscribes by canceling the request.
+//
+// Topics are made of segments separated by ".", such as "news.sports". In a
+// pattern, "*" matches any one segment, and ">" (which must come last) matches
+// one or more trailing segments. So "news.*" matches "news.sports", and
+// "news.>" also matches "news.sports.football".
+//
+// Events wait in a bounded buffer per subscriber until they can be sent, so a
+// slow subscriber doesn't hold up publishing. Events are only taken from the
+// buffer once the previous ones have left the session's send queue, so a slow
+// link fills the buffer just as a slow reader does (with flow control). When a
+// subscriber's buffer is full, the broker's OverflowPolicy decides what
+// happens.
+type Broker struct {
+	bufferSize     int
+	overflowPolicy OverflowPolicy
+	subscribers    map[*brokerSubscriber]bool
+	isClosed       bool
+	mutex          sync.Mutex
+}
+
+// Subscription receives the events published to a topic pattern (see
+// Session.Subscribe()).
+type Subscription struct {
+	Pattern string
+	reader  *MessageReader
+}
+
+// API
+
+// bufferSize is the number of events buffered per subscriber (if < 1,
+// DefaultSubscriberBufferSize is used).
+func NewBroker(bufferSize int, overflowPolicy OverflowPolicy) *Broker {
+	this := new(Broker)
+	this.Init(bufferSize, overflowPolicy)
+	return this
+}
+
+func (this *Broker) Init(bufferSize int, overflowPolicy OverflowPolicy) {
+	if bufferSize < 1 {
+		bufferSize = DefaultSubscriberBufferSize
+	}
+	this.bufferSize = bufferSize
+	this.overflowPolicy = overflowPolicy
+	this.subscribers = make(map[*brokerSubscriber]bool)
+}
+
+// Publish an event to every subscriber whose pattern matches the topic.
+// Returns ErrInvalidTopic if the topic is empty, has an empty segment or a
+// wildcard, or is longer than MaxRouteLength.
+func (this *Broker) Publish(topic string, data []byte) error {
+	segments, ok := splitTopic(topic, false)
+	if !ok {
+		return ErrInvalidTopic
+	}
+	event := brokerEvent{topic, append([]byte(nil), data...)}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for subscriber := range this.subscribers {
+		if !matchTopic(subscriber.pattern, segments) {
+			continue
+		}
+		if !subscriber.push(event) {
+			delete(this.subscribers, subscriber)
+		}
+	}
+	return nil
+}
+
+func (this *Broker) SubscriberCount() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return len(this.subscribers)
+}
+
+// End every subscription (after sending any events already buffered), and
+// reject new ones.
+func (this *Broker) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.isClosed = true
+	for subscriber := range this.subscribers {
+		subscriber.disconnect()
+	}
+	this.subscribers = make(map[*brokerSubscriber]bool)
+	return nil
+}
+
+// Internal callback
+func (this *Broker) ServeStreamux(response ResponseWriter, request *Request) {
+	pattern, err := ioutil.ReadAll(io.LimitReader(request.Body, MaxRouteLength+1))
+	if err != nil {
+		return
+	}
+	segments, ok := splitTopic(string(pattern), true)
+	if !ok {
+		// Rejected with an empty response.
+		return
+	}
+
+	subscriber := newBrokerSubscriber(segments, this.bufferSize, this.overflowPolicy)
+	this.mutex.Lock()
+	if this.isClosed {
+		this.mutex.Unlock()
+		return
+	}
+	this.subscribers[subscriber] = true
+	this.mutex.Unlock()
+	defer this.unsubscribe(subscriber)
+
+	if _, err = response.Write([]byte{subscriptionAccepted}); err != nil {
+		return
+	}
+	if err = response.Flush(); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-subscriber.wake:
+		case <-request.Context().Done():
+			return
+		}
+		events, isDisconnected := subscriber.take()
+		for _, event := range events {
+			if _, err = response.Write(encodeEvent(event)); err != nil {
+				return
+			}
+		}
+		if err = response.Flush(); err != nil || isDisconnected {
+			return
+		}
+		// Events queued for sending are out of the buffer's reach, so only
+		// take more once these have gone.
+		if waiter, ok := response.(SentWaiter); ok {
+			waiter.WaitUntilSent()
+		}
+	}
+}
+
+// Wait for the next event. Returns io.EOF once the broker ends the
+// subscription.
+func (this *Subscription) Next() (topic string, data []byte, err error) {
+	if topic, err = readRoute(this.reader); err != nil {
+		return "", nil, err
+	}
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(this.reader, header); err != nil {
+		return "", nil, unexpectedEOF(err)
+	}
+	length := int64(binary.LittleEndian.Uint32(header))
+	// Not preallocated, since the length comes from the peer.
+	if data, err = ioutil.ReadAll(io.LimitReader(this.reader, length)); err != nil {
+		return "", nil, err
+	}
+	if int64(len(data)) != length {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	return topic, data, nil
+}
+
+// Unsubscribe, by canceling the subscription's request.
+func (this *Subscription) Close() error {
+	return this.reader.Close()
+}
+
+// Internal
+
+// The first byte of a subscription's response, confirming that the
+// subscription is active. Each event follows as its topic (encoded like a
+// route), then its length as a 32-bit little endian integer, then its data.
+const subscriptionAccepted = 0
+
+type brokerEvent struct {
+	topic string
+	data  []byte
+}
+
+func encodeEvent(event brokerEvent) []byte {
+	encoded, _ := EncodeRoute(event.topic)
+	header := make([]byte, 4)
+	binary.LittleEndian.PutUint32(header, uint32(len(event.data)))
+	encoded = append(encoded, header...)
+	return append(encoded, event.data...)
+}
+
+func (this *Broker) unsubscribe(subscriber *brokerSubscriber) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	delete(this.subscribers, subscriber)
+}
+
+type brokerSubscriber struct {
+	pattern        []string
+	bufferSize     int
+	overflowPolicy OverflowPolicy
+	events         []brokerEvent
+	isDisconnected bool
+	// Signaled when there are events to send, or the subscription has ended.
+	wake  chan struct{}
+	mutex sync.Mutex
+}
+
+func newBrokerSubscriber(pattern []string, bufferSize int, overflowPolicy OverflowPolicy) *brokerSubscriber {
+	this := new(brokerSubscriber)
+	this.pattern = pattern
+	this.bufferSize = bufferSize
+	this.overflowPolicy = overflowPolicy
+	this.wake = make(chan struct{}, 1)
+	return this
+}
+
+// Returns false if the subscriber has been disconnected.
+func (this *brokerSubscriber) push(event brokerEvent) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.isDisconnected {
+		return false
+	}
+	if len(this.events) >= this.bufferSize {
+		if this.overflowPolicy == OverflowDisconnect {
+			this.isDisconnected = true
+			this.signal()
+			return false
+		}
+		this.events[0] = brokerEvent{}
+		this.events = this.events[1:]
+	}
+	this.events = append(this.events, event)
+	this.signal()
+	return true
+}
+
+func (this *brokerSubscriber) disconnect() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.isDisconnected = true
+	this.signal()
+}
+
+func (this *brokerSubscriber) take() (events []brokerEvent, isDisconnected bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	events = this.events
+	this.events = nil
+	return events, this.isDisconnected
+}
+
+// Must be called while holding the mutex.
+func (this *brokerSubscriber) signal() {
+	select {
+	case this.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Split a topic into its segments. Wildcards are only allowed in patterns.
+func splitTopic(topic string, isPattern bool) (segments []string, ok bool) {
+	if len(topic) == 0 || len(topic) > MaxRouteLength {
+		return nil, false
+	}
+	segments = strings.Split(topic, ".")
+	for i, segment := range segments {
+		switch segment {
+		case "":
+			return nil, false
+		case "*":
+			if !isPattern {
+				return nil, false
+			}
+		case ">":
+			if !isPattern || i != len(segments)-1 {
+				return nil, false
+			}
+		}
+	}
+	return segments, true
+}
+
+func matchTopic(pattern []string, topic []string) bool {
+	for i, segment := range pattern {
+		if segment == ">" {
+			return len(topic) > i
+		}
+		if i >= len(topic) || (segment != "*" && segment != topic[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,272 @@
+package streamux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestBrokerSessionPair(broker *Broker) (client, server *Session) {
+	mux := NewServeMux()
+	mux.Handle("events", broker)
+	return newTestServeMuxSessionPair(mux)
+}
+
+// A transport that takes a while to write anything.
+type slowWriteConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (this *slowWriteConn) Write(p []byte) (int, error) {
+	time.Sleep(this.delay)
+	return this.Conn.Write(p)
+}
+
+func newTestSlowBrokerSessionPair(broker *Broker, writeDelay time.Duration) (client, server *Session) {
+	mux := NewServeMux()
+	mux.Handle("events", broker)
+	client, server = newTestPipeSessionPair(nil, func(conn net.Conn) io.ReadWriteCloser {
+		return &slowWriteConn{conn, writeDelay}
+	}, mux)
+	mux.SetResponder(server)
+	return client, server
+}
+
+// Publish events numbered from 0, faster than a slow transport can send them.
+func publishNumberedEvents(broker *Broker, topic string, count int) {
+	for i := 0; i < count; i++ {
+		broker.Publish(topic, []byte(strconv.Itoa(i)))
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func assertNextEvent(t *testing.T, subscription *Subscription, expectedTopic string, expectedData string) bool {
+	topic, data, err := subscription.Next()
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+	if topic != expectedTopic || string(data) != expectedData {
+		t.Errorf("%v: Expected %v %q but got %v %q", subscription.Pattern, expectedTopic, expectedData, topic, data)
+		return false
+	}
+	return true
+}
+
+// =============================================================================
+
+func TestPubSub(t *testing.T) {
+	broker := NewBroker(0, OverflowDropOldest)
+	client, server := newTestBrokerSessionPair(broker)
+	defer server.Close()
+	defer client.Close()
+
+	subscriptions := make(map[string]*Subscription)
+	for _, pattern := range []string{"news.*", "news.>", "sports.football"} {
+		subscription, err := client.Subscribe(0, "events", pattern)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer subscription.Close()
+		subscriptions[pattern] = subscription
+	}
+
+	broker.Publish("news.local", []byte("a"))
+	broker.Publish("news.world.europe", []byte("b"))
+	broker.Publish("sports.tennis", []byte("c"))
+	broker.Publish("sports.football", []byte("d"))
+
+	if !assertNextEvent(t, subscriptions["news.*"], "news.local", "a") {
+		return
+	}
+	if !assertNextEvent(t, subscriptions["news.>"], "news.local", "a") ||
+		!assertNextEvent(t, subscriptions["news.>"], "news.world.europe", "b") {
+		return
+	}
+	assertNextEvent(t, subscriptions["sports.football"], "sports.football", "d")
+}
+
+func TestPubSubUnsubscribe(t *testing.T) {
+	broker := NewBroker(0, OverflowDropOldest)
+	client, server := newTestBrokerSessionPair(broker)
+	defer server.Close()
+	defer client.Close()
+
+	subscription, err := client.Subscribe(0, "events", "news.>")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if count := broker.SubscriberCount(); count != 1 {
+		t.Errorf("Expected 1 subscriber but got %v", count)
+	}
+	subscription.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for broker.SubscriberCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Errorf("Timed out waiting for the unsubscribe")
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	awaitIdsReleased(t, client)
+}
+
+func TestPubSubBrokerClose(t *testing.T) {
+	broker := NewBroker(0, OverflowDropOldest)
+	client, server := newTestBrokerSessionPair(broker)
+	defer server.Close()
+	defer client.Close()
+
+	subscription, err := client.Subscribe(0, "events", "news.*")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	broker.Publish("news.local", []byte("last"))
+	broker.Close()
+
+	if !assertNextEvent(t, subscription, "news.local", "last") {
+		return
+	}
+	if _, _, err = subscription.Next(); err != io.EOF {
+		t.Errorf("Expected %v but got %v", io.EOF, err)
+	}
+	if _, err = client.Subscribe(0, "events", "news.*"); err != ErrSubscriptionRejected {
+		t.Errorf("Expected %v but got %v", ErrSubscriptionRejected, err)
+	}
+}
+
+func TestPubSubInvalid(t *testing.T) {
+	broker := NewBroker(0, OverflowDropOldest)
+	client, server := newTestBrokerSessionPair(broker)
+	defer server.Close()
+	defer client.Close()
+
+	for _, pattern := range []string{"", "news..local", "news.>.local"} {
+		if _, err := client.Subscribe(0, "events", pattern); err != ErrInvalidTopic {
+			t.Errorf("Pattern %q: Expected %v but got %v", pattern, ErrInvalidTopic, err)
+		}
+	}
+	if _, err := client.Subscribe(0, "no broker", "news.*"); err != ErrSubscriptionRejected {
+		t.Errorf("Expected %v but got %v", ErrSubscriptionRejected, err)
+	}
+	if err := broker.Publish("news.*", nil); err != ErrInvalidTopic {
+		t.Errorf("Expected %v but got %v", ErrInvalidTopic, err)
+	}
+}
+
+func TestTopicMatching(t *testing.T) {
+	assertMatch := func(pattern string, topic string, expected bool) {
+		patternSegments, _ := splitTopic(pattern, true)
+		topicSegments, _ := splitTopic(topic, false)
+		if actual := matchTopic(patternSegments, topicSegments); actual != expected {
+			t.Errorf("Pattern %v, topic %v: Expected %v but got %v", pattern, topic, expected, actual)
+		}
+	}
+	assertMatch("a.b", "a.b", true)
+	assertMatch("a.b", "a.c", false)
+	assertMatch("a.b", "a.b.c", false)
+	assertMatch("a.*", "a.b", true)
+	assertMatch("a.*", "a", false)
+	assertMatch("a.*", "a.b.c", false)
+	assertMatch("*.b", "a.b", true)
+	assertMatch("a.>", "a.b.c", true)
+	assertMatch("a.>", "a", false)
+	assertMatch(">", "a.b", true)
+}
+
+func TestSubscriberOverflow(t *testing.T) {
+	subscriber := newBrokerSubscriber(nil, 2, OverflowDropOldest)
+	for _, topic := range []string{"a", "b", "c"} {
+		if !subscriber.push(brokerEvent{topic: topic}) {
+			t.Errorf("Expected the subscriber to stay connected")
+		}
+	}
+	events, isDisconnected := subscriber.take()
+	if isDisconnected || len(events) != 2 || events[0].topic != "b" || events[1].topic != "c" {
+		t.Errorf("Expected the oldest event to be dropped, but got %v (disconnected: %v)", events, isDisconnected)
+	}
+
+	subscriber = newBrokerSubscriber(nil, 2, OverflowDisconnect)
+	subscriber.push(brokerEvent{topic: "a"})
+	subscriber.push(brokerEvent{topic: "b"})
+	if subscriber.push(brokerEvent{topic: "c"}) {
+		t.Errorf("Expected the subscriber to be disconnected")
+	}
+	events, isDisconnected = subscriber.take()
+	if !isDisconnected || len(events) != 2 {
+		t.Errorf("Expected the buffered events and a disconnect, but got %v (disconnected: %v)", events, isDisconnected)
+	}
+}
+
+func TestPubSubSlowTransportDropsOldest(t *testing.T) {
+	broker := NewBroker(2, OverflowDropOldest)
+	client, server := newTestSlowBrokerSessionPair(broker, 10*time.Millisecond)
+	defer server.Close()
+	defer client.Close()
+
+	subscription, err := client.Subscribe(0, "events", "news.>")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer subscription.Close()
+
+	eventCount := 50
+	go publishNumberedEvents(broker, "news.local", eventCount)
+
+	lastEvent := fmt.Sprint(eventCount - 1)
+	receivedCount := 0
+	for {
+		_, data, err := subscription.Next()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		receivedCount++
+		if string(data) == lastEvent {
+			break
+		}
+	}
+	if receivedCount >= eventCount {
+		t.Errorf("Expected events to be dropped, but all %v were received", receivedCount)
+	}
+}
+
+func TestPubSubSlowTransportDisconnects(t *testing.T) {
+	broker := NewBroker(2, OverflowDisconnect)
+	client, server := newTestSlowBrokerSessionPair(broker, 10*time.Millisecond)
+	defer server.Close()
+	defer client.Close()
+
+	subscription, err := client.Subscribe(0, "events", "news.>")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer subscription.Close()
+
+	eventCount := 50
+	go publishNumberedEvents(broker, "news.local", eventCount)
+
+	receivedCount := 0
+	for receivedCount < eventCount {
+		if _, _, err = subscription.Next(); err != nil {
+			break
+		}
+		receivedCount++
+	}
+	if err != io.EOF {
+		t.Errorf("Expected %v but got %v", io.EOF, err)
+	}
+	if receivedCount >= eventCount {
+		t.Errorf("Expected a disconnect, but all %v events were received", receivedCount)
+	}
+}
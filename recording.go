@@ -0,0 +1,302 @@
+package streamux
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// The direction of a recorded chunk of data.
+type RecordDirection byte
+
+const (
+	// Data received from the peer, which was passed to Protocol.Feed().
+	RecordIncoming RecordDirection = 'I'
+	// Data sent to the peer, which came from MessageSender.OnMessageChunkToSend().
+	RecordOutgoing RecordDirection = 'O'
+)
+
+// A recording begins with these bytes. The final byte is the format version.
+var recordingMagic = []byte{'S', 'M', 'X', 'R', 1}
+
+// The longest chunk that a recording will hold (or that RecordingReader will
+// accept).
+const MaxRecordLength = 1 << 30
+
+// Recorder writes a log of the data passing through a connection, so that it
+// can be examined or replayed later (see Replayer). Wrap a session's transport
+// with NewRecordingTransport() to record everything it reads and writes, or
+// call Record() directly when driving a Protocol yourself.
+//
+// A recording is the magic bytes "SMXR" and a version byte (1), followed by a
+// record per chunk of data: the direction byte ('I' or 'O'), the time since
+// the recording began in nanoseconds as a 64-bit little endian integer, the
+// data's length as a 32-bit little endian integer, and then the data itself.
+//
+// If writing the recording fails, recording stops (see Err()), but the
+// connection carries on.
+type Recorder struct {
+	writer    io.Writer
+	startTime time.Time
+	err       error
+	mutex     sync.Mutex
+}
+
+// RecordedChunk is one record read back from a recording.
+type RecordedChunk struct {
+	Direction RecordDirection
+	// The time since the recording began.
+	Time time.Duration
+	Data []byte
+}
+
+// RecordingReader reads the records of a recording, in the order they were
+// written.
+type RecordingReader struct {
+	reader io.Reader
+}
+
+// Replayer feeds the incoming data of a recording into a fresh Protocol, to
+// reproduce what happened on the recorded side of a connection. The receiver
+// plays the part of the recorded application, and may send messages via
+// Protocol() from its callbacks.
+//
+// Everything the replayed protocol sends is collected rather than sent (see
+// Sent()), and can be compared with the recording's outgoing data. It will
+// only match if the receiver sends the same messages in the same order, and
+// the recorded side didn't send requests of its own, since request IDs are
+// chosen at random.
+//
+// The incoming data is fed in the same chunks as it was recorded, all from the
+// goroutine calling Replay(), so a replay doesn't depend on timing. Callbacks
+// that send messages must not block on flow control credit, since the credit
+// can only arrive once the callback has returned.
+type Replayer struct {
+	protocol *Protocol
+	sent     []byte
+	mutex    sync.Mutex
+}
+
+// API
+
+// Create a recorder that writes to writer, starting with the magic bytes.
+func NewRecorder(writer io.Writer) (*Recorder, error) {
+	this := new(Recorder)
+	if err := this.Init(writer); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+func (this *Recorder) Init(writer io.Writer) error {
+	this.writer = writer
+	this.startTime = time.Now()
+	if _, err := writer.Write(recordingMagic); err != nil {
+		this.err = err
+		return err
+	}
+	return nil
+}
+
+// Record a chunk of data. Safe to call from multiple goroutines. Returns the
+// error that stopped recording, if any.
+func (this *Recorder) Record(direction RecordDirection, data []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.err != nil {
+		return this.err
+	}
+	// Longer data is split up, so that it's still all recorded, in order.
+	for len(data) > MaxRecordLength {
+		if err := this.writeRecord(direction, data[:MaxRecordLength]); err != nil {
+			return err
+		}
+		data = data[MaxRecordLength:]
+	}
+	return this.writeRecord(direction, data)
+}
+
+// Returns the error that stopped recording, or nil if it's still recording.
+func (this *Recorder) Err() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.err
+}
+
+// Wrap a transport, recording everything read from it as incoming data, and
+// everything written to it as outgoing data. Pass the result to NewSession().
+func NewRecordingTransport(transport io.ReadWriteCloser, recorder *Recorder) io.ReadWriteCloser {
+	return &recordingTransport{
+		transport: transport,
+		recorder:  recorder,
+	}
+}
+
+// Create a reader for the recording, checking that it begins with the magic
+// bytes. Returns ErrInvalidRecording if it doesn't.
+func NewRecordingReader(reader io.Reader) (*RecordingReader, error) {
+	this := new(RecordingReader)
+	if err := this.Init(reader); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+func (this *RecordingReader) Init(reader io.Reader) error {
+	this.reader = reader
+	magic := make([]byte, len(recordingMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrInvalidRecording
+		}
+		return err
+	}
+	for i, value := range recordingMagic {
+		if magic[i] != value {
+			return ErrInvalidRecording
+		}
+	}
+	return nil
+}
+
+// Read the next record. Returns io.EOF once there are no more, or
+// ErrInvalidRecording if the recording is malformed or was cut off partway
+// through a record.
+func (this *RecordingReader) Next() (chunk RecordedChunk, err error) {
+	header := make([]byte, recordHeaderLength)
+	if _, err = io.ReadFull(this.reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrInvalidRecording
+		}
+		return chunk, err
+	}
+	chunk.Direction = RecordDirection(header[0])
+	if chunk.Direction != RecordIncoming && chunk.Direction != RecordOutgoing {
+		return chunk, ErrInvalidRecording
+	}
+	chunk.Time = time.Duration(binary.LittleEndian.Uint64(header[1:]))
+	length := binary.LittleEndian.Uint32(header[9:])
+	if length > MaxRecordLength {
+		return chunk, ErrInvalidRecording
+	}
+	chunk.Data = make([]byte, length)
+	if _, err = io.ReadFull(this.reader, chunk.Data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrInvalidRecording
+		}
+		return chunk, err
+	}
+	return chunk, nil
+}
+
+// Create a replayer whose protocol uses config, which should match the
+// recorded side's config.
+func NewReplayer(config *Config, receiver MessageReceiver) (*Replayer, error) {
+	this := new(Replayer)
+	if err := this.Init(config, receiver); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+func (this *Replayer) Init(config *Config, receiver MessageReceiver) (err error) {
+	this.protocol, err = NewProtocol(config, this, receiver)
+	return err
+}
+
+// The replayed protocol, for the receiver to send messages with.
+func (this *Replayer) Protocol() *Protocol {
+	return this.protocol
+}
+
+// Begin initialization, then feed each incoming record of the recording into
+// the protocol. Outgoing records are skipped. Returns the error that the
+// protocol failed with, if any, which is usually the bug being reproduced.
+func (this *Replayer) Replay(recording io.Reader) error {
+	reader, err := NewRecordingReader(recording)
+	if err != nil {
+		return err
+	}
+	if err = this.protocol.SendInitialization(); err != nil {
+		return err
+	}
+	for {
+		chunk, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if chunk.Direction != RecordIncoming {
+			continue
+		}
+		if err = this.protocol.Feed(chunk.Data); err != nil {
+			return err
+		}
+	}
+}
+
+// Returns a copy of everything the replayed protocol has sent so far.
+func (this *Replayer) Sent() []byte {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]byte(nil), this.sent...)
+}
+
+// Callbacks
+
+func (this *Replayer) OnAbleToSend() {
+}
+
+func (this *Replayer) OnMessageChunkToSend(priority int, messageId int, chunk []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.sent = append(this.sent, chunk...)
+	return nil
+}
+
+// Internal
+
+const recordHeaderLength = 1 + 8 + 4
+
+// Must be called while holding the mutex.
+func (this *Recorder) writeRecord(direction RecordDirection, data []byte) error {
+	record := make([]byte, recordHeaderLength, recordHeaderLength+len(data))
+	record[0] = byte(direction)
+	binary.LittleEndian.PutUint64(record[1:], uint64(time.Since(this.startTime)))
+	binary.LittleEndian.PutUint32(record[9:], uint32(len(data)))
+	record = append(record, data...)
+	if _, err := this.writer.Write(record); err != nil {
+		this.err = err
+		return err
+	}
+	return nil
+}
+
+type recordingTransport struct {
+	transport io.ReadWriteCloser
+	recorder  *Recorder
+}
+
+func (this *recordingTransport) Read(buffer []byte) (int, error) {
+	bytesRead, err := this.transport.Read(buffer)
+	if bytesRead > 0 {
+		// A failed recording mustn't take the connection down with it.
+		this.recorder.Record(RecordIncoming, buffer[:bytesRead])
+	}
+	return bytesRead, err
+}
+
+func (this *recordingTransport) Write(data []byte) (int, error) {
+	bytesWritten, err := this.transport.Write(data)
+	if bytesWritten > 0 {
+		this.recorder.Record(RecordOutgoing, data[:bytesWritten])
+	}
+	return bytesWritten, err
+}
+
+func (this *recordingTransport) Close() error {
+	return this.transport.Close()
+}
@@ -0,0 +1,204 @@
+package streamux
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kstenerud/go-streamux/test"
+)
+
+// replayTestReceiver plays the part of a sessionTestReceiver during a replay,
+// echoing every request back as a response.
+type replayTestReceiver struct {
+	replayer *Replayer
+	requests map[int][]byte
+	received [][]byte
+	mutex    sync.Mutex
+}
+
+func newReplayTestReceiver() *replayTestReceiver {
+	this := new(replayTestReceiver)
+	this.requests = make(map[int][]byte)
+	return this
+}
+
+func (this *replayTestReceiver) OnRequestChunkReceived(messageId int, isEnd bool, data []byte) error {
+	this.mutex.Lock()
+	this.requests[messageId] = append(this.requests[messageId], data...)
+	request := this.requests[messageId]
+	if isEnd {
+		delete(this.requests, messageId)
+		this.received = append(this.received, request)
+	}
+	this.mutex.Unlock()
+
+	if isEnd {
+		return this.replayer.Protocol().SendResponse(0, messageId, request)
+	}
+	return nil
+}
+
+func (this *replayTestReceiver) OnResponseChunkReceived(messageId int, isEnd bool, data []byte) error {
+	return nil
+}
+
+func (this *replayTestReceiver) OnPingReceived(messageId int) error {
+	return nil
+}
+
+func (this *replayTestReceiver) OnPingAckReceived(messageId int, latency time.Duration) error {
+	return nil
+}
+
+func (this *replayTestReceiver) OnCancelReceived(messageId int) error {
+	return nil
+}
+
+func (this *replayTestReceiver) OnCancelAckReceived(messageId int) error {
+	return nil
+}
+
+func (this *replayTestReceiver) OnEmptyResponseReceived(messageId int) error {
+	return nil
+}
+
+// Returns all the data of the recording's records in the specified direction.
+func readRecordedData(t *testing.T, recording []byte, direction RecordDirection) []byte {
+	reader, err := NewRecordingReader(bytes.NewReader(recording))
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	var data []byte
+	for {
+		chunk, err := reader.Next()
+		if err == io.EOF {
+			return data
+		}
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		if chunk.Direction == direction {
+			data = append(data, chunk.Data...)
+		}
+	}
+}
+
+// =============================================================================
+
+func TestRecordAndReplay(t *testing.T) {
+	recording := new(bytes.Buffer)
+	recorder, err := NewRecorder(recording)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	clientConn, serverConn := net.Pipe()
+	serverReceiver := newSessionTestReceiver()
+	client, _ := NewSession(clientConn, newTestConfig(8, 6, false), nil)
+	server, _ := NewSession(NewRecordingTransport(serverConn, recorder), newTestConfig(8, 6, true), serverReceiver)
+	serverReceiver.session = server
+
+	var expected [][]byte
+	for i := 1; i <= 10; i++ {
+		request := test.NewTestBytes(i * 50)
+		expected = append(expected, request)
+		response, err := client.Call(context.Background(), 0, request)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		test.AssertSlicesAreEquivalent(t, response, request)
+	}
+	client.Close()
+	server.Close()
+	client.Wait()
+	server.Wait()
+	if err = recorder.Err(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	receiver := newReplayTestReceiver()
+	replayer, err := NewReplayer(newTestConfig(8, 6, true), receiver)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	receiver.replayer = replayer
+	if err = replayer.Replay(bytes.NewReader(recording.Bytes())); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(receiver.received) != len(expected) {
+		t.Errorf("Expected %v requests but got %v", len(expected), len(receiver.received))
+		return
+	}
+	for i, request := range expected {
+		test.AssertSlicesAreEquivalent(t, receiver.received[i], request)
+	}
+	test.AssertSlicesAreEquivalent(t, replayer.Sent(), readRecordedData(t, recording.Bytes(), RecordOutgoing))
+}
+
+func TestRecordingReader(t *testing.T) {
+	recording := new(bytes.Buffer)
+	recorder, err := NewRecorder(recording)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	recorder.Record(RecordOutgoing, []byte{1, 2, 3})
+	time.Sleep(time.Millisecond)
+	recorder.Record(RecordIncoming, []byte{4, 5})
+
+	reader, err := NewRecordingReader(bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	first, err := reader.Next()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	second, err := reader.Next()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if first.Direction != RecordOutgoing || second.Direction != RecordIncoming {
+		t.Errorf("Expected directions %c, %c but got %c, %c", RecordOutgoing, RecordIncoming, first.Direction, second.Direction)
+		return
+	}
+	if second.Time-first.Time < time.Millisecond {
+		t.Errorf("Expected records at least 1ms apart, but got %v and %v", first.Time, second.Time)
+		return
+	}
+	test.AssertSlicesAreEquivalent(t, first.Data, []byte{1, 2, 3})
+	test.AssertSlicesAreEquivalent(t, second.Data, []byte{4, 5})
+	if _, err = reader.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF but got %v", err)
+		return
+	}
+
+	truncated := recording.Bytes()[:recording.Len()-1]
+	reader, _ = NewRecordingReader(bytes.NewReader(truncated))
+	reader.Next()
+	if _, err = reader.Next(); err != ErrInvalidRecording {
+		t.Errorf("Expected ErrInvalidRecording for a truncated record but got %v", err)
+		return
+	}
+
+	if _, err = NewRecordingReader(bytes.NewReader([]byte("not a recording"))); err != ErrInvalidRecording {
+		t.Errorf("Expected ErrInvalidRecording for bad magic bytes but got %v", err)
+		return
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/kstenerud/go-streamux/internal"
 	"github.com/kstenerud/go-streamux/test"
 )
 
@@ -71,7 +72,7 @@ func TestCancel(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 5)
 
-	cancelAckId := a.CancelAcksReceived[0]
+	cancelAckId := a.GetCancelAckId(0)
 
 	a.Close()
 	b.Close()
@@ -83,6 +84,62 @@ func TestCancel(t *testing.T) {
 	}
 }
 
+func TestCancelPurgesQueuedRequestChunks(t *testing.T) {
+	clientSender := newSchedulingSender()
+	serverSender := newSchedulingSender()
+	client, err := NewProtocol(newTestConfig(4, 4, false), clientSender, newSessionTestReceiver())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server, err := NewProtocol(newTestConfig(4, 4, true), serverSender, newSessionTestReceiver())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = client.SendInitialization(); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = server.SendInitialization(); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = feedQueued(serverSender, client); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = feedQueued(clientSender, server); err != nil {
+		t.Error(err)
+		return
+	}
+
+	message, err := client.BeginRequest(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = message.Feed(test.NewTestBytes(100)); err != nil {
+		t.Error(err)
+		return
+	}
+	if clientSender.Len() == 0 {
+		t.Errorf("Expected request chunks to be queued")
+		return
+	}
+	if err = client.Cancel(message.Id); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if clientSender.Len() != 1 {
+		t.Errorf("Expected only the cancel to be queued, but %v chunks are", clientSender.Len())
+		return
+	}
+	chunk, _ := clientSender.Pop()
+	test.AssertSlicesAreEquivalent(t, chunk, client.newEmptyMessageHeader(message.Id, internal.MessageTypeCancel))
+}
+
 func TestPing(t *testing.T) {
 	lengthBits := 10
 	idBits := 4
@@ -101,7 +158,7 @@ func TestPing(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 5)
 
-	pingAckId := a.PingAcksReceived[0]
+	pingAckId := a.GetPingAckId(0)
 
 	a.Close()
 	b.Close()
@@ -112,3 +169,77 @@ func TestPing(t *testing.T) {
 		t.Errorf("Ping send ID %v != ping ack ID %v", pingSendId, pingAckId)
 	}
 }
+
+func TestResponseFillingLastChunk(t *testing.T) {
+	// The response ends with an empty chunk, which is sent as an empty response.
+	lengthBits := 4
+	idBits := 4
+
+	a, b, err := newTestPeerPair(t, idBits, lengthBits)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	id, err := a.SendMessage(0, test.NewTestBytes(10))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(time.Millisecond * 5)
+
+	expectedResponse := test.NewTestBytes(30)
+	if err := b.SendResponse(0, id, expectedResponse); err != nil {
+		t.Error(err)
+		return
+	}
+
+	time.Sleep(time.Millisecond * 5)
+
+	a.Close()
+	b.Close()
+
+	a.Wait()
+
+	actualResponse := a.GetResponse(id)
+	test.AssertSlicesAreEquivalent(t, actualResponse, expectedResponse)
+	if count := a.protocol.requestStateMachine.ActiveRequestCount(); count != 0 {
+		t.Errorf("Expected the request ID to be released, but %v IDs are in use", count)
+	}
+}
+
+func TestConsecutivePings(t *testing.T) {
+	lengthBits := 10
+	idBits := 4
+
+	a, b, err := newTestPeerPair(t, idBits, lengthBits)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Ping IDs are released immediately, so both pings use the same ID.
+	if _, err := a.SendPing(); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := a.SendPing(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for a.GetPingAckCount() < 2 {
+		if time.Now().After(deadline) {
+			t.Errorf("Expected 2 ping acks but got %v", a.GetPingAckCount())
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	a.Close()
+	b.Close()
+
+	a.Wait()
+}
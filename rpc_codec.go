@@ -0,0 +1,372 @@
+package streamux
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/rpc"
+	"sync"
+)
+
+// RPCClientCodec implements rpc.ClientCodec over a session, so that a
+// net/rpc client (see rpc.NewClientWithCodec()) can call a net/rpc server on
+// the peer (see RPCServerCodec). Each call is a request whose route (see
+// EncodeRoute()) is the service method, so calls are correlated by message ID
+// and run concurrently. Arguments and replies are marshaled with the codec
+// that the peers agreed on (see Config.Codecs).
+//
+// When the rpc client discards a call's reply, the rest of the response is
+// canceled. Closing the codec cancels every outstanding call, but leaves the
+// session open.
+type RPCClientCodec struct {
+	session   *Session
+	responses chan *rpcClientResponse
+	closed    chan struct{}
+	closeOnce sync.Once
+	// Only used by the rpc client's reading goroutine.
+	current *rpcClientResponse
+	// Response readers whose header hasn't been passed to the rpc client yet.
+	pending map[*MessageReader]bool
+	mutex   sync.Mutex
+}
+
+// RPCServerCodec implements rpc.ServerCodec over a ServeMux, so that a
+// net/rpc server (see rpc.ServeCodec()) can serve calls from an
+// RPCClientCodec on the peer. Register the codec with the ServeMux as the
+// handler for the rpc server's routes (such as "Arith." for a service named
+// Arith), and pass it to rpc.ServeCodec().
+//
+// The rpc server's sequence numbers are the calls' message IDs. Canceled calls
+// still run, but their replies are discarded, and a call that reuses a canceled
+// call's ID waits until that call has replied. Closing the codec
+// (which rpc.ServeCodec() does once the session ends) fails any calls that
+// haven't been read yet, but leaves the session open.
+type RPCServerCodec struct {
+	session   *Session
+	calls     chan *rpcServerCall
+	closed    chan struct{}
+	closeOnce sync.Once
+	// Only used by the rpc server's reading goroutine.
+	current *rpcServerCall
+	// Calls that have been passed to the rpc server, waiting for their reply,
+	// by message ID.
+	replying map[int]*rpcServerCall
+	mutex    sync.Mutex
+}
+
+// API
+
+func NewRPCClientCodec(session *Session) *RPCClientCodec {
+	this := new(RPCClientCodec)
+	this.Init(session)
+	return this
+}
+
+func (this *RPCClientCodec) Init(session *Session) {
+	this.session = session
+	this.responses = make(chan *rpcClientResponse)
+	this.closed = make(chan struct{})
+	this.pending = make(map[*MessageReader]bool)
+}
+
+func (this *RPCClientCodec) WriteRequest(request *rpc.Request, args interface{}) error {
+	header, err := EncodeRoute(request.ServiceMethod)
+	if err != nil {
+		return err
+	}
+	codec, err := this.session.Codec()
+	if err != nil {
+		return err
+	}
+	payload, err := codec.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	message, response, err := this.session.OpenRequest(0)
+	if err != nil {
+		return err
+	}
+	if err = message.Feed(append(header, payload...)); err == nil {
+		err = message.End()
+	}
+	if err != nil {
+		// Cancels whatever was sent.
+		response.Close()
+		return err
+	}
+
+	this.mutex.Lock()
+	this.pending[response] = true
+	this.mutex.Unlock()
+	go this.awaitResponse(request.ServiceMethod, request.Seq, response)
+	return nil
+}
+
+func (this *RPCClientCodec) ReadResponseHeader(response *rpc.Response) error {
+	select {
+	case current := <-this.responses:
+		this.current = current
+		response.ServiceMethod = current.serviceMethod
+		response.Seq = current.seq
+		response.Error = current.err
+		return nil
+	case <-this.closed:
+		return io.EOF
+	case <-this.session.Done():
+		return io.EOF
+	}
+}
+
+func (this *RPCClientCodec) ReadResponseBody(reply interface{}) error {
+	current := this.current
+	this.current = nil
+	defer current.reader.Close()
+
+	if reply == nil && current.err == "" {
+		// Discarded, so the rest of the response isn't needed.
+		return nil
+	}
+	data, err := ioutil.ReadAll(current.reader)
+	if err != nil || reply == nil {
+		return err
+	}
+	codec, err := this.session.Codec()
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(data, reply)
+}
+
+func (this *RPCClientCodec) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+
+		this.mutex.Lock()
+		readers := make([]*MessageReader, 0, len(this.pending))
+		for reader := range this.pending {
+			readers = append(readers, reader)
+		}
+		this.mutex.Unlock()
+
+		for _, reader := range readers {
+			reader.Close()
+		}
+	})
+	return nil
+}
+
+// session provides the codec, and must be the session that the mux receives
+// for.
+func NewRPCServerCodec(session *Session) *RPCServerCodec {
+	this := new(RPCServerCodec)
+	this.Init(session)
+	return this
+}
+
+func (this *RPCServerCodec) Init(session *Session) {
+	this.session = session
+	this.calls = make(chan *rpcServerCall)
+	this.closed = make(chan struct{})
+	this.replying = make(map[int]*rpcServerCall)
+}
+
+func (this *RPCServerCodec) ReadRequestHeader(request *rpc.Request) error {
+	select {
+	case call := <-this.calls:
+		this.current = call
+		request.ServiceMethod = call.request.Route
+		request.Seq = uint64(call.request.Id)
+		return nil
+	case <-this.closed:
+		return io.EOF
+	case <-this.session.Done():
+		return io.EOF
+	}
+}
+
+func (this *RPCServerCodec) ReadRequestBody(args interface{}) error {
+	current := this.current
+	this.current = nil
+	if args == nil {
+		return nil
+	}
+	codec, err := this.session.Codec()
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(current.body, args)
+}
+
+func (this *RPCServerCodec) WriteResponse(response *rpc.Response, reply interface{}) error {
+	id := int(response.Seq)
+	this.mutex.Lock()
+	call, exists := this.replying[id]
+	delete(this.replying, id)
+	this.mutex.Unlock()
+	if !exists {
+		return nil
+	}
+	defer close(call.replied)
+
+	data := encodeRPCError(response.Error)
+	if response.Error == "" {
+		codec, err := this.session.Codec()
+		if err != nil {
+			return err
+		}
+		payload, err := codec.Marshal(reply)
+		if err != nil {
+			return err
+		}
+		data = append(data, payload...)
+	}
+	// If this fails, the call was canceled or the session is going down,
+	// neither of which the rpc server can do anything about.
+	call.response.Write(data)
+	return nil
+}
+
+func (this *RPCServerCodec) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closed)
+	})
+	return nil
+}
+
+// Internal callback
+func (this *RPCServerCodec) ServeStreamux(response ResponseWriter, request *Request) {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		// Canceled, or the session is closing.
+		return
+	}
+
+	call := &rpcServerCall{
+		request:  request,
+		body:     body,
+		response: response,
+		replied:  make(chan struct{}),
+	}
+	if !this.beginReplying(call) {
+		return
+	}
+	select {
+	case this.calls <- call:
+	case <-this.closed:
+		return
+	case <-this.session.Done():
+		return
+	}
+	select {
+	case <-call.replied:
+	case <-this.closed:
+	}
+}
+
+// Internal
+
+type rpcClientResponse struct {
+	serviceMethod string
+	seq           uint64
+	err           string
+	reader        *MessageReader
+}
+
+type rpcServerCall struct {
+	request  *Request
+	body     []byte
+	response ResponseWriter
+	replied  chan struct{}
+}
+
+// Register a call as awaiting its reply. The peer may reuse a canceled call's
+// ID while the rpc server is still running that call, so wait for it to reply
+// first. Returns false if the codec or session closes while waiting.
+func (this *RPCServerCodec) beginReplying(call *rpcServerCall) bool {
+	id := call.request.Id
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for {
+		previous, exists := this.replying[id]
+		if !exists {
+			break
+		}
+		this.mutex.Unlock()
+		select {
+		case <-previous.replied:
+		case <-this.closed:
+			this.mutex.Lock()
+			return false
+		case <-this.session.Done():
+			this.mutex.Lock()
+			return false
+		}
+		this.mutex.Lock()
+	}
+	this.replying[id] = call
+	return true
+}
+
+func (this *RPCClientCodec) awaitResponse(serviceMethod string, seq uint64, reader *MessageReader) {
+	response := &rpcClientResponse{
+		serviceMethod: serviceMethod,
+		seq:           seq,
+		reader:        reader,
+	}
+	var err error
+	if response.err, err = readRPCError(reader); err != nil {
+		response.err = err.Error()
+	}
+
+	this.mutex.Lock()
+	delete(this.pending, reader)
+	this.mutex.Unlock()
+
+	select {
+	case this.responses <- response:
+	case <-this.closed:
+		reader.Close()
+	case <-this.session.Done():
+	}
+}
+
+// A reply begins with the error (if any) that the call failed with: its
+// length as a uvarint, followed by the error text. A successful call's reply
+// follows.
+func encodeRPCError(text string) []byte {
+	header := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(text))
+	header = header[:binary.PutUvarint(header, uint64(len(text)))]
+	return append(header, text...)
+}
+
+func readRPCError(reader io.Reader) (string, error) {
+	length, err := binary.ReadUvarint(byteReader{reader})
+	if err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	// Not preallocated, since the length comes from the peer.
+	text, err := ioutil.ReadAll(io.LimitReader(reader, int64(length)))
+	if err != nil {
+		return "", err
+	}
+	if uint64(len(text)) != length {
+		return "", io.ErrUnexpectedEOF
+	}
+	return string(text), nil
+}
+
+type byteReader struct {
+	io.Reader
+}
+
+func (this byteReader) ReadByte() (byte, error) {
+	buffer := []byte{0}
+	if _, err := io.ReadFull(this.Reader, buffer); err != nil {
+		return 0, err
+	}
+	return buffer[0], nil
+}
@@ -0,0 +1,172 @@
+package streamux
+
+import (
+	"fmt"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+type TestArith struct {
+	blocked chan struct{}
+	// If set, receives a signal when Block() begins.
+	blocking chan struct{}
+	// SlowMultiply() waits for this to be closed.
+	slow chan struct{}
+}
+
+type TestArithArgs struct {
+	A, B int
+}
+
+func (this *TestArith) Multiply(args *TestArithArgs, reply *int) error {
+	*reply = args.A * args.B
+	return nil
+}
+
+func (this *TestArith) Divide(args *TestArithArgs, reply *int) error {
+	if args.B == 0 {
+		return fmt.Errorf("divide by zero")
+	}
+	*reply = args.A / args.B
+	return nil
+}
+
+func (this *TestArith) SlowMultiply(args *TestArithArgs, reply *int) error {
+	<-this.slow
+	return this.Multiply(args, reply)
+}
+
+func (this *TestArith) Block(args *TestArithArgs, reply *int) error {
+	if this.blocking != nil {
+		this.blocking <- struct{}{}
+	}
+	<-this.blocked
+	return nil
+}
+
+func newTestRPCPair(arith *TestArith) (client *rpc.Client, clientSession, serverSession *Session) {
+	server := rpc.NewServer()
+	server.Register(arith)
+	mux := NewServeMux()
+	clientSession, serverSession = newTestCodecSessionPair(DefaultCodecNames, DefaultCodecNames, mux)
+	mux.SetResponder(serverSession)
+	serverCodec := NewRPCServerCodec(serverSession)
+	mux.Handle("TestArith.", serverCodec)
+	go server.ServeCodec(serverCodec)
+	return rpc.NewClientWithCodec(NewRPCClientCodec(clientSession)), clientSession, serverSession
+}
+
+// =============================================================================
+
+func TestRPCCodec(t *testing.T) {
+	client, clientSession, serverSession := newTestRPCPair(&TestArith{})
+	defer serverSession.Close()
+	defer clientSession.Close()
+	defer client.Close()
+
+	calls := make([]*rpc.Call, 10)
+	for i := range calls {
+		calls[i] = client.Go("TestArith.Multiply", &TestArithArgs{i, 3}, new(int), nil)
+	}
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil {
+			t.Error(call.Error)
+			return
+		}
+		if actual := *call.Reply.(*int); actual != i*3 {
+			t.Errorf("Expected %v but got %v", i*3, actual)
+		}
+	}
+
+	var reply int
+	err := client.Call("TestArith.Divide", &TestArithArgs{1, 0}, &reply)
+	if err == nil || err.Error() != "divide by zero" {
+		t.Errorf("Expected a divide by zero error but got %v", err)
+	}
+	err = client.Call("TestArith.NoSuchMethod", &TestArithArgs{1, 0}, &reply)
+	if err == nil {
+		t.Errorf("Expected an unknown method to fail")
+	}
+	if err = client.Call("TestArith.Divide", &TestArithArgs{12, 4}, &reply); err != nil {
+		t.Error(err)
+		return
+	}
+	if reply != 3 {
+		t.Errorf("Expected 3 but got %v", reply)
+	}
+}
+
+func TestRPCCodecClose(t *testing.T) {
+	arith := &TestArith{blocked: make(chan struct{})}
+	client, clientSession, serverSession := newTestRPCPair(arith)
+	defer serverSession.Close()
+	defer clientSession.Close()
+	defer close(arith.blocked)
+
+	call := client.Go("TestArith.Block", &TestArithArgs{}, new(int), nil)
+	client.Close()
+	select {
+	case <-call.Done:
+		if call.Error != rpc.ErrShutdown {
+			t.Errorf("Expected %v but got %v", rpc.ErrShutdown, call.Error)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for the call to end")
+		return
+	}
+
+	// The session is still usable.
+	client = rpc.NewClientWithCodec(NewRPCClientCodec(clientSession))
+	defer client.Close()
+	var reply int
+	if err := client.Call("TestArith.Multiply", &TestArithArgs{2, 5}, &reply); err != nil {
+		t.Error(err)
+		return
+	}
+	if reply != 10 {
+		t.Errorf("Expected 10 but got %v", reply)
+	}
+}
+
+func TestRPCCodecCanceledIdReused(t *testing.T) {
+	arith := &TestArith{
+		blocked:  make(chan struct{}),
+		blocking: make(chan struct{}, 1),
+		slow:     make(chan struct{}),
+	}
+	client, clientSession, serverSession := newTestRPCPair(arith)
+	defer serverSession.Close()
+	defer clientSession.Close()
+
+	client.Go("TestArith.Block", &TestArithArgs{}, new(int), nil)
+	<-arith.blocking
+	client.Close()
+	if !awaitIdsReleased(t, clientSession) {
+		close(arith.blocked)
+		return
+	}
+
+	// The canceled call's ID is reused, and the canceled call replies first, but
+	// its reply must not be taken for this call's.
+	client = rpc.NewClientWithCodec(NewRPCClientCodec(clientSession))
+	defer client.Close()
+	call := client.Go("TestArith.SlowMultiply", &TestArithArgs{2, 5}, new(int), nil)
+	time.Sleep(10 * time.Millisecond)
+	close(arith.blocked)
+	time.Sleep(10 * time.Millisecond)
+	close(arith.slow)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			t.Error(call.Error)
+			return
+		}
+		if actual := *call.Reply.(*int); actual != 10 {
+			t.Errorf("Expected 10 but got %v", actual)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for the call to end")
+	}
+}
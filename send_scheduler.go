@@ -0,0 +1,357 @@
+package streamux
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/kstenerud/go-streamux/internal"
+)
+
+// The weight given to messages that don't specify one.
+const DefaultWeight = 1
+
+// By default, a waiting lower priority chunk is sent after being passed over
+// this many times (see SendScheduler.SetAgingLimit()).
+const DefaultAgingLimit = 32
+
+// SendScheduler is a queue of outgoing message chunks, for use by a
+// MessageSender. Chunks are popped highest priority first (so PriorityOOB
+// chunks always go first). Chunks of the same message are always popped in the
+// order they were pushed.
+//
+// Messages that share a priority are interleaved using deficit round robin, so
+// that one large message can't monopolize the link. Each message gets a share
+// proportional to its weight (see Protocol.BeginRequestWithWeight()).
+//
+// To prevent starvation, a lower priority that has been passed over too many
+// times gets to send one chunk (see SetAgingLimit()). PriorityOOB chunks are
+// never held back by this.
+//
+// A SendScheduler is safe for use from multiple goroutines. Typically the
+// protocol pushes chunks from whichever goroutine is sending, and a single
+// writer goroutine pops them and writes them to the communications channel.
+type SendScheduler struct {
+	levels map[int]*priorityLevel
+	// Priorities that have chunks queued, highest first.
+	activePriorities []int
+	chunkCount       int
+	// The quantum that a weight 1 flow gets per round. This grows to the
+	// largest chunk seen, so that every flow sends at least one chunk per turn.
+	quantum     int
+	agingLimit  int
+	isClosed    bool
+	isFinishing bool
+	mutex       sync.Mutex
+	cond        *sync.Cond
+	// Signaled whenever chunks leave the queue.
+	sent *sync.Cond
+}
+
+// API
+
+func NewSendScheduler() *SendScheduler {
+	this := new(SendScheduler)
+	this.Init()
+	return this
+}
+
+func (this *SendScheduler) Init() {
+	this.levels = make(map[int]*priorityLevel)
+	this.activePriorities = nil
+	this.chunkCount = 0
+	this.quantum = 1
+	this.agingLimit = DefaultAgingLimit
+	this.isClosed = false
+	this.isFinishing = false
+	this.cond = sync.NewCond(&this.mutex)
+	this.sent = sync.NewCond(&this.mutex)
+}
+
+// Set how many times a lower priority chunk may be passed over before it's
+// sent anyway. 0 disables aging, making priorities strict.
+func (this *SendScheduler) SetAgingLimit(limit int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.agingLimit = limit
+}
+
+// Schedule a message chunk for sending. The chunk is copied, so the caller may
+// reuse its memory (as SendableMessage does) once this method returns.
+func (this *SendScheduler) Push(priority int, messageId int, chunk []byte) error {
+	return this.PushWeighted(priority, DefaultWeight, messageId, chunk)
+}
+
+// Schedule a message chunk with a weight, which sets its message's share of the
+// link relative to other messages at the same priority. Weights below 1 are
+// treated as 1.
+func (this *SendScheduler) PushWeighted(priority int, weight int, messageId int, chunk []byte) error {
+	data := make([]byte, len(chunk))
+	copy(data, chunk)
+	if weight < 1 {
+		weight = 1
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.isClosed || this.isFinishing {
+		return ErrSchedulerClosed
+	}
+
+	level, exists := this.levels[priority]
+	if !exists {
+		level = newPriorityLevel()
+		this.levels[priority] = level
+	}
+	if level.chunkCount == 0 {
+		this.activatePriority(priority)
+	}
+	key := flowKey{messageId, messageId >= 0 && internal.IsResponseChunk(data)}
+	level.push(key, weight, data)
+	this.chunkCount++
+	if len(data) > this.quantum {
+		this.quantum = len(data)
+	}
+	this.cond.Signal()
+	return nil
+}
+
+// Pop the next chunk to send, blocking until one is available. Returns false
+// once the scheduler has been closed, or has finished (see Finish()).
+func (this *SendScheduler) Pop() (chunk []byte, ok bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for this.chunkCount == 0 && !this.isClosed && !this.isFinishing {
+		this.cond.Wait()
+	}
+	if this.isClosed || this.chunkCount == 0 {
+		return nil, false
+	}
+
+	priority := this.choosePriority()
+	level := this.levels[priority]
+	chunk = level.pop(this.quantum)
+	this.chunkCount--
+	if level.chunkCount == 0 {
+		this.deactivatePriority(priority)
+	}
+	this.sent.Broadcast()
+	return chunk, true
+}
+
+// Remove all queued response chunks to the specified message ID, returning the
+// number of chunks removed. Call this from MessageReceiver.OnCancelReceived().
+func (this *SendScheduler) PurgeResponses(messageId int) (purgedCount int) {
+	isResponse := true
+	return this.purge(flowKey{messageId, isResponse})
+}
+
+// Remove all queued request chunks of the specified message ID, returning the
+// number of chunks removed. Call this before sending a cancel for the request
+// (see PurgingMessageSender).
+func (this *SendScheduler) PurgeRequests(messageId int) (purgedCount int) {
+	isResponse := false
+	return this.purge(flowKey{messageId, isResponse})
+}
+
+// Get the number of chunks waiting to be sent.
+func (this *SendScheduler) Len() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.chunkCount
+}
+
+// Wait until none of a message's chunks are queued, because they've all been
+// popped or purged, or the scheduler has been closed.
+func (this *SendScheduler) WaitUntilSent(messageId int, isResponse bool) {
+	key := flowKey{messageId, isResponse}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for !this.isClosed && this.isQueued(key) {
+		this.sent.Wait()
+	}
+}
+
+// Stop accepting new chunks, but let Pop() return the ones already queued. Once
+// they've all been popped, Pop() returns false as if the scheduler were closed.
+func (this *SendScheduler) Finish() {
+	this.mutex.Lock()
+	this.isFinishing = true
+	this.cond.Broadcast()
+	this.mutex.Unlock()
+}
+
+// Close the scheduler, discarding all queued chunks. Any blocked Pop() calls
+// will return.
+func (this *SendScheduler) Close() {
+	this.mutex.Lock()
+	this.isClosed = true
+	this.levels = make(map[int]*priorityLevel)
+	this.activePriorities = nil
+	this.chunkCount = 0
+	this.cond.Broadcast()
+	this.sent.Broadcast()
+	this.mutex.Unlock()
+}
+
+// Internal
+
+func (this *SendScheduler) purge(key flowKey) (purgedCount int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for _, priority := range append([]int(nil), this.activePriorities...) {
+		level := this.levels[priority]
+		purgedCount += level.purge(key)
+		if level.chunkCount == 0 {
+			this.deactivatePriority(priority)
+		}
+	}
+	this.chunkCount -= purgedCount
+	this.sent.Broadcast()
+	return purgedCount
+}
+
+// Must be called while holding the mutex.
+func (this *SendScheduler) isQueued(key flowKey) bool {
+	for _, level := range this.levels {
+		if _, exists := level.flows[key]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+// Must be called while holding the mutex. Picks the highest priority, unless a
+// lower one has waited too long.
+func (this *SendScheduler) choosePriority() int {
+	chosen := this.activePriorities[0]
+	if chosen != PriorityOOB && this.agingLimit > 0 {
+		mostPassedOver := this.agingLimit - 1
+		for _, priority := range this.activePriorities[1:] {
+			if passedOver := this.levels[priority].passedOverCount; passedOver > mostPassedOver {
+				chosen = priority
+				mostPassedOver = passedOver
+			}
+		}
+	}
+
+	if chosen == PriorityOOB {
+		return chosen
+	}
+	for _, priority := range this.activePriorities {
+		level := this.levels[priority]
+		if priority == chosen {
+			level.passedOverCount = 0
+		} else if priority < chosen {
+			level.passedOverCount++
+		}
+	}
+	return chosen
+}
+
+// Must be called while holding the mutex.
+func (this *SendScheduler) activatePriority(priority int) {
+	// Sorted highest first.
+	index := sort.Search(len(this.activePriorities), func(i int) bool {
+		return this.activePriorities[i] < priority
+	})
+	this.activePriorities = append(this.activePriorities, 0)
+	copy(this.activePriorities[index+1:], this.activePriorities[index:])
+	this.activePriorities[index] = priority
+}
+
+// Must be called while holding the mutex.
+func (this *SendScheduler) deactivatePriority(priority int) {
+	for i, active := range this.activePriorities {
+		if active == priority {
+			this.activePriorities = append(this.activePriorities[:i], this.activePriorities[i+1:]...)
+			break
+		}
+	}
+	delete(this.levels, priority)
+}
+
+// The chunks of one message (in one direction) at one priority.
+type scheduledFlow struct {
+	key     flowKey
+	weight  int
+	chunks  [][]byte
+	deficit int
+	hasTurn bool
+}
+
+// The flows at one priority, served in deficit round robin order.
+type priorityLevel struct {
+	flows           map[flowKey]*scheduledFlow
+	ring            []*scheduledFlow
+	chunkCount      int
+	passedOverCount int
+}
+
+func newPriorityLevel() *priorityLevel {
+	return &priorityLevel{flows: make(map[flowKey]*scheduledFlow)}
+}
+
+func (this *priorityLevel) push(key flowKey, weight int, chunk []byte) {
+	flow, exists := this.flows[key]
+	if !exists {
+		flow = &scheduledFlow{key: key}
+		this.flows[key] = flow
+		this.ring = append(this.ring, flow)
+	}
+	flow.weight = weight
+	flow.chunks = append(flow.chunks, chunk)
+	this.chunkCount++
+}
+
+// Must only be called when the level has chunks.
+func (this *priorityLevel) pop(quantum int) []byte {
+	for {
+		flow := this.ring[0]
+		if !flow.hasTurn {
+			flow.hasTurn = true
+			flow.deficit += quantum * flow.weight
+		}
+		chunk := flow.chunks[0]
+		if len(chunk) > flow.deficit {
+			// Turn over. Let the next flow go.
+			flow.hasTurn = false
+			this.ring = append(this.ring[1:], flow)
+			continue
+		}
+
+		flow.deficit -= len(chunk)
+		flow.chunks[0] = nil
+		flow.chunks = flow.chunks[1:]
+		this.chunkCount--
+		if len(flow.chunks) == 0 {
+			// An idle flow doesn't get to save up credit.
+			this.removeFlow(flow)
+		}
+		return chunk
+	}
+}
+
+// Remove a flow and all its chunks, returning the number of chunks removed.
+func (this *priorityLevel) purge(key flowKey) int {
+	flow, exists := this.flows[key]
+	if !exists {
+		return 0
+	}
+	count := len(flow.chunks)
+	this.chunkCount -= count
+	this.removeFlow(flow)
+	return count
+}
+
+func (this *priorityLevel) removeFlow(flow *scheduledFlow) {
+	delete(this.flows, flow.key)
+	for i, ringFlow := range this.ring {
+		if ringFlow == flow {
+			this.ring = append(this.ring[:i], this.ring[i+1:]...)
+			return
+		}
+	}
+}
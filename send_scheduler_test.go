@@ -0,0 +1,239 @@
+package streamux
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kstenerud/go-streamux/internal"
+)
+
+func newTestChunk(id int, isResponse bool, marker byte) []byte {
+	header := internal.NewMessageHeader(8, 8)
+	header.SetAll(id, 1, isResponse, true)
+	return append(append([]byte{}, header.Encoded.Data...), marker)
+}
+
+func assertPopMarkers(t *testing.T, scheduler *SendScheduler, expected ...byte) {
+	for _, marker := range expected {
+		chunk, ok := scheduler.Pop()
+		if !ok {
+			t.Errorf("Expected chunk with marker %v but scheduler was closed", marker)
+			return
+		}
+		if actual := chunk[len(chunk)-1]; actual != marker {
+			t.Errorf("Expected chunk with marker %v but got %v", marker, actual)
+			return
+		}
+	}
+	if scheduler.Len() != 0 {
+		t.Errorf("Expected scheduler to be empty but it has %v chunks", scheduler.Len())
+	}
+}
+
+// =============================================================================
+
+func TestSendSchedulerPriorityOrder(t *testing.T) {
+	scheduler := NewSendScheduler()
+	scheduler.Push(0, 1, newTestChunk(1, false, 1))
+	scheduler.Push(5, 2, newTestChunk(2, false, 2))
+	scheduler.Push(-3, 3, newTestChunk(3, false, 3))
+	scheduler.Push(PriorityOOB, 4, newTestChunk(4, false, 4))
+	scheduler.Push(5, 5, newTestChunk(5, false, 5))
+
+	assertPopMarkers(t, scheduler, 4, 2, 5, 1, 3)
+}
+
+func TestSendSchedulerFIFOWithinPriority(t *testing.T) {
+	scheduler := NewSendScheduler()
+	for i := 0; i < 50; i++ {
+		scheduler.Push(1, i%3, newTestChunk(i%3, false, byte(i)))
+	}
+
+	expected := make([]byte, 50)
+	for i := range expected {
+		expected[i] = byte(i)
+	}
+	assertPopMarkers(t, scheduler, expected...)
+}
+
+func TestSendSchedulerCopiesChunk(t *testing.T) {
+	scheduler := NewSendScheduler()
+	chunk := newTestChunk(1, false, 1)
+	scheduler.Push(0, 1, chunk)
+	chunk[len(chunk)-1] = 2
+
+	assertPopMarkers(t, scheduler, 1)
+}
+
+func TestSendSchedulerPurgeResponses(t *testing.T) {
+	scheduler := NewSendScheduler()
+	scheduler.Push(0, 1, newTestChunk(1, true, 1))
+	scheduler.Push(0, 1, newTestChunk(1, false, 2))
+	scheduler.Push(3, 2, newTestChunk(2, true, 3))
+	scheduler.Push(3, 1, newTestChunk(1, true, 4))
+	scheduler.Push(1, 1, newTestChunk(1, true, 5))
+
+	if purged := scheduler.PurgeResponses(1); purged != 3 {
+		t.Errorf("Expected 3 chunks purged but got %v", purged)
+	}
+	assertPopMarkers(t, scheduler, 3, 2)
+}
+
+func TestSendSchedulerPurgeRequests(t *testing.T) {
+	scheduler := NewSendScheduler()
+	scheduler.Push(0, 1, newTestChunk(1, false, 1))
+	scheduler.Push(0, 1, newTestChunk(1, true, 2))
+	scheduler.Push(3, 1, newTestChunk(1, false, 3))
+	scheduler.Push(3, 2, newTestChunk(2, false, 4))
+
+	if purged := scheduler.PurgeRequests(1); purged != 2 {
+		t.Errorf("Expected 2 chunks purged but got %v", purged)
+	}
+	assertPopMarkers(t, scheduler, 4, 2)
+}
+
+func TestSendSchedulerWaitUntilSent(t *testing.T) {
+	scheduler := NewSendScheduler()
+	scheduler.Push(0, 1, newTestChunk(1, true, 1))
+	scheduler.Push(0, 1, newTestChunk(1, true, 2))
+	scheduler.Push(0, 2, newTestChunk(2, true, 3))
+
+	isResponse := true
+	sent := make(chan struct{})
+	go func() {
+		scheduler.WaitUntilSent(1, isResponse)
+		close(sent)
+	}()
+
+	scheduler.Pop()
+	select {
+	case <-sent:
+		t.Errorf("Expected to wait while a chunk is still queued")
+		return
+	case <-time.After(20 * time.Millisecond):
+	}
+	assertPopMarkers(t, scheduler, 3, 2)
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for the message to be sent")
+	}
+}
+
+func TestSendSchedulerClose(t *testing.T) {
+	scheduler := NewSendScheduler()
+	scheduler.Push(0, 1, newTestChunk(1, false, 1))
+
+	popped := make(chan bool)
+	go func() {
+		scheduler.Pop()
+		_, ok := scheduler.Pop()
+		popped <- ok
+	}()
+
+	scheduler.Close()
+	if ok := <-popped; ok {
+		t.Errorf("Expected Pop() to fail after Close()")
+	}
+	if err := scheduler.Push(0, 1, newTestChunk(1, false, 1)); err == nil {
+		t.Errorf("Expected Push() to fail after Close()")
+	}
+}
+
+func TestSendSchedulerFinish(t *testing.T) {
+	scheduler := NewSendScheduler()
+	scheduler.Push(0, 1, []byte{1})
+	scheduler.Push(0, 2, []byte{2})
+	scheduler.Finish()
+
+	if err := scheduler.Push(0, 3, []byte{3}); err != ErrSchedulerClosed {
+		t.Errorf("Expected %v but got %v", ErrSchedulerClosed, err)
+		return
+	}
+	for i := 1; i <= 2; i++ {
+		chunk, ok := scheduler.Pop()
+		if !ok {
+			t.Errorf("Pop %v failed after Finish()", i)
+			return
+		}
+		if len(chunk) != 1 || chunk[0] != byte(i) {
+			t.Errorf("Expected chunk %v but got %v", i, chunk)
+			return
+		}
+	}
+	if _, ok := scheduler.Pop(); ok {
+		t.Errorf("Pop should fail once a finished scheduler is empty")
+	}
+}
+
+func TestSendSchedulerInterleavesMessages(t *testing.T) {
+	scheduler := NewSendScheduler()
+	for i := 1; i <= 4; i++ {
+		scheduler.Push(0, 1, newTestChunk(1, false, byte(i)))
+	}
+	for i := 11; i <= 14; i++ {
+		scheduler.Push(0, 2, newTestChunk(2, false, byte(i)))
+	}
+
+	assertPopMarkers(t, scheduler, 1, 11, 2, 12, 3, 13, 4, 14)
+}
+
+func TestSendSchedulerRequestAndResponseAreSeparate(t *testing.T) {
+	scheduler := NewSendScheduler()
+	scheduler.Push(0, 1, newTestChunk(1, false, 1))
+	scheduler.Push(0, 1, newTestChunk(1, false, 2))
+	scheduler.Push(0, 1, newTestChunk(1, true, 11))
+	scheduler.Push(0, 1, newTestChunk(1, true, 12))
+
+	assertPopMarkers(t, scheduler, 1, 11, 2, 12)
+}
+
+func TestSendSchedulerWeights(t *testing.T) {
+	scheduler := NewSendScheduler()
+	for i := 1; i <= 6; i++ {
+		scheduler.PushWeighted(0, 2, 1, newTestChunk(1, false, byte(i)))
+	}
+	for i := 11; i <= 13; i++ {
+		scheduler.PushWeighted(0, 1, 2, newTestChunk(2, false, byte(i)))
+	}
+
+	assertPopMarkers(t, scheduler, 1, 2, 11, 3, 4, 12, 5, 6, 13)
+}
+
+func TestSendSchedulerAging(t *testing.T) {
+	scheduler := NewSendScheduler()
+	scheduler.SetAgingLimit(3)
+	for i := 1; i <= 6; i++ {
+		scheduler.Push(5, 1, newTestChunk(1, false, byte(i)))
+	}
+	scheduler.Push(0, 2, newTestChunk(2, false, 100))
+	scheduler.Push(0, 2, newTestChunk(2, false, 101))
+
+	assertPopMarkers(t, scheduler, 1, 2, 3, 100, 4, 5, 6, 101)
+}
+
+func TestSendSchedulerAgingDisabled(t *testing.T) {
+	scheduler := NewSendScheduler()
+	scheduler.SetAgingLimit(0)
+	for i := 1; i <= 40; i++ {
+		scheduler.Push(5, 1, newTestChunk(1, false, byte(i)))
+	}
+	scheduler.Push(0, 2, newTestChunk(2, false, 100))
+
+	expected := make([]byte, 0, 41)
+	for i := 1; i <= 40; i++ {
+		expected = append(expected, byte(i))
+	}
+	assertPopMarkers(t, scheduler, append(expected, 100)...)
+}
+
+func TestSendSchedulerAgingDoesNotDelayOOB(t *testing.T) {
+	scheduler := NewSendScheduler()
+	scheduler.SetAgingLimit(1)
+	scheduler.Push(0, 2, newTestChunk(2, false, 100))
+	scheduler.Push(5, 1, newTestChunk(1, false, 1))
+	scheduler.Push(PriorityOOB, 3, newTestChunk(3, false, 50))
+	scheduler.Push(PriorityOOB, 3, newTestChunk(3, false, 51))
+
+	assertPopMarkers(t, scheduler, 50, 51, 1, 100)
+}
@@ -2,6 +2,9 @@ package streamux
 
 import (
 	"fmt"
+	"io"
+	"sync"
+	"time"
 
 	// "github.com/kstenerud/go-streamux/common"
 	"github.com/kstenerud/go-streamux/internal"
@@ -9,19 +12,36 @@ import (
 )
 
 const maxInitialBufferCapacity = 1024 + 4
+const maxReadFromBlockSize = 32 * 1024
 
 // A SendableMessage is part of the advanced streamux API, allowing data to be
-// fed into a message incrementally.
+// fed into a message incrementally. It implements io.WriteCloser and
+// io.ReaderFrom, so a message body can be streamed using io.Copy().
+//
+// If the peer cancels the request that a response answers, everything
+// afterwards fails with ErrCanceledByPeer.
 type SendableMessage struct {
 	Id int
 
 	priority   int
+	weight     int
 	header     internal.MessageHeader
 	chunkData  buffer.FeedableBuffer
 	isEnded    bool
 	chunksSent int
+	isBlocking bool
+	// Streams may end without sending anything (see Protocol.BeginStream()).
+	isEmptyAllowed bool
 
 	messageSender internal.InternalMessageSender
+
+	// Only set if flow control may be used.
+	sendWindow *sendWindow
+	flow       *outgoingFlow
+
+	// Set from the feeding goroutine if the peer cancels (see fail()).
+	err      error
+	errMutex sync.Mutex
 }
 
 // API
@@ -40,6 +60,8 @@ func (this *SendableMessage) Init(messageSender internal.InternalMessageSender,
 	this.Id = id
 	this.messageSender = messageSender
 	this.priority = priority
+	this.weight = DefaultWeight
+	this.isBlocking = true
 	this.header.Init(idBits, lengthBits)
 	this.header.SetIdAndResponseNoEncode(id, isResponse)
 
@@ -51,30 +73,37 @@ func (this *SendableMessage) Init(messageSender internal.InternalMessageSender,
 		this.header.HeaderLength+this.header.MaxChunkLength, initialBufferCapacity)
 }
 
+// Choose what happens when flow control credit runs out (see
+// Config.EnableFlowControl): either wait for the peer to grant more (the
+// default), or fail with ErrWouldBlock, keeping unsent data buffered so that
+// the call can be retried later.
+//
+// Credit is granted via Feed(), so a blocking message must not be sent from
+// the goroutine that feeds the protocol (such as from a MessageReceiver
+// callback), or it may wait forever.
+func (this *SendableMessage) SetBlocking(isBlocking bool) {
+	this.isBlocking = isBlocking
+}
+
 // Feed more data into the message. Data is sent in chunks of the maximum chunk
 // size. Any remaining data that doesn't fill a full chunk will be buffered
 // until the next call to Feed(), Flush(), or End().
+//
+// With flow control, chunks may be smaller, and a non-blocking message may
+// return ErrWouldBlock after accepting only part of the data. Use Write() to
+// find out how much.
 func (this *SendableMessage) Feed(bytesToSend []byte) error {
-	if this.isEnded {
-		return fmt.Errorf("Cannot add more data: message has ended")
-	}
-
-	for len(bytesToSend) > this.chunkData.GetFreeByteCount() {
-		bytesToSend = this.chunkData.Feed(bytesToSend)
-		if err := this.sendCurrentChunk(); err != nil {
-			return err
-		}
-	}
-
-	this.chunkData.Feed(bytesToSend)
-
-	return nil
+	_, err := this.feed(bytesToSend)
+	return err
 }
 
 // Send the next chunk of data, even if the buffer isn't completely full.
 // This will send a non-terminated chunk that is less than the maximum chunk size.
 // It won't send an empty chunk if there's no buffered data.
 func (this *SendableMessage) Flush() error {
+	if err := this.failure(); err != nil {
+		return err
+	}
 	if this.getDataLength() > 0 {
 		return this.sendCurrentChunk()
 	}
@@ -88,6 +117,9 @@ func (this *SendableMessage) End() error {
 	if this.isEnded {
 		return nil
 	}
+	if err := this.failure(); err != nil {
+		return err
+	}
 
 	this.isEnded = true
 	this.header.SetLengthAndTermination(this.getDataLength(), this.isEnded)
@@ -96,8 +128,8 @@ func (this *SendableMessage) End() error {
 	default:
 		return fmt.Errorf("Internal bug: SendableMessage.End: Unhandled message type: %v", this.header.MessageType)
 	case internal.MessageTypeRequestEmptyTermination:
-		if this.chunksSent == 0 {
-			return fmt.Errorf("A request message must contain at least 1 byte of payload")
+		if this.chunksSent == 0 && !this.isEmptyAllowed {
+			return ErrEmptyRequest
 		}
 	case internal.MessageTypeCancel, internal.MessageTypeCancelAck:
 		return fmt.Errorf("Internal bug: SendableMessage.End: Message type %v should not be possible", this.header.MessageType)
@@ -105,25 +137,158 @@ func (this *SendableMessage) End() error {
 		// These are allowed
 	}
 
-	return this.sendCurrentChunk()
+	err := this.sendCurrentChunk()
+	if err == ErrWouldBlock || err == ErrTimeout {
+		// Not ended yet. End() must be called again once there's credit.
+		this.isEnded = false
+	}
+	return err
+}
+
+// Wait until the chunks sent so far have left the MessageSender's queue (see
+// WaitingMessageSender), so that the sender can avoid queuing data faster than
+// the communications channel carries it. Buffered data isn't flushed first.
+// Returns right away if the MessageSender doesn't queue chunks.
+func (this *SendableMessage) WaitUntilSent() {
+	if waiter, ok := this.messageSender.(sentChunkWaiter); ok {
+		waiter.waitUntilSent(this.Id, this.header.IsResponse)
+	}
+}
+
+// Write implements io.Writer. See Feed().
+func (this *SendableMessage) Write(bytesToSend []byte) (bytesWritten int, err error) {
+	return this.feed(bytesToSend)
+}
+
+// ReadFrom implements io.ReaderFrom. Data is read directly into the message's
+// chunk buffer, and sent as chunks fill up. Whatever doesn't fill a full chunk
+// remains buffered, as with Feed().
+func (this *SendableMessage) ReadFrom(reader io.Reader) (bytesRead int64, err error) {
+	if this.isEnded {
+		return 0, ErrMessageEnded
+	}
+	if err = this.failure(); err != nil {
+		return 0, err
+	}
+
+	for {
+		if this.chunkData.GetFreeByteCount() == 0 {
+			if err = this.sendCurrentChunk(); err != nil {
+				return bytesRead, err
+			}
+		}
+		count, err := this.chunkData.FeedFromReader(reader, maxReadFromBlockSize)
+		bytesRead += int64(count)
+		if err == io.EOF {
+			return bytesRead, nil
+		}
+		if err != nil {
+			return bytesRead, err
+		}
+	}
+}
+
+// Close implements io.Closer. See End().
+func (this *SendableMessage) Close() error {
+	return this.End()
 }
 
 // Internal
 
+// Implemented by Protocol.
+type sentChunkWaiter interface {
+	waitUntilSent(messageId int, isResponse bool)
+}
+
+func (this *SendableMessage) setFlowControl(window *sendWindow, flow *outgoingFlow) {
+	this.sendWindow = window
+	this.flow = flow
+}
+
+// Make everything afterwards fail with err. Called from the feeding goroutine,
+// while the message's owner may be sending.
+func (this *SendableMessage) fail(err error) {
+	this.errMutex.Lock()
+	defer this.errMutex.Unlock()
+	this.err = err
+}
+
+func (this *SendableMessage) failure() error {
+	this.errMutex.Lock()
+	defer this.errMutex.Unlock()
+	return this.err
+}
+
+// Waiting for flow control credit fails with ErrTimeout once the deadline passes.
+// A zero deadline means no deadline.
+func (this *SendableMessage) setDeadline(deadline time.Time) {
+	if this.flow != nil {
+		this.sendWindow.setDeadline(this.flow, deadline)
+	}
+}
+
+func (this *SendableMessage) feed(bytesToSend []byte) (bytesFed int, err error) {
+	if this.isEnded {
+		return 0, ErrMessageEnded
+	}
+	if err = this.failure(); err != nil {
+		return 0, err
+	}
+
+	for len(bytesToSend) > this.chunkData.GetFreeByteCount() {
+		remaining := this.chunkData.Feed(bytesToSend)
+		bytesFed += len(bytesToSend) - len(remaining)
+		bytesToSend = remaining
+		if err = this.sendCurrentChunk(); err != nil {
+			return bytesFed, err
+		}
+	}
+
+	this.chunkData.Feed(bytesToSend)
+	bytesFed += len(bytesToSend)
+
+	return bytesFed, nil
+}
+
 func (this *SendableMessage) getDataLength() int {
 	return this.chunkData.GetUsedByteCountOverMinimum()
 }
 
+// Send all buffered data, in several chunks if flow control credit is short.
+// On error, whatever wasn't sent remains buffered.
 func (this *SendableMessage) sendCurrentChunk() (err error) {
-	// fmt.Printf("### SM %p: Send chunk length %v, response %v, end %v\n", this, this.getDataLength(), this.header.IsResponse, this.isEnded)
-	this.header.SetLengthAndTermination(this.getDataLength(), this.isEnded)
+	for {
+		dataLength := this.getDataLength()
+		sendLength := dataLength
+		if this.flow != nil && dataLength > 0 {
+			if sendLength, err = this.sendWindow.acquire(this.flow, dataLength, this.isBlocking); err != nil {
+				return err
+			}
+		}
+		if sendLength == dataLength {
+			return this.sendChunk(dataLength, this.isEnded)
+		}
+		isEnd := false
+		if err = this.sendChunk(sendLength, isEnd); err != nil {
+			return err
+		}
+	}
+}
+
+func (this *SendableMessage) sendChunk(dataLength int, isEnd bool) (err error) {
+	// fmt.Printf("### SM %p: Send chunk length %v, response %v, end %v\n", this, dataLength, this.header.IsResponse, isEnd)
+	if err = this.failure(); err != nil {
+		return err
+	}
+	this.header.SetLengthAndTermination(dataLength, isEnd)
 	this.chunkData.OverwriteHead(this.header.Encoded.Data)
+	chunk := this.chunkData.Data[:this.header.HeaderLength+dataLength]
 	if this.header.IsResponse {
-		err = this.messageSender.OnResponseChunkToSend(this.priority, this.Id, this.header.IsEndOfMessage, this.chunkData.Data)
+		err = this.messageSender.OnResponseChunkToSend(this.priority, this.weight, this.Id, this.header.IsEndOfMessage, chunk)
 	} else {
-		err = this.messageSender.OnRequestChunkToSend(this.priority, this.Id, this.header.IsEndOfMessage, this.chunkData.Data)
+		err = this.messageSender.OnRequestChunkToSend(this.priority, this.weight, this.Id, this.header.IsEndOfMessage, chunk)
 	}
-	this.chunkData.Minimize()
+	this.chunkData.DiscardAfterHead(dataLength)
 	this.chunksSent++
 	return err
 }
@@ -0,0 +1,463 @@
+package streamux
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The longest route that a routed request can carry.
+const MaxRouteLength = 255
+
+// A Handler responds to a routed request (see ServeMux).
+type Handler interface {
+	ServeStreamux(response ResponseWriter, request *Request)
+}
+
+// HandlerFunc adapts an ordinary function to a Handler.
+type HandlerFunc func(response ResponseWriter, request *Request)
+
+func (this HandlerFunc) ServeStreamux(response ResponseWriter, request *Request) {
+	this(response, request)
+}
+
+// A Request is an incoming request that has been routed to a Handler.
+type Request struct {
+	Id    int
+	Route string
+	// The priority that the response is sent at, which may be changed before
+	// the response begins. Defaults to 0, since requests don't carry their
+	// priority over the wire.
+	Priority int
+	// The rest of the request after the route. Reading fails with
+	// ErrCanceledByPeer if the peer cancels the request.
+	Body io.Reader
+
+	ctx context.Context
+}
+
+// Returns the request's context, which is canceled when the peer cancels the
+// request, or once the handler returns.
+func (this *Request) Context() context.Context {
+	if this.ctx == nil {
+		return context.Background()
+	}
+	return this.ctx
+}
+
+// A ResponseWriter sends the response to a Request. The response begins with
+// the first Write() or Flush(), and ends once the handler returns. If the peer
+// cancels the request, writes fail with ErrCanceledByPeer.
+type ResponseWriter interface {
+	Write(data []byte) (bytesWritten int, err error)
+	Flush() error
+}
+
+// SentWaiter may optionally be implemented by a ResponseWriter, to wait until
+// the response data flushed so far has left the session's send queue (see
+// SendableMessage.WaitUntilSent()). The ServeMux's ResponseWriter implements
+// it.
+type SentWaiter interface {
+	WaitUntilSent()
+}
+
+// Responder begins responses. Both Session and Protocol implement it.
+type Responder interface {
+	BeginResponse(priority int, responseToId int) (*SendableMessage, error)
+}
+
+// ServeMux is a MessageReceiver that routes incoming requests to handlers, in
+// the manner of http.ServeMux. A routed request begins with its route: one
+// byte holding the route's length, followed by the route itself (see
+// EncodeRoute()). The rest of the request is the body.
+//
+// A route ending in "/" or "." also matches every route that it prefixes,
+// unless a longer registered route matches. Requests that match nothing go to
+// the not found handler, which by default sends an empty response.
+//
+// Each request's handler runs in its own goroutine, and can read the request
+// body as it arrives. Responses are sent via the Responder (see
+// SetResponder()). Interceptors (see Use()) run around every handler.
+//
+// A unary handler (see HandleUnary()) gets the whole request body at once, and
+// returns the whole response.
+//
+// Request data is buffered until the handler reads it, so with flow control
+// the peer's credit is limited only by how quickly the data is passed to the
+// ServeMux, not how quickly it's read.
+type ServeMux struct {
+	handlers          map[string]Handler
+	notFound          Handler
+	interceptors      []Interceptor
+	unaryInterceptors []UnaryInterceptor
+	errorEncoder      ErrorEncoder
+	responder         Responder
+	responderSet      chan struct{}
+	requests          map[int]*muxRequest
+	mutex             sync.Mutex
+	setResponderOnce  sync.Once
+}
+
+// API
+
+func NewServeMux() *ServeMux {
+	this := new(ServeMux)
+	this.Init()
+	return this
+}
+
+func (this *ServeMux) Init() {
+	this.handlers = make(map[string]Handler)
+	this.notFound = HandlerFunc(func(ResponseWriter, *Request) {})
+	this.errorEncoder = func(*Request, error) []byte { return nil }
+	this.responderSet = make(chan struct{})
+	this.requests = make(map[int]*muxRequest)
+}
+
+// Set where responses are sent. Typically this is the session that the mux is
+// receiving for. Handlers that respond before this is called wait for it.
+func (this *ServeMux) SetResponder(responder Responder) {
+	this.setResponderOnce.Do(func() {
+		this.responder = responder
+		close(this.responderSet)
+	})
+}
+
+// Register a handler for a route, replacing any registered earlier.
+func (this *ServeMux) Handle(route string, handler Handler) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.handlers[route] = handler
+}
+
+func (this *ServeMux) HandleFunc(route string, handler func(ResponseWriter, *Request)) {
+	this.Handle(route, HandlerFunc(handler))
+}
+
+// Register a typed handler for a route. function must have the form
+// func(*Request, In) (Out, error). The request body is unmarshaled into an In
+// (which may be a pointer), and the returned Out is marshaled as the response,
+// using the codec that the peers agreed on (see Config.Codecs). The Responder
+// must be a CodecProvider, as Session and Protocol are.
+//
+// Typed handlers are unary, so unary interceptors run around them.
+func (this *ServeMux) HandleTyped(route string, function interface{}) error {
+	handler, err := this.newTypedHandler(function)
+	if err != nil {
+		return err
+	}
+	this.HandleUnary(route, handler)
+	return nil
+}
+
+// Set the handler for requests that don't match any route, or whose route is
+// malformed.
+func (this *ServeMux) SetNotFoundHandler(handler Handler) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.notFound = handler
+}
+
+// Get the handler for a route, and the route it was registered under.
+func (this *ServeMux) Handler(route string) (handler Handler, pattern string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if handler, exists := this.handlers[route]; exists {
+		return handler, route
+	}
+	for candidate, candidateHandler := range this.handlers {
+		if len(candidate) <= len(pattern) || !isPrefixRoute(candidate) {
+			continue
+		}
+		if strings.HasPrefix(route, candidate) {
+			handler = candidateHandler
+			pattern = candidate
+		}
+	}
+	if handler == nil {
+		return this.notFound, ""
+	}
+	return handler, pattern
+}
+
+// Encode the header that begins a request to a route. Send the request body
+// after it.
+func EncodeRoute(route string) ([]byte, error) {
+	if len(route) > MaxRouteLength {
+		return nil, ErrRouteTooLong
+	}
+	header := make([]byte, 0, len(route)+1)
+	header = append(header, byte(len(route)))
+	return append(header, route...), nil
+}
+
+// Callbacks
+
+// Internal callback
+func (this *ServeMux) OnRequestChunkReceived(messageId int, isEnd bool, data []byte) error {
+	this.mutex.Lock()
+	request, exists := this.requests[messageId]
+	// The peer may reuse the ID as soon as the previous response has ended.
+	if !exists || request.isResponseEnding {
+		request = this.newMuxRequest(messageId)
+		this.requests[messageId] = request
+		go this.serve(request)
+	}
+	this.mutex.Unlock()
+
+	request.body.feed(data, isEnd)
+	return nil
+}
+
+// Internal callback
+func (this *ServeMux) OnCancelReceived(messageId int) error {
+	this.mutex.Lock()
+	request, exists := this.requests[messageId]
+	if exists {
+		delete(this.requests, messageId)
+	}
+	this.mutex.Unlock()
+
+	if exists {
+		request.cancelContext()
+		request.body.fail(ErrCanceledByPeer)
+		request.response.cancel()
+	}
+	return nil
+}
+
+// Internal callback
+func (this *ServeMux) OnResponseChunkReceived(messageId int, isEnd bool, data []byte) error {
+	return nil
+}
+
+// Internal callback
+func (this *ServeMux) OnPingReceived(messageId int) error {
+	return nil
+}
+
+// Internal callback
+func (this *ServeMux) OnPingAckReceived(messageId int, latency time.Duration) error {
+	return nil
+}
+
+// Internal callback
+func (this *ServeMux) OnCancelAckReceived(messageId int) error {
+	return nil
+}
+
+// Internal callback
+func (this *ServeMux) OnEmptyResponseReceived(messageId int) error {
+	return nil
+}
+
+// Internal
+
+// Runs in the request's own goroutine.
+func (this *ServeMux) serve(request *muxRequest) {
+	var handler Handler
+	route, err := readRoute(request.body)
+	if err == nil {
+		handler, _ = this.Handler(route)
+	} else {
+		this.mutex.Lock()
+		handler = this.notFound
+		this.mutex.Unlock()
+	}
+	this.mutex.Lock()
+	handler = ChainInterceptors(handler, this.interceptors...)
+	this.mutex.Unlock()
+
+	request.response.request = &Request{
+		Id:    request.id,
+		Route: route,
+		Body:  request.body,
+		ctx:   request.ctx,
+	}
+	handler.ServeStreamux(request.response, request.response.request)
+	request.cancelContext()
+
+	// Whatever the handler didn't read is discarded.
+	request.body.Close()
+	// If this fails, the request was canceled or the connection is going down.
+	request.response.end(func() {
+		this.mutex.Lock()
+		request.isResponseEnding = true
+		this.mutex.Unlock()
+	})
+
+	this.mutex.Lock()
+	if this.requests[request.id] == request {
+		delete(this.requests, request.id)
+	}
+	this.mutex.Unlock()
+}
+
+var requestPointerType = reflect.TypeOf((*Request)(nil))
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+func (this *ServeMux) newTypedHandler(function interface{}) (UnaryHandler, error) {
+	functionValue := reflect.ValueOf(function)
+	functionType := reflect.TypeOf(function)
+	if function == nil || functionType.Kind() != reflect.Func || functionValue.IsNil() ||
+		functionType.NumIn() != 2 || functionType.In(0) != requestPointerType ||
+		functionType.NumOut() != 2 || functionType.Out(1) != errorType {
+
+		return nil, fmt.Errorf("Typed handler must be a func(*Request, In) (Out, error), not %v", functionType)
+	}
+	inType := functionType.In(1)
+
+	return func(request *Request, body []byte) ([]byte, error) {
+		codec, err := this.codec()
+		if err != nil {
+			return nil, err
+		}
+		var in reflect.Value
+		if inType.Kind() == reflect.Ptr {
+			in = reflect.New(inType.Elem())
+			err = codec.Unmarshal(body, in.Interface())
+		} else {
+			in = reflect.New(inType)
+			err = codec.Unmarshal(body, in.Interface())
+			in = in.Elem()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		results := functionValue.Call([]reflect.Value{reflect.ValueOf(request), in})
+		if err, _ := results[1].Interface().(error); err != nil {
+			return nil, err
+		}
+		return codec.Marshal(results[0].Interface())
+	}, nil
+}
+
+func (this *ServeMux) codec() (Codec, error) {
+	<-this.responderSet
+	provider, ok := this.responder.(CodecProvider)
+	if !ok {
+		return nil, ErrCodecsUnavailable
+	}
+	return provider.Codec()
+}
+
+func readRoute(reader io.Reader) (string, error) {
+	length := []byte{0}
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return "", err
+	}
+	route := make([]byte, length[0])
+	if _, err := io.ReadFull(reader, route); err != nil {
+		return "", err
+	}
+	return string(route), nil
+}
+
+func isPrefixRoute(route string) bool {
+	return strings.HasSuffix(route, "/") || strings.HasSuffix(route, ".")
+}
+
+// The entry for a request is kept until its response has ended (not just the
+// request), so that a cancel can still stop the response.
+type muxRequest struct {
+	id            int
+	body          *MessageReader
+	response      *muxResponseWriter
+	ctx           context.Context
+	cancelContext context.CancelFunc
+	// Guarded by ServeMux.mutex.
+	isResponseEnding bool
+}
+
+func (this *ServeMux) newMuxRequest(messageId int) *muxRequest {
+	request := &muxRequest{id: messageId}
+	request.ctx, request.cancelContext = context.WithCancel(context.Background())
+	request.body = newMessageReader(messageId, nil)
+	request.response = &muxResponseWriter{mux: this, id: messageId, body: request.body}
+	return request
+}
+
+// Begins the response when first used.
+type muxResponseWriter struct {
+	mux     *ServeMux
+	id      int
+	request *Request
+	body    *MessageReader
+	message *SendableMessage
+	err     error
+	mutex   sync.Mutex
+}
+
+func (this *muxResponseWriter) Write(data []byte) (bytesWritten int, err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if err = this.begin(); err != nil {
+		return 0, err
+	}
+	return this.message.Write(data)
+}
+
+func (this *muxResponseWriter) Flush() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if err := this.begin(); err != nil {
+		return err
+	}
+	return this.message.Flush()
+}
+
+func (this *muxResponseWriter) WaitUntilSent() {
+	// Not held while waiting, so that a cancel isn't held up.
+	this.mutex.Lock()
+	message := this.message
+	this.mutex.Unlock()
+	if message != nil {
+		message.WaitUntilSent()
+	}
+}
+
+// onEnding is called just before the end of the response is sent.
+func (this *muxResponseWriter) end(onEnding func()) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if err := this.begin(); err != nil {
+		return err
+	}
+	onEnding()
+	return this.message.End()
+}
+
+// Called from the feeding goroutine, after the body has failed (which wakes
+// begin()) and the message's flow has been closed (which wakes a blocked
+// write). Nothing more is sent afterwards.
+func (this *muxResponseWriter) cancel() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.err == nil {
+		this.err = ErrCanceledByPeer
+	}
+}
+
+// Must be called while holding the mutex. A response can't begin until the
+// request has completely arrived.
+func (this *muxResponseWriter) begin() (err error) {
+	if this.message != nil || this.err != nil {
+		return this.err
+	}
+	<-this.body.endedSignal()
+	<-this.mux.responderSet
+	if this.body.failure() == ErrCanceledByPeer {
+		this.err = ErrCanceledByPeer
+		return this.err
+	}
+	if this.message, err = this.mux.responder.BeginResponse(this.request.Priority, this.id); err != nil {
+		this.err = err
+	}
+	return err
+}
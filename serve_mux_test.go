@@ -0,0 +1,112 @@
+package streamux
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/kstenerud/go-streamux/test"
+)
+
+func newTestServeMuxSessionPair(mux *ServeMux) (client, server *Session) {
+	client, server = newTestPipeSessionPair(nil, nil, mux)
+	mux.SetResponder(server)
+	return client, server
+}
+
+func callRoute(client *Session, route string, body []byte) ([]byte, error) {
+	request, err := EncodeRoute(route)
+	if err != nil {
+		return nil, err
+	}
+	return client.Call(context.Background(), 0, append(request, body...))
+}
+
+// =============================================================================
+
+func TestServeMuxRoutes(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("echo", func(response ResponseWriter, request *Request) {
+		io.Copy(response, request.Body)
+	})
+	mux.HandleFunc("greet.", func(response ResponseWriter, request *Request) {
+		response.Write([]byte("hello from " + request.Route))
+	})
+	mux.HandleFunc("greet.formal.", func(response ResponseWriter, request *Request) {
+		response.Write([]byte("greetings from " + request.Route))
+	})
+	client, server := newTestServeMuxSessionPair(mux)
+	defer server.Close()
+	defer client.Close()
+
+	expected := test.NewTestBytes(3000)
+	actual, err := callRoute(client, "echo", expected)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	test.AssertSlicesAreEquivalent(t, actual, expected)
+
+	assertRouteResponse := func(route string, expected string) {
+		actual, err := callRoute(client, route, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(actual) != expected {
+			t.Errorf("Route %v: Expected %q but got %q", route, expected, actual)
+		}
+	}
+	assertRouteResponse("greet.informal", "hello from greet.informal")
+	assertRouteResponse("greet.formal.sir", "greetings from greet.formal.sir")
+	// Not found
+	assertRouteResponse("echo.more", "")
+	assertRouteResponse("greet", "")
+}
+
+func TestServeMuxRouteTooLong(t *testing.T) {
+	if _, err := EncodeRoute(string(make([]byte, MaxRouteLength+1))); err != ErrRouteTooLong {
+		t.Errorf("Expected %v but got %v", ErrRouteTooLong, err)
+	}
+}
+
+func TestServeMuxCancel(t *testing.T) {
+	started := make(chan struct{})
+	readResult := make(chan error, 1)
+	mux := NewServeMux()
+	mux.HandleFunc("wait", func(response ResponseWriter, request *Request) {
+		close(started)
+		_, err := ioutil.ReadAll(request.Body)
+		readResult <- err
+	})
+	client, server := newTestServeMuxSessionPair(mux)
+	defer server.Close()
+	defer client.Close()
+
+	request, response, err := client.OpenRequest(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	route, _ := EncodeRoute("wait")
+	request.Write(route)
+	request.Flush()
+	// A cancel purges whatever of the request is still queued, so wait until
+	// it has arrived.
+	if !awaitSignal(t, started, "the handler to start") {
+		return
+	}
+	// Closing the response reader cancels the request.
+	response.Close()
+
+	select {
+	case err := <-readResult:
+		if err != ErrCanceledByPeer {
+			t.Errorf("Expected %v but got %v", ErrCanceledByPeer, err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for the handler to see the cancel")
+	}
+}
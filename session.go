@@ -0,0 +1,932 @@
+package streamux
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+const sessionReadBufferSize = 32 * 1024
+
+// Session runs a Protocol over a transport such as a net.Conn. It feeds all
+// incoming data into the protocol from its own goroutine, and writes all
+// outgoing message chunks from another, so that the send API may be used from
+// any number of goroutines. Outgoing chunks are written in priority order via a
+// SendScheduler.
+//
+// If the session is created with a MessageReceiver, all incoming messages
+// (other than responses to requests sent via Call() or OpenRequest()) are
+// passed to it from the session's read goroutine. Otherwise, the session
+// handles incoming messages itself, and incoming requests are delivered via
+// AcceptRequest().
+//
+// Streams (see OpenStream() and AcceptStream()) are always handled by the
+// session itself. Notifications are passed to the MessageReceiver if it
+// implements NotificationReceiver, and are otherwise discarded.
+type Session struct {
+	protocol  *Protocol
+	transport io.ReadWriteCloser
+	receiver  MessageReceiver
+	scheduler SendScheduler
+	ready     chan struct{}
+	readyOnce sync.Once
+	done      chan struct{}
+	writeDone chan struct{}
+	closeOnce sync.Once
+	err       error
+	waitGroup sync.WaitGroup
+
+	responseReaders    map[int]*MessageReader
+	cancelingResponses map[int]bool
+	requestReaders     map[int]*MessageReader
+	acceptQueue        []*MessageReader
+	readersMutex       sync.Mutex
+	acceptCond         *sync.Cond
+
+	// Streams opened by the peer. Streams that we open use responseReaders.
+	acceptedStreams   map[int]*Stream
+	streamAcceptQueue []*Stream
+	streamAcceptCond  *sync.Cond
+
+	keepalive      *Keepalive
+	keepaliveMutex sync.Mutex
+
+	// The session grants flow control credit itself (see GrantCredit()).
+	isManualCreditGrants bool
+}
+
+// API
+
+// Create a new session over the specified transport and begin protocol
+// initialization. The session takes ownership of the transport, and will close
+// it when the session ends (or if the config is invalid). receiver may be nil
+// (see Session).
+//
+// With flow control, credit for data read via a MessageReader is granted as it
+// is read. Credit for data passed to the MessageReceiver is granted once the
+// callback returns, unless config.ManualCreditGrants is set.
+func NewSession(transport io.ReadWriteCloser, config *Config, receiver MessageReceiver) (*Session, error) {
+	this := new(Session)
+	this.transport = transport
+	this.receiver = receiver
+	this.scheduler.Init()
+	this.responseReaders = make(map[int]*MessageReader)
+	this.cancelingResponses = make(map[int]bool)
+	this.requestReaders = make(map[int]*MessageReader)
+	this.acceptCond = sync.NewCond(&this.readersMutex)
+	this.acceptedStreams = make(map[int]*Stream)
+	this.streamAcceptCond = sync.NewCond(&this.readersMutex)
+	this.ready = make(chan struct{})
+	this.done = make(chan struct{})
+	this.writeDone = make(chan struct{})
+	this.isManualCreditGrants = config.ManualCreditGrants
+	protocolConfig := *config
+	protocolConfig.ManualCreditGrants = true
+	protocol, err := NewProtocol(&protocolConfig, this, this)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	this.protocol = protocol
+
+	// The initialize message must be queued before anything is read, because
+	// a quick init finishes early initialization right away.
+	if err := this.protocol.SendInitialization(); err != nil {
+		this.closeWithError(err)
+		return nil, err
+	}
+
+	this.waitGroup.Add(2)
+	go this.readLoop()
+	go this.writeLoop()
+
+	return this, nil
+}
+
+// Returns a channel that is closed once protocol negotiations have progressed
+// far enough that messages may be sent.
+func (this *Session) Ready() <-chan struct{} {
+	return this.ready
+}
+
+// Returns a channel that is closed once the session has ended.
+func (this *Session) Done() <-chan struct{} {
+	return this.done
+}
+
+// Wait for the session to end, and return the error that caused it. Returns nil
+// if the session was closed via Close() or the transport reached EOF.
+// Operations on an ended session fail with ErrSessionClosed.
+func (this *Session) Err() error {
+	<-this.done
+	return this.err
+}
+
+// Wait until the session's goroutines have exited.
+func (this *Session) Wait() {
+	this.waitGroup.Wait()
+}
+
+// Close the session and its transport. Any queued outgoing data is discarded.
+func (this *Session) Close() error {
+	this.closeWithError(nil)
+	return nil
+}
+
+// Gracefully shut down the session: stop sending new requests, ask the peer to
+// do the same (see Protocol.Drain()), and wait for all outstanding requests in
+// both directions to complete. Then send everything still queued, and close.
+//
+// If the context is done first, the session is closed immediately and the
+// context's error is returned.
+func (this *Session) Shutdown(ctx context.Context) error {
+	drained, err := this.protocol.Drain()
+	if err != nil {
+		this.Close()
+		return err
+	}
+
+	select {
+	case <-drained:
+	case <-this.done:
+		return this.Err()
+	case <-ctx.Done():
+		this.Close()
+		return ctx.Err()
+	}
+
+	this.scheduler.Finish()
+	select {
+	case <-this.writeDone:
+	case <-this.done:
+		return this.Err()
+	case <-ctx.Done():
+		this.Close()
+		return ctx.Err()
+	}
+	this.Close()
+	return nil
+}
+
+// Returns a channel that is closed once the peer has asked us to stop sending
+// new requests. Requests begun afterwards fail with ErrPeerDraining.
+func (this *Session) PeerDraining() <-chan struct{} {
+	return this.protocol.PeerDraining()
+}
+
+// Start pinging the peer periodically (replacing any keepalive started
+// earlier). receiver may be nil. If config.CloseOnUnresponsive is set, the
+// session is closed with ErrPeerUnresponsive when the peer stops responding.
+// The keepalive stops when the session ends.
+func (this *Session) StartKeepalive(config *KeepaliveConfig, receiver KeepaliveReceiver) (*Keepalive, error) {
+	keepalive, err := NewKeepalive(this, config, &sessionKeepaliveReceiver{
+		session:             this,
+		receiver:            receiver,
+		closeOnUnresponsive: config.CloseOnUnresponsive,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	this.keepaliveMutex.Lock()
+	defer this.keepaliveMutex.Unlock()
+	select {
+	case <-this.done:
+		return nil, ErrSessionClosed
+	default:
+	}
+	if this.keepalive != nil {
+		this.keepalive.Stop()
+	}
+	this.keepalive = keepalive
+	keepalive.Start()
+	return keepalive, nil
+}
+
+func (this *Session) SendRequest(priority int, contents []byte) (messageId int, err error) {
+	return this.protocol.SendRequest(priority, contents)
+}
+
+func (this *Session) SendResponse(priority int, responseToId int, contents []byte) error {
+	return this.protocol.SendResponse(priority, responseToId, contents)
+}
+
+// Advanced API. See Protocol.BeginRequest(). The returned message must only be
+// used from one goroutine at a time.
+func (this *Session) BeginRequest(priority int) (*SendableMessage, error) {
+	return this.protocol.BeginRequest(priority)
+}
+
+// See Protocol.SendRequestWithDeadline().
+func (this *Session) SendRequestWithDeadline(priority int, deadline time.Time, contents []byte) (messageId int, err error) {
+	return this.protocol.SendRequestWithDeadline(priority, deadline, contents)
+}
+
+// Advanced API. See Protocol.BeginRequestWithDeadline(). The returned message
+// must only be used from one goroutine at a time.
+func (this *Session) BeginRequestWithDeadline(priority int, deadline time.Time) (*SendableMessage, error) {
+	return this.protocol.BeginRequestWithDeadline(priority, deadline)
+}
+
+// Advanced API. See Protocol.BeginRequestWithWeight(). The returned message
+// must only be used from one goroutine at a time.
+func (this *Session) BeginRequestWithWeight(priority int, weight int) (*SendableMessage, error) {
+	return this.protocol.BeginRequestWithWeight(priority, weight)
+}
+
+// Advanced API. See Protocol.BeginResponse(). The returned message must only be
+// used from one goroutine at a time.
+func (this *Session) BeginResponse(priority int, responseToId int) (*SendableMessage, error) {
+	return this.protocol.BeginResponse(priority, responseToId)
+}
+
+// Advanced API. See Protocol.BeginResponseWithWeight(). The returned message
+// must only be used from one goroutine at a time.
+func (this *Session) BeginResponseWithWeight(priority int, weight int, responseToId int) (*SendableMessage, error) {
+	return this.protocol.BeginResponseWithWeight(priority, weight, responseToId)
+}
+
+// Send a request and wait for the complete response. If the context is done
+// before the response arrives, the request is canceled, and Call returns once
+// the peer has acknowledged the cancel (or the session ends).
+func (this *Session) Call(ctx context.Context, priority int, contents []byte) (response []byte, err error) {
+	select {
+	case <-this.ready:
+	case <-this.done:
+		return nil, ErrSessionClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	request, responseReader, err := this.OpenRequest(priority)
+	if err != nil {
+		return nil, err
+	}
+	if err = request.Feed(contents); err == nil {
+		err = request.End()
+	}
+	if err != nil {
+		responseReader.Close()
+		return nil, err
+	}
+
+	select {
+	case <-responseReader.endedSignal():
+	case <-ctx.Done():
+		if this.cancelResponse(responseReader) {
+			<-responseReader.endedSignal()
+			return nil, ctx.Err()
+		}
+		// The response beat the cancel.
+		<-responseReader.endedSignal()
+	}
+	return ioutil.ReadAll(responseReader)
+}
+
+// Wait for the peers to agree on a codec, and return it. See Protocol.Codec().
+func (this *Session) Codec() (Codec, error) {
+	return this.CodecWithContext(context.Background())
+}
+
+// Like Codec(), but gives up with the context's error if the context is done
+// first.
+func (this *Session) CodecWithContext(ctx context.Context) (Codec, error) {
+	select {
+	case <-this.protocol.CodecNegotiated():
+	case <-this.done:
+		return nil, ErrSessionClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return this.protocol.Codec()
+}
+
+// Like Call(), but marshal the request and unmarshal the response (into the
+// value that response points to) using the negotiated codec. response may be
+// nil to discard the response.
+func (this *Session) CallTyped(ctx context.Context, priority int, request interface{}, response interface{}) error {
+	return this.callTyped(ctx, priority, nil, request, response)
+}
+
+// Like CallTyped(), but to a route of the peer's ServeMux (see EncodeRoute()).
+func (this *Session) CallRoute(ctx context.Context, priority int, route string, request interface{}, response interface{}) error {
+	header, err := EncodeRoute(route)
+	if err != nil {
+		return err
+	}
+	return this.callTyped(ctx, priority, header, request, response)
+}
+
+// Subscribe to the events that a Broker on the peer publishes to topics
+// matching the pattern. route is where the peer's ServeMux serves the broker.
+// Waits until the broker has accepted the subscription, so no event published
+// afterwards is missed.
+func (this *Session) Subscribe(priority int, route string, pattern string) (*Subscription, error) {
+	if _, ok := splitTopic(pattern, true); !ok {
+		return nil, ErrInvalidTopic
+	}
+	header, err := EncodeRoute(route)
+	if err != nil {
+		return nil, err
+	}
+	request, response, err := this.OpenRequest(priority)
+	if err != nil {
+		return nil, err
+	}
+	if err = request.Feed(append(header, pattern...)); err == nil {
+		err = request.End()
+	}
+	if err != nil {
+		response.Close()
+		return nil, err
+	}
+
+	accepted := []byte{0}
+	if _, err = io.ReadFull(response, accepted); err != nil || accepted[0] != subscriptionAccepted {
+		response.Close()
+		if err == io.EOF || err == nil {
+			err = ErrSubscriptionRejected
+		}
+		return nil, err
+	}
+	return &Subscription{Pattern: pattern, reader: response}, nil
+}
+
+// Begin a request whose response will be streamed. Write the request body to
+// the returned SendableMessage, and read the response body from the returned
+// MessageReader. Closing the reader before the response has ended cancels the
+// request.
+//
+// Responses to requests opened this way are not passed to the MessageReceiver.
+func (this *Session) OpenRequest(priority int) (request *SendableMessage, response *MessageReader, err error) {
+	if request, err = this.protocol.BeginRequest(priority); err != nil {
+		return nil, nil, err
+	}
+	return this.openResponseReader(request)
+}
+
+// Like OpenRequest(), but if the response hasn't completed by the deadline, the
+// request is canceled and the response's Read() fails with ErrDeadlineExceeded.
+func (this *Session) OpenRequestWithDeadline(priority int, deadline time.Time) (request *SendableMessage, response *MessageReader, err error) {
+	if request, err = this.protocol.BeginRequestWithDeadline(priority, deadline); err != nil {
+		return nil, nil, err
+	}
+	return this.openResponseReader(request)
+}
+
+// Wait for the next incoming request. This is only available when the session
+// was created without a MessageReceiver. Send the response via BeginResponse()
+// or SendResponse(). If the peer cancels the request, the body's Read() fails.
+func (this *Session) AcceptRequest() (messageId int, body *MessageReader, err error) {
+	if this.receiver != nil {
+		return 0, nil, ErrAcceptUnavailable
+	}
+
+	this.readersMutex.Lock()
+	defer this.readersMutex.Unlock()
+
+	for len(this.acceptQueue) == 0 {
+		select {
+		case <-this.done:
+			return 0, nil, ErrSessionClosed
+		default:
+		}
+		this.acceptCond.Wait()
+	}
+
+	body = this.acceptQueue[0]
+	this.acceptQueue[0] = nil
+	this.acceptQueue = this.acceptQueue[1:]
+	return body.Id, body, nil
+}
+
+// Open a bidirectional stream to the peer, which receives it via
+// AcceptStream(). Waits for negotiation to complete, since streams need the
+// control extension (see Protocol.BeginStream()).
+func (this *Session) OpenStream(priority int) (*Stream, error) {
+	select {
+	case <-this.protocol.Negotiated():
+	case <-this.done:
+		return nil, ErrSessionClosed
+	}
+
+	// The peer may begin sending as soon as the stream opens, so the reader
+	// must be registered before anything can be received.
+	this.readersMutex.Lock()
+	defer this.readersMutex.Unlock()
+	writer, err := this.protocol.BeginStream(priority)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := this.registerResponseReader(writer.Id)
+	if err != nil {
+		return nil, err
+	}
+	isOpener := true
+	return newStream(this, writer, reader, isOpener), nil
+}
+
+// Send a one-way notification. Waits for negotiation to complete, since
+// notifications need the control extension (see Protocol.SendNotification()).
+func (this *Session) SendNotification(contents []byte) error {
+	select {
+	case <-this.protocol.Negotiated():
+	case <-this.done:
+		return ErrSessionClosed
+	}
+	return this.protocol.SendNotification(contents)
+}
+
+// Wait for the next stream opened by the peer. Our side of the stream is sent at
+// the priority that the peer opened it with.
+func (this *Session) AcceptStream() (*Stream, error) {
+	return this.acceptStream(nil)
+}
+
+// Create a Listener whose Accept() returns the streams opened by the peer.
+func (this *Session) Listen() *Listener {
+	return newListener(this)
+}
+
+// Grant flow control credit for data passed to the MessageReceiver. Only needed
+// with Config.ManualCreditGrants. See Protocol.GrantCredit().
+func (this *Session) GrantCredit(messageId int, isResponse bool, byteCount int) error {
+	return this.protocol.GrantCredit(messageId, isResponse, byteCount)
+}
+
+func (this *Session) Cancel(messageId int) error {
+	return this.protocol.Cancel(messageId)
+}
+
+func (this *Session) Ping() (id int, err error) {
+	return this.protocol.Ping()
+}
+
+// Callbacks
+
+// Internal callback
+func (this *Session) OnAbleToSend() {
+	this.readyOnce.Do(func() {
+		close(this.ready)
+	})
+}
+
+// Internal callback
+func (this *Session) OnMessageChunkToSend(priority int, messageId int, chunk []byte) error {
+	return this.OnWeightedMessageChunkToSend(priority, DefaultWeight, messageId, chunk)
+}
+
+// Internal callback
+func (this *Session) OnWeightedMessageChunkToSend(priority int, weight int, messageId int, chunk []byte) error {
+	if err := this.scheduler.PushWeighted(priority, weight, messageId, chunk); err != nil {
+		return ErrSessionClosed
+	}
+	return nil
+}
+
+// Internal callback
+func (this *Session) OnPurgeRequestChunks(messageId int) {
+	this.scheduler.PurgeRequests(messageId)
+}
+
+// Internal callback
+func (this *Session) OnWaitUntilSent(messageId int, isResponse bool) {
+	this.scheduler.WaitUntilSent(messageId, isResponse)
+}
+
+// Internal callback
+func (this *Session) OnRequestChunkReceived(messageId int, isEnd bool, data []byte) error {
+	if this.receiveStreamData(messageId, isEnd, data) {
+		return nil
+	}
+
+	isResponse := false
+	if this.receiver != nil {
+		if err := this.receiver.OnRequestChunkReceived(messageId, isEnd, data); err != nil {
+			return err
+		}
+		return this.grantReceiverCredit(messageId, isResponse, len(data))
+	}
+
+	this.readersMutex.Lock()
+	body, exists := this.requestReaders[messageId]
+	if !exists {
+		body = newMessageReader(messageId, nil)
+		body.onConsumed = this.newCreditGranter(messageId, isResponse)
+		this.requestReaders[messageId] = body
+		this.acceptQueue = append(this.acceptQueue, body)
+		this.acceptCond.Signal()
+	}
+	if isEnd {
+		delete(this.requestReaders, messageId)
+	}
+	this.readersMutex.Unlock()
+
+	body.feed(data, isEnd)
+	return nil
+}
+
+// Internal callback
+func (this *Session) OnResponseChunkReceived(messageId int, isEnd bool, data []byte) error {
+	isResponse := true
+	if this.receiveStreamedResponse(messageId, isEnd, data) {
+		return nil
+	}
+	if this.receiver == nil {
+		// Discarded
+		return this.protocol.GrantCredit(messageId, isResponse, len(data))
+	}
+	if err := this.receiver.OnResponseChunkReceived(messageId, isEnd, data); err != nil {
+		return err
+	}
+	return this.grantReceiverCredit(messageId, isResponse, len(data))
+}
+
+// Internal callback
+func (this *Session) OnPingReceived(messageId int) error {
+	if this.receiver == nil {
+		return nil
+	}
+	return this.receiver.OnPingReceived(messageId)
+}
+
+// Internal callback
+func (this *Session) OnPingAckReceived(messageId int, latency time.Duration) error {
+	this.keepaliveMutex.Lock()
+	keepalive := this.keepalive
+	this.keepaliveMutex.Unlock()
+	if keepalive != nil {
+		keepalive.OnPingAckReceived(messageId, latency)
+	}
+
+	if this.receiver == nil {
+		return nil
+	}
+	return this.receiver.OnPingAckReceived(messageId, latency)
+}
+
+// Internal callback
+func (this *Session) OnCancelReceived(messageId int) (err error) {
+	this.readersMutex.Lock()
+	stream, isStream := this.acceptedStreams[messageId]
+	delete(this.acceptedStreams, messageId)
+	this.readersMutex.Unlock()
+
+	if isStream {
+		stream.cancelByPeer()
+	} else if this.receiver != nil {
+		err = this.receiver.OnCancelReceived(messageId)
+	} else {
+		this.readersMutex.Lock()
+		body, exists := this.requestReaders[messageId]
+		delete(this.requestReaders, messageId)
+		this.readersMutex.Unlock()
+		if exists {
+			body.fail(ErrCanceledByPeer)
+		}
+	}
+	// Purge afterwards so that anything queued during the callback goes too.
+	this.scheduler.PurgeResponses(messageId)
+	return err
+}
+
+// Internal callback
+func (this *Session) OnStreamOpened(messageId int, priority int) error {
+	// Both directions of the stream are sent at the opener's priority.
+	writer, err := this.protocol.BeginResponse(priority, messageId)
+	if err != nil {
+		return err
+	}
+	reader := newMessageReader(messageId, nil)
+	isResponse := false
+	reader.onConsumed = this.newCreditGranter(messageId, isResponse)
+	isOpener := false
+	stream := newStream(this, writer, reader, isOpener)
+
+	this.readersMutex.Lock()
+	defer this.readersMutex.Unlock()
+	this.acceptedStreams[messageId] = stream
+	this.streamAcceptQueue = append(this.streamAcceptQueue, stream)
+	this.streamAcceptCond.Signal()
+	return nil
+}
+
+// Internal callback
+func (this *Session) OnCancelAckReceived(messageId int) error {
+	this.readersMutex.Lock()
+	response, exists := this.responseReaders[messageId]
+	isCanceling := this.cancelingResponses[messageId]
+	if isCanceling {
+		delete(this.responseReaders, messageId)
+		delete(this.cancelingResponses, messageId)
+	}
+	this.readersMutex.Unlock()
+
+	if exists {
+		response.fail(ErrCanceled)
+		return nil
+	}
+	if this.receiver == nil {
+		return nil
+	}
+	return this.receiver.OnCancelAckReceived(messageId)
+}
+
+// Internal callback
+func (this *Session) OnRequestDeadlineExceeded(messageId int) error {
+	this.readersMutex.Lock()
+	response, exists := this.responseReaders[messageId]
+	if exists {
+		// Any response chunks still in flight are discarded until the cancel
+		// ack arrives.
+		this.cancelingResponses[messageId] = true
+	}
+	this.readersMutex.Unlock()
+
+	if exists {
+		response.fail(ErrDeadlineExceeded)
+		return nil
+	}
+	if receiver, ok := this.receiver.(DeadlineReceiver); ok {
+		return receiver.OnRequestDeadlineExceeded(messageId)
+	}
+	return nil
+}
+
+// Internal callback
+func (this *Session) OnNotificationReceived(data []byte) error {
+	if receiver, ok := this.receiver.(NotificationReceiver); ok {
+		return receiver.OnNotificationReceived(data)
+	}
+	return nil
+}
+
+// Internal callback
+func (this *Session) OnEmptyResponseReceived(messageId int) error {
+	isEnd := true
+	if this.receiveStreamedResponse(messageId, isEnd, []byte{}) || this.receiver == nil {
+		return nil
+	}
+	return this.receiver.OnEmptyResponseReceived(messageId)
+}
+
+// Internal
+
+func (this *Session) closeWithError(err error) {
+	this.closeOnce.Do(func() {
+		this.err = err
+		close(this.done)
+		this.scheduler.Close()
+		this.transport.Close()
+		this.protocol.Abort(ErrSessionClosed)
+
+		this.keepaliveMutex.Lock()
+		if this.keepalive != nil {
+			this.keepalive.Stop()
+		}
+		this.keepaliveMutex.Unlock()
+
+		this.readersMutex.Lock()
+		readers := make([]*MessageReader, 0, len(this.responseReaders)+len(this.requestReaders))
+		for _, reader := range this.responseReaders {
+			readers = append(readers, reader)
+		}
+		for _, reader := range this.requestReaders {
+			readers = append(readers, reader)
+		}
+		this.responseReaders = make(map[int]*MessageReader)
+		this.cancelingResponses = make(map[int]bool)
+		for _, stream := range this.acceptedStreams {
+			readers = append(readers, stream.reader)
+		}
+		for _, stream := range this.streamAcceptQueue {
+			readers = append(readers, stream.reader)
+		}
+		this.requestReaders = make(map[int]*MessageReader)
+		this.acceptedStreams = make(map[int]*Stream)
+		this.streamAcceptQueue = nil
+		this.acceptCond.Broadcast()
+		this.streamAcceptCond.Broadcast()
+		this.readersMutex.Unlock()
+
+		for _, reader := range readers {
+			reader.fail(ErrSessionClosed)
+		}
+	})
+}
+
+func (this *Session) callTyped(ctx context.Context, priority int, header []byte, request interface{}, response interface{}) error {
+	codec, err := this.CodecWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	payload, err := codec.Marshal(request)
+	if err != nil {
+		return err
+	}
+	result, err := this.Call(ctx, priority, append(header, payload...))
+	if err != nil || response == nil {
+		return err
+	}
+	return codec.Unmarshal(result, response)
+}
+
+func (this *Session) openResponseReader(request *SendableMessage) (*SendableMessage, *MessageReader, error) {
+	this.readersMutex.Lock()
+	defer this.readersMutex.Unlock()
+	response, err := this.registerResponseReader(request.Id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return request, response, nil
+}
+
+// Must be called while holding readersMutex.
+func (this *Session) registerResponseReader(messageId int) (*MessageReader, error) {
+	select {
+	case <-this.done:
+		return nil, ErrSessionClosed
+	default:
+	}
+	response := newMessageReader(messageId, this.onResponseReaderClosedEarly)
+	isResponse := true
+	response.onConsumed = this.newCreditGranter(messageId, isResponse)
+	// A previous request with this ID may have expired without sending
+	// anything, in which case no cancel ack will arrive to clear this.
+	delete(this.cancelingResponses, messageId)
+	this.responseReaders[messageId] = response
+	return response, nil
+}
+
+// Wait for the next stream opened by the peer, or until the stop channel (if
+// any) is closed, in which case ErrListenerClosed is returned. Whoever closes
+// the stop channel must call wakeStreamAcceptors() afterwards.
+func (this *Session) acceptStream(stop <-chan struct{}) (*Stream, error) {
+	this.readersMutex.Lock()
+	defer this.readersMutex.Unlock()
+
+	for len(this.streamAcceptQueue) == 0 {
+		select {
+		case <-this.done:
+			return nil, ErrSessionClosed
+		case <-stop:
+			return nil, ErrListenerClosed
+		default:
+		}
+		this.streamAcceptCond.Wait()
+	}
+
+	stream := this.streamAcceptQueue[0]
+	this.streamAcceptQueue[0] = nil
+	this.streamAcceptQueue = this.streamAcceptQueue[1:]
+	return stream, nil
+}
+
+func (this *Session) wakeStreamAcceptors() {
+	this.readersMutex.Lock()
+	defer this.readersMutex.Unlock()
+	this.streamAcceptCond.Broadcast()
+}
+
+// Feed a request chunk to the stream it belongs to, if any. Returns false if
+// the chunk isn't stream data.
+func (this *Session) receiveStreamData(messageId int, isEnd bool, data []byte) bool {
+	this.readersMutex.Lock()
+	stream, exists := this.acceptedStreams[messageId]
+	this.readersMutex.Unlock()
+
+	if !exists {
+		return false
+	}
+	stream.reader.feed(data, isEnd)
+	if isEnd {
+		isPeerSide := true
+		this.onAcceptedStreamEnded(stream, isPeerSide)
+	}
+	return true
+}
+
+// Forget an accepted stream once both sides have ended.
+func (this *Session) onAcceptedStreamEnded(stream *Stream, isPeerSide bool) {
+	this.readersMutex.Lock()
+	defer this.readersMutex.Unlock()
+
+	if isPeerSide {
+		stream.isPeerEnded = true
+	} else {
+		stream.isLocalEnded = true
+	}
+	if stream.isPeerEnded && stream.isLocalEnded && this.acceptedStreams[stream.Id] == stream {
+		delete(this.acceptedStreams, stream.Id)
+	}
+}
+
+// Feed a response chunk to the reader opened for it, if any. Returns false if
+// there's no such reader.
+func (this *Session) receiveStreamedResponse(messageId int, isEnd bool, data []byte) bool {
+	this.readersMutex.Lock()
+	response, exists := this.responseReaders[messageId]
+	// While canceling, the entry is kept until the cancel ack arrives.
+	if exists && isEnd && !this.cancelingResponses[messageId] {
+		delete(this.responseReaders, messageId)
+	}
+	this.readersMutex.Unlock()
+
+	if exists {
+		response.feed(data, isEnd)
+	}
+	return exists
+}
+
+// Cancel the request that a response reader belongs to. Returns false if the
+// response has already been completely received, or is already being canceled.
+func (this *Session) cancelResponse(response *MessageReader) bool {
+	this.readersMutex.Lock()
+	defer this.readersMutex.Unlock()
+
+	if this.responseReaders[response.Id] != response || this.cancelingResponses[response.Id] {
+		return false
+	}
+	this.cancelingResponses[response.Id] = true
+	if err := this.protocol.Cancel(response.Id); err != nil {
+		delete(this.responseReaders, response.Id)
+		delete(this.cancelingResponses, response.Id)
+		response.fail(err)
+	}
+	return true
+}
+
+func (this *Session) onResponseReaderClosedEarly(response *MessageReader) {
+	this.cancelResponse(response)
+}
+
+func (this *Session) grantReceiverCredit(messageId int, isResponse bool, byteCount int) error {
+	if this.isManualCreditGrants {
+		return nil
+	}
+	return this.protocol.GrantCredit(messageId, isResponse, byteCount)
+}
+
+// Returns a MessageReader.onConsumed function that grants credit as the
+// message is read.
+func (this *Session) newCreditGranter(messageId int, isResponse bool) func(int) {
+	return func(byteCount int) {
+		// This only fails if the session is closing anyway.
+		this.protocol.GrantCredit(messageId, isResponse, byteCount)
+	}
+}
+
+func (this *Session) readLoop() {
+	defer this.waitGroup.Done()
+
+	buffer := make([]byte, sessionReadBufferSize)
+	for {
+		bytesRead, err := this.transport.Read(buffer)
+		if bytesRead > 0 {
+			if feedErr := this.protocol.Feed(buffer[:bytesRead]); feedErr != nil {
+				this.closeWithError(feedErr)
+				return
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			this.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (this *Session) writeLoop() {
+	defer this.waitGroup.Done()
+	defer close(this.writeDone)
+
+	for {
+		data, ok := this.scheduler.Pop()
+		if !ok {
+			return
+		}
+		if _, err := this.transport.Write(data); err != nil {
+			this.closeWithError(err)
+			return
+		}
+	}
+}
+
+type sessionKeepaliveReceiver struct {
+	session             *Session
+	receiver            KeepaliveReceiver
+	closeOnUnresponsive bool
+}
+
+func (this *sessionKeepaliveReceiver) OnPeerUnresponsive(stats KeepaliveStats) {
+	if this.receiver != nil {
+		this.receiver.OnPeerUnresponsive(stats)
+	}
+	if this.closeOnUnresponsive {
+		this.session.closeWithError(ErrPeerUnresponsive)
+	}
+}
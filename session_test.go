@@ -0,0 +1,469 @@
+package streamux
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kstenerud/go-streamux/test"
+)
+
+// sessionTestReceiver echoes every request back as a response, and records
+// everything else it receives.
+type sessionTestReceiver struct {
+	session   *Session
+	requests  map[int][]byte
+	responses map[int][]byte
+	completed chan int
+	pingAcks  chan int
+	cancels   chan int
+	isSilent  bool
+	mutex     sync.Mutex
+}
+
+func newSessionTestReceiver() *sessionTestReceiver {
+	this := new(sessionTestReceiver)
+	this.requests = make(map[int][]byte)
+	this.responses = make(map[int][]byte)
+	this.completed = make(chan int, 1000)
+	this.pingAcks = make(chan int, 10)
+	this.cancels = make(chan int, 10)
+	return this
+}
+
+func (this *sessionTestReceiver) OnRequestChunkReceived(messageId int, isEnd bool, data []byte) error {
+	this.mutex.Lock()
+	this.requests[messageId] = append(this.requests[messageId], data...)
+	request := this.requests[messageId]
+	if isEnd {
+		delete(this.requests, messageId)
+	}
+	this.mutex.Unlock()
+
+	if isEnd && !this.isSilent {
+		return this.session.SendResponse(0, messageId, request)
+	}
+	return nil
+}
+
+func (this *sessionTestReceiver) OnResponseChunkReceived(messageId int, isEnd bool, data []byte) error {
+	this.mutex.Lock()
+	this.responses[messageId] = append(this.responses[messageId], data...)
+	this.mutex.Unlock()
+	if isEnd {
+		this.completed <- messageId
+	}
+	return nil
+}
+
+func (this *sessionTestReceiver) GetResponse(messageId int) []byte {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	response := this.responses[messageId]
+	delete(this.responses, messageId)
+	return response
+}
+
+func (this *sessionTestReceiver) OnPingReceived(messageId int) error {
+	return nil
+}
+
+func (this *sessionTestReceiver) OnPingAckReceived(messageId int, latency time.Duration) error {
+	this.pingAcks <- messageId
+	return nil
+}
+
+func (this *sessionTestReceiver) OnCancelReceived(messageId int) error {
+	this.cancels <- messageId
+	return nil
+}
+
+func (this *sessionTestReceiver) OnCancelAckReceived(messageId int) error {
+	return nil
+}
+
+func (this *sessionTestReceiver) OnEmptyResponseReceived(messageId int) error {
+	return this.OnResponseChunkReceived(messageId, true, []byte{})
+}
+
+func newTestSessionPair(idBits, lengthBits int) (client, server *Session, clientReceiver, serverReceiver *sessionTestReceiver) {
+	clientConn, serverConn := net.Pipe()
+	clientReceiver = newSessionTestReceiver()
+	serverReceiver = newSessionTestReceiver()
+	client, _ = NewSession(clientConn, newTestConfig(idBits, lengthBits, false), clientReceiver)
+	server, _ = NewSession(serverConn, newTestConfig(idBits, lengthBits, true), serverReceiver)
+	clientReceiver.session = client
+	serverReceiver.session = server
+	return client, server, clientReceiver, serverReceiver
+}
+
+func newTestStreamingSessionPair(idBits, lengthBits int) (client, server *Session) {
+	clientConn, serverConn := net.Pipe()
+	client, _ = NewSession(clientConn, newTestConfig(idBits, lengthBits, false), nil)
+	server, _ = NewSession(serverConn, newTestConfig(idBits, lengthBits, true), nil)
+	return client, server
+}
+
+// Accept requests and stream each request body back as the response.
+func serveStreamingEcho(t *testing.T, server *Session) {
+	for {
+		id, body, err := server.AcceptRequest()
+		if err != nil {
+			return
+		}
+		go func() {
+			response, err := server.BeginResponse(0, id)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := io.Copy(response, body); err != nil {
+				return
+			}
+			response.Close()
+		}()
+	}
+}
+
+func awaitSignal(t *testing.T, signal <-chan struct{}, description string) bool {
+	select {
+	case <-signal:
+		return true
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for %v", description)
+		return false
+	}
+}
+
+// =============================================================================
+
+func TestSessionRequestResponse(t *testing.T) {
+	client, server, clientReceiver, _ := newTestSessionPair(8, 10)
+	defer server.Close()
+	defer client.Close()
+
+	expected := test.NewTestBytes(5000)
+	id, err := client.SendRequest(0, expected)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case completedId := <-clientReceiver.completed:
+		if completedId != id {
+			t.Errorf("Expected response to %v but got %v", id, completedId)
+			return
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for response")
+		return
+	}
+
+	test.AssertSlicesAreEquivalent(t, clientReceiver.GetResponse(id), expected)
+}
+
+func TestSessionConcurrentSenders(t *testing.T) {
+	client, server, clientReceiver, _ := newTestSessionPair(10, 8)
+	defer server.Close()
+	defer client.Close()
+
+	senderCount := 20
+	requestsPerSender := 10
+	wg := new(sync.WaitGroup)
+	for i := 0; i < senderCount; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			for j := 0; j < requestsPerSender; j++ {
+				if _, err := client.SendRequest(index, test.NewTestBytes(index*50+j+1)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < senderCount*requestsPerSender; i++ {
+		select {
+		case <-clientReceiver.completed:
+		case <-time.After(time.Second):
+			t.Errorf("Timed out after %v responses", i)
+			return
+		}
+	}
+}
+
+func TestSessionPing(t *testing.T) {
+	client, server, clientReceiver, _ := newTestSessionPair(4, 10)
+	defer server.Close()
+	defer client.Close()
+
+	if !awaitSignal(t, client.Ready(), "client ready") {
+		return
+	}
+
+	id, err := client.Ping()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case ackId := <-clientReceiver.pingAcks:
+		if ackId != id {
+			t.Errorf("Ping send ID %v != ping ack ID %v", id, ackId)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for ping ack")
+	}
+}
+
+func TestSessionPeerClose(t *testing.T) {
+	client, server, _, _ := newTestSessionPair(4, 10)
+
+	if !awaitSignal(t, server.Ready(), "server ready") {
+		return
+	}
+
+	client.Close()
+	if !awaitSignal(t, server.Done(), "server to end") {
+		return
+	}
+	server.Wait()
+	client.Wait()
+
+	if err := client.Err(); err != nil {
+		t.Errorf("Expected clean shutdown but got %v", err)
+	}
+	if _, err := client.SendRequest(0, []byte{1}); err == nil {
+		t.Errorf("Expected send on closed session to fail")
+	}
+}
+
+func TestSessionBadInitialization(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	server, err := NewSession(serverConn, newTestConfig(4, 10, true), newSessionTestReceiver())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	go func() {
+		clientConn.Write([]byte{ProtocolVersion + 1, 0, 0, 0, 0})
+	}()
+	go func() {
+		buffer := make([]byte, 100)
+		for {
+			if _, err := clientConn.Read(buffer); err != nil {
+				return
+			}
+		}
+	}()
+
+	if !awaitSignal(t, server.Done(), "server to end") {
+		return
+	}
+	if server.Err() == nil {
+		t.Errorf("Expected negotiation failure")
+	}
+	clientConn.Close()
+}
+
+func TestSessionCall(t *testing.T) {
+	client, server, _, _ := newTestSessionPair(8, 6)
+	defer server.Close()
+	defer client.Close()
+
+	wg := new(sync.WaitGroup)
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(size int) {
+			defer wg.Done()
+			expected := test.NewTestBytes(size * 7)
+			actual, err := client.Call(context.Background(), size%4, expected)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			test.AssertSlicesAreEquivalent(t, actual, expected)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSessionCallContextCanceled(t *testing.T) {
+	client, server, _, serverReceiver := newTestSessionPair(8, 10)
+	defer server.Close()
+	defer client.Close()
+	serverReceiver.isSilent = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.Call(ctx, 0, []byte{1, 2, 3}); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v but got %v", context.DeadlineExceeded, err)
+		return
+	}
+
+	select {
+	case <-serverReceiver.cancels:
+	case <-time.After(time.Second):
+		t.Errorf("Server never received the cancel")
+	}
+}
+
+func TestSessionCallSessionClosed(t *testing.T) {
+	client, server, _, serverReceiver := newTestSessionPair(8, 10)
+	defer server.Close()
+	serverReceiver.isSilent = true
+
+	result := make(chan error)
+	go func() {
+		_, err := client.Call(context.Background(), 0, []byte{1, 2, 3})
+		result <- err
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	client.Close()
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Errorf("Expected call to fail when the session closed")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Call didn't return after the session closed")
+	}
+}
+
+func TestSessionStreamedRequestResponse(t *testing.T) {
+	client, server := newTestStreamingSessionPair(6, 9)
+	defer server.Close()
+	defer client.Close()
+	go serveStreamingEcho(t, server)
+
+	for _, size := range []int{1, 511, 512, 100000} {
+		expected := test.NewTestBytes(size)
+		request, response, err := client.OpenRequest(0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// Note: io.Copy would prefer bytes.Reader.WriteTo over ReadFrom.
+		if _, err := request.ReadFrom(bytes.NewReader(expected)); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := request.Close(); err != nil {
+			t.Error(err)
+			return
+		}
+
+		actual, err := ioutil.ReadAll(response)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		test.AssertSlicesAreEquivalent(t, actual, expected)
+	}
+}
+
+func TestSessionCallWithoutReceiver(t *testing.T) {
+	client, server := newTestStreamingSessionPair(6, 9)
+	defer server.Close()
+	defer client.Close()
+	go serveStreamingEcho(t, server)
+
+	expected := test.NewTestBytes(3000)
+	actual, err := client.Call(context.Background(), 0, expected)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	test.AssertSlicesAreEquivalent(t, actual, expected)
+}
+
+func TestSessionCancelAcceptedRequest(t *testing.T) {
+	client, server := newTestStreamingSessionPair(6, 9)
+	defer server.Close()
+	defer client.Close()
+
+	request, response, err := client.OpenRequest(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	request.Feed([]byte{1, 2, 3})
+	request.Flush()
+
+	_, body, err := server.AcceptRequest()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	response.Close()
+	if _, err := ioutil.ReadAll(body); err == nil {
+		t.Errorf("Expected reading a canceled request to fail")
+	}
+}
+
+func TestSessionWriteResponseAfterPeerCancel(t *testing.T) {
+	// Without flow control, nothing else stops the response.
+	client, server := newTestStreamingSessionPair(6, 9)
+	defer server.Close()
+	defer client.Close()
+
+	request, response, err := client.OpenRequest(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	request.Feed([]byte{1, 2, 3})
+	request.Flush()
+
+	id, body, err := server.AcceptRequest()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	serverResponse, err := server.BeginResponse(0, id)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = serverResponse.Write([]byte{4, 5, 6}); err != nil {
+		t.Error(err)
+		return
+	}
+
+	response.Close()
+	// The request body fails once the cancel has been received.
+	ioutil.ReadAll(body)
+	if _, err = serverResponse.Write([]byte{7, 8, 9}); err != ErrCanceledByPeer {
+		t.Errorf("Expected %v but got %v", ErrCanceledByPeer, err)
+	}
+	if err = serverResponse.Flush(); err != ErrCanceledByPeer {
+		t.Errorf("Expected %v but got %v", ErrCanceledByPeer, err)
+	}
+	if err = serverResponse.End(); err != ErrCanceledByPeer {
+		t.Errorf("Expected %v but got %v", ErrCanceledByPeer, err)
+	}
+}
+
+func TestSessionAcceptRequestWithReceiverFails(t *testing.T) {
+	client, server, _, _ := newTestSessionPair(4, 10)
+	defer server.Close()
+	defer client.Close()
+
+	if _, _, err := server.AcceptRequest(); err == nil {
+		t.Errorf("Expected AcceptRequest to fail when a receiver is set")
+	}
+}
@@ -0,0 +1,182 @@
+package streamux
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// A Stream is a bidirectional byte stream carried on a single message ID, in
+// the manner of a network connection. It implements net.Conn, so it can be used
+// wherever a connection is expected.
+//
+// The side that opens the stream (see Session.OpenStream()) sends its data as
+// request chunks, and the side that accepts it (see Session.AcceptStream())
+// sends its data as response chunks to the same ID. Each direction ends
+// independently (see CloseWrite()), and the ID is released once both have
+// ended.
+//
+// Every Write() is flushed, so that data isn't held back waiting for a full
+// chunk. Write() must only be called from one goroutine at a time, as must
+// Read().
+type Stream struct {
+	Id int
+
+	session  *Session
+	isOpener bool
+	reader   *MessageReader
+	writer   *SendableMessage
+
+	writeErr      error
+	writeDeadline time.Time
+	writeMutex    sync.Mutex
+
+	// Only used by the accepting side (guarded by Session.readersMutex).
+	isPeerEnded  bool
+	isLocalEnded bool
+}
+
+// API
+
+func newStream(session *Session, writer *SendableMessage, reader *MessageReader, isOpener bool) *Stream {
+	this := new(Stream)
+	this.Id = writer.Id
+	this.session = session
+	this.isOpener = isOpener
+	this.writer = writer
+	this.reader = reader
+	return this
+}
+
+// Read data sent by the peer. Returns io.EOF once the peer has closed its side
+// of the stream and all of its data has been read.
+func (this *Stream) Read(buffer []byte) (bytesRead int, err error) {
+	return this.reader.Read(buffer)
+}
+
+// Write data to the peer. Fails with ErrCanceledByPeer if the peer has closed
+// the stream.
+func (this *Stream) Write(data []byte) (bytesWritten int, err error) {
+	this.writeMutex.Lock()
+	defer this.writeMutex.Unlock()
+
+	if this.writeErr != nil {
+		return 0, this.writeErr
+	}
+	if !this.writeDeadline.IsZero() && !time.Now().Before(this.writeDeadline) {
+		return 0, ErrTimeout
+	}
+	if bytesWritten, err = this.writer.Write(data); err != nil {
+		return bytesWritten, err
+	}
+	return bytesWritten, this.writer.Flush()
+}
+
+// Close our side of the stream, so that the peer's Read() returns io.EOF once
+// it has read everything. We may continue reading until the peer does the same.
+func (this *Stream) CloseWrite() error {
+	this.writeMutex.Lock()
+	defer this.writeMutex.Unlock()
+
+	if this.writeErr != nil {
+		return this.writeErr
+	}
+	if err := this.writer.End(); err != nil {
+		return err
+	}
+	this.writeErr = ErrMessageEnded
+	if !this.isOpener {
+		isPeerSide := false
+		this.session.onAcceptedStreamEnded(this, isPeerSide)
+	}
+	return nil
+}
+
+// Close both sides of the stream. Anything the peer sends from now on is
+// discarded. If we opened the stream and the peer hasn't finished sending, its
+// side is canceled.
+func (this *Stream) Close() error {
+	err := this.CloseWrite()
+	if err == ErrMessageEnded || err == ErrCanceledByPeer {
+		err = nil
+	}
+	this.reader.Close()
+	return err
+}
+
+// Returns the local address of the session's transport if it's a net.Conn.
+// Otherwise, the address identifies the stream.
+func (this *Stream) LocalAddr() net.Addr {
+	if conn, ok := this.session.transport.(net.Conn); ok {
+		return conn.LocalAddr()
+	}
+	return &StreamAddr{this.Id, this.isOpener}
+}
+
+// Returns the remote address of the session's transport if it's a net.Conn.
+// Otherwise, the address identifies the stream.
+func (this *Stream) RemoteAddr() net.Addr {
+	if conn, ok := this.session.transport.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return &StreamAddr{this.Id, this.isOpener}
+}
+
+func (this *Stream) SetDeadline(deadline time.Time) error {
+	this.SetReadDeadline(deadline)
+	return this.SetWriteDeadline(deadline)
+}
+
+// Read() fails with ErrTimeout once the deadline passes. A zero deadline means
+// no deadline.
+func (this *Stream) SetReadDeadline(deadline time.Time) error {
+	this.reader.setDeadline(deadline)
+	return nil
+}
+
+// Write() fails with ErrTimeout once the deadline passes, including while it's
+// waiting for flow control credit. A zero deadline means no deadline.
+func (this *Stream) SetWriteDeadline(deadline time.Time) error {
+	// Not under writeMutex, so that a blocked Write() can be interrupted.
+	this.writer.setDeadline(deadline)
+	this.writeMutex.Lock()
+	this.writeDeadline = deadline
+	this.writeMutex.Unlock()
+	return nil
+}
+
+// StreamAddr identifies a stream on a transport that has no address of its own.
+// A Listener's address has Id NoMessageId.
+type StreamAddr struct {
+	Id       int
+	IsOpener bool
+}
+
+func (this *StreamAddr) Network() string {
+	return "streamux"
+}
+
+func (this *StreamAddr) String() string {
+	if this.Id == NoMessageId {
+		return "streamux"
+	}
+	if this.IsOpener {
+		return fmt.Sprintf("stream %v (opened)", this.Id)
+	}
+	return fmt.Sprintf("stream %v (accepted)", this.Id)
+}
+
+// Internal
+
+// Called from the feeding goroutine when the peer cancels an accepted stream.
+func (this *Stream) cancelByPeer() {
+	this.reader.fail(ErrCanceledByPeer)
+	// Any Write() in progress has been woken by its flow being closed, so this
+	// won't wait long. Afterwards, nothing more can be sent.
+	this.writeMutex.Lock()
+	if this.writeErr == nil {
+		this.writeErr = ErrCanceledByPeer
+	}
+	this.writeMutex.Unlock()
+}
@@ -0,0 +1,258 @@
+package streamux
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kstenerud/go-streamux/test"
+)
+
+// Accept streams and echo everything back until the peer closes its side.
+func serveStreamEcho(t *testing.T, server *Session) {
+	for {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			if _, err := io.Copy(stream, stream); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := stream.CloseWrite(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+}
+
+func awaitIdsReleased(t *testing.T, session *Session) bool {
+	deadline := time.Now().Add(time.Second)
+	for session.protocol.requestStateMachine.ActiveRequestCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Errorf("Expected all IDs to be released, but %v are in use",
+				session.protocol.requestStateMachine.ActiveRequestCount())
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// =============================================================================
+
+func TestStreamEcho(t *testing.T) {
+	enableControlExtension := true
+	client, server := newTestControlSessionPair(enableControlExtension)
+	defer server.Close()
+	defer client.Close()
+	go serveStreamEcho(t, server)
+
+	stream, err := client.OpenStream(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Several chunks' worth, written concurrently with reading the echo.
+	expected := test.NewTestBytes(5000)
+	go func() {
+		if _, err := stream.Write(expected); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := stream.CloseWrite(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	actual, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	test.AssertSlicesAreEquivalent(t, actual, expected)
+	awaitIdsReleased(t, client)
+}
+
+func TestStreamAcceptedAtOpenerPriority(t *testing.T) {
+	enableControlExtension := true
+	client, server := newTestControlSessionPair(enableControlExtension)
+	defer server.Close()
+	defer client.Close()
+
+	priority := 7
+	if _, err := client.OpenStream(priority); err != nil {
+		t.Error(err)
+		return
+	}
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if stream.writer.priority != priority {
+		t.Errorf("Expected the accepted stream to be sent at priority %v, but got %v", priority, stream.writer.priority)
+	}
+}
+
+func TestStreamOpenPayload(t *testing.T) {
+	messageId, priority, ok := decodeOpenStream(encodeOpenStream(5, -3))
+	if !ok || messageId != 5 || priority != -3 {
+		t.Errorf("Expected ID 5 and priority -3, but got %v, %v, %v", messageId, priority, ok)
+	}
+	// Peers that predate the priority field send only the ID.
+	messageId, priority, ok = decodeOpenStream([]byte{5, 0, 0, 0})
+	if !ok || messageId != 5 || priority != 0 {
+		t.Errorf("Expected ID 5 and priority 0, but got %v, %v, %v", messageId, priority, ok)
+	}
+	if _, _, ok = decodeOpenStream([]byte{5, 0, 0, 0, 0}); ok {
+		t.Errorf("Expected a malformed payload to fail")
+	}
+}
+
+func TestStreamAcceptorWritesFirst(t *testing.T) {
+	enableControlExtension := true
+	client, server := newTestControlSessionPair(enableControlExtension)
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.OpenStream(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// The acceptor's side ends before the opener has sent anything.
+	expected := []byte("hello")
+	if _, err = accepted.Write(expected); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = accepted.CloseWrite(); err != nil {
+		t.Error(err)
+		return
+	}
+	actual, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	test.AssertSlicesAreEquivalent(t, actual, expected)
+
+	// An empty side is allowed.
+	if err = stream.Close(); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = ioutil.ReadAll(accepted); err != nil {
+		t.Error(err)
+		return
+	}
+	awaitIdsReleased(t, client)
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	enableControlExtension := true
+	client, server := newTestControlSessionPair(enableControlExtension)
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.OpenStream(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	stream.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = stream.Read(make([]byte, 10))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("Expected a timeout, but got %v", err)
+	}
+}
+
+func TestStreamCloseCancelsPeer(t *testing.T) {
+	enableControlExtension := true
+	client, server := newTestControlSessionPair(enableControlExtension)
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.OpenStream(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	stream.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err = accepted.Write([]byte{1}); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("Timed out waiting for the stream to be canceled")
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != ErrCanceledByPeer {
+		t.Errorf("Expected %v but got %v", ErrCanceledByPeer, err)
+		return
+	}
+	awaitIdsReleased(t, client)
+}
+
+func TestStreamRequiresControlExtension(t *testing.T) {
+	enableControlExtension := false
+	client, server := newTestControlSessionPair(enableControlExtension)
+	defer server.Close()
+	defer client.Close()
+
+	if _, err := client.OpenStream(0); err != ErrStreamsUnavailable {
+		t.Errorf("Expected %v but got %v", ErrStreamsUnavailable, err)
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	client, server := newTestFlowControlSessionPair(0)
+	defer server.Close()
+	defer client.Close()
+	go serveStreamEcho(t, server)
+
+	stream, err := client.OpenStream(0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Unlike a request, the echo flows back while we're still sending.
+	expected := test.NewTestBytes(DefaultConnectionWindow * 3)
+	go func() {
+		if _, err := stream.Write(expected); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := stream.CloseWrite(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	actual, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	test.AssertSlicesAreEquivalent(t, actual, expected)
+}
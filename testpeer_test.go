@@ -2,6 +2,8 @@ package streamux
 
 import (
 	"fmt"
+	"io"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -23,6 +25,9 @@ type testPeer struct {
 	RequestOrder       []int
 	AbleToSend         bool
 	isShutdown         bool
+	// Guards everything recorded by the callbacks, which are called from the
+	// feeding goroutine.
+	mutex sync.Mutex
 }
 
 func newTestPeer(t *testing.T, idBits, lengthBits int, isServer bool, sendChannel chan []byte, wg *sync.WaitGroup) *testPeer {
@@ -36,35 +41,81 @@ func newTestPeer(t *testing.T, idBits, lengthBits int, isServer bool, sendChanne
 	this.sendChannel = sendChannel
 	this.wg = wg
 
-	requestQuickInit := true
-	allowQuickInit := false
-	if isServer {
-		requestQuickInit = false
-		allowQuickInit = true
+	var err error
+	if this.protocol, err = NewProtocol(newTestConfig(idBits, lengthBits, isServer), this, this); err != nil {
+		t.Error(err)
 	}
-	this.protocol = NewProtocol(0, 29, idBits, 1, 30, lengthBits, requestQuickInit, allowQuickInit, this, this)
 	return this
 }
 
+func newTestConfig(idBits, lengthBits int, isServer bool) *Config {
+	config := NewDefaultConfig()
+	config.IdRecommendBits = idBits
+	config.LengthRecommendBits = lengthBits
+	config.RequestQuickInit = !isServer
+	config.AllowQuickInit = isServer
+	return config
+}
+
+// Connect a client and a server session over a pipe. Each session's config
+// comes from newTestConfig() with 8 ID bits and 10 length bits, adjusted by
+// configure (if not nil). wrapServerConn (if not nil) wraps the server's end
+// of the pipe.
+func newTestPipeSessionPair(configure func(config *Config, isServer bool), wrapServerConn func(conn net.Conn) io.ReadWriteCloser, serverReceiver MessageReceiver) (client, server *Session) {
+	newConfig := func(isServer bool) *Config {
+		config := newTestConfig(8, 10, isServer)
+		if configure != nil {
+			configure(config, isServer)
+		}
+		return config
+	}
+	clientConn, serverConn := net.Pipe()
+	var serverTransport io.ReadWriteCloser = serverConn
+	if wrapServerConn != nil {
+		serverTransport = wrapServerConn(serverConn)
+	}
+	client, _ = NewSession(clientConn, newConfig(false), nil)
+	server, _ = NewSession(serverTransport, newConfig(true), serverReceiver)
+	return client, server
+}
+
+func newTestControlSessionPair(enableControlExtension bool) (client, server *Session) {
+	return newTestPipeSessionPair(func(config *Config, isServer bool) {
+		config.EnableControlExtension = enableControlExtension
+	}, nil, nil)
+}
+
 func (this *testPeer) OnPingReceived(id int) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	// fmt.Printf("### TP %p: Ping %v received\n", this, id)
 	this.PingsReceived = append(this.PingsReceived, id)
 	return nil
 }
 
 func (this *testPeer) OnPingAckReceived(id int, latency time.Duration) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	// fmt.Printf("### TP %p: Ping ack %v received after %v\n", this, id, latency)
 	this.PingAcksReceived = append(this.PingAcksReceived, id)
 	return nil
 }
 
 func (this *testPeer) OnCancelReceived(messageId int) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	// fmt.Printf("### TP %p: Cancel %v received\n", this, messageId)
 	this.CancelsReceived = append(this.CancelsReceived, messageId)
 	return nil
 }
 
 func (this *testPeer) OnCancelAckReceived(messageId int) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	// fmt.Printf("### TP %p: Cancel ack %v received\n", this, messageId)
 	this.CancelAcksReceived = append(this.CancelAcksReceived, messageId)
 	return nil
@@ -75,6 +126,9 @@ func (this *testPeer) OnEmptyResponseReceived(id int) error {
 }
 
 func (this *testPeer) OnRequestChunkReceived(messageId int, isEnd bool, data []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	// fmt.Printf("### TP %p: Received request id %v, %v bytes, end %v\n", this, messageId, len(data), isEnd)
 	message, messageFound := this.RequestsReceived[messageId]
 	endOfMessage, _ := this.RequestsEnded[messageId]
@@ -94,6 +148,9 @@ func (this *testPeer) OnRequestChunkReceived(messageId int, isEnd bool, data []b
 }
 
 func (this *testPeer) OnResponseChunkReceived(messageId int, isEnd bool, data []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	// fmt.Printf("### TP %p: Receive response id %v, %v bytes, end %v\n", this, messageId, len(data), isEnd)
 	message, messageFound := this.ResponsesReceived[messageId]
 	endOfMessage, _ := this.ResponsesEnded[messageId]
@@ -109,6 +166,9 @@ func (this *testPeer) OnResponseChunkReceived(messageId int, isEnd bool, data []
 }
 
 func (this *testPeer) OnAbleToSend() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	// fmt.Printf("### Able to send\n")
 	this.AbleToSend = true
 }
@@ -138,6 +198,9 @@ func (this *testPeer) GetRequestAtIndex(index int) []byte {
 }
 
 func (this *testPeer) GetRequestId(index int) int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	if index < len(this.RequestOrder) {
 		return this.RequestOrder[index]
 	}
@@ -145,6 +208,9 @@ func (this *testPeer) GetRequestId(index int) int {
 }
 
 func (this *testPeer) GetRequest(id int) []byte {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	if value, ok := this.RequestsReceived[id]; ok {
 		if !this.RequestsEnded[id] {
 			panic(fmt.Errorf("Request ID %v was not terminated", id))
@@ -155,6 +221,9 @@ func (this *testPeer) GetRequest(id int) []byte {
 }
 
 func (this *testPeer) GetResponse(id int) []byte {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	if value, ok := this.ResponsesReceived[id]; ok {
 		if !this.ResponsesEnded[id] {
 			panic(fmt.Errorf("Response ID %v was not terminated", id))
@@ -176,16 +245,50 @@ func (this *testPeer) SendInitialization() error {
 	return this.protocol.SendInitialization()
 }
 
+func (this *testPeer) GetCancelAckId(index int) int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if index < len(this.CancelAcksReceived) {
+		return this.CancelAcksReceived[index]
+	}
+	panic(fmt.Errorf("Cancel ack at index %v not found", index))
+}
+
+func (this *testPeer) GetPingAckId(index int) int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if index < len(this.PingAcksReceived) {
+		return this.PingAcksReceived[index]
+	}
+	panic(fmt.Errorf("Ping ack at index %v not found", index))
+}
+
+func (this *testPeer) GetPingAckCount() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return len(this.PingAcksReceived)
+}
+
 func (this *testPeer) Shutdown() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 	this.isShutdown = true
 }
 
+func (this *testPeer) isShutDown() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.isShutdown
+}
+
 func (this *testPeer) FeedFromChannel(recvChannel chan []byte) {
 	this.wg.Add(1)
 	go func() {
 		defer this.wg.Done()
 		for data := range recvChannel {
-			if this.isShutdown == true {
+			if this.isShutDown() {
 				return
 			}
 			// fmt.Printf("### Reading chunk of %v bytes\n", len(data))
@@ -227,3 +330,45 @@ func newTestPeerPair(t *testing.T, idBits, lengthBits int) (client, server *test
 
 	return client, server, nil
 }
+
+// nullSender discards everything sent to it.
+type nullSender struct{}
+
+func (this *nullSender) OnAbleToSend() {}
+
+func (this *nullSender) OnMessageChunkToSend(priority int, messageId int, chunk []byte) error {
+	return nil
+}
+
+// schedulingSender queues everything sent to it in a SendScheduler, which the
+// test pops from directly.
+type schedulingSender struct {
+	SendScheduler
+}
+
+func newSchedulingSender() *schedulingSender {
+	this := new(schedulingSender)
+	this.Init()
+	return this
+}
+
+func (this *schedulingSender) OnAbleToSend() {}
+
+func (this *schedulingSender) OnMessageChunkToSend(priority int, messageId int, chunk []byte) error {
+	return this.Push(priority, messageId, chunk)
+}
+
+func (this *schedulingSender) OnPurgeRequestChunks(messageId int) {
+	this.PurgeRequests(messageId)
+}
+
+// Feed everything queued in a sender to a protocol.
+func feedQueued(from *schedulingSender, to *Protocol) error {
+	for from.Len() > 0 {
+		chunk, _ := from.Pop()
+		if err := to.Feed(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}